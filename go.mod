@@ -5,6 +5,7 @@ go 1.24.1
 require (
 	github.com/nickwells/check.mod/v2 v2.1.26
 	github.com/nickwells/english.mod v1.2.6
+	github.com/nickwells/filecheck.mod v1.2.10
 	github.com/nickwells/param.mod/v6 v6.5.3
 	github.com/nickwells/pusu.mod v0.1.3
 	github.com/nickwells/pusuparams.mod v0.1.4
@@ -12,12 +13,12 @@ require (
 	github.com/nickwells/testhelper.mod/v2 v2.4.3
 	github.com/nickwells/verbose.mod v1.1.15
 	github.com/nickwells/versionparams.mod v1.2.19
+	google.golang.org/protobuf v1.36.11
 )
 
 require (
 	github.com/nickwells/col.mod/v6 v6.0.0 // indirect
 	github.com/nickwells/errutil.mod v1.2.22 // indirect
-	github.com/nickwells/filecheck.mod v1.2.10 // indirect
 	github.com/nickwells/fileparse.mod v1.1.37 // indirect
 	github.com/nickwells/location.mod v1.2.34 // indirect
 	github.com/nickwells/mathutil.mod/v2 v2.5.8 // indirect
@@ -30,5 +31,4 @@ require (
 	golang.org/x/exp v0.0.0-20251219203646-944ab1f22d93 // indirect
 	golang.org/x/sys v0.40.0 // indirect
 	golang.org/x/term v0.38.0 // indirect
-	google.golang.org/protobuf v1.36.11 // indirect
 )
@@ -8,6 +8,24 @@ const (
 	noteBaseName = "pubSubSvr - "
 
 	noteNameSecurity = noteBaseName + "security"
+	noteNameHeaders  = noteBaseName + "publication headers"
+	noteNameFilters  = noteBaseName + "subscription filters"
+	noteNameSchemas  = noteBaseName + "schema registry"
+
+	noteNameCompression = noteBaseName + "payload compression"
+	noteNameBatch       = noteBaseName + "publication batches"
+	noteNameConfirms    = noteBaseName + "publisher confirms"
+	noteNameIdempotency = noteBaseName + "idempotency keys"
+	noteNameDurable     = noteBaseName + "durable subscriptions"
+	noteNameSysEvents   = noteBaseName + "system events"
+	noteNameWill        = noteBaseName + "last-will publications"
+	noteNameSnapshot    = noteBaseName + "subscription snapshots"
+	noteNameMQTT        = noteBaseName + "MQTT clients"
+	noteNameHTTP        = noteBaseName + "HTTP gateway"
+	noteNameRouting     = noteBaseName + "routing rules"
+	noteNameBridges     = noteBaseName + "namespace bridges"
+	noteNameNamespaces  = noteBaseName + "namespace rules"
+	noteNameProfiles    = noteBaseName + "namespace profiles"
 )
 
 // addNotes adds the notes for this program.
@@ -16,6 +34,73 @@ func addNotes(_ *prog) param.PSetOptFunc {
 		ps.AddNote(noteNameSecurity,
 			"security is provided by the use of mutual TLS")
 
+		ps.AddNote(noteNameHeaders,
+			"a publication may carry a set of headers, name/value"+
+				" pairs giving metadata about the publication such"+
+				" as the content-type, origin or a correlation ID."+
+				" The server preserves the headers when it sends"+
+				" the publication on to the subscribers and it can"+
+				" inspect them without decoding the payload."+
+				" A header name may only contain lower-case letters,"+
+				" digits, '-', '_' and '.'."+
+				" The W3C trace context headers (traceparent and"+
+				" tracestate) are used for tracing publications"+
+				" through the server."+
+				"\n\n"+
+				"The headers are carried in field number 100 of the"+
+				" Publish message payload, encoded as a"+
+				" map<string, string>. Clients which do not"+
+				" know about the headers will ignore them.")
+
+		ps.AddNote(noteNameFilters, noteTextFilter)
+
+		ps.AddNote(noteNameSchemas, noteTextSchemaRegistry)
+
+		ps.AddNote(noteNameCompression, noteTextCompression)
+
+		ps.AddNote(noteNameBatch, noteTextPublishBatch)
+
+		ps.AddNote(noteNameIdempotency, noteTextIdempotency)
+
+		ps.AddNote(noteNameDurable, noteTextDurable)
+
+		ps.AddNote(noteNameSysEvents, noteTextSysEvents)
+
+		ps.AddNote(noteNameWill, noteTextWill)
+
+		ps.AddNote(noteNameSnapshot, noteTextSnapshot)
+
+		ps.AddNote(noteNameMQTT, noteTextMQTT)
+
+		ps.AddNote(noteNameHTTP, noteTextHTTP)
+
+		ps.AddNote(noteNameRouting, noteTextRouting)
+
+		ps.AddNote(noteNameBridges, noteTextBridges)
+
+		ps.AddNote(noteNameNamespaces, noteTextNamespaceRules)
+
+		ps.AddNote(noteNameProfiles, noteTextProfiles)
+
+		ps.AddNote(noteNameConfirms,
+			"a client may ask, in its Start message, for its"+
+				" publications to be confirmed. The server then"+
+				" acknowledges each Publish message only once the"+
+				" publications in it have been queued for sending to"+
+				" the subscribers, and the Ack gives the number of"+
+				" subscribers to which they were queued and the number"+
+				" for which they were dropped because the subscriber"+
+				" had disconnected or was not keeping up. A publisher"+
+				" can use this to tell when nobody is listening."+
+				"\n\n"+
+				"The request is carried in field number 101 of the"+
+				" Start message payload, as a bool, and the server"+
+				" shows that it will confirm publications by setting"+
+				" field number 103 of the Ack payload. The number of"+
+				" subscribers is in field number 104 of the Ack"+
+				" payload, and the number dropped in field number 105,"+
+				" both as integers.")
+
 		return nil
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/nickwells/check.mod/v2/check"
+	"github.com/nickwells/filecheck.mod/filecheck"
 	"github.com/nickwells/param.mod/v6/param"
 	"github.com/nickwells/param.mod/v6/psetter"
 	"github.com/nickwells/pusu.mod/pusu"
@@ -12,11 +13,61 @@ import (
 
 const (
 	paramNamePort           = "port"
+	paramNameMQTTPort       = "mqtt-port"
+	paramNameHTTPPort       = "http-port"
 	paramNameLogLevel       = "log-level"
+	paramNameLogFormat      = "log-format"
+	paramNameLogToFile      = "log-to-file"
+	paramNameLogDir         = "log-dir"
+	paramNameLogMaxSize     = "log-max-size"
+	paramNameLogMaxAge      = "log-max-age"
+	paramNameLogKeep        = "log-keep"
+	paramNameAuditFile      = "audit-file"
+	paramNameTraceEndpoint  = "trace-otlp-endpoint"
+	paramNameTraceFile      = "trace-file"
 	paramNameStatusInterval = "status-interval"
 
 	paramNameAllowedNamespaces = "namespaces-allowed"
 	paramNameNamespacePrefixes = "namespace-prefixes"
+	paramNameNamespacePatterns = "namespace-patterns"
+	paramNameDeniedNamespaces  = "namespaces-denied"
+	paramNameNamespaceRules    = "namespace-rules"
+
+	paramNameMaxConns            = "max-connections"
+	paramNameMaxConnsPerIP       = "max-connections-per-ip"
+	paramNameMaxConnsPerIdentity = "max-connections-per-identity"
+	paramNameMaxSubs             = "max-subscriptions"
+
+	paramNameSchemaRegistry = "schema-registry"
+	paramNameRoutingRules   = "routing-rules"
+	paramNameBridges        = "namespace-bridges"
+	paramNameProfiles       = "namespace-profiles"
+
+	paramNameWriteMaxLatency = "write-max-latency"
+
+	paramNameDedupWindow  = "dedup-window"
+	paramNameDedupMaxKeys = "dedup-max-keys"
+
+	paramNameRedeliveryTimeout = "redelivery-timeout"
+	paramNameMaxDelivery       = "max-delivery-attempts"
+	paramNameDeadLetterTopic   = "dead-letter-topic"
+	paramNameDurableInflight   = "durable-max-inflight"
+	paramNameDurablePending    = "durable-max-pending"
+
+	paramNameSnapshotFile     = "snapshot-file"
+	paramNameSnapshotInterval = "snapshot-interval"
+	paramNameSnapshotMaxAge   = "snapshot-max-age"
+
+	paramNameCompression        = "compression"
+	paramNameCompressionMinSize = "compression-min-size"
+
+	paramNameMaxHeaders    = "max-headers"
+	paramNameMaxHeaderSize = "max-header-size"
+
+	paramNameRateLimitClient    = "rate-limit-client"
+	paramNameRateLimitNamespace = "rate-limit-namespace"
+	paramNameRateLimitIdentity  = "rate-limit-identity"
+	paramNameRateLimitAction    = "rate-limit-action"
 )
 
 // addParams adds the parameters for this program
@@ -32,30 +83,485 @@ func addParams(prog *prog) param.PSetOptFunc {
 			"the port number for the server to listen on",
 			param.Attrs(param.MustBeSet))
 
+		ps.Add(paramNameMQTTPort,
+			psetter.Int[int]{
+				Value: &prog.mqttPort,
+				Checks: []check.ValCk[int]{
+					check.ValGE(0),
+				},
+			},
+			"the port number for the server to listen on for MQTT"+
+				" clients. If this is not given then MQTT clients are"+
+				" not accepted",
+			param.SeeNote(noteNameMQTT))
+
+		ps.Add(paramNameHTTPPort,
+			psetter.Int[int]{
+				Value: &prog.httpPort,
+				Checks: []check.ValCk[int]{
+					check.ValGE(0),
+				},
+			},
+			"the port number for the server to listen on for HTTPS"+
+				" requests to publish and subscribe. If this is not"+
+				" given then the HTTP gateway is not started",
+			param.SeeNote(noteNameHTTP))
+
 		ps.Add(paramNameLogLevel,
 			slogsetter.Level{
 				Value: &prog.logLevel,
 			},
 			"the level of logging")
 
+		ps.Add(paramNameLogFormat,
+			psetter.Enum[logFormat]{
+				Value: &prog.logFormat,
+				AllowedVals: psetter.AllowedVals[logFormat]{
+					logFormatText: "log messages are written as" +
+						" key=value pairs",
+					logFormatJSON: "log messages are written as" +
+						" JSON objects, one per line",
+				},
+			},
+			"the format in which to write log messages")
+
+		ps.Add(paramNameLogToFile,
+			psetter.Bool{
+				Value: &prog.logToFile,
+			},
+			"write the log messages to files in the log directory"+
+				" rather than to the standard output."+
+				" The files are rotated when they grow too big or"+
+				" too old and only a limited number of old files"+
+				" are retained")
+
+		ps.Add(paramNameLogDir,
+			psetter.Pathname{
+				Value: &prog.logDir,
+			},
+			"the directory in which to write the log files."+
+				" It will be created if it does not exist")
+
+		ps.Add(paramNameLogMaxSize,
+			psetter.Int[int64]{
+				Value: &prog.logMaxSize,
+				Checks: []check.ValCk[int64]{
+					check.ValGE[int64](0),
+				},
+			},
+			"the size in bytes at which a log file will be rotated."+
+				" A value of zero means that files are not rotated"+
+				" by size")
+
+		ps.Add(paramNameLogMaxAge,
+			psetter.Duration{
+				Value: &prog.logMaxAge,
+			},
+			"the age at which a log file will be rotated."+
+				" A value of zero means that files are not rotated"+
+				" by age")
+
+		ps.Add(paramNameLogKeep,
+			psetter.Int[int]{
+				Value: &prog.logKeep,
+				Checks: []check.ValCk[int]{
+					check.ValGE(0),
+				},
+			},
+			"the number of old, rotated log files to keep."+
+				" A value of zero means that all the files are kept")
+
+		ps.Add(paramNameAuditFile,
+			psetter.Pathname{
+				Value: &prog.auditFile,
+			},
+			"the file to which audit records are written. These record"+
+				" security-relevant events such as connections"+
+				" being accepted or rejected, TLS handshake failures,"+
+				" namespace and protocol version rejections and"+
+				" protocol errors. Each record is written as a"+
+				" JSON object on a single line and the file is only"+
+				" ever appended to. If this is not given then"+
+				" no audit records are written")
+
+		ps.Add(paramNameTraceEndpoint,
+			psetter.String[string]{
+				Value: &prog.traceEndpoint,
+			},
+			"the URL of an OTLP/HTTP collector to which trace spans"+
+				" are sent in JSON format, for instance:"+
+				" http://localhost:4318/v1/traces."+
+				" Only publications carrying a sampled W3C trace"+
+				" context (a traceparent header) are traced")
+
+		ps.Add(paramNameTraceFile,
+			psetter.Pathname{
+				Value: &prog.traceFile,
+			},
+			"the file to which trace spans are written in OTLP JSON"+
+				" format, one batch of spans per line."+
+				" Only publications carrying a sampled W3C trace"+
+				" context (a traceparent header) are traced")
+
 		ps.Add(paramNameStatusInterval,
 			psetter.Duration{
 				Value: &prog.statusReportingInterval,
 			},
 			"the time to wait between status reports")
 
-		allowedNSParam := ps.Add(paramNameAllowedNamespaces,
+		ps.Add(paramNameAllowedNamespaces,
 			psetter.Map[pusu.Namespace]{
 				Value: (*map[pusu.Namespace]bool)(&prog.nsRules.allowed),
 			},
-			"the namespaces to allow clients to connect with")
+			"the namespaces to allow clients to connect with",
+			param.SeeNote(noteNameNamespaces))
 
-		nsPfxParam := ps.Add(paramNameNamespacePrefixes,
+		ps.Add(paramNameNamespacePrefixes,
 			psetter.StrList[string]{
 				Value: &prog.nsRules.prefixes,
 			},
-			"the prefixes which a namespace must have to allow"+
-				" clients to connect with it")
+			"the prefixes which a namespace may have to allow"+
+				" clients to connect with it",
+			param.SeeNote(noteNameNamespaces))
+
+		var nsPatterns []string
+
+		ps.Add(paramNameNamespacePatterns,
+			psetter.StrList[string]{
+				Value: &nsPatterns,
+			},
+			"regular expressions which a namespace may match to allow"+
+				" clients to connect with it. The expression must"+
+				" match the whole namespace",
+			param.SeeNote(noteNameNamespaces))
+
+		ps.Add(paramNameDeniedNamespaces,
+			psetter.Map[pusu.Namespace]{
+				Value: (*map[pusu.Namespace]bool)(&prog.nsRules.denied),
+			},
+			"the namespaces which clients may not connect with, even"+
+				" if they are otherwise allowed",
+			param.SeeNote(noteNameNamespaces))
+
+		var nsRulesFile string
+
+		ps.Add(paramNameNamespaceRules,
+			psetter.Pathname{
+				Value:       &nsRulesFile,
+				Expectation: filecheck.FileExists(),
+			},
+			"the file giving further rules for the namespaces which"+
+				" clients may connect with. See the note '"+
+				noteNameNamespaces+"' for details of the file format",
+			param.SeeNote(noteNameNamespaces))
+
+		ps.Add(paramNameMaxConns,
+			psetter.Int[int]{
+				Value: &prog.connLimits.maxTotal,
+				Checks: []check.ValCk[int]{
+					check.ValGE(0),
+				},
+			},
+			"the maximum number of client connections the server will"+
+				" accept at any one time. A value of zero means"+
+				" there is no limit")
+
+		ps.Add(paramNameMaxConnsPerIP,
+			psetter.Int[int]{
+				Value: &prog.connLimits.maxPerIP,
+				Checks: []check.ValCk[int]{
+					check.ValGE(0),
+				},
+			},
+			"the maximum number of client connections the server will"+
+				" accept from any one remote IP address."+
+				" A value of zero means there is no limit")
+
+		ps.Add(paramNameMaxConnsPerIdentity,
+			psetter.Int[int]{
+				Value: &prog.connLimits.maxPerIdentity,
+				Checks: []check.ValCk[int]{
+					check.ValGE(0),
+				},
+			},
+			"the maximum number of client connections the server will"+
+				" accept with the same certificate identity (the"+
+				" common name from the client certificate)."+
+				" A value of zero means there is no limit")
+
+		ps.Add(paramNameMaxSubs,
+			psetter.Int[int]{
+				Value: &prog.connLimits.maxSubs,
+				Checks: []check.ValCk[int]{
+					check.ValGE(0),
+				},
+			},
+			"the maximum number of topics to which any one client"+
+				" may be subscribed. A value of zero means"+
+				" there is no limit")
+
+		ps.Add(paramNameMaxHeaders,
+			psetter.Int[int]{
+				Value: &prog.hdrLimits.maxCount,
+				Checks: []check.ValCk[int]{
+					check.ValGE(0),
+				},
+			},
+			"the maximum number of headers which may be given on"+
+				" a publication. A value of zero means"+
+				" there is no limit")
+
+		ps.Add(paramNameMaxHeaderSize,
+			psetter.Int[int]{
+				Value: &prog.hdrLimits.maxSize,
+				Checks: []check.ValCk[int]{
+					check.ValGE(0),
+				},
+			},
+			"the maximum total size, in bytes, of the names and"+
+				" values of the headers on a publication."+
+				" A value of zero means there is no limit")
+
+		ps.Add(paramNameSchemaRegistry,
+			psetter.Pathname{
+				Value:       &prog.schemaFile,
+				Expectation: filecheck.FileExists(),
+			},
+			"the file giving the schemas which publication payloads"+
+				" must match. See the note '"+noteNameSchemas+"'"+
+				" for details of the file format",
+			param.SeeNote(noteNameSchemas))
+
+		ps.Add(paramNameRoutingRules,
+			psetter.Pathname{
+				Value:       &prog.routingFile,
+				Expectation: filecheck.FileExists(),
+			},
+			"the file giving the rules for republishing publications"+
+				" on other topics. See the note '"+noteNameRouting+"'"+
+				" for details of the file format",
+			param.SeeNote(noteNameRouting))
+
+		ps.Add(paramNameBridges,
+			psetter.Pathname{
+				Value:       &prog.bridgesFile,
+				Expectation: filecheck.FileExists(),
+			},
+			"the file giving the topics which namespaces export and"+
+				" import. See the note '"+noteNameBridges+"'"+
+				" for details of the file format",
+			param.SeeNote(noteNameBridges))
+
+		ps.Add(paramNameProfiles,
+			psetter.Pathname{
+				Value:       &prog.profilesFile,
+				Expectation: filecheck.FileExists(),
+			},
+			"the file giving the settings, such as the client backlog"+
+				" and the largest payload, for each namespace."+
+				" See the note '"+noteNameProfiles+"'"+
+				" for details of the file format",
+			param.SeeNote(noteNameProfiles))
+
+		ps.Add(paramNameWriteMaxLatency,
+			psetter.Duration{
+				Value: &prog.writeMaxLatency,
+			},
+			"the longest time for which messages to a busy client"+
+				" are held back so that they can be written together"+
+				" with the messages following them. Messages queued for"+
+				" the client are always written together and are sent"+
+				" as soon as the queue is empty; this only limits how"+
+				" long they may wait while the queue never empties. If"+
+				" this is zero the messages are written only when the"+
+				" queue is empty or the write buffer is full",
+			param.Attrs(param.DontShowInStdUsage))
+
+		ps.Add(paramNameDedupWindow,
+			psetter.Duration{
+				Value: &prog.dedupWindow,
+			},
+			"how long the idempotency key of a publication is"+
+				" remembered. A repeated publication with the same key"+
+				" within this time is not sent to the subscribers"+
+				" again. A value of zero means that idempotency keys"+
+				" are ignored",
+			param.SeeNote(noteNameIdempotency))
+
+		ps.Add(paramNameDedupMaxKeys,
+			psetter.Int[int]{
+				Value: &prog.dedupMaxKeys,
+				Checks: []check.ValCk[int]{
+					check.ValGE(0),
+				},
+			},
+			"the most idempotency keys to remember. If more keys are"+
+				" seen within the deduplication window the oldest"+
+				" are forgotten",
+			param.SeeNote(noteNameIdempotency),
+			param.Attrs(param.DontShowInStdUsage))
+
+		ps.Add(paramNameRedeliveryTimeout,
+			psetter.Duration{
+				Value: &prog.durableCfg.redeliveryTimeout,
+			},
+			"how long to wait for the subscriber to a durable"+
+				" subscription to acknowledge a publication before"+
+				" sending it again",
+			param.SeeNote(noteNameDurable))
+
+		ps.Add(paramNameMaxDelivery,
+			psetter.Int[int]{
+				Value: &prog.durableCfg.maxAttempts,
+				Checks: []check.ValCk[int]{
+					check.ValGT(0),
+				},
+			},
+			"the number of times a publication is sent to the"+
+				" subscriber to a durable subscription without being"+
+				" acknowledged before it is moved to the dead-letter"+
+				" topic",
+			param.SeeNote(noteNameDurable))
+
+		ps.Add(paramNameDeadLetterTopic,
+			psetter.String[string]{
+				Value: &prog.durableCfg.deadLetterTopic,
+			},
+			"the topic under which publications which cannot be"+
+				" delivered to a durable subscription are published."+
+				" Each durable subscription has its own sub-topic,"+
+				" named after the subscription",
+			param.SeeNote(noteNameDurable))
+
+		ps.Add(paramNameDurableInflight,
+			psetter.Int[int]{
+				Value: &prog.durableCfg.maxInflight,
+				Checks: []check.ValCk[int]{
+					check.ValGT(0),
+				},
+			},
+			"the most publications to send to the subscriber to a"+
+				" durable subscription before they are acknowledged",
+			param.SeeNote(noteNameDurable),
+			param.Attrs(param.DontShowInStdUsage))
+
+		ps.Add(paramNameDurablePending,
+			psetter.Int[int]{
+				Value: &prog.durableCfg.maxPending,
+				Checks: []check.ValCk[int]{
+					check.ValGT(0),
+				},
+			},
+			"the most publications to hold for a durable"+
+				" subscription. If more are held the oldest are moved"+
+				" to the dead-letter topic",
+			param.SeeNote(noteNameDurable),
+			param.Attrs(param.DontShowInStdUsage))
+
+		ps.Add(paramNameSnapshotFile,
+			psetter.Pathname{
+				Value: &prog.snapshotFile,
+			},
+			"the file in which the subscriptions are saved so that they"+
+				" can be restored when the server restarts. If this is"+
+				" not given then the subscriptions are not saved",
+			param.SeeNote(noteNameSnapshot))
+
+		ps.Add(paramNameSnapshotInterval,
+			psetter.Duration{
+				Value: &prog.snapshotInterval,
+			},
+			"how long between saving the subscriptions to the"+
+				" snapshot file",
+			param.SeeNote(noteNameSnapshot),
+			param.Attrs(param.DontShowInStdUsage))
+
+		ps.Add(paramNameSnapshotMaxAge,
+			psetter.Duration{
+				Value: &prog.snapshotMaxAge,
+			},
+			"how long the saved subscriptions of a client are kept"+
+				" if the client does not reconnect. If this is zero"+
+				" they are kept until the client reconnects",
+			param.SeeNote(noteNameSnapshot),
+			param.Attrs(param.DontShowInStdUsage))
+
+		ps.Add(paramNameCompression,
+			psetter.EnumList[contentEncoding]{
+				Value: &prog.compression.allowed,
+				AllowedVals: psetter.AllowedVals[contentEncoding]{
+					encGzip:    "gzip compression (RFC 1952)",
+					encDeflate: "deflate compression (RFC 1951)",
+				},
+			},
+			"the payload compression schemes which clients may use."+
+				" See the note '"+noteNameCompression+"' for details",
+			param.SeeNote(noteNameCompression))
+
+		ps.Add(paramNameCompressionMinSize,
+			psetter.Int[int]{
+				Value: &prog.compression.minSize,
+				Checks: []check.ValCk[int]{
+					check.ValGE(0),
+				},
+			},
+			"the size in bytes below which the server will not"+
+				" compress a publication payload",
+			param.SeeNote(noteNameCompression))
+
+		ps.Add(paramNameRateLimitClient,
+			psetter.String[string]{
+				Value: &prog.rlRules.clientLimitStr,
+			},
+			"the rate limit to apply to each client connection."+
+				" The value is given as the number of messages per"+
+				" second optionally followed by a comma and"+
+				" the number of bytes per second."+
+				" A value of zero means there is no limit."+
+				" This does not apply to clients whose"+
+				" certificate identity has its own limit set through"+
+				" the "+paramNameRateLimitIdentity+" parameter."+
+				" Only Publish and Subscribe messages are limited")
+
+		ps.Add(paramNameRateLimitNamespace,
+			psetter.StrList[string]{
+				Value: &prog.rlRules.namespaceLimitStrs,
+			},
+			"the rate limits to apply to namespaces."+
+				" Each value is given as the namespace followed by"+
+				" '=' and then the limits (as for the "+
+				paramNameRateLimitClient+" parameter)."+
+				" The limit is shared between all the clients in the"+
+				" namespace")
+
+		ps.Add(paramNameRateLimitIdentity,
+			psetter.StrList[string]{
+				Value: &prog.rlRules.identityLimitStrs,
+			},
+			"the rate limits to apply to certificate identities."+
+				" Each value is given as the common name from the"+
+				" client certificate followed by"+
+				" '=' and then the limits (as for the "+
+				paramNameRateLimitClient+" parameter)."+
+				" The limit is shared between all the clients"+
+				" presenting a certificate with that common name")
+
+		ps.Add(paramNameRateLimitAction,
+			psetter.Enum[rateLimitAction]{
+				Value: &prog.rlRules.action,
+				AllowedVals: psetter.AllowedVals[rateLimitAction]{
+					rlActionThrottle: "delay the processing of the" +
+						" message until it is within the limit, by no" +
+						" more than " + maxThrottleWait.String() +
+						" for any one message",
+					rlActionReject: "reject the message, sending an Error" +
+						" message to the client explaining which" +
+						" limit was exceeded",
+					rlActionDisconnect: "disconnect the client without" +
+						" any further message",
+				},
+			},
+			"what to do when a client message exceeds a rate limit")
 
 		ps.AddFinalCheck(func() error {
 			prog.progName = ps.ProgName()
@@ -64,33 +570,79 @@ func addParams(prog *prog) param.PSetOptFunc {
 		})
 
 		ps.AddFinalCheck(func() error {
-			if allowedNSParam.HasBeenSet() &&
-				nsPfxParam.HasBeenSet() {
-				return fmt.Errorf(
-					"you may set the %q parameter or the %q parameter"+
-						" or neither but not both",
-					paramNameAllowedNamespaces,
-					paramNameNamespacePrefixes)
+			return prog.nsRules.addPatterns(false, nsPatterns...)
+		})
+
+		ps.AddFinalCheck(func() error {
+			return prog.nsRules.loadNSRules(nsRulesFile)
+		})
+
+		ps.AddFinalCheck(func() error {
+			return prog.nsRules.checkPrefixes()
+		})
+
+		ps.AddFinalCheck(func() error {
+			return prog.rlRules.parseLimits()
+		})
+
+		ps.AddFinalCheck(func() error {
+			return pusu.Topic(prog.durableCfg.deadLetterTopic).Check()
+		})
+
+		ps.AddFinalCheck(func() error {
+			if prog.snapshotInterval <= 0 {
+				return fmt.Errorf("the %q parameter must be greater than zero",
+					paramNameSnapshotInterval)
+			}
+
+			if prog.snapshotMaxAge < 0 {
+				return fmt.Errorf("the %q parameter must not be negative",
+					paramNameSnapshotMaxAge)
 			}
 
 			return nil
 		})
 
 		ps.AddFinalCheck(func() error {
-			if allowedNSParam.HasBeenSet() &&
-				nsPfxParam.HasBeenSet() {
-				return fmt.Errorf(
-					"you may set the %q parameter or the %q parameter"+
-						" or neither but not both",
-					paramNameAllowedNamespaces,
-					paramNameNamespacePrefixes)
+			var err error
+
+			prog.schemas, err = loadSchemaRegistry(prog.schemaFile)
+
+			return err
+		})
+
+		ps.AddFinalCheck(func() error {
+			var err error
+
+			prog.routes.rules, err = loadRoutingRules(prog.routingFile)
+			if err != nil {
+				return err
+			}
+
+			return prog.routes.checkNamespaces(prog.nsRules)
+		})
+
+		ps.AddFinalCheck(func() error {
+			if err := loadBridges(prog.bridgesFile, &prog.bridges); err != nil {
+				return err
 			}
 
-			return nil
+			return prog.bridges.checkNamespaces(prog.nsRules)
 		})
 
 		ps.AddFinalCheck(func() error {
-			return prog.nsRules.checkPrefixes()
+			if err := loadProfiles(prog.profilesFile,
+				&prog.profiles); err != nil {
+				return err
+			}
+
+			if err := prog.profiles.checkNamespaces(prog.nsRules); err != nil {
+				return err
+			}
+
+			prog.profiles.setDefaults(prog.durableCfg.maxPending)
+
+			return prog.profiles.addRateLimits(&prog.rlRules)
 		})
 
 		return nil
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// auditEvent names the type of security-relevant event being audited
+type auditEvent string
+
+const (
+	auditEvtConnect   auditEvent = "connect"
+	auditEvtHandshake auditEvent = "tls-handshake"
+	auditEvtNamespace auditEvent = "namespace"
+	auditEvtProtoVsn  auditEvent = "protocol-version"
+	auditEvtProtocol  auditEvent = "protocol-error"
+	auditEvtRateLimit auditEvent = "rate-limit"
+)
+
+// auditOutcome records the result of an audited event
+type auditOutcome string
+
+const (
+	auditAccepted     auditOutcome = "accepted"
+	auditRejected     auditOutcome = "rejected"
+	auditFailed       auditOutcome = "failed"
+	auditDisconnected auditOutcome = "disconnected"
+)
+
+// auditLog records security-relevant events, separately from the general
+// log, in a form suitable for compliance review. The audit file is only
+// ever appended to. If no audit file is given the events are discarded.
+type auditLog struct {
+	logger *slog.Logger
+}
+
+// newAuditLog returns an auditLog writing JSON records to the named
+// file. If the filename is empty the audit records are discarded.
+func newAuditLog(filename string) (*auditLog, error) {
+	const filePerms = 0o600
+
+	if filename == "" {
+		return &auditLog{logger: slog.New(slog.DiscardHandler)}, nil
+	}
+
+	f, err := os.OpenFile(filename,
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, filePerms)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the audit file: %w", err)
+	}
+
+	return &auditLog{logger: slog.New(slog.NewJSONHandler(f, nil))}, nil
+}
+
+// certAttrs returns slog Attrs describing the certificate. If the
+// certificate is nil the Attrs have empty values.
+func certAttrs(cert *x509.Certificate) []any {
+	subject, serial := "", ""
+
+	if cert != nil {
+		subject = cert.Subject.String()
+		serial = cert.SerialNumber.String()
+	}
+
+	return []any{
+		slog.String(cltAttrPfx+"Cert-Subject", subject),
+		slog.String(cltAttrPfx+"Cert-Serial", serial),
+	}
+}
+
+// peerCert returns the certificate presented by the remote end of the
+// connection or nil if there is none
+func peerCert(conn net.Conn) *x509.Certificate {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	pc := tlsConn.ConnectionState().PeerCertificates
+	if len(pc) == 0 {
+		return nil
+	}
+
+	return pc[0]
+}
+
+// record writes an audit record for the event. A non-nil error is recorded
+// as the reason for the outcome.
+func (al *auditLog) record(
+	evt auditEvent,
+	outcome auditOutcome,
+	err error,
+	attrs ...any,
+) {
+	attrs = append(attrs,
+		slog.String("event", string(evt)),
+		slog.String("outcome", string(outcome)))
+
+	if err != nil {
+		attrs = append(attrs, pusu.ErrorAttr(err))
+	}
+
+	al.logger.Info("audit", attrs...)
+}
+
+// recordConn writes an audit record for an event on a connection which has
+// not been given a connection ID.
+func (al *auditLog) recordConn(
+	conn net.Conn,
+	evt auditEvent,
+	outcome auditOutcome,
+	err error,
+) {
+	attrs := append(certAttrs(peerCert(conn)), netAddrAttr(conn))
+
+	al.record(evt, outcome, err, attrs...)
+}
+
+// audit writes an audit record for an event on the client connection
+func (clt *client) audit(evt auditEvent, outcome auditOutcome, err error) {
+	attrs := append(certAttrs(clt.cert), netAddrAttr(clt.conn), clt.cID.Attr())
+
+	if clt.namespace != "" {
+		attrs = append(attrs, clt.namespace.Attr())
+	}
+
+	clt.auditLog.record(evt, outcome, err, attrs...)
+}
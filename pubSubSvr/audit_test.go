@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// testAuditLog returns an auditLog writing its records to the buffer
+func testAuditLog(buf *bytes.Buffer) *auditLog {
+	return &auditLog{logger: slog.New(slog.NewJSONHandler(buf, nil))}
+}
+
+// auditRecords returns the audit records written to the buffer
+func auditRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var recs []map[string]any
+
+	for line := range strings.Lines(buf.String()) {
+		rec := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal("cannot decode the audit record:", err)
+		}
+
+		recs = append(recs, rec)
+	}
+
+	buf.Reset()
+
+	return recs
+}
+
+// checkAuditRecord checks that the record has the expected values. A field
+// given an expected value of nil should not be in the record.
+func checkAuditRecord(
+	t *testing.T,
+	id string,
+	rec map[string]any,
+	exp map[string]any,
+) {
+	t.Helper()
+
+	for k, expVal := range exp {
+		val, ok := rec[k]
+		if expVal == nil {
+			if ok {
+				t.Log(id)
+				t.Errorf("\t: unexpected field %q: %v", k, val)
+			}
+
+			continue
+		}
+
+		if val != expVal {
+			t.Log(id)
+			t.Errorf("\t: %q: expected: %v, actual: %v", k, expVal, val)
+		}
+	}
+}
+
+func TestAuditRecord(t *testing.T) {
+	testErr := errors.New("bad thing")
+
+	testCases := []struct {
+		testhelper.ID
+		evt     auditEvent
+		outcome auditOutcome
+		err     error
+		attrs   []any
+		exp     map[string]any
+	}{
+		{
+			ID:      testhelper.MkID("accepted"),
+			evt:     auditEvtConnect,
+			outcome: auditAccepted,
+			exp: map[string]any{
+				"msg":     "audit",
+				"event":   "connect",
+				"outcome": "accepted",
+				"error":   nil,
+			},
+		},
+		{
+			ID:      testhelper.MkID("rejected, with an error and attrs"),
+			evt:     auditEvtNamespace,
+			outcome: auditRejected,
+			err:     testErr,
+			attrs:   []any{slog.String("extra", "value")},
+			exp: map[string]any{
+				"event":   "namespace",
+				"outcome": "rejected",
+				"error":   testErr.Error(),
+				"extra":   "value",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			al := testAuditLog(&buf)
+			al.record(tc.evt, tc.outcome, tc.err, tc.attrs...)
+
+			recs := auditRecords(t, &buf)
+			testhelper.DiffInt(t, tc.IDStr(), "records", len(recs), 1)
+
+			if len(recs) == 1 {
+				checkAuditRecord(t, tc.IDStr(), recs[0], tc.exp)
+			}
+		})
+	}
+}
+
+func TestClientAudit(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		ns  pusu.Namespace
+		err error
+		exp map[string]any
+	}{
+		{
+			ID: testhelper.MkID("before the Start message"),
+			exp: map[string]any{
+				"event":                     "protocol-error",
+				"outcome":                   "rejected",
+				"error":                     "bad message",
+				cltAttrPfx + "connID":       float64(7),
+				cltAttrPfx + "Net-Address":  "pipe",
+				cltAttrPfx + "Cert-Subject": "",
+				cltAttrPfx + "Cert-Serial":  "",
+				pusu.NamespaceAttrKey:       nil,
+			},
+			err: errors.New("bad message"),
+		},
+		{
+			ID: testhelper.MkID("with a namespace"),
+			ns: "test",
+			exp: map[string]any{
+				"event":               "protocol-error",
+				"outcome":             "rejected",
+				pusu.NamespaceAttrKey: "test",
+			},
+			err: errors.New("bad message"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			conn, _ := net.Pipe()
+			clt := testClient(tc.ns)
+			clt.cID = 7
+			clt.conn = conn
+			clt.clientShared = &clientShared{
+				auditLog: testAuditLog(&buf),
+			}
+
+			clt.audit(auditEvtProtocol, auditRejected, tc.err)
+
+			recs := auditRecords(t, &buf)
+			testhelper.DiffInt(t, tc.IDStr(), "records", len(recs), 1)
+
+			if len(recs) == 1 {
+				checkAuditRecord(t, tc.IDStr(), recs[0], tc.exp)
+			}
+		})
+	}
+}
+
+func TestHandlerErrorAudited(t *testing.T) {
+	var buf bytes.Buffer
+
+	conn, _ := net.Pipe()
+	handlerErr := errors.New("bad payload")
+
+	clt := testClient("test")
+	clt.conn = conn
+	clt.clientShared = &clientShared{
+		auditLog:       testAuditLog(&buf),
+		disconnectChan: make(chan *client, 1),
+	}
+	clt.handlers = clientMsgHandlerMap{
+		pusu.Publish: func(*client, *pusu.Message) error { return handlerErr },
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		mt       pusu.MsgType
+		expError string
+	}{
+		{
+			ID:       testhelper.MkID("handler error"),
+			mt:       pusu.Publish,
+			expError: handlerErr.Error(),
+		},
+		{
+			ID:       testhelper.MkID("no handler"),
+			mt:       pusu.Subscribe,
+			expError: "unexpected message type: " + pusu.Subscribe.String(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ok := clt.handleMsg(&pusu.Message{MT: tc.mt})
+			testhelper.DiffBool(t, tc.IDStr(), "handled", ok, false)
+
+			<-clt.disconnectChan
+
+			recs := auditRecords(t, &buf)
+			testhelper.DiffInt(t, tc.IDStr(), "records", len(recs), 1)
+
+			if len(recs) == 1 {
+				checkAuditRecord(t, tc.IDStr(), recs[0], map[string]any{
+					"event":   "protocol-error",
+					"outcome": "rejected",
+					"error":   tc.expError,
+				})
+			}
+		})
+	}
+}
+
+func TestNewAuditLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+
+	for _, evt := range []auditEvent{auditEvtConnect, auditEvtHandshake} {
+		al, err := newAuditLog(filename)
+		if err != nil {
+			t.Fatal("cannot open the audit log:", err)
+		}
+
+		al.record(evt, auditAccepted, nil)
+	}
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal("cannot read the audit log:", err)
+	}
+
+	buf := bytes.NewBuffer(content)
+	recs := auditRecords(t, buf)
+	testhelper.DiffInt(t, "reopened audit log", "records", len(recs), 2)
+
+	if len(recs) == 2 {
+		checkAuditRecord(t, "first record", recs[0],
+			map[string]any{"event": string(auditEvtConnect)})
+		checkAuditRecord(t, "second record", recs[1],
+			map[string]any{"event": string(auditEvtHandshake)})
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// The kinds of line in the namespace bridges file
+const (
+	bridgeExport = "export"
+	bridgeImport = "import"
+)
+
+// bridgeAnyNS is the importer given in an export to let any namespace
+// import the topics
+const bridgeAnyNS = "*"
+
+// noteTextBridges describes the format of the namespace bridges file
+const noteTextBridges = "Namespaces are normally kept apart: a" +
+	" publication is only sent to subscribers in the namespace in which" +
+	" it was made. The namespace bridges file lets one namespace export" +
+	" topics and another import them so that publications on those" +
+	" topics are also sent to subscribers in the importing namespace." +
+	" Both sides must agree: a topic is only imported if the exporting" +
+	" namespace exports it to the importing namespace." +
+	"\n\n" +
+	"Each line of the file has one of the forms:" +
+	"\n\n" +
+	bridgeExport + " namespace topic-pattern importer[,importer...]" +
+	"\n\n" +
+	bridgeImport + " namespace from-namespace topic-pattern [prefix]" +
+	"\n\n" +
+	"An " + bridgeExport + " line lets the listed namespaces import the" +
+	" topics in the namespace matching the pattern; an importer given" +
+	" as '" + bridgeAnyNS + "' lets any namespace import them. An " +
+	bridgeImport + " line imports the topics matching the pattern from" +
+	" the other namespace. If a prefix is given the imported topics are" +
+	" placed under it, so with the prefix '/ext/prices' a publication on" +
+	" '/fx/eur' is sent to the subscribers to '/ext/prices/fx/eur';" +
+	" otherwise the topic is unchanged. Each import must be allowed by" +
+	" at least one export; a publication whose topic is matched by an" +
+	" import but not exported to the importing namespace is not sent." +
+	"\n\n" +
+	"As for the schema registry, a topic pattern matches a topic if it" +
+	" matches the topic or any of its parent topics and the pattern may" +
+	" contain '*' wildcards which match a single part of a topic." +
+	"\n\n" +
+	"Publications from clients and those republished by the routing" +
+	" rules are bridged. Imported publications are not bridged on again" +
+	" so a namespace cannot pass on topics it has imported, and the " +
+	string(sysTopic) + " topics are never bridged. The imported" +
+	" publication has '" + hdrRoutedFromNS + "' and '" +
+	hdrRoutedFromTopic + "' headers giving where it was published." +
+	"\n\n" +
+	"Blank lines and lines starting with '#' are ignored."
+
+// errBadBridges is the error returned when the namespace bridges cannot be
+// loaded
+var errBadBridges = errors.New("bad namespace bridges")
+
+// nsExport lets the importers import the topics matching the pattern from
+// the namespace
+type nsExport struct {
+	ns        pusu.Namespace
+	pattern   string
+	importers map[pusu.Namespace]bool
+}
+
+// allows returns true if the export lets the namespace import the topic
+func (e nsExport) allows(importer pusu.Namespace, topic pusu.Topic) bool {
+	return (e.importers[bridgeAnyNS] || e.importers[importer]) &&
+		topicPatternMatches(e.pattern, topic)
+}
+
+// nsImport imports the topics matching the pattern from the other
+// namespace into the namespace, under the prefix
+type nsImport struct {
+	ns      pusu.Namespace
+	from    pusu.Namespace
+	pattern string
+	prefix  pusu.Topic
+}
+
+// target returns the topic onto which the imported topic is placed
+func (i nsImport) target(topic pusu.Topic) pusu.Topic {
+	parts := append(topicParts(i.prefix), topicParts(topic)...)
+
+	return pusu.Topic("/" + strings.Join(parts, "/"))
+}
+
+// nsBridges holds the exports and imports between namespaces and counts
+// of the publications imported and of those not imported because they
+// were not exported
+type nsBridges struct {
+	exports []nsExport
+	imports []nsImport
+
+	imported atomic.Int64
+	denied   atomic.Int64
+}
+
+// checkPattern returns a non-nil error if the topic pattern is malformed
+func checkPattern(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("bad topic pattern %q: it must start with '/'",
+			pattern)
+	}
+
+	if _, err := path.Match(pattern, "/"); err != nil {
+		return fmt.Errorf("bad topic pattern %q: %w", pattern, err)
+	}
+
+	return nil
+}
+
+// parseExport parses the fields of an export line
+func parseExport(parts []string) (nsExport, error) {
+	const expParts = 4
+
+	if len(parts) != expParts {
+		return nsExport{}, fmt.Errorf("an %s needs %d fields, found %d",
+			bridgeExport, expParts, len(parts))
+	}
+
+	e := nsExport{
+		ns:        pusu.Namespace(parts[1]),
+		pattern:   parts[2],
+		importers: make(map[pusu.Namespace]bool),
+	}
+
+	for imp := range strings.SplitSeq(parts[3], ",") {
+		if imp == "" {
+			return e, errors.New("an importer is empty")
+		}
+
+		e.importers[pusu.Namespace(imp)] = true
+	}
+
+	return e, checkPattern(e.pattern)
+}
+
+// parseImport parses the fields of an import line
+func parseImport(parts []string) (nsImport, error) {
+	const (
+		minParts = 4
+		maxParts = 5
+	)
+
+	if len(parts) < minParts || len(parts) > maxParts {
+		return nsImport{}, fmt.Errorf(
+			"an %s needs %d or %d fields, found %d",
+			bridgeImport, minParts, maxParts, len(parts))
+	}
+
+	i := nsImport{
+		ns:      pusu.Namespace(parts[1]),
+		from:    pusu.Namespace(parts[2]),
+		pattern: parts[3],
+		prefix:  "/",
+	}
+
+	if len(parts) == maxParts {
+		i.prefix = pusu.Topic(parts[4])
+	}
+
+	if i.ns == i.from {
+		return i, errors.New("a namespace cannot import from itself")
+	}
+
+	if err := i.prefix.Check(); err != nil {
+		return i, fmt.Errorf("bad prefix: %w", err)
+	}
+
+	if err := checkPublishTopic(i.prefix); err != nil {
+		return i, fmt.Errorf("bad prefix: %w", err)
+	}
+
+	return i, checkPattern(i.pattern)
+}
+
+// loadBridges reads the namespace bridges file. An empty filename gives no
+// bridges.
+func loadBridges(filename string, bridges *nsBridges) error {
+	if filename == "" {
+		return nil
+	}
+
+	f, err := os.Open(filename) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBadBridges, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := bridges.parseLine(line); err != nil {
+			return fmt.Errorf("%w: %s:%d: %w",
+				errBadBridges, filename, lineNum, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%w: %w", errBadBridges, err)
+	}
+
+	return bridges.checkImports()
+}
+
+// parseLine parses a line from the namespace bridges file, adding the
+// export or import to the bridges
+func (b *nsBridges) parseLine(line string) error {
+	parts := strings.Fields(line)
+
+	switch parts[0] {
+	case bridgeExport:
+		e, err := parseExport(parts)
+		if err != nil {
+			return err
+		}
+
+		b.exports = append(b.exports, e)
+	case bridgeImport:
+		i, err := parseImport(parts)
+		if err != nil {
+			return err
+		}
+
+		b.imports = append(b.imports, i)
+	default:
+		return fmt.Errorf("unknown kind of line %q (use %q or %q)",
+			parts[0], bridgeExport, bridgeImport)
+	}
+
+	return nil
+}
+
+// checkImports returns a non-nil error if any import is not allowed by any
+// export
+func (b *nsBridges) checkImports() error {
+	for _, i := range b.imports {
+		allowed := false
+
+		for _, e := range b.exports {
+			if e.ns == i.from &&
+				(e.importers[bridgeAnyNS] || e.importers[i.ns]) {
+				allowed = true
+
+				break
+			}
+		}
+
+		if !allowed {
+			return fmt.Errorf(
+				"%w: namespace %q imports %q from %q"+
+					" but nothing is exported to it",
+				errBadBridges, i.ns, i.pattern, i.from)
+		}
+	}
+
+	return nil
+}
+
+// checkNamespaces returns a non-nil error if any of the namespaces is not
+// allowed by the namespace rules
+func (b *nsBridges) checkNamespaces(nsRules namespaceRules) error {
+	check := func(ns pusu.Namespace) error {
+		if !nsRules.isValid(ns) {
+			return fmt.Errorf("%w: the namespace %q is not allowed",
+				errBadBridges, ns)
+		}
+
+		return nil
+	}
+
+	for _, e := range b.exports {
+		if err := check(e.ns); err != nil {
+			return err
+		}
+	}
+
+	for _, i := range b.imports {
+		if err := check(i.ns); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// report logs the exports and imports
+func (b *nsBridges) report(logger *slog.Logger) {
+	for _, e := range b.exports {
+		logger.Info("namespace export",
+			e.ns.Attr(),
+			slog.String("topic-pattern", e.pattern),
+			slog.Any("importers", slices.Sorted(maps.Keys(e.importers))))
+	}
+
+	for _, i := range b.imports {
+		logger.Info("namespace import",
+			i.ns.Attr(),
+			slog.String("from", string(i.from)),
+			slog.String("topic-pattern", i.pattern),
+			slog.String("prefix", string(i.prefix)))
+	}
+}
+
+// statusAttr returns a slog Attr giving the counts of publications
+// imported and of those not imported because they were not exported since
+// the last call. The counts are reset.
+func (b *nsBridges) statusAttr() slog.Attr {
+	return slog.Group("bridged",
+		slog.Int64("imported", b.imported.Swap(0)),
+		slog.Int64("notExported", b.denied.Swap(0)))
+}
+
+// exported returns true if the topic in the namespace is exported to the
+// importer
+func (b *nsBridges) exported(
+	ns, importer pusu.Namespace,
+	topic pusu.Topic,
+) bool {
+	for _, e := range b.exports {
+		if e.ns == ns && e.allows(importer, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bridge sends the publication, made on the topic in the namespace, to the
+// subscribers in each namespace which imports the topic, if it has been
+// exported to them. The topic is that on which the publication was made,
+// taken before it was sent to any subscribers.
+func (prog *prog) bridge(
+	ns pusu.Namespace,
+	topic pusu.Topic,
+	pub *publication,
+	nsm namespaceSubsMap,
+) {
+	if isSysTopic(topic) {
+		return
+	}
+
+	for _, i := range prog.bridges.imports {
+		if i.from != ns || !topicPatternMatches(i.pattern, topic) {
+			continue
+		}
+
+		if !prog.bridges.exported(ns, i.ns, topic) {
+			prog.bridges.denied.Add(1)
+			prog.logger.Debug("publication not exported - not imported",
+				ns.Attr(), topic.Attr(),
+				slog.String("importer", string(i.ns)))
+
+			continue
+		}
+
+		ip := pub.routedCopy(routeKey{ns: ns, topic: topic}, i.target(topic))
+
+		prog.fanOut(clientMessage{
+			clt:  &client{namespace: i.ns, logger: prog.logger},
+			msg:  &pusu.Message{MT: pusu.Publish, MsgID: pusu.NoMsgID},
+			rcvd: time.Now(),
+		}, ip, nsm)
+		prog.bridges.imported.Add(1)
+	}
+}
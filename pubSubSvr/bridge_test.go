@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestBridgesParse(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		lines []string
+	}{
+		{
+			ID: testhelper.MkID("good"),
+			lines: []string{
+				"export prices /fx/* risk,ops",
+				"import risk prices /fx/eur /ext/prices",
+				"import ops prices /fx",
+			},
+		},
+		{
+			ID:     testhelper.MkID("bad: not exported"),
+			ExpErr: testhelper.MkExpErr("nothing is exported to it"),
+			lines: []string{
+				"export prices /fx risk",
+				"import ops prices /fx",
+			},
+		},
+		{
+			ID:     testhelper.MkID("bad: unknown kind"),
+			ExpErr: testhelper.MkExpErr(`unknown kind of line "share"`),
+			lines:  []string{"share prices /fx risk"},
+		},
+		{
+			ID:     testhelper.MkID("bad: export without importers"),
+			ExpErr: testhelper.MkExpErr("an export needs 4 fields, found 3"),
+			lines:  []string{"export prices /fx"},
+		},
+		{
+			ID:     testhelper.MkID("bad: empty importer"),
+			ExpErr: testhelper.MkExpErr("an importer is empty"),
+			lines:  []string{"export prices /fx risk,"},
+		},
+		{
+			ID:     testhelper.MkID("bad: relative pattern"),
+			ExpErr: testhelper.MkExpErr("bad topic pattern", "must start"),
+			lines:  []string{"export prices fx risk"},
+		},
+		{
+			ID:     testhelper.MkID("bad: import from itself"),
+			ExpErr: testhelper.MkExpErr("cannot import from itself"),
+			lines:  []string{"import prices prices /fx"},
+		},
+		{
+			ID:     testhelper.MkID("bad: system topic prefix"),
+			ExpErr: testhelper.MkExpErr("bad prefix", "reserved topic"),
+			lines:  []string{"import risk prices /fx /$sys/fx"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var (
+				b   nsBridges
+				err error
+			)
+
+			for _, line := range tc.lines {
+				if err = b.parseLine(line); err != nil {
+					break
+				}
+			}
+
+			if err == nil {
+				err = b.checkImports()
+			}
+
+			testhelper.CheckExpErr(t, err, tc)
+		})
+	}
+}
+
+func TestBridge(t *testing.T) {
+	const (
+		prices = pusu.Namespace("prices")
+		risk   = pusu.Namespace("risk")
+		ops    = pusu.Namespace("ops")
+	)
+
+	prog := &prog{logger: testLogger}
+
+	for _, line := range []string{
+		"export prices /fx/eur risk",
+		"export prices /$sys *",
+		"import risk prices /fx /ext",
+		"import ops prices /fx",
+		"import ops prices /$sys",
+	} {
+		if err := prog.bridges.parseLine(line); err != nil {
+			t.Fatal("cannot parse the bridges:", err)
+		}
+	}
+
+	riskSub, opsSub := testClient(risk), testClient(ops)
+
+	nsm := namespaceSubsMap{
+		risk: {topics: subsMap{"/ext/fx": subscribers{riskSub: nil}}},
+		ops:  {topics: subsMap{"/": subscribers{opsSub: nil}}},
+	}
+
+	for _, topic := range []string{"/fx/eur", "/fx/usd", "/$sys/clients"} {
+		prog.bridge(prices, pusu.Topic(topic), &publication{
+			pmp:   &pusu.PublishMsgPayload{Topic: topic},
+			plain: []byte("1.08"),
+		}, nsm)
+	}
+
+	testhelper.DiffInt(t, "bridge", "imported by risk",
+		len(riskSub.sendChan), 1)
+	testhelper.DiffInt(t, "bridge", "imported by ops", len(opsSub.sendChan), 0)
+	testhelper.DiffInt(t, "bridge", "imported", prog.bridges.imported.Load(), 1)
+	testhelper.DiffInt(t, "bridge", "not exported",
+		prog.bridges.denied.Load(), 3)
+}
+
+func TestPublishBridged(t *testing.T) {
+	const (
+		prices = pusu.Namespace("prices")
+		risk   = pusu.Namespace("risk")
+	)
+
+	prog := &prog{logger: testLogger}
+
+	for _, line := range []string{
+		"export prices /fx/eur risk",
+		"import risk prices /fx /ext",
+	} {
+		if err := prog.bridges.parseLine(line); err != nil {
+			t.Fatal("cannot parse the bridges:", err)
+		}
+	}
+
+	parentSub, riskSub := testClient(prices), testClient(risk)
+
+	nsm := namespaceSubsMap{
+		prices: {topics: subsMap{"/fx": subscribers{parentSub: nil}}},
+		risk:   {topics: subsMap{"/ext/fx/eur": subscribers{riskSub: nil}}},
+	}
+
+	serverHandlePublish(prog, clientMessage{
+		clt: testClient(prices),
+		msg: &pusu.Message{MT: pusu.Publish, MsgID: 7},
+		pubs: []*publication{{
+			pmp:   &pusu.PublishMsgPayload{Topic: "/fx/eur"},
+			plain: []byte("1.08"),
+		}},
+	}, nsm)
+
+	testhelper.DiffInt(t, "publish", "publications on /fx",
+		len(parentSub.sendChan), 1)
+	testhelper.DiffInt(t, "publish", "imported by risk",
+		len(riskSub.sendChan), 1)
+
+	if len(riskSub.sendChan) != 1 {
+		return
+	}
+
+	pmp, err := (<-riskSub.sendChan).publication()
+	if err != nil {
+		t.Fatal("cannot decode the publication:", err)
+	}
+
+	hdrs, err := getExtMap(pmp, extPublishHeaders)
+	if err != nil {
+		t.Fatal("cannot decode the headers:", err)
+	}
+
+	testhelper.DiffString(t, "publish", "topic", pmp.Topic, "/ext/fx/eur")
+	testhelper.DiffString(t, "publish", "routed-from topic",
+		hdrs[hdrRoutedFromTopic], "/fx/eur")
+}
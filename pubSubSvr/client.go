@@ -1,15 +1,117 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io"
 	"log/slog"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/nickwells/pusu.mod/pusu"
+	"google.golang.org/protobuf/proto"
 )
 
+// The reasons recorded for a client connection being closed
+const (
+	closeReasonEOF       = "EOF"
+	closeReasonReadErr   = "read error"
+	closeReasonSlow      = "slow consumer"
+	closeReasonProtocol  = "protocol error"
+	closeReasonRateLimit = "rate limited"
+)
+
+// writeBufferSize is the size of the buffer through which messages are
+// written to the client. It is the largest TLS record size; a message which
+// is bigger than the buffer is written directly.
+const writeBufferSize = 16 * 1024
+
+// clientShared holds the server state which is shared by all the clients
+type clientShared struct {
+	pubSubChan     chan clientMessage
+	disconnectChan chan *client
+
+	nsRules     namespaceRules
+	connLimits  *connLimits
+	rlRules     *rateLimitRules
+	hdrLimits   headerLimits
+	schemas     *schemaRegistry
+	savedSubs   *savedSubs
+	compression compressionConfig
+	auditLog    *auditLog
+	tracer      *tracer
+	profiles    *nsProfiles
+
+	writeMaxLatency time.Duration
+}
+
+// outMsg is a message to be written to the client together with the trace
+// context, if any, of the operation which sent it. If enc is not nil it
+// holds the message already encoded and only the type is set in msg. If
+// raw is not nil it holds bytes to be written as they are, such as an MQTT
+// control packet, and msg is not set.
+type outMsg struct {
+	msg pusu.Message
+	enc *encodedMsg
+	raw []byte
+	tc  traceContext
+}
+
+// write writes the message to the writer, releasing the reference to
+// any encoded message.
+func (om outMsg) write(w io.Writer) error {
+	if om.raw != nil {
+		_, err := w.Write(om.raw)
+		return err
+	}
+
+	if om.enc == nil {
+		return om.msg.Write(w)
+	}
+
+	defer om.enc.release()
+
+	_, err := w.Write(om.enc.bytes())
+
+	return err
+}
+
+// discard releases the reference to any encoded message without writing it
+func (om outMsg) discard() {
+	if om.enc != nil {
+		om.enc.release()
+	}
+}
+
+// publication returns the payload of a Publish message, decoding the
+// message if it has already been encoded. It releases the reference to any
+// encoded message.
+func (om outMsg) publication() (*pusu.PublishMsgPayload, error) {
+	msg := om.msg
+
+	if om.enc != nil {
+		var err error
+
+		msg, err = pusu.ReadMsg(bytes.NewReader(om.enc.bytes()))
+		om.discard()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pmp := &pusu.PublishMsgPayload{}
+	if err := proto.Unmarshal(msg.Payload, pmp); err != nil {
+		return nil, err
+	}
+
+	return pmp, nil
+}
+
 // client represents a client of the server - a connection from another
 // program. The identity is supplied by the connecting client and is not
 // verified or validated; it should not be trusted
@@ -27,6 +129,50 @@ type client struct {
 	// protoVsn is the version of the communication protocol that
 	// this client will use
 	protoVsn pusu.ProtoVsn
+	// cert is the certificate presented by the client during the TLS
+	// handshake. Unlike the identity, this has been verified.
+	cert *x509.Certificate
+	// certID is the identity given in the client certificate (the Subject
+	// Common Name)
+	certID string
+	// encoding is the scheme, negotiated in the Start message, with which
+	// publication payloads sent to the client are compressed
+	encoding contentEncoding
+	// confirms is set, in the Start message, if the client wants its
+	// publications acknowledged only once they have been sent on to the
+	// subscribers
+	confirms bool
+	// will is the publication, given in the Start message, to be made on
+	// the client's behalf if the connection ends abnormally
+	will *publication
+	// origTopic is set if publications should be sent with the topic on
+	// which they were published rather than the topic subscribed to. The
+	// client is then sent each publication only once even if it has
+	// subscribed to more than one of the topics it is sent to.
+	origTopic bool
+	// mqtt is the MQTT session state, for clients connected over MQTT
+	mqtt *mqttSession
+	// assignedID is set if the client gave no identity and the server
+	// made one up. Such an identity does not identify the client across
+	// connections.
+	assignedID bool
+	// gateway is set for clients connected through the HTTP gateway
+	gateway bool
+	// profile gives the settings for the client's namespace. It is set
+	// once the namespace is known.
+	profile *nsProfile
+
+	// lastDeliveryID is the message ID last used to deliver a publication
+	// to a durable subscription. It is only used by the pubSubHandler.
+	lastDeliveryID pusu.MsgID
+	// started is set once the server has seen the client's Start
+	// message. It is only used by the pubSubHandler.
+	started bool
+
+	// closeReason and closeErr record why the connection was closed. Only
+	// the first reason is kept.
+	closeReason string
+	closeErr    error
 
 	logger *slog.Logger
 
@@ -36,12 +182,12 @@ type client struct {
 	subs     map[pusu.Topic]bool
 	handlers clientMsgHandlerMap
 
-	pubSubChan     chan clientMessage
-	disconnectChan chan *client
+	sendChan chan outMsg
 
-	sendChan chan pusu.Message
+	remoteIP string
+	limiters []*rateLimiter
 
-	nsRules namespaceRules
+	*clientShared
 }
 
 // startClient returns a pointer to a newly instantiated client
@@ -49,21 +195,16 @@ func startClient(
 	logger *slog.Logger,
 	cid connID,
 	conn net.Conn,
-	psChan chan clientMessage,
-	disconnectChan chan *client,
-	nsRules namespaceRules,
+	shared *clientShared,
 ) {
-	const maxBacklog = 20
-
 	clt := &client{
-		cID:            cid,
-		conn:           conn,
-		subs:           make(map[pusu.Topic]bool),
-		handlers:       make(clientMsgHandlerMap),
-		pubSubChan:     psChan,
-		disconnectChan: disconnectChan,
-		sendChan:       make(chan pusu.Message, maxBacklog),
-		nsRules:        nsRules,
+		cID:          cid,
+		conn:         conn,
+		subs:         make(map[pusu.Topic]bool),
+		handlers:     make(clientMsgHandlerMap),
+		sendChan:     make(chan outMsg, shared.profiles.chanSize()),
+		remoteIP:     remoteIP(conn),
+		clientShared: shared,
 	}
 
 	clt.logger = logger.With(cid.Attr())
@@ -93,6 +234,72 @@ func (clt *client) startInfoAttr() slog.Attr {
 	return slog.String(cltAttrPfx+"Start-Info", clt.identity)
 }
 
+// certIDAttr returns a standardised slog Attr giving the identity from the
+// client certificate.
+func (clt *client) certIDAttr() slog.Attr {
+	return slog.String(cltAttrPfx+"Cert-Identity", clt.certID)
+}
+
+// handshake completes the TLS handshake, if the connection is a TLS
+// connection, and records the certificate presented by the client.
+func (clt *client) handshake() error {
+	tlsConn, ok := clt.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	cs := tlsConn.ConnectionState()
+	if len(cs.PeerCertificates) > 0 {
+		clt.cert = cs.PeerCertificates[0]
+		clt.certID = clt.cert.Subject.CommonName
+	}
+
+	clt.logger.Info("handshake complete", clt.certIDAttr())
+
+	return nil
+}
+
+// admit completes the TLS handshake, if any, and checks that the identity
+// in the client certificate is allowed another connection, auditing the
+// outcome. It returns a non-nil error if the client may not connect; the
+// error wraps errConnLimit if the handshake succeeded but the identity has
+// too many connections. If the client is admitted the caller must release
+// the identity once the client has gone.
+func (clt *client) admit() error {
+	if err := clt.handshake(); err != nil {
+		clt.audit(auditEvtHandshake, auditFailed, err)
+
+		return err
+	}
+
+	if err := clt.connLimits.admitIdentity(clt.certID); err != nil {
+		clt.audit(auditEvtConnect, auditRejected, err)
+
+		return err
+	}
+
+	clt.audit(auditEvtConnect, auditAccepted, nil)
+
+	return nil
+}
+
+// enterNamespace sets the client namespace, together with the rate limiters
+// which apply to the client. It returns a non-nil error, which has been
+// audited, if the namespace is not allowed.
+func (clt *client) enterNamespace(ns string) error {
+	if err := clt.setNamespace(ns); err != nil {
+		return err
+	}
+
+	clt.limiters = clt.rlRules.limitersFor(clt.certID, clt.namespace)
+
+	return nil
+}
+
 // readMsg reads the next message received over the client's connection
 func (clt *client) readMsg() (pusu.Message, error) {
 	return pusu.ReadMsg(clt.conn)
@@ -105,66 +312,256 @@ func (clt *client) reader(wg *sync.WaitGroup) {
 
 	wg.Done()
 
-Loop:
+	defer clt.logger.Info("reader finished")
+	defer clt.connLimits.releaseConn(clt.remoteIP)
+
+	if err := clt.admit(); err != nil {
+		if errors.Is(err, errConnLimit) {
+			clt.reject(err)
+		} else {
+			clt.handleReadError(err)
+		}
+
+		return
+	}
+
+	defer clt.connLimits.releaseIdentity(clt.certID)
+
 	for {
 		msg, err := clt.readMsg()
 		if err != nil {
 			clt.handleReadError(err)
 
-			break Loop
+			break
 		}
 
-		clt.logger.Info("client message received", msg.MT.Attr())
+		if !clt.handleMsg(&msg) {
+			break
+		}
+	}
+}
 
-		handler, ok := clt.handlers[msg.MT]
+// handleMsg passes the message to the handler for its type. It returns
+// false if the message could not be handled, in which case the error has
+// been audited and sent to the client, which will be disconnected. A
+// client disconnected for exceeding its rate limits has been audited as
+// such rather than as having made a protocol error.
+func (clt *client) handleMsg(msg *pusu.Message) bool {
+	clt.logger.Info("client message received", msg.MT.Attr())
 
-		if !ok {
-			err := errors.New("unexpected message type: " + msg.MT.String())
+	handler, ok := clt.handlers[msg.MT]
 
-			clt.logger.Error("couldn't handle client message",
-				pusu.ErrorAttr(err))
-			clt.sendError(msg.MsgID, err)
+	if !ok {
+		err := errors.New("unexpected message type: " + msg.MT.String())
 
-			break Loop
-		}
+		clt.logger.Error("couldn't handle client message",
+			pusu.ErrorAttr(err))
+		clt.audit(auditEvtProtocol, auditRejected, err)
+		clt.handleProtocolError(msg.MsgID, err)
 
-		if err = handler(clt, &msg); err != nil {
-			clt.logger.Error("the client message handler failed",
-				pusu.ErrorAttr(err),
-				msg.MT.Attr())
-			clt.sendError(msg.MsgID, err)
+		return false
+	}
 
-			break Loop
-		}
+	err := handler(clt, msg)
+	if errors.Is(err, errMsgRejected) {
+		clt.sendError(msg.MsgID, err)
+
+		return true
+	}
+
+	if errors.Is(err, errRateLimited) {
+		clt.rateLimitDisconnect()
+
+		return false
+	}
+
+	if err != nil {
+		clt.logger.Error("the client message handler failed",
+			pusu.ErrorAttr(err),
+			msg.MT.Attr())
+		clt.audit(auditEvtProtocol, auditRejected, err)
+		clt.handleProtocolError(msg.MsgID, err)
+
+		return false
+	}
+
+	return true
+}
+
+// handleProtocolError sends the error to the client, which will be
+// disconnected once the Error has been sent, and notifies the server that
+// the client is disconnecting.
+func (clt *client) handleProtocolError(msgID pusu.MsgID, err error) {
+	clt.setCloseReason(closeReasonProtocol, err)
+	clt.sendError(msgID, err)
+
+	clt.disconnectChan <- clt
+}
+
+// rateLimitDisconnect disconnects the client, without any further message,
+// and notifies the server that the client is disconnecting. The
+// disconnection has already been audited and the close reason recorded.
+func (clt *client) rateLimitDisconnect() {
+	clt.disconnect()
+
+	clt.disconnectChan <- clt
+}
+
+// reject reads the first message from the client and replies with an Error
+// message giving the reason for the rejection. The client will be
+// disconnected once the Error has been sent. It will not spend more than
+// the rejectTimeout doing this.
+func (clt *client) reject(reason error) {
+	clt.logger.Error("connection rejected", pusu.ErrorAttr(reason))
+
+	msgID := pusu.NoMsgID
+
+	if err := clt.conn.SetDeadline(time.Now().Add(rejectTimeout)); err != nil {
+		clt.logger.Error("couldn't set the deadline", pusu.ErrorAttr(err))
+	} else if msg, err := clt.readMsg(); err == nil {
+		msgID = msg.MsgID
 	}
 
-	clt.logger.Info("reader finished")
+	clt.sendError(msgID, reason)
 }
 
-// writer listens on a channel and writes the messages to the client
+// writer listens on a channel and writes the messages to the client. The
+// messages are written through a buffer which is flushed as soon as there
+// are no more messages queued, so that messages which arrive together are
+// sent together. If a maximum write latency is set the buffer is also
+// flushed once that time has passed since the first unflushed message was
+// written, so that messages are not held back for longer than that while
+// the queue never empties.
 func (clt *client) writer(wg *sync.WaitGroup) {
 	clt.logger.Info("writer started")
 
 	wg.Done()
 
+	bw := bufio.NewWriterSize(clt.conn, writeBufferSize)
+
+	var flushTimer <-chan time.Time // only set while there is unflushed data
+
 Loop:
-	for msg := range clt.sendChan {
-		if err := msg.Write(clt.conn); err != nil {
-			clt.logger.Error("couldn't write the message to the client",
-				msg.MT.Attr(),
-				pusu.ErrorAttr(err))
+	for {
+		var om outMsg
+
+		var ok bool
+
+		select {
+		case om, ok = <-clt.sendChan:
+		default:
+			if bw.Buffered() > 0 && !clt.flush(bw) {
+				clt.abandonWrites()
+
+				break Loop
+			}
+
+			flushTimer = nil
+			om, ok = <-clt.sendChan
+		}
+
+		if !ok {
+			clt.flush(bw)
+
+			break Loop
+		}
+
+		if !clt.writeMsg(bw, om) {
+			clt.abandonWrites()
 
 			break Loop
 		}
 
-		if msg.MT == pusu.Error {
+		if om.msg.MT == pusu.Error {
+			clt.flush(bw)
 			clt.disconnect()
+
+			continue Loop
+		}
+
+		if clt.writeMaxLatency <= 0 {
+			continue Loop
+		}
+
+		if flushTimer == nil {
+			flushTimer = time.After(clt.writeMaxLatency)
+
+			continue Loop
+		}
+
+		select {
+		case <-flushTimer:
+			flushTimer = nil
+
+			if !clt.flush(bw) {
+				clt.abandonWrites()
+
+				break Loop
+			}
+		default:
 		}
 	}
 
 	clt.logger.Info("writer finished")
 }
 
+// abandonWrites is called when the writer can no longer write to the
+// client. It disconnects the client, so that the reader stops, and then
+// discards any messages still queued, releasing their encoded form, until
+// the send channel is closed.
+func (clt *client) abandonWrites() {
+	clt.disconnect()
+
+	for om := range clt.sendChan {
+		om.discard()
+	}
+}
+
+// writeMsg writes the message to the buffered writer, reporting any
+// error. It returns false if the write failed.
+func (clt *client) writeMsg(bw *bufio.Writer, om outMsg) bool {
+	wSpan := clt.tracer.startSpan("pubsub write", spanKindProducer,
+		om.tc, time.Now())
+	wSpan.setAttr(cltAttrPfx+"connID", clt.cID.String())
+
+	err := clt.writeOut(bw, om)
+
+	wSpan.setError(err)
+	wSpan.finish()
+
+	if err != nil {
+		clt.logger.Error("couldn't write the message to the client",
+			om.msg.MT.Attr(),
+			pusu.ErrorAttr(err))
+
+		return false
+	}
+
+	return true
+}
+
+// writeOut writes the message in the protocol the client is using
+func (clt *client) writeOut(w io.Writer, om outMsg) error {
+	if clt.mqtt != nil {
+		return clt.mqttWrite(w, om)
+	}
+
+	return om.write(w)
+}
+
+// flush writes any buffered messages to the client, reporting any
+// error. It returns false if the flush failed.
+func (clt *client) flush(bw *bufio.Writer) bool {
+	if err := bw.Flush(); err != nil {
+		clt.logger.Error("couldn't write the messages to the client",
+			pusu.ErrorAttr(err))
+
+		return false
+	}
+
+	return true
+}
+
 // handleReadError reports an error detected when reading from the client
 // connection. It then notifies the server that the client is disconnecting.
 func (clt *client) handleReadError(err error) {
@@ -174,9 +571,11 @@ func (clt *client) handleReadError(err error) {
 
 	if errors.Is(err, io.EOF) {
 		clt.logger.Info("client disconnected")
+		clt.setCloseReason(closeReasonEOF, nil)
 	} else {
 		clt.logger.Error("could not read the client message",
 			pusu.ErrorAttr(err))
+		clt.setCloseReason(closeReasonReadErr, err)
 	}
 
 	clt.disconnectChan <- clt
@@ -218,25 +617,77 @@ func (clt *client) sendAck(msgID pusu.MsgID) {
 	})
 }
 
-// sendMessage checks that the sendChan is not full and closes it if it
-// is. Otherwise it writes the message to the channel.
+// sendMessage sends the message to the client with no trace context
 func (clt *client) sendMessage(msg pusu.Message) {
+	clt.sendTracedMessage(msg, traceContext{})
+}
+
+// sendTracedMessage sends the message to the client with the trace context
+func (clt *client) sendTracedMessage(msg pusu.Message, tc traceContext) {
+	clt.send(outMsg{msg: msg, tc: tc})
+}
+
+// sendEncodedMessage sends the encoded message to the client with the trace
+// context. It takes a reference to the encoded message which is released
+// once the message has been written or discarded. It returns false if the
+// message was discarded.
+func (clt *client) sendEncodedMessage(em *encodedMsg, tc traceContext) bool {
+	em.retain()
+
+	return clt.send(outMsg{msg: pusu.Message{MT: em.mt}, enc: em, tc: tc})
+}
+
+// send checks that the client's backlog is not full and, if it is, either
+// discards the message or closes the sendChan, as the namespace profile
+// says. Otherwise it writes the outMsg to the channel. It returns false if
+// the message was discarded.
+func (clt *client) send(om outMsg) bool {
 	clt.Lock()
 	defer clt.Unlock()
 
 	if !clt.connected {
-		return
+		om.discard()
+		return false
+	}
+
+	if clt.profile != nil && len(clt.sendChan) >= clt.profile.backlog {
+		return clt.overflow(om)
 	}
 
 	select {
-	case clt.sendChan <- msg:
+	case clt.sendChan <- om:
+		return true
 	default:
-		clt.logger.Error("slow consumer")
+		return clt.overflow(om)
+	}
+}
+
+// overflow handles a message for a client whose backlog is full. The
+// message is discarded and, unless the namespace profile says that such
+// messages should be dropped, the client is disconnected as a slow
+// consumer. It always returns false. It must be called with the client
+// locked.
+func (clt *client) overflow(om outMsg) bool {
+	om.discard()
 
-		clt.closeConn()
-		close(clt.sendChan)
-		clt.connected = false
+	if clt.profile != nil && clt.profile.overflow == overflowDrop {
+		clt.profile.dropped.Add(1)
+		clt.logger.Warn("message dropped - the backlog is full")
+
+		return false
+	}
+
+	clt.logger.Error("slow consumer")
+
+	if clt.closeReason == "" {
+		clt.closeReason = closeReasonSlow
 	}
+
+	clt.closeConn()
+	close(clt.sendChan)
+	clt.connected = false
+
+	return false
 }
 
 // disconnect handles the disconnection behaviour
@@ -252,3 +703,28 @@ func (clt *client) disconnect() {
 	close(clt.sendChan)
 	clt.connected = false
 }
+
+// setCloseReason records why the client connection is being closed unless
+// a reason has already been recorded
+func (clt *client) setCloseReason(reason string, err error) {
+	clt.Lock()
+	defer clt.Unlock()
+
+	if clt.closeReason == "" {
+		clt.closeReason = reason
+		clt.closeErr = err
+	}
+}
+
+// getCloseReason returns the reason the client connection was closed and
+// the text of any error
+func (clt *client) getCloseReason() (string, string) {
+	clt.Lock()
+	defer clt.Unlock()
+
+	if clt.closeErr == nil {
+		return clt.closeReason, ""
+	}
+
+	return clt.closeReason, clt.closeErr.Error()
+}
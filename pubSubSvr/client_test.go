@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// testLogger is the logger given to the clients and progs made by the tests.
+// It discards everything logged.
+var testLogger = slog.New(slog.DiscardHandler)
+
+// testClient returns a started, connected client in the given namespace
+// with room on its send channel for a few messages. Tests needing anything
+// more should set the fields on the returned client.
+func testClient(ns pusu.Namespace) *client {
+	return &client{
+		namespace: ns,
+		logger:    testLogger,
+		connected: true,
+		started:   true,
+		subs:      map[pusu.Topic]bool{},
+		sendChan:  make(chan outMsg, 10),
+	}
+}
+
+func TestWriterReleasesQueued(t *testing.T) {
+	const queued = 3
+
+	em, err := encodeMsg(pusu.Message{
+		MT:      pusu.Publish,
+		Payload: bytes.Repeat([]byte("x"), 2*writeBufferSize),
+	})
+	if err != nil {
+		t.Fatal("cannot encode the message:", err)
+	}
+
+	conn, peer := net.Pipe()
+	_ = peer.Close()
+
+	clt := testClient("test")
+	clt.conn = conn
+	clt.clientShared = &clientShared{}
+
+	for range queued {
+		if !clt.send(outMsg{msg: pusu.Message{MT: pusu.Publish}, enc: em}) {
+			t.Fatal("the message was not queued")
+		}
+
+		em.retain()
+	}
+
+	em.release()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	clt.writer(&wg)
+
+	testhelper.DiffInt(t, "failed write", "references", em.refs.Load(), 0)
+	testhelper.DiffBool(t, "failed write", "connected", clt.connected, false)
+}
+
+func TestWriterFlushesWhenIdle(t *testing.T) {
+	conn, peer := net.Pipe()
+
+	t.Cleanup(func() { _ = peer.Close() })
+
+	clt := testClient("test")
+	clt.conn = conn
+	clt.clientShared = &clientShared{writeMaxLatency: time.Hour}
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go clt.writer(&wg)
+
+	if !clt.send(outMsg{msg: pusu.Message{MT: pusu.Ping, MsgID: 7}}) {
+		t.Fatal("the message was not queued")
+	}
+
+	if err := peer.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal("cannot set the read deadline:", err)
+	}
+
+	msg, err := pusu.ReadMsg(peer)
+	if err != nil {
+		t.Fatal("the message was not written once the queue was empty:",
+			err)
+	}
+
+	testhelper.DiffInt(t, "written message", "message ID", msg.MsgID, 7)
+
+	clt.disconnect()
+}
+
+// loopbackConn returns the client end of a TCP connection over the loopback
+// interface. Everything written to it is read and discarded by the server
+// end.
+func loopbackConn(b *testing.B) net.Conn {
+	b.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal("cannot listen:", err)
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		_, _ = io.Copy(io.Discard, conn)
+		_ = conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal("cannot connect:", err)
+	}
+
+	b.Cleanup(func() {
+		_ = conn.Close()
+		_ = l.Close()
+	})
+
+	return conn
+}
+
+// BenchmarkWriter compares the throughput of writing each message to the
+// connection separately with that of the client writer, which coalesces
+// queued messages into fewer writes.
+func BenchmarkWriter(b *testing.B) {
+	msg := pusu.Message{
+		MT:      pusu.Publish,
+		Payload: bytes.Repeat([]byte("x"), 256),
+	}
+
+	b.Run("write per message", func(b *testing.B) {
+		conn := loopbackConn(b)
+
+		b.SetBytes(int64(len(msg.Payload)))
+
+		for b.Loop() {
+			if err := msg.Write(conn); err != nil {
+				b.Fatal("unexpected write error:", err)
+			}
+		}
+	})
+
+	for _, latency := range []time.Duration{0, time.Millisecond} {
+		b.Run("batched, max latency: "+latency.String(), func(b *testing.B) {
+			clt := &client{
+				logger:    testLogger,
+				conn:      loopbackConn(b),
+				connected: true,
+				sendChan:  make(chan outMsg, 1000),
+				clientShared: &clientShared{
+					writeMaxLatency: latency,
+				},
+			}
+
+			var wg sync.WaitGroup
+
+			wg.Add(1)
+
+			done := make(chan struct{})
+
+			go func() {
+				clt.writer(&wg)
+				close(done)
+			}()
+
+			b.SetBytes(int64(len(msg.Payload)))
+
+			for b.Loop() {
+				clt.sendChan <- outMsg{msg: msg}
+			}
+
+			close(clt.sendChan)
+			<-done
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// noteTextCompression describes how payload compression is negotiated
+const noteTextCompression = "A client may offer, in its Start message," +
+	" the payload compression schemes it can accept, in order of" +
+	" preference. The server chooses the first of these that it allows" +
+	" and reports its choice in the payload of the Ack to the Start" +
+	" message. The server will then compress the payloads of" +
+	" publications sent to that client with the chosen scheme, unless" +
+	" the payload is too small to be worth compressing or compressing" +
+	" it does not make it any smaller." +
+	"\n\n" +
+	"A compressed payload is marked by the '" + hdrContentEncoding + "'" +
+	" publication header, whose value is the name of the scheme. A" +
+	" publisher may send a compressed payload in the same way; the" +
+	" server will decompress it for any subscribers which cannot" +
+	" accept that scheme and recompress it for those which have chosen" +
+	" another. Each form of the payload is produced at most once per" +
+	" publication, however many subscribers receive it. A decompressed" +
+	" payload must still fit within the maximum message size." +
+	"\n\n" +
+	"The offered schemes are carried in field number 100 of the Start" +
+	" message payload, as a repeated string, and the chosen scheme in" +
+	" field number 100 of the Ack payload, as a string. An empty" +
+	" string means that payloads will not be compressed."
+
+// contentEncoding names a scheme for compressing publication payloads
+type contentEncoding string
+
+const (
+	encIdentity contentEncoding = ""
+	encGzip     contentEncoding = "gzip"
+	encDeflate  contentEncoding = "deflate"
+)
+
+// hdrContentEncoding is the publication header giving the scheme with which
+// the payload has been compressed
+const hdrContentEncoding = "content-encoding"
+
+// errBadEncoding is the error returned when a compressed payload cannot be
+// decoded
+var errBadEncoding = errors.New("bad payload encoding")
+
+// codec holds the functions to compress and decompress a payload with some
+// content encoding
+type codec struct {
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// codecs holds the supported content encodings
+var codecs = map[contentEncoding]codec{
+	encGzip: {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	encDeflate: {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flate.DefaultCompression)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	},
+}
+
+// compress returns the payload compressed with the content encoding
+func (enc contentEncoding) compress(payload []byte) ([]byte, error) {
+	c, ok := codecs[enc]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown encoding: %q", errBadEncoding, enc)
+	}
+
+	var buf bytes.Buffer
+
+	w, err := c.newWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = w.Write(payload); err != nil {
+		return nil, err
+	}
+
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompress returns the payload decompressed with the content encoding. It
+// returns an error if the decompressed payload is bigger than the maximum
+// message payload.
+func (enc contentEncoding) decompress(payload []byte) ([]byte, error) {
+	c, ok := codecs[enc]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown encoding: %q", errBadEncoding, enc)
+	}
+
+	r, err := c.newReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", errBadEncoding, enc, err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(io.LimitReader(r, pusu.MaxMessagePayload+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", errBadEncoding, enc, err)
+	}
+
+	if len(b) > pusu.MaxMessagePayload {
+		return nil, fmt.Errorf("%w: %s: the decompressed payload is too big",
+			errBadEncoding, enc)
+	}
+
+	return b, nil
+}
+
+// compressionConfig records the compression schemes the server allows and
+// the smallest payload it will compress
+type compressionConfig struct {
+	allowed []contentEncoding
+	minSize int
+}
+
+// isAllowed returns true if the content encoding may be used
+func (cc compressionConfig) isAllowed(enc contentEncoding) bool {
+	return enc == encIdentity || slices.Contains(cc.allowed, enc)
+}
+
+// negotiate returns the first of the offered encodings which the server
+// allows. It returns encIdentity if there is none.
+func (cc compressionConfig) negotiate(offered []string) contentEncoding {
+	for _, o := range offered {
+		enc := contentEncoding(o)
+		if cc.isAllowed(enc) {
+			return enc
+		}
+	}
+
+	return encIdentity
+}
+
+// decodePayload removes the content-encoding header from the publication
+// headers and decompresses the payload, if it is compressed. The payload as
+// received is kept so that it need not be recompressed for subscribers using
+// the same encoding.
+func (pub *publication) decodePayload(cc compressionConfig) error {
+	pub.plain = pub.pmp.Payload
+
+	encName, ok := pub.hdrs[hdrContentEncoding]
+	if !ok {
+		return nil
+	}
+
+	pub.hdrs = maps.Clone(pub.hdrs)
+	delete(pub.hdrs, hdrContentEncoding)
+
+	enc := contentEncoding(encName)
+	if enc == encIdentity {
+		return nil
+	}
+
+	if !cc.isAllowed(enc) {
+		return fmt.Errorf("%w: the encoding %q is not allowed",
+			errBadEncoding, enc)
+	}
+
+	plain, err := enc.decompress(pub.pmp.Payload)
+	if err != nil {
+		return err
+	}
+
+	pub.encoding = enc
+	pub.encoded = pub.pmp.Payload
+	pub.plain = plain
+
+	return nil
+}
+
+// encodedPayload is a publication payload with the encoding actually used
+type encodedPayload struct {
+	enc     contentEncoding
+	payload []byte
+}
+
+// payloadCache holds the forms of a publication payload for each content
+// encoding requested, so that each is produced at most once per fan-out.
+type payloadCache struct {
+	pub      *publication
+	minSize  int
+	payloads map[contentEncoding]encodedPayload
+	logger   *slog.Logger
+}
+
+// newPayloadCache returns a payloadCache for the publication
+func newPayloadCache(
+	pub *publication,
+	cc compressionConfig,
+	logger *slog.Logger,
+) *payloadCache {
+	return &payloadCache{
+		pub:      pub,
+		minSize:  cc.minSize,
+		payloads: map[contentEncoding]encodedPayload{},
+		logger:   logger,
+	}
+}
+
+// payload returns the payload to send to a client which has chosen the
+// content encoding. The encoding actually used may differ from that chosen:
+// the payload is sent uncompressed if it is too small to be worth
+// compressing, if compressing it would not make it smaller or if the
+// compression fails.
+func (pc *payloadCache) payload(enc contentEncoding) encodedPayload {
+	if ep, ok := pc.payloads[enc]; ok {
+		return ep
+	}
+
+	ep := encodedPayload{payload: pc.pub.plain}
+
+	switch {
+	case enc == encIdentity:
+	case enc == pc.pub.encoding:
+		ep = encodedPayload{enc: enc, payload: pc.pub.encoded}
+	case len(pc.pub.plain) < pc.minSize:
+	default:
+		b, err := enc.compress(pc.pub.plain)
+		if err != nil {
+			pc.logger.Error("couldn't compress the payload",
+				slog.String("encoding", string(enc)), pusu.ErrorAttr(err))
+		} else if len(b) < len(pc.pub.plain) {
+			ep = encodedPayload{enc: enc, payload: b}
+		}
+	}
+
+	pc.payloads[enc] = ep
+
+	return ep
+}
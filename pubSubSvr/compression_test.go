@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestNegotiate(t *testing.T) {
+	cc := compressionConfig{allowed: []contentEncoding{encGzip}}
+
+	testCases := []struct {
+		testhelper.ID
+		offered []string
+		expEnc  contentEncoding
+	}{
+		{
+			ID:     testhelper.MkID("nothing offered"),
+			expEnc: encIdentity,
+		},
+		{
+			ID:      testhelper.MkID("allowed encoding offered"),
+			offered: []string{"gzip"},
+			expEnc:  encGzip,
+		},
+		{
+			ID:      testhelper.MkID("first allowed encoding chosen"),
+			offered: []string{"zstd", "deflate", "gzip"},
+			expEnc:  encGzip,
+		},
+		{
+			ID:      testhelper.MkID("no allowed encoding offered"),
+			offered: []string{"zstd", "deflate"},
+			expEnc:  encIdentity,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			testhelper.DiffString(t, tc.IDStr(), "encoding",
+				cc.negotiate(tc.offered), tc.expEnc)
+		})
+	}
+}
+
+func TestPayloadCache(t *testing.T) {
+	const minSize = 100
+
+	cc := compressionConfig{
+		allowed: []contentEncoding{encGzip, encDeflate},
+		minSize: minSize,
+	}
+	plain := bytes.Repeat([]byte(`{"key": "value"}`), 50)
+
+	gz, err := encGzip.compress(plain)
+	if err != nil {
+		t.Fatal("unexpected compression error:", err)
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		rcvdEnc contentEncoding
+		payload []byte
+		sendEnc contentEncoding
+		expEnc  contentEncoding
+	}{
+		{
+			ID:      testhelper.MkID("plain in, plain out"),
+			payload: plain,
+			expEnc:  encIdentity,
+		},
+		{
+			ID:      testhelper.MkID("plain in, gzip out"),
+			payload: plain,
+			sendEnc: encGzip,
+			expEnc:  encGzip,
+		},
+		{
+			ID:      testhelper.MkID("gzip in, plain out"),
+			rcvdEnc: encGzip,
+			payload: gz,
+			expEnc:  encIdentity,
+		},
+		{
+			ID:      testhelper.MkID("gzip in, deflate out"),
+			rcvdEnc: encGzip,
+			payload: gz,
+			sendEnc: encDeflate,
+			expEnc:  encDeflate,
+		},
+		{
+			ID:      testhelper.MkID("small payload, not compressed"),
+			payload: plain[:minSize-1],
+			sendEnc: encGzip,
+			expEnc:  encIdentity,
+		},
+		{
+			ID:      testhelper.MkID("bad: corrupt payload"),
+			ExpErr:  testhelper.MkExpErr("bad payload encoding", "gzip"),
+			rcvdEnc: encGzip,
+			payload: plain,
+		},
+		{
+			ID:      testhelper.MkID("bad: unsupported encoding"),
+			ExpErr:  testhelper.MkExpErr(`the encoding "zstd" is not allowed`),
+			rcvdEnc: "zstd",
+			payload: plain,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			pub := &publication{
+				pmp: &pusu.PublishMsgPayload{
+					Topic:   "/a",
+					Payload: tc.payload,
+				},
+			}
+			if tc.rcvdEnc != encIdentity {
+				pub.hdrs = map[string]string{
+					hdrContentEncoding: string(tc.rcvdEnc),
+				}
+			}
+
+			err := pub.decodePayload(cc)
+			if !testhelper.CheckExpErr(t, err, tc) || err != nil {
+				return
+			}
+
+			if _, ok := pub.hdrs[hdrContentEncoding]; ok {
+				t.Log(tc.IDStr())
+				t.Error("\t: the content-encoding header was not removed")
+			}
+
+			pc := newPayloadCache(pub, cc, testLogger)
+			ep := pc.payload(tc.sendEnc)
+			testhelper.DiffString(t, tc.IDStr(), "encoding",
+				ep.enc, tc.expEnc)
+
+			got := ep.payload
+			if ep.enc != encIdentity {
+				if got, err = ep.enc.decompress(got); err != nil {
+					t.Fatal("unexpected decompression error:", err)
+				}
+			}
+
+			exp := tc.payload
+			if tc.rcvdEnc != encIdentity {
+				exp = plain
+			}
+
+			testhelper.DiffSlice(t, tc.IDStr(), "payload", got, exp)
+
+			if again := pc.payload(tc.sendEnc); &again.payload[0] !=
+				&ep.payload[0] {
+				t.Log(tc.IDStr())
+				t.Error("\t: the cached payload was not reused")
+			}
+		})
+	}
+}
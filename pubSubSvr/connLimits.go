@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// errConnLimit is the error reported when a connection would exceed one of
+// the connection limits
+var errConnLimit = errors.New("connection limit exceeded")
+
+// rejectTimeout is the maximum time to spend on a rejected connection
+const rejectTimeout = 5 * time.Second
+
+// connLimits records the limits on the number of client connections and
+// subscriptions and the current connection counts. A limit of zero means
+// that there is no limit.
+type connLimits struct {
+	sync.Mutex
+
+	maxTotal       int
+	maxPerIP       int
+	maxPerIdentity int
+	maxSubs        int
+
+	total      int
+	byIP       map[string]int
+	byIdentity map[string]int
+	rejected   int
+}
+
+// newConnLimits returns a properly initialised connLimits value
+func newConnLimits() *connLimits {
+	return &connLimits{
+		byIP:       make(map[string]int),
+		byIdentity: make(map[string]int),
+	}
+}
+
+// remoteIP returns the IP address of the remote end of the connection
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// admitConn checks that a new connection from the given IP address would
+// not exceed the total or per-IP limits and, if not, records it. It returns
+// a non-nil error if the connection should be rejected.
+func (cl *connLimits) admitConn(ip string) error {
+	cl.Lock()
+	defer cl.Unlock()
+
+	if cl.maxTotal > 0 && cl.total >= cl.maxTotal {
+		cl.rejected++
+
+		return fmt.Errorf("%w: the server allows at most %d connections",
+			errConnLimit, cl.maxTotal)
+	}
+
+	if cl.maxPerIP > 0 && cl.byIP[ip] >= cl.maxPerIP {
+		cl.rejected++
+
+		return fmt.Errorf(
+			"%w: the server allows at most %d connections from %s",
+			errConnLimit, cl.maxPerIP, ip)
+	}
+
+	cl.total++
+	cl.byIP[ip]++
+
+	return nil
+}
+
+// admitIdentity checks that a new connection with the given certificate
+// identity would not exceed the per-identity limit and, if not, records
+// it. It returns a non-nil error if the connection should be rejected.
+func (cl *connLimits) admitIdentity(certID string) error {
+	cl.Lock()
+	defer cl.Unlock()
+
+	if cl.maxPerIdentity > 0 && cl.byIdentity[certID] >= cl.maxPerIdentity {
+		cl.rejected++
+
+		return fmt.Errorf(
+			"%w: the server allows at most %d connections"+
+				" with the certificate identity %q",
+			errConnLimit, cl.maxPerIdentity, certID)
+	}
+
+	cl.byIdentity[certID]++
+
+	return nil
+}
+
+// decr reduces the count for the key in the map, removing the entry if it
+// reaches zero.
+func decr(m map[string]int, key string) {
+	m[key]--
+	if m[key] <= 0 {
+		delete(m, key)
+	}
+}
+
+// releaseConn removes the connection from the counts
+func (cl *connLimits) releaseConn(ip string) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	cl.total--
+	decr(cl.byIP, ip)
+}
+
+// releaseIdentity removes the certificate identity from the counts
+func (cl *connLimits) releaseIdentity(certID string) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	decr(cl.byIdentity, certID)
+}
+
+// checkSubs returns a non-nil error if the number of subscriptions would
+// exceed the maximum allowed per client. The error wraps errMsgRejected as
+// only the subscription is refused; the client is not disconnected.
+func (cl *connLimits) checkSubs(subCount int) error {
+	if cl.maxSubs > 0 && subCount > cl.maxSubs {
+		return fmt.Errorf(
+			"%w: too many subscriptions:"+
+				" the server allows at most %d per client",
+			errMsgRejected, cl.maxSubs)
+	}
+
+	return nil
+}
+
+// checkNewSubs returns a non-nil error if subscribing to the topics would
+// take the client over the limit on the number of subscriptions. Topics to
+// which the client is already subscribed are not counted and a topic given
+// more than once is counted only once.
+func (clt *client) checkNewSubs(topics []pusu.Topic) error {
+	newTopics := map[pusu.Topic]bool{}
+
+	for _, t := range topics {
+		if !clt.subs[t] {
+			newTopics[t] = true
+		}
+	}
+
+	return clt.connLimits.checkSubs(len(clt.subs) + len(newTopics))
+}
+
+// statusAttr returns a slog Attr giving the current connection count and
+// the number of connections rejected since the last call. The rejected
+// count is reset.
+func (cl *connLimits) statusAttr() slog.Attr {
+	cl.Lock()
+	defer cl.Unlock()
+
+	rejected := cl.rejected
+	cl.rejected = 0
+
+	return slog.Group("connections",
+		slog.Int("current", cl.total),
+		slog.Int("rejected", rejected))
+}
+
+// rejectConn reads the first message from the client (completing the TLS
+// handshake), replies with an Error message explaining why the connection
+// has been rejected and then closes the connection. It will not spend more
+// than the rejectTimeout doing this.
+func rejectConn(
+	logger *slog.Logger,
+	al *auditLog,
+	conn net.Conn,
+	reason error,
+) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	logger.Error("connection rejected",
+		netAddrAttr(conn), pusu.ErrorAttr(reason))
+
+	if err := conn.SetDeadline(time.Now().Add(rejectTimeout)); err != nil {
+		return
+	}
+
+	msg := pusu.Message{
+		MT:    pusu.Error,
+		MsgID: pusu.NoMsgID,
+	}
+
+	firstMsg, err := pusu.ReadMsg(conn)
+	if err == nil {
+		msg.MsgID = firstMsg.MsgID
+	}
+
+	al.recordConn(conn, auditEvtConnect, auditRejected, reason)
+
+	if err := (&msg).Marshal(&pusu.ErrorMsgPayload{
+		Error: reason.Error(),
+	}, logger); err != nil {
+		return
+	}
+
+	if err := msg.Write(conn); err != nil {
+		logger.Error("couldn't send the rejection to the client",
+			netAddrAttr(conn), pusu.ErrorAttr(err))
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestCheckNewSubs(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		topics []pusu.Topic
+	}{
+		{
+			ID:     testhelper.MkID("new topics"),
+			topics: []pusu.Topic{"/b", "/c"},
+		},
+		{
+			ID:     testhelper.MkID("repeated and existing topics"),
+			topics: []pusu.Topic{"/a", "/b", "/b", "/c", "/c"},
+		},
+		{
+			ID:     testhelper.MkID("too many"),
+			ExpErr: testhelper.MkExpErr("too many subscriptions"),
+			topics: []pusu.Topic{"/b", "/c", "/d"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			limits := newConnLimits()
+			limits.maxSubs = 3
+
+			clt := &client{
+				subs:         map[pusu.Topic]bool{"/a": true},
+				clientShared: &clientShared{connLimits: limits},
+			}
+
+			err := clt.checkNewSubs(tc.topics)
+			testhelper.CheckExpErr(t, err, tc)
+
+			if err != nil && !errors.Is(err, errMsgRejected) {
+				t.Log(tc.IDStr())
+				t.Error("\t: the error should wrap errMsgRejected")
+			}
+		})
+	}
+}
+
+func TestSubscribeLimit(t *testing.T) {
+	limits := newConnLimits()
+	limits.maxSubs = 1
+
+	clt := testClient("test")
+	clt.subs["/a"] = true
+	clt.clientShared = &clientShared{
+		pubSubChan: make(chan clientMessage, 1),
+		connLimits: limits,
+	}
+	clt.handlers = clientMsgHandlerMap{pusu.Subscribe: clientHandleSubscribe}
+
+	testhelper.DiffBool(t, "over the limit", "handled",
+		clt.handleMsg(subMsg(t, pusu.Subscribe, "/b")), true)
+	testhelper.DiffBool(t, "over the limit", "connected",
+		clt.connected, true)
+	testhelper.DiffBool(t, "over the limit", "subscribed",
+		clt.subs["/b"], false)
+	testhelper.DiffInt(t, "over the limit", "sent to the server",
+		len(clt.pubSubChan), 0)
+
+	if len(clt.sendChan) != 1 {
+		t.Fatal("no reply was sent")
+	}
+
+	testhelper.DiffInt(t, "over the limit", "reply",
+		(<-clt.sendChan).msg.MT, pusu.Error)
+}
+
+func TestMQTTSubscribeLimit(t *testing.T) {
+	limits := newConnLimits()
+	limits.maxSubs = 1
+
+	clt := testClient("test")
+	clt.mqtt = newMQTTSession()
+	clt.clientShared = &clientShared{
+		pubSubChan: make(chan clientMessage, 1),
+		connLimits: limits,
+	}
+
+	subscribe := func(id uint16, filters ...string) []byte {
+		t.Helper()
+
+		body := binary.BigEndian.AppendUint16(nil, id)
+		for _, f := range filters {
+			body = binary.BigEndian.AppendUint16(body, uint16(len(f)))
+			body = append(body, f...)
+			body = append(body, 0)
+		}
+
+		err := clt.mqttHandleSubscribe(
+			mqttPacket{typ: mqttSubscribe, flags: 0x02, body: body})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+
+		if len(clt.sendChan) != 1 {
+			t.Fatal("no SUBACK was sent")
+		}
+
+		raw := (<-clt.sendChan).raw
+
+		return raw[len(raw)-len(filters):]
+	}
+
+	testhelper.DiffSlice(t, "within the limit", "return codes",
+		subscribe(1, "a/#"), []byte{0})
+	testhelper.DiffSlice(t, "over the limit", "return codes",
+		subscribe(2, "a/#", "b/#"),
+		[]byte{mqttSubAckFailure, mqttSubAckFailure})
+	testhelper.DiffBool(t, "over the limit", "earlier filter kept",
+		clt.mqtt.hasFilter("a/#"), true)
+	testhelper.DiffBool(t, "over the limit", "new filter kept",
+		clt.mqtt.hasFilter("b/#"), false)
+	testhelper.DiffInt(t, "over the limit", "subscriptions",
+		len(clt.subs), 1)
+}
+
+func TestConnLimits(t *testing.T) {
+	type op struct {
+		admit  bool   // admit the connection or identity, else release
+		ip     string // set for a connection
+		certID string // set for an identity
+		expErr string // the expected error, if admitting
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		maxTotal, maxPerIP, maxPerIdentity int
+		ops                                []op
+		expRejected                        int
+	}{
+		{
+			ID:  testhelper.MkID("no limits"),
+			ops: []op{{admit: true, ip: "a"}, {admit: true, ip: "a"}},
+		},
+		{
+			ID:       testhelper.MkID("total limit, released"),
+			maxTotal: 2,
+			ops: []op{
+				{admit: true, ip: "a"},
+				{admit: true, ip: "b"},
+				{admit: true, ip: "c", expErr: "at most 2 connections"},
+				{ip: "a"},
+				{admit: true, ip: "c"},
+			},
+			expRejected: 1,
+		},
+		{
+			ID:       testhelper.MkID("per-IP limit, released"),
+			maxPerIP: 1,
+			ops: []op{
+				{admit: true, ip: "a"},
+				{admit: true, ip: "b"},
+				{admit: true, ip: "a", expErr: "at most 1 connections from a"},
+				{ip: "a"},
+				{admit: true, ip: "a"},
+			},
+			expRejected: 1,
+		},
+		{
+			ID:             testhelper.MkID("per-identity limit, released"),
+			maxPerIdentity: 1,
+			ops: []op{
+				{admit: true, certID: "feeds"},
+				{admit: true, certID: "other"},
+				{admit: true, certID: "feeds", expErr: `identity "feeds"`},
+				{admit: true, certID: "feeds", expErr: `identity "feeds"`},
+				{certID: "feeds"},
+				{admit: true, certID: "feeds"},
+			},
+			expRejected: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			cl := newConnLimits()
+			cl.maxTotal = tc.maxTotal
+			cl.maxPerIP = tc.maxPerIP
+			cl.maxPerIdentity = tc.maxPerIdentity
+
+			for i, o := range tc.ops {
+				var err error
+
+				switch {
+				case o.admit && o.ip != "":
+					err = cl.admitConn(o.ip)
+				case o.admit:
+					err = cl.admitIdentity(o.certID)
+				case o.ip != "":
+					cl.releaseConn(o.ip)
+				default:
+					cl.releaseIdentity(o.certID)
+				}
+
+				id := fmt.Sprintf("%s: op %d", tc.IDStr(), i)
+				testhelper.CheckError(t, id, err,
+					o.expErr != "", []string{o.expErr})
+
+				if err != nil && !errors.Is(err, errConnLimit) {
+					t.Log(id)
+					t.Error("\t: the error should wrap errConnLimit")
+				}
+			}
+
+			testhelper.DiffInt(t, tc.IDStr(), "rejected",
+				cl.rejected, tc.expRejected)
+		})
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	var buf bytes.Buffer
+
+	cl := newConnLimits()
+	cl.maxPerIdentity = 1
+
+	newClient := func() *client {
+		conn, _ := net.Pipe()
+
+		clt := testClient("test")
+		clt.conn = conn
+		clt.certID = "feeds"
+		clt.clientShared = &clientShared{
+			connLimits: cl,
+			auditLog:   testAuditLog(&buf),
+		}
+
+		return clt
+	}
+
+	if err := newClient().admit(); err != nil {
+		t.Fatal("the first client should be admitted:", err)
+	}
+
+	err := newClient().admit()
+	testhelper.DiffBool(t, "second client", "connection limit",
+		errors.Is(err, errConnLimit), true)
+
+	recs := auditRecords(t, &buf)
+	testhelper.DiffInt(t, "admit", "audit records", len(recs), 2)
+
+	if len(recs) == 2 {
+		checkAuditRecord(t, "first client", recs[0], map[string]any{
+			"event":   "connect",
+			"outcome": "accepted",
+		})
+		checkAuditRecord(t, "second client", recs[1], map[string]any{
+			"event":   "connect",
+			"outcome": "rejected",
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
-import "log/slog"
+import (
+	"log/slog"
+	"strconv"
+)
 
 // connID is a type representing a connection ID.
 type connID int64
@@ -9,3 +12,13 @@ type connID int64
 func (cID connID) Attr() slog.Attr {
 	return slog.Int64(cltAttrPfx+"connID", int64(cID))
 }
+
+// String returns a string representation of the connection ID
+func (cID connID) String() string {
+	return strconv.FormatInt(int64(cID), 10)
+}
+
+// nextConnID returns the ID for the next connection accepted
+func (prog *prog) nextConnID() connID {
+	return connID(prog.lastConnID.Add(1))
+}
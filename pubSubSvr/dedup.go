@@ -0,0 +1,167 @@
+package main
+
+import (
+	"container/list"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// hdrIdempotencyKey is the publication header giving the key used to
+// recognise a repeated publication
+const hdrIdempotencyKey = "idempotency-key"
+
+// noteTextIdempotency describes how repeated publications are recognised
+const noteTextIdempotency = "A publisher may give a publication an" +
+	" idempotency key in the '" + hdrIdempotencyKey + "' header. If" +
+	" another publication with the same key is made in the same" +
+	" namespace within the deduplication window it is taken to be a" +
+	" retry of the first and is not sent to the subscribers again." +
+	" The publisher receives the same Ack as it did for the first" +
+	" publication, including any delivery counts if it has asked for" +
+	" confirms. Within a batch each publication may have its own key;" +
+	" a repeated publication in a batch is skipped and is not counted" +
+	" in the delivery counts." +
+	"\n\n" +
+	"The server remembers only a limited number of keys; if more keys" +
+	" than this are seen within the window the oldest are forgotten" +
+	" early and a retry of a publication using one of those keys" +
+	" will be sent again."
+
+// dedupKey identifies a publication by its namespace and idempotency key
+type dedupKey struct {
+	ns  pusu.Namespace
+	key string
+}
+
+// dedupEntry records a publication seen with an idempotency key and the
+// payload of the Ack that was sent for it
+type dedupEntry struct {
+	dedupKey
+
+	expires time.Time
+	ack     []byte
+}
+
+// dedupCache records the idempotency keys of recent publications. The
+// entries are kept in the order in which they were added, which is also the
+// order in which they expire, so that expired entries, and the oldest
+// entries if the cache is full, can be removed from the front. It is only
+// used by the pubSubHandler goroutine; only the counts are safe to read
+// from other goroutines.
+type dedupCache struct {
+	window  time.Duration
+	maxKeys int
+
+	entries map[dedupKey]*list.Element
+	order   *list.List
+
+	size       atomic.Int64
+	duplicates atomic.Int64
+	evicted    atomic.Int64
+}
+
+// newDedupCache returns an empty dedupCache
+func newDedupCache(window time.Duration, maxKeys int) *dedupCache {
+	return &dedupCache{
+		window:  window,
+		maxKeys: maxKeys,
+		entries: make(map[dedupKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// enabled returns true if publications are to be deduplicated
+func (dc *dedupCache) enabled() bool {
+	return dc != nil && dc.window > 0 && dc.maxKeys > 0
+}
+
+// expire removes the entries which have expired by the given time
+func (dc *dedupCache) expire(now time.Time) {
+	for e := dc.order.Front(); e != nil; e = dc.order.Front() {
+		de, _ := e.Value.(*dedupEntry)
+		if de.expires.After(now) {
+			break
+		}
+
+		dc.remove(e)
+	}
+}
+
+// remove removes the list element and its map entry
+func (dc *dedupCache) remove(e *list.Element) {
+	de, _ := dc.order.Remove(e).(*dedupEntry)
+	delete(dc.entries, de.dedupKey)
+	dc.size.Add(-1)
+}
+
+// lookup returns the entry for the key in the namespace if the key has been
+// seen within the window, otherwise nil.
+func (dc *dedupCache) lookup(
+	ns pusu.Namespace,
+	key string,
+	now time.Time,
+) *dedupEntry {
+	if !dc.enabled() {
+		return nil
+	}
+
+	dc.expire(now)
+
+	e, ok := dc.entries[dedupKey{ns: ns, key: key}]
+	if !ok {
+		return nil
+	}
+
+	dc.duplicates.Add(1)
+
+	de, _ := e.Value.(*dedupEntry)
+
+	return de
+}
+
+// add records the key in the namespace together with the Ack payload sent
+// for the publication. If the cache is full the oldest entry is removed.
+func (dc *dedupCache) add(
+	ns pusu.Namespace,
+	key string,
+	ack []byte,
+	now time.Time,
+) {
+	if !dc.enabled() {
+		return
+	}
+
+	dk := dedupKey{ns: ns, key: key}
+	if _, ok := dc.entries[dk]; ok {
+		return
+	}
+
+	for dc.order.Len() >= dc.maxKeys {
+		dc.remove(dc.order.Front())
+		dc.evicted.Add(1)
+	}
+
+	dc.entries[dk] = dc.order.PushBack(&dedupEntry{
+		dedupKey: dk,
+		expires:  now.Add(dc.window),
+		ack:      ack,
+	})
+	dc.size.Add(1)
+}
+
+// statusAttr returns a slog Attr giving the number of keys held and the
+// counts of duplicates found and keys evicted early since the last call.
+// The counts are reset.
+func (dc *dedupCache) statusAttr() slog.Attr {
+	if dc == nil {
+		return slog.Attr{}
+	}
+
+	return slog.Group("dedup",
+		slog.Int64("keys", dc.size.Load()),
+		slog.Int64("duplicates", dc.duplicates.Swap(0)),
+		slog.Int64("evicted", dc.evicted.Swap(0)))
+}
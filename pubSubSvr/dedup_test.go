@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestDedupCache(t *testing.T) {
+	const window = time.Minute
+
+	start := time.Now()
+	dc := newDedupCache(window, 2)
+
+	testhelper.DiffBool(t, "new key", "found",
+		dc.lookup("ns", "k1", start) != nil, false)
+
+	dc.add("ns", "k1", []byte("ack1"), start)
+
+	if de := dc.lookup("ns", "k1", start.Add(window/2)); de == nil {
+		t.Error("repeated key: not found")
+	} else {
+		testhelper.DiffString(t, "repeated key", "ack",
+			string(de.ack), "ack1")
+	}
+
+	testhelper.DiffBool(t, "same key, other namespace", "found",
+		dc.lookup("other", "k1", start) != nil, false)
+	testhelper.DiffBool(t, "key after the window", "found",
+		dc.lookup("ns", "k1", start.Add(window)) != nil, false)
+
+	dc.add("ns", "k2", nil, start)
+	dc.add("ns", "k3", nil, start)
+	dc.add("ns", "k4", nil, start)
+
+	testhelper.DiffBool(t, "oldest key, cache full", "found",
+		dc.lookup("ns", "k2", start) != nil, false)
+	testhelper.DiffBool(t, "newest key, cache full", "found",
+		dc.lookup("ns", "k4", start) != nil, true)
+	testhelper.DiffInt(t, "cache full", "size", dc.size.Load(), 2)
+	testhelper.DiffInt(t, "cache full", "evicted", dc.evicted.Load(), 1)
+}
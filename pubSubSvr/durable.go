@@ -0,0 +1,625 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// noteTextDurable describes at-least-once delivery to durable subscriptions
+const noteTextDurable = "A subscription may be made durable by giving it a" +
+	" name. Publications are then delivered to it at least once: the" +
+	" subscriber must acknowledge each publication by sending an Ack" +
+	" message with the same message ID as the Publish message that" +
+	" delivered it. A publication which is not acknowledged within the" +
+	" redelivery timeout is sent again, and once it has been sent the" +
+	" maximum number of times without being acknowledged it is moved" +
+	" to the dead-letter topic. Only a limited number of publications" +
+	" are sent to the subscriber before they are acknowledged; the" +
+	" rest are held by the server until there is room." +
+	"\n\n" +
+	"A durable subscription is identified by its name within the" +
+	" namespace and it survives the disconnection of the subscriber:" +
+	" publications made while no client is attached are held and any" +
+	" which were not acknowledged are sent again once a client" +
+	" subscribes with the same name. If a client subscribes with a" +
+	" name already in use by another client the subscription moves to" +
+	" the new client. The subscription ends when the client" +
+	" unsubscribes from the topic; any publications still held are" +
+	" then discarded. If more publications are held than the limit" +
+	" allows the oldest are moved to the dead-letter topic. Durable" +
+	" subscriptions are held in memory and do not survive a restart" +
+	" of the server. The payloads of publications sent to durable" +
+	" subscriptions are not compressed." +
+	"\n\n" +
+	"A publication is moved to the dead-letter topic by publishing it" +
+	" on a sub-topic of the dead-letter topic named after the durable" +
+	" subscription, in the same namespace. Headers are added giving" +
+	" the original topic (" + hdrDeadLetterTopic + "), the name of" +
+	" the subscription (" + hdrDeadLetterSub + "), the number of" +
+	" attempts made (" + hdrDeadLetterAttempts + ") and the reason" +
+	" (" + hdrDeadLetterReason + "). A dead letter which itself cannot" +
+	" be delivered is discarded rather than being moved to the" +
+	" dead-letter topic again." +
+	"\n\n" +
+	"The name is carried in field number 101 of the Sub message in the" +
+	" Subscribe message payload, encoded as a string. It may only" +
+	" contain lower-case letters, digits, '-', '_' and '.'."
+
+// The headers added to a publication when it is moved to the dead-letter
+// topic
+const (
+	hdrDeadLetterTopic    = "dead-letter-topic"
+	hdrDeadLetterSub      = "dead-letter-subscription"
+	hdrDeadLetterAttempts = "dead-letter-attempts"
+	hdrDeadLetterReason   = "dead-letter-reason"
+)
+
+// The reasons for moving a publication to the dead-letter topic
+const (
+	dlReasonAttempts = "too many delivery attempts"
+	dlReasonPending  = "too many pending publications"
+)
+
+// errBadDurable is the error returned when a durable subscription is
+// malformed
+var errBadDurable = errors.New("bad durable subscription")
+
+// checkDurableName returns a non-nil error if the name of the durable
+// subscription is not well-formed. It may only contain lower-case letters,
+// digits, '-', '_' and '.'.
+func checkDurableName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: the name must not be empty", errBadDurable)
+	}
+
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z',
+			r >= '0' && r <= '9',
+			r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("%w: %q - bad character %q in the name",
+				errBadDurable, name, r)
+		}
+	}
+
+	return nil
+}
+
+// durableConfig records the settings for durable subscriptions
+type durableConfig struct {
+	redeliveryTimeout time.Duration
+	maxAttempts       int
+	maxInflight       int
+	maxPending        int
+	deadLetterTopic   string
+}
+
+// durableKey identifies a durable subscription by its namespace and name
+type durableKey struct {
+	ns   pusu.Namespace
+	name string
+}
+
+// pendingDelivery is a publication which has yet to be acknowledged by the
+// subscriber to a durable subscription
+type pendingDelivery struct {
+	pub      *publication
+	pubTopic pusu.Topic   // the topic on which the publication was made
+	msg      pusu.Message // the message which delivers the publication
+	attempts int          // the number of times the message has been sent
+	due      time.Time    // when the message should be sent again
+	seq      uint64       // the order in which the publication was held
+}
+
+// durableSub is a durable subscription. The messages which have been sent
+// to the client and are awaiting acknowledgement are in the inflight map,
+// keyed by the message ID with which they were sent. The messages which
+// have yet to be sent, or which must be sent again to a new client, are in
+// the waiting queue, oldest first.
+type durableSub struct {
+	durableKey
+
+	topic  pusu.Topic
+	filter filter
+	clt    *client // nil if there is no client attached
+
+	inflight map[pusu.MsgID]*pendingDelivery
+	waiting  []*pendingDelivery
+	lastSeq  uint64 // the seq given to the latest publication held
+}
+
+// pendingCount returns the number of publications held for the subscription
+func (ds *durableSub) pendingCount() int {
+	return len(ds.inflight) + len(ds.waiting)
+}
+
+// hold records the order in which the publication is held for the
+// subscription
+func (ds *durableSub) hold(pd *pendingDelivery) {
+	ds.lastSeq++
+	pd.seq = ds.lastSeq
+}
+
+// inflightInOrder returns the publications awaiting acknowledgement in the
+// order in which they were first held. This is not the order of their
+// message IDs, which change each time a publication is sent again.
+func (ds *durableSub) inflightInOrder() []*pendingDelivery {
+	return slices.SortedFunc(maps.Values(ds.inflight),
+		func(a, b *pendingDelivery) int { return cmp.Compare(a.seq, b.seq) })
+}
+
+// durableSubs holds all the durable subscriptions. It is only used by the
+// pubSubHandler goroutine; only the counts are safe to read from other
+// goroutines.
+type durableSubs struct {
+	durableConfig
+
+	byKey    map[durableKey]*durableSub
+	byTopic  map[pusu.Namespace]map[pusu.Topic]map[*durableSub]bool
+	byClient map[*client]map[*durableSub]bool
+
+	subCount     atomic.Int64
+	pending      atomic.Int64
+	redelivered  atomic.Int64
+	deadLettered atomic.Int64
+}
+
+// newDurableSubs returns an empty set of durable subscriptions
+func newDurableSubs(cfg durableConfig) *durableSubs {
+	return &durableSubs{
+		durableConfig: cfg,
+		byKey:         make(map[durableKey]*durableSub),
+		byTopic: make(
+			map[pusu.Namespace]map[pusu.Topic]map[*durableSub]bool),
+		byClient: make(map[*client]map[*durableSub]bool),
+	}
+}
+
+// forTopic returns the durable subscriptions to the topic in the namespace
+func (dss *durableSubs) forTopic(
+	ns pusu.Namespace,
+	topic pusu.Topic,
+) map[*durableSub]bool {
+	if dss == nil {
+		return nil
+	}
+
+	return dss.byTopic[ns][topic]
+}
+
+// addToTopic records the subscription against its topic
+func (dss *durableSubs) addToTopic(ds *durableSub) {
+	topics, ok := dss.byTopic[ds.ns]
+	if !ok {
+		topics = make(map[pusu.Topic]map[*durableSub]bool)
+		dss.byTopic[ds.ns] = topics
+	}
+
+	subs, ok := topics[ds.topic]
+	if !ok {
+		subs = make(map[*durableSub]bool)
+		topics[ds.topic] = subs
+	}
+
+	subs[ds] = true
+}
+
+// removeFromTopic removes the record of the subscription against its topic
+func (dss *durableSubs) removeFromTopic(ds *durableSub) {
+	topics := dss.byTopic[ds.ns]
+	subs := topics[ds.topic]
+
+	delete(subs, ds)
+
+	if len(subs) == 0 {
+		delete(topics, ds.topic)
+
+		if len(topics) == 0 {
+			delete(dss.byTopic, ds.ns)
+		}
+	}
+}
+
+// detach removes the client from the subscription. Any messages awaiting
+// acknowledgement are put back at the front of the waiting queue, in the
+// order in which they were first held, to be sent to the next client.
+func (dss *durableSubs) detach(ds *durableSub) {
+	if ds.clt == nil {
+		return
+	}
+
+	if subs := dss.byClient[ds.clt]; subs != nil {
+		delete(subs, ds)
+
+		if len(subs) == 0 {
+			delete(dss.byClient, ds.clt)
+		}
+	}
+
+	ds.waiting = append(ds.inflightInOrder(), ds.waiting...)
+	ds.inflight = make(map[pusu.MsgID]*pendingDelivery)
+	ds.clt = nil
+}
+
+// attach attaches the client to the named durable subscription in the
+// client's namespace, creating the subscription if necessary. Any other
+// client attached to the subscription is detached from it.
+func (dss *durableSubs) attach(
+	clt *client,
+	name string,
+	topic pusu.Topic,
+	f filter,
+) *durableSub {
+	key := durableKey{ns: clt.namespace, name: name}
+
+	ds, ok := dss.byKey[key]
+	if !ok {
+		ds = &durableSub{
+			durableKey: key,
+			topic:      topic,
+			inflight:   make(map[pusu.MsgID]*pendingDelivery),
+		}
+		dss.byKey[key] = ds
+		dss.addToTopic(ds)
+		dss.subCount.Add(1)
+	}
+
+	if ds.clt != clt {
+		dss.detach(ds)
+	}
+
+	if ds.topic != topic {
+		dss.removeFromTopic(ds)
+		ds.topic = topic
+		dss.addToTopic(ds)
+	}
+
+	ds.filter = f
+	ds.clt = clt
+
+	subs, ok := dss.byClient[clt]
+	if !ok {
+		subs = make(map[*durableSub]bool)
+		dss.byClient[clt] = subs
+	}
+
+	subs[ds] = true
+
+	return ds
+}
+
+// remove ends the durable subscription, discarding any publications still
+// held for it.
+func (dss *durableSubs) remove(ds *durableSub) {
+	dss.detach(ds)
+	dss.removeFromTopic(ds)
+	delete(dss.byKey, ds.durableKey)
+	dss.subCount.Add(-1)
+	dss.pending.Add(-int64(ds.pendingCount()))
+}
+
+// clientSubOnTopic returns the durable subscription to the topic attached
+// to the client, if any.
+func (dss *durableSubs) clientSubOnTopic(
+	clt *client,
+	topic pusu.Topic,
+) *durableSub {
+	if dss == nil {
+		return nil
+	}
+
+	for ds := range dss.byClient[clt] {
+		if ds.topic == topic {
+			return ds
+		}
+	}
+
+	return nil
+}
+
+// detachClient detaches the client from all its durable subscriptions
+func (dss *durableSubs) detachClient(clt *client) {
+	if dss == nil {
+		return
+	}
+
+	for ds := range dss.byClient[clt] {
+		dss.detach(ds)
+	}
+}
+
+// send sends the pending publication to the client attached to the
+// subscription with a new message ID and records it as awaiting
+// acknowledgement.
+func (dss *durableSubs) send(
+	ds *durableSub,
+	pd *pendingDelivery,
+	now time.Time,
+) {
+	ds.clt.lastDeliveryID++
+
+	pd.msg.MsgID = ds.clt.lastDeliveryID
+	pd.attempts++
+	pd.due = now.Add(dss.redeliveryTimeout)
+	ds.inflight[pd.msg.MsgID] = pd
+
+	ds.clt.sendMessage(pd.msg)
+}
+
+// pump sends waiting publications to the attached client, if any, until
+// the limit on the number awaiting acknowledgement is reached.
+func (dss *durableSubs) pump(ds *durableSub, now time.Time) {
+	if ds.clt == nil {
+		return
+	}
+
+	for len(ds.waiting) > 0 && len(ds.inflight) < dss.maxInflight {
+		pd := ds.waiting[0]
+		ds.waiting[0] = nil
+		ds.waiting = ds.waiting[1:]
+
+		dss.send(ds, pd, now)
+	}
+}
+
+// enqueue adds the publication to those held for the subscription and
+// sends it if there is room. If more than maxPending publications are then
+// held the oldest waiting publication is removed and returned so that it
+// can be moved to the dead-letter topic.
+func (dss *durableSubs) enqueue(
+	ds *durableSub,
+	pd *pendingDelivery,
+	now time.Time,
+	maxPending int,
+) *pendingDelivery {
+	ds.hold(pd)
+	ds.waiting = append(ds.waiting, pd)
+	dss.pending.Add(1)
+
+	dss.pump(ds, now)
+
+	if ds.pendingCount() <= maxPending || len(ds.waiting) == 0 {
+		return nil
+	}
+
+	oldest := ds.waiting[0]
+	ds.waiting[0] = nil
+	ds.waiting = ds.waiting[1:]
+	dss.pending.Add(-1)
+
+	return oldest
+}
+
+// ack records the acknowledgement by the client of the message with the
+// given ID and sends the next waiting publication. It returns false if no
+// such message is awaiting acknowledgement.
+func (dss *durableSubs) ack(clt *client, id pusu.MsgID, now time.Time) bool {
+	if dss == nil {
+		return false
+	}
+
+	for ds := range dss.byClient[clt] {
+		if _, ok := ds.inflight[id]; ok {
+			delete(ds.inflight, id)
+			dss.pending.Add(-1)
+			dss.pump(ds, now)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// deadLetter records a publication which is to be moved to the dead-letter
+// topic
+type deadLetter struct {
+	ds     *durableSub
+	pd     *pendingDelivery
+	reason string
+}
+
+// redeliver sends again any publications which have not been acknowledged
+// in time. Publications which have been sent the maximum number of times
+// are removed and returned so that they can be moved to the dead-letter
+// topic.
+func (dss *durableSubs) redeliver(now time.Time) []deadLetter {
+	if dss == nil {
+		return nil
+	}
+
+	var dls []deadLetter
+
+	for _, subs := range dss.byClient {
+		for ds := range subs {
+			dls = dss.redeliverSub(ds, now, dls)
+		}
+	}
+
+	return dls
+}
+
+// redeliverSub sends again the publications to the subscription which have
+// not been acknowledged in time, appending those which have been sent too
+// often to the dead letters.
+func (dss *durableSubs) redeliverSub(
+	ds *durableSub,
+	now time.Time,
+	dls []deadLetter,
+) []deadLetter {
+	for _, pd := range ds.inflightInOrder() {
+		if pd.due.After(now) {
+			continue
+		}
+
+		delete(ds.inflight, pd.msg.MsgID)
+
+		if pd.attempts >= dss.maxAttempts {
+			dss.pending.Add(-1)
+			dls = append(dls,
+				deadLetter{ds: ds, pd: pd, reason: dlReasonAttempts})
+
+			continue
+		}
+
+		dss.redelivered.Add(1)
+		dss.send(ds, pd, now)
+	}
+
+	dss.pump(ds, now)
+
+	return dls
+}
+
+// statusAttr returns a slog Attr giving the number of durable subscriptions
+// and of publications held for them, and the counts of publications sent
+// again and moved to the dead-letter topic since the last call. The counts
+// are reset.
+func (dss *durableSubs) statusAttr() slog.Attr {
+	if dss == nil {
+		return slog.Attr{}
+	}
+
+	return slog.Group("durable",
+		slog.Int64("subscriptions", dss.subCount.Load()),
+		slog.Int64("pending", dss.pending.Load()),
+		slog.Int64("redelivered", dss.redelivered.Swap(0)),
+		slog.Int64("deadLettered", dss.deadLettered.Swap(0)))
+}
+
+// sendToDurables adds the publication on the topic to each of the durable
+// subscriptions to the topic in the namespace whose filter matches the
+// publication headers. It returns the delivery counts; a publication held
+// for a durable subscription counts as delivered.
+func (prog *prog) sendToDurables(
+	ns pusu.Namespace,
+	pub *publication,
+	pubTopic, topic pusu.Topic,
+	now time.Time,
+	nsm namespaceSubsMap,
+) deliveryCounts {
+	var counts deliveryCounts
+
+	subs := prog.durables.forTopic(ns, topic)
+	if len(subs) == 0 {
+		return counts
+	}
+
+	maxPending := prog.durables.maxPending
+	if p := prog.nsProfile(nsm, ns); p != nil {
+		maxPending = p.maxPending
+	}
+
+	msg, err := pub.message(topic, encodedPayload{payload: pub.plain},
+		prog.logger)
+	if err != nil {
+		prog.logger.Error("couldn't make the publication message",
+			topic.Attr(), pusu.ErrorAttr(err))
+
+		counts.dropped += len(subs)
+
+		return counts
+	}
+
+	for ds := range subs {
+		if ds.filter != nil && !ds.filter.matches(pub.hdrs) {
+			continue
+		}
+
+		pd := &pendingDelivery{pub: pub, pubTopic: pubTopic, msg: msg}
+
+		oldest := prog.durables.enqueue(ds, pd, now, maxPending)
+		if oldest != nil {
+			prog.deadLetter(deadLetter{
+				ds:     ds,
+				pd:     oldest,
+				reason: dlReasonPending,
+			}, nsm)
+		}
+
+		counts.delivered++
+	}
+
+	return counts
+}
+
+// redeliver sends again any publications to durable subscriptions which
+// have not been acknowledged in time, moving those which have been sent
+// too often to the dead-letter topic.
+func (prog *prog) redeliver(now time.Time, nsm namespaceSubsMap) {
+	for _, dl := range prog.durables.redeliver(now) {
+		prog.deadLetter(dl, nsm)
+	}
+}
+
+// deadLetter publishes the publication on the dead-letter topic for the
+// durable subscription. Publications which are themselves dead letters are
+// discarded.
+func (prog *prog) deadLetter(dl deadLetter, nsm namespaceSubsMap) {
+	logAttrs := []any{
+		dl.ds.ns.Attr(),
+		slog.String("durable", dl.ds.name),
+		dl.pd.pubTopic.Attr(),
+		slog.Int("attempts", dl.pd.attempts),
+		slog.String("reason", dl.reason),
+	}
+
+	if _, ok := dl.pd.pub.header(hdrDeadLetterSub); ok {
+		prog.logger.Error("undeliverable dead letter discarded", logAttrs...)
+
+		return
+	}
+
+	prog.logger.Warn("publication moved to the dead-letter topic",
+		logAttrs...)
+	prog.durables.deadLettered.Add(1)
+
+	hdrs := maps.Clone(dl.pd.pub.hdrs)
+	if hdrs == nil {
+		hdrs = map[string]string{}
+	}
+
+	hdrs[hdrDeadLetterTopic] = string(dl.pd.pubTopic)
+	hdrs[hdrDeadLetterSub] = dl.ds.name
+	hdrs[hdrDeadLetterAttempts] = strconv.Itoa(dl.pd.attempts)
+	hdrs[hdrDeadLetterReason] = dl.reason
+
+	prog.publishInternal(dl.ds.ns,
+		pusu.Topic(path.Join(prog.durables.deadLetterTopic, dl.ds.name)),
+		hdrs, dl.pd.pub.plain, nsm)
+}
+
+// publishInternal makes a publication originating in the server itself on
+// the topic in the namespace.
+func (prog *prog) publishInternal(
+	ns pusu.Namespace,
+	topic pusu.Topic,
+	hdrs map[string]string,
+	payload []byte,
+	nsm namespaceSubsMap,
+) {
+	pub := &publication{
+		pmp:   &pusu.PublishMsgPayload{Topic: string(topic)},
+		hdrs:  hdrs,
+		plain: payload,
+	}
+
+	cMsg := clientMessage{
+		clt:  &client{namespace: ns, logger: prog.logger},
+		msg:  &pusu.Message{MT: pusu.Publish, MsgID: pusu.NoMsgID},
+		rcvd: time.Now(),
+	}
+
+	prog.fanOut(cMsg, pub, nsm)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// sentIDs returns the message IDs of the messages queued for the client
+func sentIDs(clt *client) []pusu.MsgID {
+	var ids []pusu.MsgID
+
+	for {
+		select {
+		case om := <-clt.sendChan:
+			ids = append(ids, om.msg.MsgID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestDurableDelivery(t *testing.T) {
+	const (
+		ns      = pusu.Namespace("test")
+		topic   = pusu.Topic("/a")
+		timeout = time.Minute
+	)
+
+	prog := &prog{
+		logger: testLogger,
+		durables: newDurableSubs(durableConfig{
+			redeliveryTimeout: timeout,
+			maxAttempts:       2,
+			maxInflight:       2,
+			maxPending:        4,
+			deadLetterTopic:   "/dl",
+		}),
+	}
+
+	subscriber := testClient(ns)
+	dlWatcher := testClient(ns)
+	nsm := namespaceSubsMap{
+		ns: {topics: subsMap{"/dl": subscribers{dlWatcher: nil}}},
+	}
+
+	publish := func(now time.Time) {
+		pub := &publication{pmp: &pusu.PublishMsgPayload{Topic: "/a/b"}}
+		prog.sendToDurables(ns, pub, pub.topic(), topic, now, nsm)
+	}
+
+	start := time.Now()
+	ds := prog.durables.attach(subscriber, "sub", topic, nil)
+
+	for range 3 {
+		publish(start)
+	}
+
+	testhelper.DiffSlice(t, "3 published", "sent",
+		sentIDs(subscriber), []pusu.MsgID{1, 2})
+
+	testhelper.DiffBool(t, "ack", "found",
+		prog.durables.ack(subscriber, 1, start), true)
+	testhelper.DiffBool(t, "repeated ack", "found",
+		prog.durables.ack(subscriber, 1, start), false)
+	testhelper.DiffSlice(t, "ack", "sent",
+		sentIDs(subscriber), []pusu.MsgID{3})
+
+	prog.redeliver(start.Add(timeout), nsm)
+	testhelper.DiffSlice(t, "first redelivery", "sent",
+		sentIDs(subscriber), []pusu.MsgID{4, 5})
+
+	prog.redeliver(start.Add(2*timeout), nsm)
+	testhelper.DiffSlice(t, "attempts exhausted", "sent",
+		sentIDs(subscriber), nil)
+
+	dls := 0
+
+	for range sentIDs(dlWatcher) {
+		dls++
+	}
+
+	testhelper.DiffInt(t, "attempts exhausted", "dead letters", dls, 2)
+	testhelper.DiffInt(t, "attempts exhausted", "pending",
+		prog.durables.pending.Load(), 0)
+
+	for range 3 {
+		publish(start)
+	}
+
+	prog.durables.detachClient(subscriber)
+	sentIDs(subscriber)
+
+	for range 2 {
+		publish(start)
+	}
+
+	testhelper.DiffInt(t, "detached", "waiting", len(ds.waiting), 4)
+	testhelper.DiffInt(t, "detached, too many pending", "dead letters",
+		len(sentIDs(dlWatcher)), 1)
+
+	other := testClient(ns)
+	prog.durables.pump(prog.durables.attach(other, "sub", topic, nil), start)
+	testhelper.DiffSlice(t, "reattached", "sent",
+		sentIDs(other), []pusu.MsgID{1, 2})
+
+	prog.durables.remove(ds)
+	testhelper.DiffInt(t, "removed", "subscriptions",
+		prog.durables.subCount.Load(), 0)
+	testhelper.DiffInt(t, "removed", "pending",
+		prog.durables.pending.Load(), 0)
+}
+
+func TestDurableDetachOrder(t *testing.T) {
+	const (
+		ns      = pusu.Namespace("test")
+		topic   = pusu.Topic("/a")
+		timeout = time.Minute
+	)
+
+	prog := &prog{
+		logger: testLogger,
+		durables: newDurableSubs(durableConfig{
+			redeliveryTimeout: timeout,
+			maxAttempts:       5,
+			maxInflight:       2,
+			maxPending:        10,
+			deadLetterTopic:   "/dl",
+		}),
+	}
+	nsm := namespaceSubsMap{}
+
+	subscriber := testClient(ns)
+	ds := prog.durables.attach(subscriber, "sub", topic, nil)
+
+	start := time.Now()
+
+	for i, pubTopic := range []pusu.Topic{"/a/first", "/a/second"} {
+		pub := &publication{
+			pmp: &pusu.PublishMsgPayload{Topic: string(pubTopic)},
+		}
+		prog.sendToDurables(ns, pub, pubTopic, topic,
+			start.Add(time.Duration(i)*timeout/2), nsm)
+	}
+
+	prog.redeliver(start.Add(timeout), nsm)
+	testhelper.DiffSlice(t, "first publication sent again", "sent",
+		sentIDs(subscriber), []pusu.MsgID{1, 2, 3})
+
+	expTopics := []pusu.Topic{"/a/first", "/a/second"}
+
+	var saved []pusu.Topic
+
+	for _, sp := range ds.saved().Pending {
+		saved = append(saved, sp.Topic)
+	}
+
+	testhelper.DiffSlice(t, "in flight", "saved", saved, expTopics)
+
+	prog.durables.detachClient(subscriber)
+
+	var waiting []pusu.Topic
+
+	for _, pd := range ds.waiting {
+		waiting = append(waiting, pd.pubTopic)
+	}
+
+	testhelper.DiffSlice(t, "detached", "waiting", waiting, expTopics)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// encodedMsgPool holds buffers for encoded messages which are no longer in
+// use so that they can be reused for later messages
+var encodedMsgPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// encodedMsg holds a message in the form in which it is written to the
+// connection. The same encodedMsg can be sent to many clients, each writing
+// the bytes directly to its connection, so that a publication is encoded
+// only once however many subscribers it has. It is reference counted and the
+// buffer is returned to the pool when the last reference is released.
+type encodedMsg struct {
+	mt   pusu.MsgType
+	buf  *bytes.Buffer
+	refs atomic.Int32
+}
+
+// encodeMsg returns the message encoded for writing to a connection. The
+// caller holds the only reference to it and should release it when it is
+// no longer needed.
+func encodeMsg(msg pusu.Message) (*encodedMsg, error) {
+	buf, _ := encodedMsgPool.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	if err := msg.Write(buf); err != nil {
+		encodedMsgPool.Put(buf)
+		return nil, err
+	}
+
+	em := &encodedMsg{mt: msg.MT, buf: buf}
+	em.refs.Store(1)
+
+	return em, nil
+}
+
+// bytes returns the encoded message. The bytes must not be used once the
+// reference has been released.
+func (em *encodedMsg) bytes() []byte {
+	return em.buf.Bytes()
+}
+
+// retain adds a reference to the encoded message
+func (em *encodedMsg) retain() {
+	em.refs.Add(1)
+}
+
+// release drops a reference to the encoded message. When the last reference
+// is dropped the buffer is returned to the pool.
+func (em *encodedMsg) release() {
+	if em.refs.Add(-1) == 0 {
+		encodedMsgPool.Put(em.buf)
+		em.buf = nil
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// noteTextFilter describes the syntax of a subscription filter
+const noteTextFilter = "A subscription may carry a filter expression;" +
+	" the server will only send publications to the subscriber if" +
+	" the headers of the publication match the filter." +
+	"\n\n" +
+	"A filter is made up of comparisons between a header and a value." +
+	" The comparison operators are: =, !=, <, <=, > and >=." +
+	" If both the header value and the value it is compared with" +
+	" are numbers then they are compared numerically, otherwise" +
+	" they are compared as strings. A header can also be tested" +
+	" for membership of a set of values with 'in', for" +
+	" instance: 'region in (eu, us)', and for presence with 'exists'." +
+	" A comparison with a header that is not present is always false." +
+	"\n\n" +
+	"Comparisons can be combined with 'and', 'or' and 'not' and" +
+	" grouped with parentheses. Values containing spaces or" +
+	" punctuation must be quoted with double quotes." +
+	"\n\n" +
+	"For example: content-type = \"application/json\" and" +
+	" (priority >= 5 or region in (eu, us))" +
+	"\n\n" +
+	"The filter is carried in field number 100 of the Sub message in" +
+	" the Subscribe message payload, encoded as a string."
+
+// errBadFilter is the error returned when a filter cannot be parsed
+var errBadFilter = errors.New("bad filter")
+
+// filter is a parsed filter expression which can be evaluated against the
+// headers of a publication
+type filter interface {
+	matches(hdrs map[string]string) bool
+}
+
+// sourcedFilter is a parsed filter together with the expression from which
+// it was parsed, so that the subscription can be saved and restored
+type sourcedFilter struct {
+	filter
+
+	text string
+}
+
+// filterText returns the expression from which the filter was parsed. It
+// returns the empty string, which matches everything, for a nil filter.
+func filterText(f filter) string {
+	if sf, ok := f.(sourcedFilter); ok {
+		return sf.text
+	}
+
+	return ""
+}
+
+// filterAnd is satisfied if all of its terms are satisfied
+type filterAnd []filter
+
+func (f filterAnd) matches(hdrs map[string]string) bool {
+	for _, t := range f {
+		if !t.matches(hdrs) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// filterOr is satisfied if any of its terms are satisfied
+type filterOr []filter
+
+func (f filterOr) matches(hdrs map[string]string) bool {
+	for _, t := range f {
+		if t.matches(hdrs) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterNot is satisfied if its term is not satisfied
+type filterNot struct {
+	term filter
+}
+
+func (f filterNot) matches(hdrs map[string]string) bool {
+	return !f.term.matches(hdrs)
+}
+
+// filterExists is satisfied if the header is present
+type filterExists struct {
+	name string
+}
+
+func (f filterExists) matches(hdrs map[string]string) bool {
+	_, ok := hdrs[f.name]
+	return ok
+}
+
+// filterIn is satisfied if the header value is one of the set of values
+type filterIn struct {
+	name string
+	vals map[string]bool
+}
+
+func (f filterIn) matches(hdrs map[string]string) bool {
+	v, ok := hdrs[f.name]
+	return ok && f.vals[v]
+}
+
+// filterCmp is satisfied if the header value compares with the value as
+// given by the operator
+type filterCmp struct {
+	name   string
+	op     string
+	val    string
+	numVal float64
+	isNum  bool
+}
+
+// compare returns -1, 0 or 1 as the header value is less than, equal to or
+// greater than the filter value.
+func (f filterCmp) compare(hv string) int {
+	if f.isNum {
+		if n, err := strconv.ParseFloat(hv, 64); err == nil {
+			switch {
+			case n < f.numVal:
+				return -1
+			case n > f.numVal:
+				return 1
+			default:
+				return 0
+			}
+		}
+	}
+
+	return strings.Compare(hv, f.val)
+}
+
+func (f filterCmp) matches(hdrs map[string]string) bool {
+	hv, ok := hdrs[f.name]
+	if !ok {
+		return false
+	}
+
+	c := f.compare(hv)
+
+	switch f.op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+
+	return false
+}
+
+// filterToken is a lexical token from a filter expression
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+// isFilterPunct returns true if the rune is a single-character token in a
+// filter expression
+func isFilterPunct(r rune) bool {
+	return r == '(' || r == ')' || r == ','
+}
+
+// isFilterOpChar returns true if the rune may be part of a comparison
+// operator
+func isFilterOpChar(r rune) bool {
+	return r == '=' || r == '!' || r == '<' || r == '>'
+}
+
+// lexFilter splits the filter expression into tokens
+func lexFilter(s string) ([]filterToken, error) {
+	var toks []filterToken
+
+	rs := []rune(s)
+
+	for i := 0; i < len(rs); {
+		r := rs[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case isFilterPunct(r):
+			toks = append(toks, filterToken{text: string(r)})
+			i++
+		case isFilterOpChar(r):
+			j := i
+			for j < len(rs) && isFilterOpChar(rs[j]) {
+				j++
+			}
+
+			toks = append(toks, filterToken{text: string(rs[i:j])})
+			i = j
+		case r == '"':
+			var sb strings.Builder
+
+			j := i + 1
+			for ; j < len(rs) && rs[j] != '"'; j++ {
+				if rs[j] == '\\' && j+1 < len(rs) {
+					j++
+				}
+
+				sb.WriteRune(rs[j])
+			}
+
+			if j >= len(rs) {
+				return nil, fmt.Errorf("%w: unterminated string", errBadFilter)
+			}
+
+			toks = append(toks, filterToken{text: sb.String(), quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(rs) &&
+				!unicode.IsSpace(rs[j]) &&
+				!isFilterPunct(rs[j]) &&
+				!isFilterOpChar(rs[j]) &&
+				rs[j] != '"' {
+				j++
+			}
+
+			toks = append(toks, filterToken{text: string(rs[i:j])})
+			i = j
+		}
+	}
+
+	return toks, nil
+}
+
+// filterParser holds the state of the parse of a filter expression
+type filterParser struct {
+	toks []filterToken
+	pos  int
+}
+
+// peek returns true and the next token if there is one
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.pos >= len(p.toks) {
+		return filterToken{}, false
+	}
+
+	return p.toks[p.pos], true
+}
+
+// isKeyword returns true if the next token is the (unquoted) keyword
+func (p *filterParser) isKeyword(kw string) bool {
+	t, ok := p.peek()
+	return ok && !t.quoted && strings.EqualFold(t.text, kw)
+}
+
+// next returns the next token, failing if there is none
+func (p *filterParser) next(expected string) (filterToken, error) {
+	t, ok := p.peek()
+	if !ok {
+		return t, fmt.Errorf("%w: expected %s, found the end of the filter",
+			errBadFilter, expected)
+	}
+
+	p.pos++
+
+	return t, nil
+}
+
+// expect consumes the next token, failing if it is not the given
+// punctuation or keyword
+func (p *filterParser) expect(text string) error {
+	t, err := p.next(fmt.Sprintf("%q", text))
+	if err != nil {
+		return err
+	}
+
+	if t.quoted || !strings.EqualFold(t.text, text) {
+		return fmt.Errorf("%w: expected %q, found %q",
+			errBadFilter, text, t.text)
+	}
+
+	return nil
+}
+
+// parseOr parses: and-expr { 'or' and-expr }
+func (p *filterParser) parseOr() (filter, error) {
+	terms := filterOr{}
+
+	for {
+		t, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		terms = append(terms, t)
+
+		if !p.isKeyword("or") {
+			break
+		}
+
+		p.pos++
+	}
+
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+
+	return terms, nil
+}
+
+// parseAnd parses: unary { 'and' unary }
+func (p *filterParser) parseAnd() (filter, error) {
+	terms := filterAnd{}
+
+	for {
+		t, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		terms = append(terms, t)
+
+		if !p.isKeyword("and") {
+			break
+		}
+
+		p.pos++
+	}
+
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+
+	return terms, nil
+}
+
+// parseUnary parses: 'not' unary | '(' or-expr ')' | comparison
+func (p *filterParser) parseUnary() (filter, error) {
+	if p.isKeyword("not") {
+		p.pos++
+
+		t, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return filterNot{term: t}, nil
+	}
+
+	if p.isKeyword("(") {
+		p.pos++
+
+		t, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		return t, p.expect(")")
+	}
+
+	return p.parseComparison()
+}
+
+// parseValue parses a single value
+func (p *filterParser) parseValue() (string, error) {
+	t, err := p.next("a value")
+	if err != nil {
+		return "", err
+	}
+
+	if !t.quoted && (isFilterPunct([]rune(t.text)[0]) ||
+		isFilterOpChar([]rune(t.text)[0])) {
+		return "", fmt.Errorf("%w: expected a value, found %q",
+			errBadFilter, t.text)
+	}
+
+	return t.text, nil
+}
+
+// parseComparison parses: name op value | name 'in' '(' values ')' |
+// name 'exists'
+func (p *filterParser) parseComparison() (filter, error) {
+	name, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkHeaderName(name); err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadFilter, err)
+	}
+
+	if p.isKeyword("exists") {
+		p.pos++
+
+		return filterExists{name: name}, nil
+	}
+
+	if p.isKeyword("in") {
+		p.pos++
+
+		return p.parseIn(name)
+	}
+
+	op, err := p.next("a comparison operator")
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.text {
+	case "=", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("%w: expected a comparison operator, found %q",
+			errBadFilter, op.text)
+	}
+
+	val, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	f := filterCmp{name: name, op: op.text, val: val}
+
+	if n, err := strconv.ParseFloat(val, 64); err == nil {
+		f.numVal = n
+		f.isNum = true
+	}
+
+	return f, nil
+}
+
+// parseIn parses the set of values following 'in': '(' value {, value} ')'
+func (p *filterParser) parseIn(name string) (filter, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	f := filterIn{name: name, vals: map[string]bool{}}
+
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		f.vals[v] = true
+
+		if !p.isKeyword(",") {
+			break
+		}
+
+		p.pos++
+	}
+
+	return f, p.expect(")")
+}
+
+// parseFilter parses the filter expression. An empty expression gives a nil
+// filter which matches everything.
+func parseFilter(s string) (filter, error) {
+	toks, err := lexFilter(s)
+	if err != nil || len(toks) == 0 {
+		return nil, err
+	}
+
+	p := &filterParser{toks: toks}
+
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t, ok := p.peek(); ok {
+		return nil, fmt.Errorf("%w: unexpected %q", errBadFilter, t.text)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestFilter(t *testing.T) {
+	hdrs := map[string]string{
+		"content-type": "application/json",
+		"priority":     "7",
+		"region":       "eu",
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		f        string
+		expMatch bool
+	}{
+		{
+			ID:       testhelper.MkID("empty filter"),
+			f:        "",
+			expMatch: true,
+		},
+		{
+			ID:       testhelper.MkID("equality, quoted"),
+			f:        `content-type = "application/json"`,
+			expMatch: true,
+		},
+		{
+			ID:       testhelper.MkID("inequality"),
+			f:        `region != eu`,
+			expMatch: false,
+		},
+		{
+			ID:       testhelper.MkID("numeric range"),
+			f:        `priority >= 5 and priority < 10`,
+			expMatch: true,
+		},
+		{
+			ID:       testhelper.MkID("numeric, not string, comparison"),
+			f:        `priority > 10`,
+			expMatch: false,
+		},
+		{
+			ID:       testhelper.MkID("set membership"),
+			f:        `region in (us, eu)`,
+			expMatch: true,
+		},
+		{
+			ID:       testhelper.MkID("missing header"),
+			f:        `origin = x or not (region exists)`,
+			expMatch: false,
+		},
+		{
+			ID:       testhelper.MkID("or and not"),
+			f:        `not region = us or priority < 0`,
+			expMatch: true,
+		},
+		{
+			ID:     testhelper.MkID("bad: no value"),
+			ExpErr: testhelper.MkExpErr("bad filter", "expected a value"),
+			f:      `region =`,
+		},
+		{
+			ID:     testhelper.MkID("bad: unterminated string"),
+			ExpErr: testhelper.MkExpErr("bad filter", "unterminated string"),
+			f:      `region = "eu`,
+		},
+		{
+			ID:     testhelper.MkID("bad: unclosed set"),
+			ExpErr: testhelper.MkExpErr("bad filter", `expected ")"`),
+			f:      `region in (eu, us`,
+		},
+		{
+			ID:     testhelper.MkID("bad: bad header name"),
+			ExpErr: testhelper.MkExpErr("bad filter", "bad character"),
+			f:      `Region = eu`,
+		},
+		{
+			ID:     testhelper.MkID("bad: trailing tokens"),
+			ExpErr: testhelper.MkExpErr("bad filter", `unexpected "eu"`),
+			f:      `region exists eu`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			f, err := parseFilter(tc.f)
+			if testhelper.CheckExpErr(t, err, tc) && err == nil {
+				match := f == nil || f.matches(hdrs)
+				testhelper.DiffBool(t, tc.IDStr(), "match",
+					match, tc.expMatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// clientHandleAck handles an Ack message from the client acknowledging a
+// publication delivered to a durable subscription. It simply hands it on
+// to the server over the pubSubChan; no reply is sent.
+func clientHandleAck(clt *client, msg *pusu.Message) error {
+	clt.logger.Info("client handling message", msg.MT.Attr(), msg.MsgID.Attr())
+
+	clt.pubSubChan <- clientMessage{
+		clt:  clt,
+		msg:  msg,
+		rcvd: time.Now(),
+	}
+
+	return nil
+}
+
+// serverHandleAck handles an Ack message from the server side. It records
+// that the publication delivered with the message ID has been received by
+// the client so that it is not sent again.
+//
+// Note that this handler takes the clientMessage sent over the pubSubChan by
+// the clientHandleAck func.
+func serverHandleAck(prog *prog, cMsg clientMessage, _ namespaceSubsMap) {
+	if !prog.durables.ack(cMsg.clt, cMsg.msg.MsgID, cMsg.rcvd) {
+		prog.logger.Warn("unexpected Ack - no such delivery awaiting one",
+			cMsg.clt.cID.Attr(), cMsg.msg.MsgID.Attr())
+	}
+}
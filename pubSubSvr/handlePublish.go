@@ -1,25 +1,108 @@
 package main
 
 import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"strconv"
+	"time"
+
 	"github.com/nickwells/pusu.mod/pusu"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 // clientHandlePublish handles the publish message from the client side. It
-// simply hands it on to the server over the pubSubChan.
+// decodes the message, checking the headers, decompressing the payload if
+// necessary and validating it against any registered schema, and hands it
+// on to the server over the pubSubChan. A message carrying a batch of
+// publications is handed on to clientHandlePublishBatch. If the client has
+// asked for confirms the server sends the Ack once the publication has
+// been sent to the subscribers, otherwise it is sent here.
 func clientHandlePublish(clt *client, msg *pusu.Message) error {
 	clt.logger.Info("client handling message", msg.MT.Attr(), msg.MsgID.Attr())
 
+	rcvd := time.Now()
+
+	pmp := &pusu.PublishMsgPayload{}
+	if err := msg.Unmarshal(pmp, clt.logger); err != nil {
+		return err
+	}
+
+	items, err := extFields(pmp, extPublishBatch)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBadBatch, err)
+	}
+
+	if err = clt.applyRateLimits(msg, max(1, len(items))); err != nil {
+		return err
+	}
+
+	if len(items) > 0 {
+		return clientHandlePublishBatch(clt, msg, pmp, items, rcvd)
+	}
+
+	pub, err := clt.preparePublication(pmp)
+	if err != nil {
+		return err
+	}
+
 	clt.pubSubChan <- clientMessage{
-		clt: clt,
-		msg: msg,
+		clt:     clt,
+		msg:     msg,
+		pubs:    []*publication{pub},
+		confirm: clt.confirms,
+		rcvd:    rcvd,
 	}
 
-	clt.sendAck(msg.MsgID)
+	if !clt.confirms {
+		clt.sendAck(msg.MsgID)
+	}
 
 	return nil
 }
 
-// serverHandlePublish handles a Publish message from the server side
+// preparePublication checks the headers of the publication, decompresses
+// the payload if necessary, checks that it is no bigger than the namespace
+// allows and validates it against any registered schema.
+func (clt *client) preparePublication(
+	pmp *pusu.PublishMsgPayload,
+) (*publication, error) {
+	if err := checkPublishTopic(pusu.Topic(pmp.Topic)); err != nil {
+		return nil, err
+	}
+
+	pub, err := newPublication(pmp, clt.hdrLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	clt.logger.Debug("publication headers",
+		pub.topic().Attr(), slog.Int("header-count", len(pub.hdrs)))
+
+	if err = pub.decodePayload(clt.compression); err != nil {
+		return nil, err
+	}
+
+	if clt.profile != nil && len(pub.plain) > clt.profile.maxPayload {
+		return nil, fmt.Errorf(
+			"the payload is too big: %d bytes (max for the namespace: %d)",
+			len(pub.plain), clt.profile.maxPayload)
+	}
+
+	if err = clt.schemas.validate(
+		clt.namespace, pub.topic(), pub.plain); err != nil {
+		return nil, err
+	}
+
+	return pub, nil
+}
+
+// serverHandlePublish handles a Publish message from the server side. Each
+// of the publications in the message is sent to the subscribers in turn.
+// If the publisher has asked for confirms the Ack is then sent giving the
+// delivery counts. A publication whose idempotency key has been seen
+// recently is not sent again; if it is the only publication in the message
+// the Ack sent for the original publication is repeated.
 //
 // Note that this handler takes the clientMessage sent over the pubSubChan by
 // the clientHandlePublish func.
@@ -29,45 +112,276 @@ func serverHandlePublish(
 	nsm namespaceSubsMap,
 ) {
 	prog.logger.Info("server handling message",
-		cMsg.msg.MT.Attr(), cMsg.msg.MsgID.Attr())
+		cMsg.msg.MT.Attr(), cMsg.msg.MsgID.Attr(),
+		slog.Int("publications", len(cMsg.pubs)))
+
+	var counts deliveryCounts
+
+	var dup *dedupEntry // set only if the one publication is a duplicate
+
+	var newKeys []string
 
-	pmp := pusu.PublishMsgPayload{}
-	if err := cMsg.msg.Unmarshal(&pmp, prog.logger); err != nil {
-		cMsg.clt.sendError(cMsg.msg.MsgID, err)
+	seen := map[string]bool{} // the keys in this message
+
+	ns := cMsg.clt.namespace
+	now := time.Now()
+
+	for _, pub := range cMsg.pubs {
+		key, hasKey := pub.header(hdrIdempotencyKey)
+		if hasKey && prog.dedup.enabled() {
+			de := prog.dedup.lookup(ns, key, now)
+			if de != nil || seen[key] {
+				prog.logger.Info("duplicate publication skipped",
+					cMsg.clt.cID.Attr(), ns.Attr(), pub.topic().Attr(),
+					slog.String("idempotency-key", key))
+
+				if len(cMsg.pubs) == 1 {
+					dup = de
+				}
+
+				continue
+			}
+
+			seen[key] = true
+			newKeys = append(newKeys, key)
+		}
 
-		return
+		topic := pub.topic()
+
+		counts.add(prog.fanOut(cMsg, pub, nsm))
+		prog.route(ns, topic, pub, nsm)
+		prog.bridge(ns, topic, pub, nsm)
 	}
 
-	var topicSubs subsMap
+	ack := publishAck(cMsg.msg.MsgID, cMsg.itemErrs, &counts)
+	if !cMsg.confirm {
+		ack.Payload = nil
+	}
 
-	var cMap map[*client]bool
+	if dup != nil {
+		ack.Payload = dup.ack
+	}
 
-	var ok bool
+	for _, key := range newKeys {
+		if len(cMsg.pubs) == 1 {
+			prog.dedup.add(ns, key, ack.Payload, now)
+		} else {
+			prog.dedup.add(ns, key, nil, now)
+		}
+	}
 
-	if topicSubs, ok = nsm[cMsg.clt.namespace]; !ok {
-		return
+	if cMsg.confirm {
+		cMsg.clt.sendMessage(ack)
 	}
+}
 
-	subTopics := pusu.Topic(pmp.Topic).SubTopics()
+// deliveryCounts records the number of subscribers to which publications
+// were sent and the number for which they were dropped, because the
+// subscriber had disconnected or was not keeping up.
+type deliveryCounts struct {
+	delivered int
+	dropped   int
+}
+
+// add adds the counts to dc
+func (dc *deliveryCounts) add(counts deliveryCounts) {
+	dc.delivered += counts.delivered
+	dc.dropped += counts.dropped
+}
 
-SubTopicLoop:
-	for _, topic := range subTopics {
-		if cMap, ok = topicSubs[topic]; !ok {
-			continue SubTopicLoop // no subscriptions
+// publishAck returns the Ack message for a Publish message. It describes any
+// publications in a batch which were skipped and, if the counts are given,
+// the number of subscribers to which the publications were sent and the
+// number for which they were dropped.
+func publishAck(
+	msgID pusu.MsgID,
+	itemErrs []batchItemError,
+	counts *deliveryCounts,
+) pusu.Message {
+	var payload []byte
+
+	if counts != nil {
+		payload = protowire.AppendTag(payload,
+			extAckDelivered, protowire.VarintType)
+		payload = protowire.AppendVarint(payload,
+			uint64(counts.delivered)) //nolint:gosec
+		payload = protowire.AppendTag(payload,
+			extAckDropped, protowire.VarintType)
+		payload = protowire.AppendVarint(payload,
+			uint64(counts.dropped)) //nolint:gosec
+	}
+
+	return pusu.Message{
+		MT:      pusu.Ack,
+		MsgID:   msgID,
+		Payload: appendBatchErrs(payload, itemErrs),
+	}
+}
+
+// fanOut sends the publication to all the subscribers to the topic, or to
+// any of its parent topics, whose filters match the publication headers,
+// and adds it to any matching durable subscriptions. It returns the
+// delivery counts.
+func (prog *prog) fanOut(
+	cMsg clientMessage,
+	pub *publication,
+	nsm namespaceSubsMap,
+) deliveryCounts {
+	var counts deliveryCounts
+
+	fanOutSpan := prog.startPublishSpans(cMsg, pub.pmp.Topic, pub.hdrs)
+	defer fanOutSpan.finish()
+
+	if fanOutSpan != nil {
+		hdrs := maps.Clone(pub.hdrs)
+		setTraceHeaders(hdrs, fanOutSpan.context())
+		pub.setHeaders(hdrs)
+	}
+
+	ns := cMsg.clt.namespace
+	pubTopic := pub.topic()
+	topicSubs := nsm.topics(ns)
+	payloads := newPayloadCache(pub, prog.compression, prog.logger)
+	now := time.Now()
+
+	sent := map[*client]bool{} // the clients sent the original topic
+
+	for _, topic := range pubTopic.SubTopics() {
+		if cMap, ok := topicSubs[topic]; ok {
+			counts.add(prog.sendToSubscribers(pub, pubTopic, topic, cMap,
+				payloads, sent, fanOutSpan.context()))
 		}
 
-		msg := pusu.Message{
-			MT: pusu.Publish,
+		counts.add(prog.sendToDurables(ns, pub, pubTopic, topic, now, nsm))
+	}
+
+	fanOutSpan.setAttr("pubsub.delivery_count",
+		strconv.Itoa(counts.delivered))
+	fanOutSpan.setAttr("pubsub.dropped_count", strconv.Itoa(counts.dropped))
+
+	return counts
+}
+
+// sendToSubscribers sends the publication on the topic to each of the
+// subscribers whose filter matches the publication headers. Each form of
+// the message is encoded once and shared between the subscribers.
+// Subscribers which want the topic on which the publication was made are
+// sent it with that topic, once only; sent records those already sent it.
+// It returns the delivery counts.
+func (prog *prog) sendToSubscribers(
+	pub *publication,
+	pubTopic, topic pusu.Topic,
+	cMap subscribers,
+	payloads *payloadCache,
+	sent map[*client]bool,
+	tc traceContext,
+) deliveryCounts {
+	var counts deliveryCounts
+
+	type msgKey struct {
+		enc   contentEncoding
+		topic pusu.Topic
+	}
+
+	msgs := map[msgKey]*encodedMsg{}
+
+	for clt, f := range cMap {
+		if f != nil && !f.matches(pub.hdrs) {
+			continue
 		}
 
-		pmp.Topic = string(topic)
+		key := msgKey{topic: topic}
 
-		if err := (&msg).Marshal(&pmp, prog.logger); err != nil {
-			return
+		if clt.origTopic {
+			if sent[clt] {
+				continue
+			}
+
+			sent[clt] = true
+			key.topic = pubTopic
 		}
 
-		for clt := range cMap {
-			clt.sendMessage(msg)
+		ep := payloads.payload(clt.encoding)
+		key.enc = ep.enc
+
+		em, ok := msgs[key]
+		if !ok {
+			var err error
+
+			em, err = prog.encodePublication(pub, key.topic, ep)
+			if err != nil {
+				counts.dropped++
+
+				continue
+			}
+
+			msgs[key] = em
+		}
+
+		if clt.sendEncodedMessage(em, tc) {
+			counts.delivered++
+		} else {
+			counts.dropped++
+		}
+	}
+
+	for _, em := range msgs {
+		em.release()
+	}
+
+	return counts
+}
+
+// startPublishSpans records the span for the receipt of the publication and
+// starts and returns the span for its fan-out to the subscribers. The spans
+// are only created if the publication carries a sampled trace context in its
+// headers, otherwise they are nil.
+func (prog *prog) startPublishSpans(
+	cMsg clientMessage,
+	topic string,
+	hdrs map[string]string,
+) *span {
+	parent, err := traceContextFromHeaders(hdrs)
+	if err != nil {
+		prog.logger.Error("couldn't get the trace context",
+			cMsg.clt.cID.Attr(), pusu.ErrorAttr(err))
+	}
+
+	rcvSpan := prog.tracer.startSpan("pubsub receive", spanKindConsumer,
+		parent, cMsg.rcvd)
+	rcvSpan.setAttr("pubsub.topic", topic)
+	rcvSpan.setAttr("pubsub.namespace", string(cMsg.clt.namespace))
+	rcvSpan.setAttr(cltAttrPfx+"connID", cMsg.clt.cID.String())
+	rcvSpan.finish()
+
+	fanOutSpan := prog.tracer.startSpan("pubsub fan-out", spanKindInternal,
+		rcvSpan.context(), time.Now())
+	fanOutSpan.setAttr("pubsub.topic", topic)
+
+	return fanOutSpan
+}
+
+// encodePublication returns the publication on the topic, with the payload
+// in the given encoding, encoded ready for writing to the subscribers'
+// connections. Any errors are logged.
+func (prog *prog) encodePublication(
+	pub *publication,
+	topic pusu.Topic,
+	ep encodedPayload,
+) (*encodedMsg, error) {
+	msg, err := pub.message(topic, ep, prog.logger)
+	if err == nil {
+		var em *encodedMsg
+
+		if em, err = encodeMsg(msg); err == nil {
+			return em, nil
 		}
 	}
+
+	prog.logger.Error("couldn't make the publication message",
+		topic.Attr(),
+		slog.String("encoding", string(ep.enc)),
+		pusu.ErrorAttr(err))
+
+	return nil, err
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// discardConn is a net.Conn which discards everything written to it
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// ackVarints returns the integer fields in the Ack payload
+func ackVarints(t *testing.T, payload []byte) map[protowire.Number]uint64 {
+	t.Helper()
+
+	vals := map[protowire.Number]uint64{}
+
+	for len(payload) > 0 {
+		n, typ, tagLen := protowire.ConsumeTag(payload)
+		valLen := protowire.ConsumeFieldValue(n, typ, payload[tagLen:])
+
+		if valLen < 0 {
+			t.Fatal("bad Ack payload:", protowire.ParseError(valLen))
+		}
+
+		if typ == protowire.VarintType {
+			vals[n], _ = protowire.ConsumeVarint(payload[tagLen:])
+		}
+
+		payload = payload[tagLen+valLen:]
+	}
+
+	return vals
+}
+
+func TestPublishConfirm(t *testing.T) {
+	const ns = pusu.Namespace("test")
+
+	prog := &prog{logger: testLogger}
+
+	disconnected := testClient(ns)
+	disconnected.connected = false
+
+	noMatch, err := parseFilter("region = eu")
+	if err != nil {
+		t.Fatal("cannot parse the filter:", err)
+	}
+
+	nsm := namespaceSubsMap{
+		ns: {topics: subsMap{
+			"/a/b": subscribers{
+				testClient(ns): nil,
+				disconnected:   nil,
+			},
+			"/a": subscribers{
+				testClient(ns): nil,
+				testClient(ns): noMatch,
+			},
+		}},
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		confirm      bool
+		expDelivered uint64
+		expDropped   uint64
+	}{
+		{
+			ID:           testhelper.MkID("confirmed"),
+			confirm:      true,
+			expDelivered: 2,
+			expDropped:   1,
+		},
+		{
+			ID: testhelper.MkID("not confirmed"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			publisher := testClient(ns)
+			cMsg := clientMessage{
+				clt: publisher,
+				msg: &pusu.Message{MT: pusu.Publish, MsgID: 7},
+				pubs: []*publication{{
+					pmp: &pusu.PublishMsgPayload{Topic: "/a/b/c"},
+				}},
+				confirm: tc.confirm,
+			}
+
+			serverHandlePublish(prog, cMsg, nsm)
+
+			for _, cMap := range nsm.topics(ns) {
+				for clt := range cMap {
+					select {
+					case om := <-clt.sendChan:
+						om.discard()
+					default:
+					}
+				}
+			}
+
+			select {
+			case om := <-publisher.sendChan:
+				if !tc.confirm {
+					t.Log(tc.IDStr())
+					t.Fatal("\t: unexpected Ack")
+				}
+
+				vals := ackVarints(t, om.msg.Payload)
+				testhelper.DiffInt(t, tc.IDStr(), "delivered",
+					vals[extAckDelivered], tc.expDelivered)
+				testhelper.DiffInt(t, tc.IDStr(), "dropped",
+					vals[extAckDropped], tc.expDropped)
+			default:
+				if tc.confirm {
+					t.Log(tc.IDStr())
+					t.Fatal("\t: no Ack was sent")
+				}
+			}
+		})
+	}
+}
+
+func TestPublishBatchRepeatedKey(t *testing.T) {
+	const ns = pusu.Namespace("test")
+
+	prog := &prog{logger: testLogger, dedup: newDedupCache(time.Minute, 10)}
+
+	sub := testClient(ns)
+	nsm := namespaceSubsMap{ns: {topics: subsMap{"/a": {sub: nil}}}}
+
+	mkPub := func(key string) *publication {
+		return &publication{
+			pmp:  &pusu.PublishMsgPayload{Topic: "/a"},
+			hdrs: map[string]string{hdrIdempotencyKey: key},
+		}
+	}
+
+	serverHandlePublish(prog, clientMessage{
+		clt:  testClient(ns),
+		msg:  &pusu.Message{MT: pusu.Publish, MsgID: 7},
+		pubs: []*publication{mkPub("k1"), mkPub("k1"), mkPub("k2")},
+	}, nsm)
+
+	testhelper.DiffInt(t, "batch with a repeated key", "publications sent",
+		len(sub.sendChan), 2)
+}
+
+// fanOutSetup returns a prog, a namespaceSubsMap with the given number of
+// subscribers to the topic and a publication message on the topic
+func fanOutSetup(
+	b *testing.B,
+	subCount int,
+) (*prog, namespaceSubsMap, []*client, clientMessage) {
+	b.Helper()
+
+	const (
+		ns    = pusu.Namespace("bench")
+		topic = pusu.Topic("/bench/topic")
+	)
+
+	prog := &prog{logger: testLogger}
+
+	cMap := subscribers{}
+	clients := make([]*client, 0, subCount)
+
+	for i := range subCount {
+		clt := &client{
+			cID:       connID(i),
+			namespace: ns,
+			logger:    testLogger,
+			conn:      discardConn{},
+			connected: true,
+			sendChan:  make(chan outMsg, 1),
+		}
+		cMap[clt] = nil
+		clients = append(clients, clt)
+	}
+
+	pub := &publication{
+		pmp: &pusu.PublishMsgPayload{
+			Topic:   string(topic),
+			Payload: bytes.Repeat([]byte("x"), 1024),
+		},
+	}
+	pub.plain = pub.pmp.Payload
+
+	cMsg := clientMessage{
+		clt:  &client{namespace: ns, logger: testLogger},
+		msg:  &pusu.Message{MT: pusu.Publish},
+		pubs: []*publication{pub},
+	}
+
+	nsm := namespaceSubsMap{ns: {topics: subsMap{topic: cMap}}}
+
+	return prog, nsm, clients, cMsg
+}
+
+// BenchmarkFanOut measures the cost of fanning out a publication to 1000
+// subscribers, from the server handling the publication to each message
+// being written to the subscriber's connection.
+func BenchmarkFanOut(b *testing.B) {
+	const subCount = 1000
+
+	b.Run("pre-encoded", func(b *testing.B) {
+		prog, nsm, clients, cMsg := fanOutSetup(b, subCount)
+
+		b.ReportAllocs()
+
+		for b.Loop() {
+			serverHandlePublish(prog, cMsg, nsm)
+
+			for _, clt := range clients {
+				om := <-clt.sendChan
+				if err := om.write(clt.conn); err != nil {
+					b.Fatal("unexpected write error:", err)
+				}
+			}
+		}
+	})
+
+	b.Run("encoded per subscriber", func(b *testing.B) {
+		prog, _, clients, cMsg := fanOutSetup(b, subCount)
+		pub := cMsg.pubs[0]
+
+		b.ReportAllocs()
+
+		for b.Loop() {
+			msg, err := pub.message(pub.topic(),
+				encodedPayload{payload: pub.plain}, prog.logger)
+			if err != nil {
+				b.Fatal("unexpected error:", err)
+			}
+
+			for _, clt := range clients {
+				if err := msg.Write(clt.conn); err != nil {
+					b.Fatal("unexpected write error:", err)
+				}
+			}
+		}
+	})
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 
 	"github.com/nickwells/pusu.mod/pusu"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
-// setNamespace sets the client namespace from the passed string. It returns
-// a non-nil error if the server does not allow the supplied namespace.
+// setNamespace sets the client namespace from the passed string, together
+// with the profile for the namespace. It returns a non-nil error if the
+// server does not allow the supplied namespace.
 func (clt *client) setNamespace(n string) error {
 	clt.namespace = pusu.Namespace(n)
 	if !clt.nsRules.isValid(clt.namespace) {
@@ -16,10 +19,15 @@ func (clt *client) setNamespace(n string) error {
 		clt.logger.Error("namespace not allowed by this server",
 			clt.namespace.Attr(),
 			pusu.ErrorAttr(err))
+		clt.audit(auditEvtNamespace, auditRejected, err)
 
 		return err
 	}
 
+	clt.Lock()
+	clt.profile = clt.profiles.forNamespace(clt.namespace)
+	clt.Unlock()
+
 	return nil
 }
 
@@ -45,6 +53,7 @@ func (clt *client) setProtoVsn(pv int32) error {
 		clt.logger.Error("protocol version not allowed by this server",
 			clt.protoVsn.Attr(),
 			pusu.ErrorAttr(err))
+		clt.audit(auditEvtProtoVsn, auditRejected, err)
 	}
 
 	return err
@@ -62,7 +71,7 @@ func clientHandleStart(clt *client, msg *pusu.Message) error {
 
 	clt.identity = smp.ClientId
 
-	if err := clt.setNamespace(smp.Namespace); err != nil {
+	if err := clt.enterNamespace(smp.Namespace); err != nil {
 		return err
 	}
 
@@ -70,8 +79,26 @@ func clientHandleStart(clt *client, msg *pusu.Message) error {
 		return err
 	}
 
+	offered, err := getExtStrings(&smp, extStartEncodings)
+	if err != nil {
+		return err
+	}
+
+	clt.encoding = clt.compression.negotiate(offered)
+
+	if clt.confirms, err = getExtBool(&smp, extStartConfirms); err != nil {
+		return err
+	}
+
+	if clt.will, err = clt.parseWill(&smp); err != nil {
+		return err
+	}
+
 	clt.logger.Info("client start information",
-		clt.startInfoAttr(), clt.namespace.Attr(), clt.protoVsn.Attr())
+		clt.startInfoAttr(), clt.namespace.Attr(), clt.protoVsn.Attr(),
+		slog.String(cltAttrPfx+"Encoding", string(clt.encoding)),
+		slog.Bool(cltAttrPfx+"Confirms", clt.confirms),
+		slog.Bool(cltAttrPfx+"Will", clt.will != nil))
 
 	// disable any future messages of this type ...
 	clt.handlers.setAllEntries(
@@ -85,8 +112,46 @@ func clientHandleStart(clt *client, msg *pusu.Message) error {
 	clt.handlers.setEntries(clientHandleSubscribe, pusu.Subscribe)
 	clt.handlers.setEntries(clientHandleUnsubscribe, pusu.Unsubscribe)
 	clt.handlers.setEntries(clientHandlePing, pusu.Ping)
+	clt.handlers.setEntries(clientHandleAck, pusu.Ack)
 
-	clt.sendAck(msg.MsgID)
+	clt.pubSubChan <- clientMessage{
+		clt: clt,
+		msg: msg,
+	}
+
+	restored := clt.restoreSubs()
+
+	ack := startAck(msg.MsgID, clt, len(offered) > 0)
+	ack.Payload = appendRestored(ack.Payload, restored)
+
+	clt.sendMessage(ack)
 
 	return nil
 }
+
+// startAck returns the Ack message for the Start message. If the client
+// offered any compression schemes the Ack reports the one chosen and if the
+// client asked for its publications to be confirmed the Ack shows that they
+// will be.
+func startAck(msgID pusu.MsgID, clt *client, reportEnc bool) pusu.Message {
+	var payload []byte
+
+	if reportEnc {
+		payload = protowire.AppendTag(payload,
+			extAckEncoding, protowire.BytesType)
+		payload = protowire.AppendString(payload, string(clt.encoding))
+	}
+
+	if clt.confirms {
+		payload = protowire.AppendTag(payload,
+			extAckConfirms, protowire.VarintType)
+		payload = protowire.AppendVarint(payload,
+			protowire.EncodeBool(clt.confirms))
+	}
+
+	return pusu.Message{
+		MT:      pusu.Ack,
+		MsgID:   msgID,
+		Payload: payload,
+	}
+}
@@ -1,20 +1,53 @@
 package main
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/nickwells/pusu.mod/pusu"
 )
 
-// clientHandleSubscribe handles the subscribe message. It first sends the
-// Subscribe message to the pubSubChan. Then it opens the messasge and adds
-// each topic to the clients own subscription map.
+// subTopics returns the topics in the subscription message payload
+func subTopics(smp *pusu.SubscriptionMsgPayload) []pusu.Topic {
+	topics := make([]pusu.Topic, 0, len(smp.Subs))
+
+	for _, sub := range smp.Subs {
+		topics = append(topics, pusu.Topic(sub.Topic))
+	}
+
+	return topics
+}
+
+// clientHandleSubscribe handles the subscribe message. It opens the message,
+// parses any filters and adds each topic to the clients own subscription
+// map. Then it sends the Subscribe message, with the parsed filters, to the
+// pubSubChan.
 func clientHandleSubscribe(clt *client, msg *pusu.Message) error {
 	clt.logger.Info("client handling message", msg.MT.Attr(), msg.MsgID.Attr())
 
+	if err := clt.applyRateLimits(msg, 1); err != nil {
+		return err
+	}
+
 	smp := pusu.SubscriptionMsgPayload{}
 	if err := msg.Unmarshal(&smp, clt.logger); err != nil {
 		return err
 	}
 
+	if err := clt.checkNewSubs(subTopics(&smp)); err != nil {
+		return err
+	}
+
+	filters, err := parseSubFilters(&smp)
+	if err != nil {
+		return err
+	}
+
+	durables, err := parseSubDurables(&smp)
+	if err != nil {
+		return err
+	}
+
 	for _, sub := range smp.Subs {
 		topic := pusu.Topic(sub.Topic)
 
@@ -22,8 +55,10 @@ func clientHandleSubscribe(clt *client, msg *pusu.Message) error {
 	}
 
 	clt.pubSubChan <- clientMessage{
-		clt: clt,
-		msg: msg,
+		clt:      clt,
+		msg:      msg,
+		filters:  filters,
+		durables: durables,
 	}
 
 	clt.sendAck(msg.MsgID)
@@ -48,25 +83,114 @@ func serverHandleSubscribe(
 		return
 	}
 
-	var topicSubs subsMap
+	topicSubs := prog.nsEntry(nsm, cMsg.clt.namespace).topics
 
-	var cMap map[*client]bool
+	var cMap subscribers
 
 	var ok bool
 
-	if topicSubs, ok = nsm[cMsg.clt.namespace]; !ok {
-		topicSubs = make(subsMap)
-		nsm[cMsg.clt.namespace] = topicSubs
-	}
-
 	for _, sub := range smp.Subs {
 		topic := pusu.Topic(sub.Topic)
 
+		if name, ok := cMsg.durables[topic]; ok {
+			if cMap, ok = topicSubs[topic]; ok {
+				delete(cMap, cMsg.clt)
+
+				if len(cMap) == 0 {
+					delete(topicSubs, topic)
+					prog.notifySubscription(cMsg.clt.namespace, topic,
+						sysEventLastSub, nsm)
+				}
+			}
+
+			prog.durables.pump(
+				prog.durables.attach(cMsg.clt, name, topic,
+					cMsg.filters[topic]),
+				time.Now())
+
+			continue
+		}
+
+		if ds := prog.durables.clientSubOnTopic(cMsg.clt, topic); ds != nil {
+			prog.durables.detach(ds)
+		}
+
 		if cMap, ok = topicSubs[topic]; !ok {
-			cMap = make(map[*client]bool)
+			cMap = make(subscribers)
 			topicSubs[topic] = cMap
 		}
 
-		cMap[cMsg.clt] = true
+		cMap[cMsg.clt] = cMsg.filters[topic]
+
+		if !ok {
+			prog.notifySubscription(cMsg.clt.namespace, topic,
+				sysEventFirstSub, nsm)
+		}
+	}
+}
+
+// parseSubFilters parses any filters given with the subscriptions and
+// returns a map from the topic to the filter. Subscriptions without a filter
+// do not have an entry in the map.
+func parseSubFilters(
+	smp *pusu.SubscriptionMsgPayload,
+) (map[pusu.Topic]filter, error) {
+	var filters map[pusu.Topic]filter
+
+	for _, sub := range smp.Subs {
+		fStr, err := getExtString(sub, extSubFilter)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errBadFilter, err)
+		}
+
+		f, err := parseFilter(fStr)
+		if err != nil {
+			return nil, fmt.Errorf("topic %q: %w", sub.Topic, err)
+		}
+
+		if f == nil {
+			continue
+		}
+
+		if filters == nil {
+			filters = make(map[pusu.Topic]filter)
+		}
+
+		filters[pusu.Topic(sub.Topic)] = sourcedFilter{filter: f, text: fStr}
 	}
+
+	return filters, nil
+}
+
+// parseSubDurables checks the names of any durable subscriptions and
+// returns a map from the topic to the name. Subscriptions which are not
+// durable do not have an entry in the map.
+func parseSubDurables(
+	smp *pusu.SubscriptionMsgPayload,
+) (map[pusu.Topic]string, error) {
+	var durables map[pusu.Topic]string
+
+	for _, sub := range smp.Subs {
+		vals, err := extFields(sub, extSubDurable)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errBadDurable, err)
+		}
+
+		if len(vals) == 0 {
+			continue
+		}
+
+		name := string(vals[len(vals)-1])
+		if err := checkDurableName(name); err != nil {
+			return nil, fmt.Errorf("topic %q: %w", sub.Topic, err)
+		}
+
+		if durables == nil {
+			durables = make(map[pusu.Topic]string)
+		}
+
+		durables[pusu.Topic(sub.Topic)] = name
+	}
+
+	return durables, nil
 }
@@ -36,6 +36,7 @@ func clientHandleUnsubscribe(clt *client, msg *pusu.Message,
 // side. It removes the client from the set of clients subscribed to the
 // topic and if that leaves the set of clients subscribed to a topic empty
 // then it removes the topic from the set of topic subscriptions as well.
+// Any durable subscription the client has to the topic is ended.
 //
 // Note that this handler takes the clientMessage sent over the pubSubChan by
 // the clientHandleUnsubscribe func.
@@ -55,16 +56,23 @@ func serverHandleUnsubscribe(
 		return
 	}
 
-	var topicSubs subsMap
-
-	var cMap map[*client]bool
+	for _, sub := range smp.Subs {
+		topic := pusu.Topic(sub.Topic)
 
-	var ok bool
+		if ds := prog.durables.clientSubOnTopic(cMsg.clt, topic); ds != nil {
+			prog.durables.remove(ds)
+		}
+	}
 
-	if topicSubs, ok = nsm[cMsg.clt.namespace]; !ok {
+	topicSubs := nsm.topics(cMsg.clt.namespace)
+	if topicSubs == nil {
 		return
 	}
 
+	var cMap subscribers
+
+	var ok bool
+
 	for _, sub := range smp.Subs {
 		topic := pusu.Topic(sub.Topic)
 
@@ -73,6 +81,8 @@ func serverHandleUnsubscribe(
 
 			if len(cMap) == 0 {
 				delete(topicSubs, topic)
+				prog.notifySubscription(cMsg.clt.namespace, topic,
+					sysEventLastSub, nsm)
 			}
 		}
 	}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// errBadHeader is the error returned when a publication header is invalid
+var errBadHeader = errors.New("bad publication header")
+
+// headerLimits records the constraints on the headers which may be given on
+// a publication. A limit of zero means that there is no limit.
+type headerLimits struct {
+	maxCount int // the maximum number of headers
+	maxSize  int // the maximum total size of the header names and values
+}
+
+// publication holds the decoded contents of a Publish message. The headers
+// are decoded separately from the payload so that they can be inspected
+// without touching the payload.
+type publication struct {
+	pmp  *pusu.PublishMsgPayload
+	hdrs map[string]string
+
+	encoding contentEncoding // the encoding of the payload as received
+	encoded  []byte          // the payload as received, if compressed
+	plain    []byte          // the uncompressed payload
+}
+
+// topic returns the topic on which the publication was made
+func (pub *publication) topic() pusu.Topic {
+	return pusu.Topic(pub.pmp.Topic)
+}
+
+// header returns the value of the named header and whether it was present
+func (pub *publication) header(name string) (string, bool) {
+	v, ok := pub.hdrs[name]
+	return v, ok
+}
+
+// setHeaders replaces the headers, both in the publication and in the
+// encoded payload.
+func (pub *publication) setHeaders(hdrs map[string]string) {
+	pub.hdrs = hdrs
+	setExtMap(pub.pmp, extPublishHeaders, hdrs)
+}
+
+// message returns a Publish message carrying the publication on the topic
+// with the payload in the given encoding. The content-encoding header is
+// set to show the encoding used. The publication itself is not changed so
+// that it may be encoded again, for another topic or encoding.
+func (pub *publication) message(
+	topic pusu.Topic,
+	ep encodedPayload,
+	logger *slog.Logger,
+) (pusu.Message, error) {
+	hdrs := pub.hdrs
+	if ep.enc != encIdentity {
+		hdrs = maps.Clone(pub.hdrs)
+		if hdrs == nil {
+			hdrs = map[string]string{}
+		}
+
+		hdrs[hdrContentEncoding] = string(ep.enc)
+	}
+
+	pmp := &pusu.PublishMsgPayload{
+		Topic:   string(topic),
+		Payload: ep.payload,
+	}
+	pmp.ProtoReflect().SetUnknown(pub.pmp.ProtoReflect().GetUnknown())
+	setExtMap(pmp, extPublishHeaders, hdrs)
+
+	msg := pusu.Message{
+		MT: pusu.Publish,
+	}
+
+	if err := (&msg).Marshal(pmp, logger); err != nil {
+		return msg, err
+	}
+
+	if len(msg.Payload) > pusu.MaxMessagePayload {
+		return msg, fmt.Errorf("the message is too big: %d bytes (max: %d)",
+			len(msg.Payload), pusu.MaxMessagePayload)
+	}
+
+	return msg, nil
+}
+
+// checkHeaderName returns a non-nil error if the header name is not
+// well-formed. A header name must be non-empty and may only contain
+// lower-case letters, digits, '-', '_' and '.'.
+func checkHeaderName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: the name must not be empty", errBadHeader)
+	}
+
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z',
+			r >= '0' && r <= '9',
+			r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("%w: %q - bad character %q in the name",
+				errBadHeader, name, r)
+		}
+	}
+
+	return nil
+}
+
+// check returns a non-nil error if the headers break any of the limits or
+// if any header name is malformed.
+func (hl headerLimits) check(hdrs map[string]string) error {
+	if hl.maxCount > 0 && len(hdrs) > hl.maxCount {
+		return fmt.Errorf("%w: too many headers: %d (max: %d)",
+			errBadHeader, len(hdrs), hl.maxCount)
+	}
+
+	size := 0
+
+	for k, v := range hdrs {
+		if err := checkHeaderName(k); err != nil {
+			return err
+		}
+
+		size += len(k) + len(v)
+	}
+
+	if hl.maxSize > 0 && size > hl.maxSize {
+		return fmt.Errorf("%w: the headers are too big: %d bytes (max: %d)",
+			errBadHeader, size, hl.maxSize)
+	}
+
+	return nil
+}
+
+// newPublication decodes the headers of the Publish message payload,
+// checking them against the limits, and returns the publication.
+func newPublication(
+	pmp *pusu.PublishMsgPayload,
+	hl headerLimits,
+) (*publication, error) {
+	pub := &publication{pmp: pmp}
+
+	var err error
+
+	if pub.hdrs, err = getExtMap(pub.pmp, extPublishHeaders); err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadHeader, err)
+	}
+
+	if err = hl.check(pub.hdrs); err != nil {
+		return nil, err
+	}
+
+	return pub, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCheckHeaderName(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		name string
+	}{
+		{
+			ID:   testhelper.MkID("good"),
+			name: "trace-id",
+		},
+		{
+			ID:   testhelper.MkID("good: all the allowed characters"),
+			name: "az09-_.",
+		},
+		{
+			ID:     testhelper.MkID("bad: empty"),
+			ExpErr: testhelper.MkExpErr("the name must not be empty"),
+		},
+		{
+			ID:     testhelper.MkID("bad: upper case"),
+			ExpErr: testhelper.MkExpErr(`"Trace-Id" - bad character 'T'`),
+			name:   "Trace-Id",
+		},
+		{
+			ID:     testhelper.MkID("bad: space"),
+			ExpErr: testhelper.MkExpErr(`bad character ' '`),
+			name:   "trace id",
+		},
+		{
+			ID:     testhelper.MkID("bad: non-ASCII letter"),
+			ExpErr: testhelper.MkExpErr(`bad character 'é'`),
+			name:   "café",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := checkHeaderName(tc.name)
+			testhelper.CheckExpErr(t, err, tc)
+
+			if err != nil && !errors.Is(err, errBadHeader) {
+				t.Log(tc.IDStr())
+				t.Error("\t: the error should wrap errBadHeader")
+			}
+		})
+	}
+}
+
+func TestHeaderLimitsCheck(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		hl   headerLimits
+		hdrs map[string]string
+	}{
+		{
+			ID: testhelper.MkID("good: no headers"),
+			hl: headerLimits{maxCount: 1, maxSize: 1},
+		},
+		{
+			ID:   testhelper.MkID("good: no limits"),
+			hdrs: map[string]string{"a": strings.Repeat("x", 1000), "b": ""},
+		},
+		{
+			ID:   testhelper.MkID("good: at the limits"),
+			hl:   headerLimits{maxCount: 2, maxSize: 6},
+			hdrs: map[string]string{"a": "xx", "b": "yy"},
+		},
+		{
+			ID:     testhelper.MkID("bad: too many headers"),
+			ExpErr: testhelper.MkExpErr("too many headers: 3 (max: 2)"),
+			hl:     headerLimits{maxCount: 2},
+			hdrs:   map[string]string{"a": "", "b": "", "c": ""},
+		},
+		{
+			ID: testhelper.MkID("bad: too big"),
+			ExpErr: testhelper.MkExpErr(
+				"the headers are too big: 7 bytes (max: 6)"),
+			hl:   headerLimits{maxSize: 6},
+			hdrs: map[string]string{"a": "xx", "b": "yyy"},
+		},
+		{
+			ID:     testhelper.MkID("bad: header name"),
+			ExpErr: testhelper.MkExpErr(`"A" - bad character 'A'`),
+			hl:     headerLimits{maxCount: 2, maxSize: 100},
+			hdrs:   map[string]string{"A": "x"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := tc.hl.check(tc.hdrs)
+			testhelper.CheckExpErr(t, err, tc)
+
+			if err != nil && !errors.Is(err, errBadHeader) {
+				t.Log(tc.IDStr())
+				t.Error("\t: the error should wrap errBadHeader")
+			}
+		})
+	}
+}
+
+func TestPublicationMessage(t *testing.T) {
+	pmp := &pusu.PublishMsgPayload{Topic: "/a/b", Payload: []byte("plain")}
+	setExtMap(pmp, extPublishHeaders, map[string]string{"region": "eu"})
+
+	pub, err := newPublication(pmp, headerLimits{})
+	if err != nil {
+		t.Fatal("cannot make the publication:", err)
+	}
+
+	msg, err := pub.message("/a",
+		encodedPayload{enc: encGzip, payload: []byte("zipped")}, testLogger)
+	if err != nil {
+		t.Fatal("cannot make the message:", err)
+	}
+
+	sent := &pusu.PublishMsgPayload{}
+	if err := proto.Unmarshal(msg.Payload, sent); err != nil {
+		t.Fatal("cannot decode the message:", err)
+	}
+
+	sentHdrs, err := getExtMap(sent, extPublishHeaders)
+	if err != nil {
+		t.Fatal("cannot decode the sent headers:", err)
+	}
+
+	testhelper.DiffString(t, "message", "topic", sent.Topic, "/a")
+	testhelper.DiffString(t, "message", "payload",
+		string(sent.Payload), "zipped")
+	testhelper.DiffString(t, "message", "encoding header",
+		sentHdrs[hdrContentEncoding], string(encGzip))
+
+	hdrs, err := getExtMap(pub.pmp, extPublishHeaders)
+	if err != nil {
+		t.Fatal("cannot decode the publication headers:", err)
+	}
+
+	testhelper.DiffString(t, "publication", "topic", pub.pmp.Topic, "/a/b")
+	testhelper.DiffString(t, "publication", "payload",
+		string(pub.pmp.Payload), "plain")
+	testhelper.DiffInt(t, "publication", "headers", len(hdrs), 1)
+	testhelper.DiffInt(t, "publication", "decoded headers", len(pub.hdrs), 1)
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// httpTopicPath is the pattern of the HTTP gateway URL paths. The topic is
+// given by the path segments after 'topic' so that '/ns/prices/topic/a/b'
+// is the topic '/a/b' in the 'prices' namespace.
+const httpTopicPath = "/ns/{namespace}/topic/{topic...}"
+
+// The HTTP request headers recognised by the gateway. Headers whose name
+// starts with httpHdrPubPfx give the headers of the publication.
+const (
+	httpHdrClientID = "Pusu-Client-Id"
+	httpHdrPubPfx   = "Pusu-Header-"
+)
+
+// The content type of the response to a subscription and the name of the
+// events sent for each publication
+const (
+	sseContentType = "text/event-stream"
+	sseEventPub    = "publication"
+)
+
+// sseKeepAliveInterval is how long the gateway waits with nothing to send
+// before sending a comment to keep the event stream open
+const sseKeepAliveInterval = 30 * time.Second
+
+// httpReadHeaderTimeout is how long the gateway waits for the request
+// headers
+const httpReadHeaderTimeout = 10 * time.Second
+
+// noteTextHTTP describes the HTTP gateway
+const noteTextHTTP = "If an HTTP port is given the server also accepts" +
+	" HTTPS requests on that port so that programs can publish and" +
+	" subscribe without using the pusu protocol. The connection must use" +
+	" mutual TLS, as for pusu clients, and the namespace must be allowed" +
+	" by the server. Requests are subject to the same limits as pusu" +
+	" clients." +
+	"\n\n" +
+	"The URL path gives the namespace and topic: '/ns/<namespace>/topic/" +
+	"<topic>' so a request for '/ns/prices/topic/fx/eur' is for the" +
+	" topic '/fx/eur' in the 'prices' namespace. A '" + httpHdrClientID +
+	"' request header may give the identity of the client." +
+	"\n\n" +
+	"A POST request publishes the request body on the topic. Any" +
+	" request headers whose name starts with '" + httpHdrPubPfx + "'" +
+	" give the publication headers; the rest of the name, in lower" +
+	" case, is the header name. The response is sent once the" +
+	" publication has been sent to the subscribers and gives the" +
+	" delivery counts as JSON, for instance:" +
+	"\n\n" +
+	`{"delivered":3,"dropped":0}` +
+	"\n\n" +
+	"A GET request accepting '" + sseContentType + "' subscribes to the" +
+	" topic and the publications are sent as server-sent events until" +
+	" the request ends. A 'filter' query parameter may give a" +
+	" subscription filter. Each event is named '" + sseEventPub + "'" +
+	" and the data is JSON giving the topic on which the publication was" +
+	" made, any headers and the payload; the payload is given as" +
+	" 'payload' if it is valid UTF-8 text and otherwise as" +
+	" base64-encoded 'payloadBase64'. For instance:" +
+	"\n\n" +
+	`{"topic":"/fx/eur","headers":{"source":"ecb"},"payload":"1.08"}`
+
+// connCtxKey is the key of the request context value holding the
+// connection on which the request was received
+type connCtxKey struct{}
+
+// httpGateway handles the requests made to the HTTP gateway. Each request
+// is treated as coming from a new client which lasts as long as the
+// request.
+type httpGateway struct {
+	logger     *slog.Logger
+	shared     *clientShared
+	nextConnID func() connID
+}
+
+// openHTTPListener constructs the tls listener for the HTTP gateway, if an
+// HTTP port has been given. Any errors will be logged, will set the
+// exitStatus to non-zero and this will return false.
+func (prog *prog) openHTTPListener() bool {
+	if prog.httpPort == 0 {
+		return true
+	}
+
+	var err error
+
+	laddr := net.JoinHostPort("localhost", fmt.Sprintf("%d", prog.httpPort))
+
+	prog.httpListener, err = tls.Listen("tcp", laddr, prog.tlsConfig)
+	if err != nil {
+		prog.logger.Error("couldn't make the HTTP tls Listener",
+			pusu.ErrorAttr(err))
+		prog.setExitStatus(1)
+
+		return false
+	}
+
+	prog.logger.Info("listening for HTTP requests",
+		listeningPortAttr(prog.httpPort))
+
+	return true
+}
+
+// closeHTTPListener closes the listener for the HTTP gateway, if there is
+// one
+func (prog *prog) closeHTTPListener() {
+	if prog.httpListener == nil {
+		return
+	}
+
+	prog.logger.Info("closing the HTTP listener",
+		listeningPortAttr(prog.httpPort))
+
+	if err := prog.httpListener.Close(); err != nil {
+		prog.logger.Error("problem closing the HTTP listener",
+			pusu.ErrorAttr(err))
+	} else {
+		prog.logger.Info("HTTP listener closed")
+	}
+}
+
+// serveHTTP serves the HTTP gateway requests
+func (prog *prog) serveHTTP(shared *clientShared) {
+	gw := &httpGateway{
+		logger:     prog.logger,
+		shared:     shared,
+		nextConnID: prog.nextConnID,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(http.MethodPost+" "+httpTopicPath, gw.publish)
+	mux.HandleFunc(http.MethodGet+" "+httpTopicPath, gw.subscribe)
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ErrorLog: slog.NewLogLogger(
+			prog.logger.Handler(), slog.LevelError),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connCtxKey{}, c)
+		},
+	}
+
+	err := srv.Serve(prog.httpListener)
+	if !errors.Is(err, net.ErrClosed) {
+		prog.logger.Error("the HTTP gateway failed", pusu.ErrorAttr(err))
+	}
+}
+
+// httpStatus returns the HTTP status code for the error
+func httpStatus(err error) int {
+	var mbErr *http.MaxBytesError
+
+	switch {
+	case errors.Is(err, errConnLimit):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errReservedTopic):
+		return http.StatusForbidden
+	case errors.As(err, &mbErr):
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
+
+// start creates the client for the request and checks that it is allowed
+// to connect. If it is not, the reply is sent and a nil client is
+// returned. Otherwise the caller must call the returned func once the
+// request has been handled.
+func (gw *httpGateway) start(
+	w http.ResponseWriter,
+	r *http.Request,
+) (*client, func()) {
+	conn, _ := r.Context().Value(connCtxKey{}).(net.Conn)
+	cid := gw.nextConnID()
+
+	clt := &client{
+		cID:          cid,
+		conn:         conn,
+		subs:         make(map[pusu.Topic]bool),
+		sendChan:     make(chan outMsg, gw.shared.profiles.chanSize()),
+		remoteIP:     remoteIP(conn),
+		origTopic:    true,
+		gateway:      true,
+		connected:    true,
+		clientShared: gw.shared,
+	}
+
+	clt.logger = gw.logger.With(cid.Attr(), slog.Bool(cltAttrPfx+"HTTP", true))
+
+	clt.logger.Info("HTTP request received", netAddrAttr(clt.conn),
+		slog.String("method", r.Method), slog.String("path", r.URL.Path))
+
+	if err := clt.connLimits.admitConn(clt.remoteIP); err != nil {
+		clt.audit(auditEvtConnect, auditRejected, err)
+		http.Error(w, err.Error(), httpStatus(err))
+
+		return nil, nil
+	}
+
+	if err := clt.admit(); err != nil {
+		clt.connLimits.releaseConn(clt.remoteIP)
+		http.Error(w, err.Error(), httpStatus(err))
+
+		return nil, nil
+	}
+
+	release := func() {
+		clt.connLimits.releaseIdentity(clt.certID)
+		clt.connLimits.releaseConn(clt.remoteIP)
+	}
+
+	clt.identity = r.Header.Get(httpHdrClientID)
+	if clt.identity == "" {
+		clt.identity = "http-" + cid.String()
+		clt.assignedID = true
+	}
+
+	if err := clt.enterNamespace(r.PathValue("namespace")); err != nil {
+		release()
+		http.Error(w, err.Error(), http.StatusForbidden)
+
+		return nil, nil
+	}
+
+	clt.logger.Info("HTTP client start information",
+		clt.startInfoAttr(), clt.namespace.Attr())
+
+	return clt, release
+}
+
+// httpTopic returns the topic given in the request path
+func httpTopic(r *http.Request) (pusu.Topic, error) {
+	topic := pusu.Topic("/" + r.PathValue("topic"))
+
+	return topic, topic.Check()
+}
+
+// httpPubHeaders returns the publication headers given in the request
+// headers
+func httpPubHeaders(h http.Header) map[string]string {
+	var hdrs map[string]string
+
+	for k, v := range h {
+		name, ok := strings.CutPrefix(k, httpHdrPubPfx)
+		if !ok || len(v) == 0 {
+			continue
+		}
+
+		if hdrs == nil {
+			hdrs = make(map[string]string)
+		}
+
+		hdrs[strings.ToLower(name)] = v[0]
+	}
+
+	return hdrs
+}
+
+// publish handles a POST request, publishing the request body on the
+// topic. It replies once the publication has been sent to the subscribers,
+// giving the delivery counts.
+func (gw *httpGateway) publish(w http.ResponseWriter, r *http.Request) {
+	rcvd := time.Now()
+
+	clt, release := gw.start(w, r)
+	if clt == nil {
+		return
+	}
+	defer release()
+
+	pub, msg, err := clt.httpPublication(w, r)
+	if err != nil {
+		clt.logger.Error("bad HTTP publication", pusu.ErrorAttr(err))
+		http.Error(w, err.Error(), httpStatus(err))
+
+		return
+	}
+
+	clt.pubSubChan <- clientMessage{
+		clt:     clt,
+		msg:     msg,
+		pubs:    []*publication{pub},
+		confirm: true,
+		rcvd:    rcvd,
+	}
+
+	var om outMsg
+
+	select {
+	case om = <-clt.sendChan:
+	case <-r.Context().Done():
+		return
+	}
+
+	counts, status, err := publishResult(om.msg)
+	if err != nil {
+		clt.logger.Error("HTTP publication failed", pusu.ErrorAttr(err))
+		http.Error(w, err.Error(), status)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(struct {
+		Delivered int `json:"delivered"`
+		Dropped   int `json:"dropped"`
+	}{
+		Delivered: counts.delivered,
+		Dropped:   counts.dropped,
+	}); err != nil {
+		clt.logger.Error("couldn't send the HTTP response",
+			pusu.ErrorAttr(err))
+	}
+}
+
+// httpPublication reads the publication from the request and checks it as
+// for a publication from a pusu client. It returns the publication and the
+// equivalent Publish message.
+func (clt *client) httpPublication(
+	w http.ResponseWriter,
+	r *http.Request,
+) (*publication, *pusu.Message, error) {
+	topic, err := httpTopic(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, err := io.ReadAll(
+		http.MaxBytesReader(w, r.Body, pusu.MaxMessagePayload))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pmp := &pusu.PublishMsgPayload{Topic: string(topic), Payload: payload}
+
+	if hdrs := httpPubHeaders(r.Header); hdrs != nil {
+		setExtMap(pmp, extPublishHeaders, hdrs)
+	}
+
+	msg := &pusu.Message{MT: pusu.Publish, MsgID: pusu.NoMsgID}
+	if err := msg.Marshal(pmp, clt.logger); err != nil {
+		return nil, nil, err
+	}
+
+	if err := clt.applyRateLimits(msg, 1); err != nil {
+		return nil, nil, err
+	}
+
+	pub, err := clt.preparePublication(pmp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pub, msg, nil
+}
+
+// publishResult returns the delivery counts from the server's reply to a
+// confirmed publication. If the server replied with an Error, or the reply
+// cannot be understood, it returns the error and the HTTP status code to
+// report.
+func publishResult(msg pusu.Message) (deliveryCounts, int, error) {
+	switch msg.MT {
+	case pusu.Ack:
+		counts, err := ackCounts(msg.Payload)
+		if err != nil {
+			return counts, http.StatusInternalServerError, err
+		}
+
+		return counts, http.StatusOK, nil
+	case pusu.Error:
+		emp := &pusu.ErrorMsgPayload{}
+		if err := proto.Unmarshal(msg.Payload, emp); err != nil {
+			return deliveryCounts{}, http.StatusInternalServerError, err
+		}
+
+		return deliveryCounts{},
+			errorMsgStatus(emp.GetError()),
+			errors.New(emp.GetError())
+	}
+
+	return deliveryCounts{}, http.StatusInternalServerError,
+		fmt.Errorf("unexpected reply to the publication: %s", msg.MT)
+}
+
+// errorMsgStatus returns the HTTP status code for the text of an Error
+// message. An Error message carries only the text of the error so those
+// errors with their own status codes are recognised by their text.
+func errorMsgStatus(text string) int {
+	for _, err := range []error{
+		errConnLimit, errRateLimited, errReservedTopic,
+	} {
+		if strings.Contains(text, err.Error()) {
+			return httpStatus(err)
+		}
+	}
+
+	return http.StatusBadRequest
+}
+
+// ackCounts returns the delivery counts from the payload of the Ack to a
+// confirmed publication
+func ackCounts(payload []byte) (deliveryCounts, error) {
+	var counts deliveryCounts
+
+	for len(payload) > 0 {
+		n, typ, tagLen := protowire.ConsumeTag(payload)
+		if tagLen < 0 {
+			return counts, extErr(tagLen)
+		}
+
+		payload = payload[tagLen:]
+
+		valLen := protowire.ConsumeFieldValue(n, typ, payload)
+		if valLen < 0 {
+			return counts, extErr(valLen)
+		}
+
+		if typ == protowire.VarintType {
+			v, _ := protowire.ConsumeVarint(payload)
+
+			switch n {
+			case extAckDelivered:
+				counts.delivered = int(v) //nolint:gosec
+			case extAckDropped:
+				counts.dropped = int(v) //nolint:gosec
+			}
+		}
+
+		payload = payload[valLen:]
+	}
+
+	return counts, nil
+}
+
+// acceptsEventStream returns true if the request accepts server-sent events
+func acceptsEventStream(r *http.Request) bool {
+	for _, a := range r.Header.Values("Accept") {
+		if strings.Contains(a, sseContentType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// subscribe handles a GET request, subscribing to the topic and sending
+// the publications as server-sent events until the request ends.
+func (gw *httpGateway) subscribe(w http.ResponseWriter, r *http.Request) {
+	if !acceptsEventStream(r) {
+		http.Error(w, "the request must accept "+sseContentType,
+			http.StatusNotAcceptable)
+
+		return
+	}
+
+	clt, release := gw.start(w, r)
+	if clt == nil {
+		return
+	}
+	defer release()
+
+	cMsg, err := clt.httpSubscription(r)
+	if err != nil {
+		clt.logger.Error("bad HTTP subscription", pusu.ErrorAttr(err))
+		http.Error(w, err.Error(), httpStatus(err))
+
+		return
+	}
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", sseContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if err := rc.Flush(); err != nil {
+		clt.logger.Error("couldn't start the event stream",
+			pusu.ErrorAttr(err))
+
+		return
+	}
+
+	clt.pubSubChan <- clientMessage{
+		clt: clt,
+		msg: &pusu.Message{MT: pusu.Start, MsgID: pusu.NoMsgID},
+	}
+	clt.pubSubChan <- cMsg
+
+	clt.endStream(clt.streamEvents(r.Context(), w, rc))
+}
+
+// httpSubscription reads the subscription from the request and checks it
+// as for a subscription from a pusu client. It returns the message to send
+// to the server.
+func (clt *client) httpSubscription(r *http.Request) (clientMessage, error) {
+	topic, err := httpTopic(r)
+	if err != nil {
+		return clientMessage{}, err
+	}
+
+	sub := &pusu.SubscriptionMsgPayload_Sub{Topic: string(topic)}
+
+	if f := r.URL.Query().Get("filter"); f != "" {
+		setExtFields(sub, extSubFilter, [][]byte{[]byte(f)})
+	}
+
+	smp := &pusu.SubscriptionMsgPayload{
+		Subs: []*pusu.SubscriptionMsgPayload_Sub{sub},
+	}
+
+	msg := &pusu.Message{MT: pusu.Subscribe, MsgID: pusu.NoMsgID}
+	if err := msg.Marshal(smp, clt.logger); err != nil {
+		return clientMessage{}, err
+	}
+
+	if err := clt.applyRateLimits(msg, 1); err != nil {
+		return clientMessage{}, err
+	}
+
+	filters, err := parseSubFilters(smp)
+	if err != nil {
+		return clientMessage{}, err
+	}
+
+	clt.subs[topic] = true
+
+	return clientMessage{clt: clt, msg: msg, filters: filters}, nil
+}
+
+// streamEvents writes the publications sent to the client as server-sent
+// events until the request ends or the client is disconnected. It returns
+// any error writing the events.
+func (clt *client) streamEvents(
+	ctx context.Context,
+	w io.Writer,
+	rc *http.ResponseController,
+) error {
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		var err error
+
+		select {
+		case om, ok := <-clt.sendChan:
+			if !ok {
+				return nil
+			}
+
+			err = clt.writeEvent(w, om)
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+		case <-ctx.Done():
+			return nil
+		}
+
+		if err == nil {
+			err = rc.Flush()
+		}
+
+		if err != nil {
+			return err
+		}
+
+		keepAlive.Reset(sseKeepAliveInterval)
+	}
+}
+
+// endStream records why the event stream ended, notifies the server that
+// the client is disconnecting and discards any messages not yet sent.
+func (clt *client) endStream(err error) {
+	if err != nil {
+		clt.logger.Error("couldn't write the event", pusu.ErrorAttr(err))
+		clt.setCloseReason(closeReasonReadErr, err)
+	} else {
+		clt.logger.Info("client disconnected")
+		clt.setCloseReason(closeReasonEOF, nil)
+	}
+
+	clt.disconnectChan <- clt
+
+	clt.disconnect()
+
+	for om := range clt.sendChan {
+		om.discard()
+	}
+}
+
+// sseEvent is the data of the server-sent event for a publication
+type sseEvent struct {
+	Topic         string            `json:"topic"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Payload       string            `json:"payload,omitempty"`
+	PayloadBase64 []byte            `json:"payloadBase64,omitempty"`
+}
+
+// writeEvent writes the message as a server-sent event. Only publications
+// are sent; any other messages, such as Acks, are discarded.
+func (clt *client) writeEvent(w io.Writer, om outMsg) error {
+	if om.msg.MT != pusu.Publish {
+		om.discard()
+
+		return nil
+	}
+
+	pmp, err := om.publication()
+	if err != nil {
+		return err
+	}
+
+	evt := sseEvent{Topic: pmp.Topic}
+
+	if evt.Headers, err = getExtMap(pmp, extPublishHeaders); err != nil {
+		return err
+	}
+
+	if utf8.Valid(pmp.Payload) {
+		evt.Payload = string(pmp.Payload)
+	} else {
+		evt.PayloadBase64 = pmp.Payload
+	}
+
+	b, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", sseEventPub, b)
+
+	return err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestAckCounts(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		counts   *deliveryCounts
+		itemErrs []batchItemError
+	}{
+		{
+			ID: testhelper.MkID("no counts"),
+		},
+		{
+			ID:     testhelper.MkID("counts"),
+			counts: &deliveryCounts{delivered: 300, dropped: 2},
+		},
+		{
+			ID:       testhelper.MkID("counts and batch errors"),
+			counts:   &deliveryCounts{delivered: 5},
+			itemErrs: []batchItemError{{index: 1, err: errBadBatch}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ack := publishAck(pusu.NoMsgID, tc.itemErrs, tc.counts)
+
+			counts, err := ackCounts(ack.Payload)
+			if err != nil {
+				t.Fatal(tc.IDStr(), ": unexpected error:", err)
+			}
+
+			var exp deliveryCounts
+			if tc.counts != nil {
+				exp = *tc.counts
+			}
+
+			testhelper.DiffInt(t, tc.IDStr(), "delivered",
+				counts.delivered, exp.delivered)
+			testhelper.DiffInt(t, tc.IDStr(), "dropped",
+				counts.dropped, exp.dropped)
+		})
+	}
+}
+
+func TestHTTPPubHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set(httpHdrPubPfx+"Content-Type", "application/json")
+	h.Set(httpHdrPubPfx+"region", "eu")
+	h.Set("Accept", "*/*")
+	h.Set(httpHdrClientID, "ci-job")
+
+	hdrs := httpPubHeaders(h)
+
+	testhelper.DiffInt(t, "headers", "count", len(hdrs), 2)
+	testhelper.DiffString(t, "headers", "content-type",
+		hdrs["content-type"], "application/json")
+	testhelper.DiffString(t, "headers", "region", hdrs["region"], "eu")
+}
+
+func TestWriteEvent(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		pmp    *pusu.PublishMsgPayload
+		hdrs   map[string]string
+		expOut string
+	}{
+		{
+			ID: testhelper.MkID("text payload"),
+			pmp: &pusu.PublishMsgPayload{
+				Topic:   "/fx/eur",
+				Payload: []byte("1.08"),
+			},
+			hdrs: map[string]string{"source": "ecb"},
+			expOut: "event: publication\n" +
+				`data: {"topic":"/fx/eur","headers":{"source":"ecb"},` +
+				`"payload":"1.08"}` + "\n\n",
+		},
+		{
+			ID: testhelper.MkID("binary payload"),
+			pmp: &pusu.PublishMsgPayload{
+				Topic:   "/bin",
+				Payload: []byte{0xff, 0x00},
+			},
+			expOut: "event: publication\n" +
+				`data: {"topic":"/bin","payloadBase64":"/wA="}` + "\n\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			if tc.hdrs != nil {
+				setExtMap(tc.pmp, extPublishHeaders, tc.hdrs)
+			}
+
+			msg := pusu.Message{MT: pusu.Publish, MsgID: pusu.NoMsgID}
+			if err := msg.Marshal(tc.pmp, nil); err != nil {
+				t.Fatal("cannot marshal the publication:", err)
+			}
+
+			var buf bytes.Buffer
+
+			clt := &client{}
+
+			if err := clt.writeEvent(&buf, outMsg{msg: msg}); err != nil {
+				t.Fatal(tc.IDStr(), ": unexpected error:", err)
+			}
+
+			testhelper.DiffString(t, tc.IDStr(), "event",
+				buf.String(), tc.expOut)
+		})
+	}
+}
+
+func TestPublishResult(t *testing.T) {
+	errMsg := func(err error) pusu.Message {
+		msg := pusu.Message{MT: pusu.Error}
+		_ = (&msg).Marshal(&pusu.ErrorMsgPayload{Error: err.Error()},
+			testLogger)
+
+		return msg
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		msg       pusu.Message
+		expStatus int
+		expCounts deliveryCounts
+	}{
+		{
+			ID: testhelper.MkID("ack"),
+			msg: publishAck(pusu.NoMsgID, nil,
+				&deliveryCounts{delivered: 3, dropped: 1}),
+			expStatus: http.StatusOK,
+			expCounts: deliveryCounts{delivered: 3, dropped: 1},
+		},
+		{
+			ID:        testhelper.MkID("error: rate limited"),
+			ExpErr:    testhelper.MkExpErr("rate limit exceeded (client)"),
+			msg:       errMsg(fmt.Errorf("%w (client)", errRateLimited)),
+			expStatus: http.StatusTooManyRequests,
+		},
+		{
+			ID:        testhelper.MkID("error: reserved topic"),
+			ExpErr:    testhelper.MkExpErr("reserved topic"),
+			msg:       errMsg(fmt.Errorf("%w: /$sys", errReservedTopic)),
+			expStatus: http.StatusForbidden,
+		},
+		{
+			ID:        testhelper.MkID("error: other"),
+			ExpErr:    testhelper.MkExpErr("bad payload"),
+			msg:       errMsg(errors.New("bad payload")),
+			expStatus: http.StatusBadRequest,
+		},
+		{
+			ID: testhelper.MkID("unexpected reply"),
+			ExpErr: testhelper.MkExpErr(
+				"unexpected reply to the publication"),
+			msg:       pusu.Message{MT: pusu.Publish},
+			expStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			counts, status, err := publishResult(tc.msg)
+			testhelper.CheckExpErr(t, err, tc)
+			testhelper.DiffInt(t, tc.IDStr(), "status", status, tc.expStatus)
+			testhelper.DiffInt(t, tc.IDStr(), "delivered",
+				counts.delivered, tc.expCounts.delivered)
+			testhelper.DiffInt(t, tc.IDStr(), "dropped",
+				counts.dropped, tc.expCounts.dropped)
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"unicode/utf8"
+)
+
+// errSchemaMismatch is the error returned when a payload does not match the
+// schema for its topic
+var errSchemaMismatch = errors.New("the payload does not match the schema")
+
+// jsonSchema is a compiled JSON Schema. Only a subset of the JSON Schema
+// keywords is supported: type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, minLength, maxLength,
+// pattern, minimum, maximum, exclusiveMinimum and exclusiveMaximum. Any
+// other keywords are ignored.
+type jsonSchema struct {
+	types []string
+
+	enum     []any
+	constVal any
+	hasConst bool
+
+	properties           map[string]*jsonSchema
+	required             []string
+	additionalProperties *bool
+
+	items    *jsonSchema
+	minItems *int
+	maxItems *int
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+}
+
+// jsonSchemaSrc is the form in which a JSON Schema is read
+type jsonSchemaSrc struct {
+	Type                 json.RawMessage          `json:"type"`
+	Enum                 []any                    `json:"enum"`
+	Const                json.RawMessage          `json:"const"`
+	Properties           map[string]jsonSchemaSrc `json:"properties"`
+	Required             []string                 `json:"required"`
+	AdditionalProperties *bool                    `json:"additionalProperties"`
+	Items                *jsonSchemaSrc           `json:"items"`
+	MinItems             *int                     `json:"minItems"`
+	MaxItems             *int                     `json:"maxItems"`
+	MinLength            *int                     `json:"minLength"`
+	MaxLength            *int                     `json:"maxLength"`
+	Pattern              *string                  `json:"pattern"`
+	Minimum              *float64                 `json:"minimum"`
+	Maximum              *float64                 `json:"maximum"`
+	ExclusiveMinimum     *float64                 `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64                 `json:"exclusiveMaximum"`
+}
+
+// parseJSONSchema parses the JSON Schema
+func parseJSONSchema(b []byte) (*jsonSchema, error) {
+	var src jsonSchemaSrc
+
+	if err := json.Unmarshal(b, &src); err != nil {
+		return nil, fmt.Errorf("bad JSON Schema: %w", err)
+	}
+
+	return src.compile()
+}
+
+// compile converts the source form of the schema into the compiled form
+func (src jsonSchemaSrc) compile() (*jsonSchema, error) {
+	s := &jsonSchema{
+		enum:                 src.Enum,
+		required:             src.Required,
+		additionalProperties: src.AdditionalProperties,
+		minItems:             src.MinItems,
+		maxItems:             src.MaxItems,
+		minLength:            src.MinLength,
+		maxLength:            src.MaxLength,
+		minimum:              src.Minimum,
+		maximum:              src.Maximum,
+		exclusiveMinimum:     src.ExclusiveMinimum,
+		exclusiveMaximum:     src.ExclusiveMaximum,
+	}
+
+	if len(src.Type) > 0 {
+		var t string
+		if err := json.Unmarshal(src.Type, &t); err == nil {
+			s.types = []string{t}
+		} else if err := json.Unmarshal(src.Type, &s.types); err != nil {
+			return nil, fmt.Errorf("bad JSON Schema type: %s", src.Type)
+		}
+	}
+
+	if len(src.Const) > 0 {
+		if err := json.Unmarshal(src.Const, &s.constVal); err != nil {
+			return nil, fmt.Errorf("bad JSON Schema const: %w", err)
+		}
+
+		s.hasConst = true
+	}
+
+	if src.Pattern != nil {
+		re, err := regexp.Compile(*src.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad JSON Schema pattern: %w", err)
+		}
+
+		s.pattern = re
+	}
+
+	if len(src.Properties) > 0 {
+		s.properties = make(map[string]*jsonSchema, len(src.Properties))
+
+		for name, pSrc := range src.Properties {
+			ps, err := pSrc.compile()
+			if err != nil {
+				return nil, fmt.Errorf("property %q: %w", name, err)
+			}
+
+			s.properties[name] = ps
+		}
+	}
+
+	if src.Items != nil {
+		is, err := src.Items.compile()
+		if err != nil {
+			return nil, fmt.Errorf("items: %w", err)
+		}
+
+		s.items = is
+	}
+
+	return s, nil
+}
+
+// validateJSON checks that the payload is a JSON value matching the
+// schema. It returns a non-nil error describing the first mismatch found.
+func (s *jsonSchema) validateJSON(payload []byte) error {
+	var v any
+
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("%w: not valid JSON: %w", errSchemaMismatch, err)
+	}
+
+	if dec.More() {
+		return fmt.Errorf("%w: not a single JSON value", errSchemaMismatch)
+	}
+
+	return s.validate(normaliseJSON(v), "$")
+}
+
+// normaliseJSON converts any json.Number values into float64 values
+func normaliseJSON(v any) any {
+	switch val := v.(type) {
+	case json.Number:
+		f, _ := val.Float64()
+		return f
+	case map[string]any:
+		for k, mv := range val {
+			val[k] = normaliseJSON(mv)
+		}
+	case []any:
+		for i, av := range val {
+			val[i] = normaliseJSON(av)
+		}
+	}
+
+	return v
+}
+
+// jsonType returns the JSON Schema type name of the value
+func jsonType(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+
+	return "unknown"
+}
+
+// mismatch returns an error describing a schema mismatch at the location
+func mismatch(loc, format string, args ...any) error {
+	return fmt.Errorf("%w: %s: %s",
+		errSchemaMismatch, loc, fmt.Sprintf(format, args...))
+}
+
+// validate checks the value against the schema
+func (s *jsonSchema) validate(v any, loc string) error {
+	if err := s.validateGeneric(v, loc); err != nil {
+		return err
+	}
+
+	switch val := v.(type) {
+	case string:
+		return s.validateString(val, loc)
+	case float64:
+		return s.validateNumber(val, loc)
+	case []any:
+		return s.validateArray(val, loc)
+	case map[string]any:
+		return s.validateObject(val, loc)
+	}
+
+	return nil
+}
+
+// validateGeneric applies the checks that apply to values of any type
+func (s *jsonSchema) validateGeneric(v any, loc string) error {
+	if len(s.types) > 0 {
+		t := jsonType(v)
+		if !slices.Contains(s.types, t) &&
+			(t != "integer" || !slices.Contains(s.types, "number")) {
+			return mismatch(loc, "the type is %s, expected %v", t, s.types)
+		}
+	}
+
+	if s.hasConst && !reflect.DeepEqual(v, s.constVal) {
+		return mismatch(loc, "the value must be %v", s.constVal)
+	}
+
+	if len(s.enum) > 0 &&
+		!slices.ContainsFunc(s.enum, func(e any) bool {
+			return reflect.DeepEqual(v, e)
+		}) {
+		return mismatch(loc, "the value must be one of %v", s.enum)
+	}
+
+	return nil
+}
+
+// validateString applies the string-specific checks
+func (s *jsonSchema) validateString(v, loc string) error {
+	l := utf8.RuneCountInString(v)
+
+	if s.minLength != nil && l < *s.minLength {
+		return mismatch(loc, "too short (min length: %d)", *s.minLength)
+	}
+
+	if s.maxLength != nil && l > *s.maxLength {
+		return mismatch(loc, "too long (max length: %d)", *s.maxLength)
+	}
+
+	if s.pattern != nil && !s.pattern.MatchString(v) {
+		return mismatch(loc, "does not match the pattern %q", s.pattern)
+	}
+
+	return nil
+}
+
+// validateNumber applies the number-specific checks
+func (s *jsonSchema) validateNumber(v float64, loc string) error {
+	if s.minimum != nil && v < *s.minimum {
+		return mismatch(loc, "less than the minimum: %g", *s.minimum)
+	}
+
+	if s.maximum != nil && v > *s.maximum {
+		return mismatch(loc, "greater than the maximum: %g", *s.maximum)
+	}
+
+	if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+		return mismatch(loc, "not greater than %g", *s.exclusiveMinimum)
+	}
+
+	if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+		return mismatch(loc, "not less than %g", *s.exclusiveMaximum)
+	}
+
+	return nil
+}
+
+// validateArray applies the array-specific checks
+func (s *jsonSchema) validateArray(v []any, loc string) error {
+	if s.minItems != nil && len(v) < *s.minItems {
+		return mismatch(loc, "too few items (min: %d)", *s.minItems)
+	}
+
+	if s.maxItems != nil && len(v) > *s.maxItems {
+		return mismatch(loc, "too many items (max: %d)", *s.maxItems)
+	}
+
+	if s.items != nil {
+		for i, item := range v {
+			if err := s.items.validate(item,
+				fmt.Sprintf("%s[%d]", loc, i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateObject applies the object-specific checks
+func (s *jsonSchema) validateObject(v map[string]any, loc string) error {
+	for _, name := range s.required {
+		if _, ok := v[name]; !ok {
+			return mismatch(loc, "the required property %q is missing", name)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(v)) {
+		ps, ok := s.properties[name]
+		if !ok {
+			if s.additionalProperties != nil && !*s.additionalProperties {
+				return mismatch(loc, "the property %q is not allowed", name)
+			}
+
+			continue
+		}
+
+		if err := ps.validate(v[name], loc+"."+name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
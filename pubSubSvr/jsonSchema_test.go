@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestJSONSchema(t *testing.T) {
+	const schemaSrc = `{
+	"type": "object",
+	"required": ["id", "level"],
+	"additionalProperties": false,
+	"properties": {
+		"id":    {"type": "string", "pattern": "^[a-z]+-[0-9]+$"},
+		"level": {"type": "integer", "minimum": 0, "maximum": 9},
+		"kind":  {"enum": ["alert", "info"]},
+		"tags":  {"type": "array", "maxItems": 2, "items": {"type": "string"}}
+	}
+}`
+
+	s, err := parseJSONSchema([]byte(schemaSrc))
+	if err != nil {
+		t.Fatal("cannot parse the schema:", err)
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		payload string
+	}{
+		{
+			ID:      testhelper.MkID("good: minimal"),
+			payload: `{"id": "abc-1", "level": 3}`,
+		},
+		{
+			ID:      testhelper.MkID("good: all properties"),
+			payload: `{"id": "abc-1", "level": 0, "kind": "info", "tags": ["x"]}`,
+		},
+		{
+			ID:      testhelper.MkID("bad: not JSON"),
+			ExpErr:  testhelper.MkExpErr("does not match", "not valid JSON"),
+			payload: `{"id": `,
+		},
+		{
+			ID:      testhelper.MkID("bad: wrong type"),
+			ExpErr:  testhelper.MkExpErr("$: the type is array"),
+			payload: `[1, 2]`,
+		},
+		{
+			ID:      testhelper.MkID("bad: missing required"),
+			ExpErr:  testhelper.MkExpErr(`required property "level"`),
+			payload: `{"id": "abc-1"}`,
+		},
+		{
+			ID:      testhelper.MkID("bad: extra property"),
+			ExpErr:  testhelper.MkExpErr(`property "x" is not allowed`),
+			payload: `{"id": "abc-1", "level": 3, "x": 1}`,
+		},
+		{
+			ID:      testhelper.MkID("bad: not an integer"),
+			ExpErr:  testhelper.MkExpErr("$.level", "the type is number"),
+			payload: `{"id": "abc-1", "level": 3.5}`,
+		},
+		{
+			ID:      testhelper.MkID("bad: above maximum"),
+			ExpErr:  testhelper.MkExpErr("$.level", "greater than the maximum"),
+			payload: `{"id": "abc-1", "level": 10}`,
+		},
+		{
+			ID:      testhelper.MkID("bad: pattern"),
+			ExpErr:  testhelper.MkExpErr("$.id", "does not match the pattern"),
+			payload: `{"id": "ABC", "level": 3}`,
+		},
+		{
+			ID:      testhelper.MkID("bad: enum"),
+			ExpErr:  testhelper.MkExpErr("$.kind", "must be one of"),
+			payload: `{"id": "abc-1", "level": 3, "kind": "debug"}`,
+		},
+		{
+			ID:      testhelper.MkID("bad: array item"),
+			ExpErr:  testhelper.MkExpErr("$.tags[1]", "the type is integer"),
+			payload: `{"id": "abc-1", "level": 3, "tags": ["x", 1]}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := s.validateJSON([]byte(tc.payload))
+			testhelper.CheckExpErr(t, err, tc)
+		})
+	}
+}
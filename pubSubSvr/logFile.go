@@ -0,0 +1,296 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFileTimeFmt is the format of the timestamp added to the name of a
+// rotated log file. It sorts in time order. If a rotated file with that
+// timestamp already exists a sequence number is added after the timestamp,
+// as in "name.20060102-150405.000-1.log".
+const logFileTimeFmt = "20060102-150405.000"
+
+// rotatingFile is an io.Writer which writes to a file in a directory,
+// rotating the file when it grows too large or too old and removing the
+// oldest rotated files so that no more than a fixed number are retained.
+type rotatingFile struct {
+	sync.Mutex
+
+	dir      string
+	baseName string
+
+	maxSize int64         // rotate once the file would exceed this size
+	maxAge  time.Duration // rotate once the file is older than this
+	keep    int           // the number of rotated files to retain
+
+	f      *os.File
+	size   int64
+	opened time.Time // when the file was opened or, if appended to, written
+}
+
+// newRotatingFile creates the log directory if necessary and opens the log
+// file, appending to any existing file.
+func newRotatingFile(
+	dir, baseName string,
+	maxSize int64,
+	maxAge time.Duration,
+	keep int,
+) (*rotatingFile, error) {
+	const dirPerms = 0o700
+
+	if err := os.MkdirAll(dir, dirPerms); err != nil {
+		return nil, fmt.Errorf("cannot create the log directory: %w", err)
+	}
+
+	rf := &rotatingFile{
+		dir:      dir,
+		baseName: baseName,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		keep:     keep,
+	}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+// name returns the pathname of the current log file
+func (rf *rotatingFile) name() string {
+	return filepath.Join(rf.dir, rf.baseName+".log")
+}
+
+// open opens the current log file for appending. If the file already
+// holds some logs its age is taken from when it was last changed, so that
+// restarting the program does not stop an old file from being rotated.
+func (rf *rotatingFile) open() error {
+	const filePerms = 0o600
+
+	f, err := os.OpenFile(rf.name(),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, filePerms)
+	if err != nil {
+		return fmt.Errorf("cannot open the log file: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+
+		return fmt.Errorf("cannot stat the log file: %w", err)
+	}
+
+	rf.f = f
+	rf.size = info.Size()
+	rf.opened = time.Now()
+
+	if rf.size > 0 {
+		// the file was already in use so its age is taken from when it
+		// was last written rather than from now
+		rf.opened = info.ModTime()
+	}
+
+	return nil
+}
+
+// needsRotation returns true if writing n more bytes to the file would
+// break the size or age limits.
+func (rf *rotatingFile) needsRotation(n int) bool {
+	if rf.size == 0 {
+		return false
+	}
+
+	if rf.maxSize > 0 && rf.size+int64(n) > rf.maxSize {
+		return true
+	}
+
+	if rf.maxAge > 0 && time.Since(rf.opened) > rf.maxAge {
+		return true
+	}
+
+	return false
+}
+
+// rotate closes the current log file, renames it with a timestamp and opens
+// a new one. It then removes any rotated files beyond the number to keep. If
+// no log file could be opened the file will be nil on return.
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		rf.f = nil
+
+		return fmt.Errorf("cannot close the log file: %w", err)
+	}
+
+	rotatedName, err := rf.rotatedName(time.Now())
+	if err == nil {
+		if renameErr := os.Rename(rf.name(), rotatedName); renameErr != nil {
+			err = fmt.Errorf("cannot rename the log file: %w", renameErr)
+		}
+	}
+
+	if err != nil {
+		if openErr := rf.open(); openErr != nil {
+			rf.f = nil
+		}
+
+		return err
+	}
+
+	if err := rf.open(); err != nil {
+		rf.f = nil
+
+		return err
+	}
+
+	return rf.prune()
+}
+
+// rotatedName returns the pathname to give the current log file when it is
+// rotated at the given time. If any file already rotated has the same
+// timestamp a sequence number is added, one more than the largest already
+// used, so that no file is overwritten and the order of rotation is kept.
+func (rf *rotatingFile) rotatedName(now time.Time) (string, error) {
+	stamp := now.Format(logFileTimeFmt)
+
+	entries, err := os.ReadDir(rf.dir)
+	if err != nil {
+		return "", fmt.Errorf("cannot read the log directory: %w", err)
+	}
+
+	seq := -1
+
+	for _, e := range entries {
+		if rot, ok := rf.parseRotated(e.Name()); ok && rot.stamp == stamp {
+			seq = max(seq, rot.seq)
+		}
+	}
+
+	name := rf.baseName + "." + stamp
+	if seq >= 0 {
+		name += "-" + strconv.Itoa(seq+1)
+	}
+
+	return filepath.Join(rf.dir, name+".log"), nil
+}
+
+// rotatedFile records the name of a rotated log file and the parts of the
+// name giving its place in the order of rotation
+type rotatedFile struct {
+	name  string
+	stamp string
+	seq   int
+}
+
+// parseRotated reports whether the file name is that of a file rotated from
+// this log file and, if so, returns the details from the name. Only names
+// exactly matching those given by rotatedName are accepted so that other
+// files in the log directory are never mistaken for rotated log files.
+func (rf *rotatingFile) parseRotated(name string) (rotatedFile, bool) {
+	rot := rotatedFile{name: name}
+
+	rest, ok := strings.CutPrefix(name, rf.baseName+".")
+	if !ok {
+		return rot, false
+	}
+
+	rest, ok = strings.CutSuffix(rest, ".log")
+	if !ok || len(rest) < len(logFileTimeFmt) {
+		return rot, false
+	}
+
+	rot.stamp, rest = rest[:len(logFileTimeFmt)], rest[len(logFileTimeFmt):]
+	if _, err := time.Parse(logFileTimeFmt, rot.stamp); err != nil {
+		return rot, false
+	}
+
+	if rest == "" {
+		return rot, true
+	}
+
+	seqStr, ok := strings.CutPrefix(rest, "-")
+	if !ok {
+		return rot, false
+	}
+
+	seq, err := strconv.Atoi(seqStr)
+	if err != nil || seq <= 0 || strconv.Itoa(seq) != seqStr {
+		return rot, false
+	}
+
+	rot.seq = seq
+
+	return rot, true
+}
+
+// prune removes the oldest rotated log files leaving at most rf.keep of
+// them. If rf.keep is zero then all the rotated files are retained.
+func (rf *rotatingFile) prune() error {
+	if rf.keep <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(rf.dir)
+	if err != nil {
+		return fmt.Errorf("cannot read the log directory: %w", err)
+	}
+
+	var rotated []rotatedFile
+
+	for _, e := range entries {
+		if rot, ok := rf.parseRotated(e.Name()); ok && e.Type().IsRegular() {
+			rotated = append(rotated, rot)
+		}
+	}
+
+	if len(rotated) <= rf.keep {
+		return nil
+	}
+
+	slices.SortFunc(rotated, func(a, b rotatedFile) int {
+		return cmp.Or(
+			strings.Compare(a.stamp, b.stamp),
+			cmp.Compare(a.seq, b.seq))
+	})
+
+	for _, rot := range rotated[:len(rotated)-rf.keep] {
+		if err := os.Remove(filepath.Join(rf.dir, rot.name)); err != nil {
+			return fmt.Errorf("cannot remove the old log file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Write writes the bytes to the current log file, rotating it first if
+// necessary. If the rotation fails the error is reported on stderr and the
+// bytes are written to whichever file could be opened.
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	rf.Lock()
+	defer rf.Unlock()
+
+	if rf.needsRotation(len(b)) {
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "log file rotation failed:", err)
+		}
+	}
+
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+
+	return n, err
+}
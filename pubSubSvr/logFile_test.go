@@ -0,0 +1,296 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestNeedsRotation(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		size    int64
+		maxSize int64
+		maxAge  time.Duration
+		age     time.Duration
+		n       int
+		expRot  bool
+	}{
+		{
+			ID:      testhelper.MkID("empty file"),
+			maxSize: 10,
+			maxAge:  time.Minute,
+			age:     time.Hour,
+			n:       100,
+		},
+		{
+			ID:      testhelper.MkID("within the limits"),
+			size:    5,
+			maxSize: 10,
+			maxAge:  time.Minute,
+			n:       5,
+		},
+		{
+			ID:      testhelper.MkID("too big"),
+			size:    5,
+			maxSize: 10,
+			n:       6,
+			expRot:  true,
+		},
+		{
+			ID:     testhelper.MkID("too old"),
+			size:   5,
+			maxAge: time.Minute,
+			age:    time.Hour,
+			n:      1,
+			expRot: true,
+		},
+		{
+			ID:   testhelper.MkID("no limits"),
+			size: 5,
+			age:  time.Hour,
+			n:    1000,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			rf := &rotatingFile{
+				maxSize: tc.maxSize,
+				maxAge:  tc.maxAge,
+				size:    tc.size,
+				opened:  time.Now().Add(-tc.age),
+			}
+
+			testhelper.DiffBool(t, tc.IDStr(), "needs rotation",
+				rf.needsRotation(tc.n), tc.expRot)
+		})
+	}
+}
+
+func TestParseRotated(t *testing.T) {
+	rf := &rotatingFile{baseName: "pubSubSvr"}
+
+	testCases := []struct {
+		testhelper.ID
+		name     string
+		expOK    bool
+		expStamp string
+		expSeq   int
+	}{
+		{
+			ID:       testhelper.MkID("rotated"),
+			name:     "pubSubSvr.20240102-030405.678.log",
+			expOK:    true,
+			expStamp: "20240102-030405.678",
+		},
+		{
+			ID:       testhelper.MkID("rotated, with a sequence number"),
+			name:     "pubSubSvr.20240102-030405.678-2.log",
+			expOK:    true,
+			expStamp: "20240102-030405.678",
+			expSeq:   2,
+		},
+		{
+			ID:   testhelper.MkID("the current log file"),
+			name: "pubSubSvr.log",
+		},
+		{
+			ID:   testhelper.MkID("another file"),
+			name: "pubSubSvr.old.log",
+		},
+		{
+			ID:   testhelper.MkID("another program's file"),
+			name: "other.20240102-030405.678.log",
+		},
+		{
+			ID:   testhelper.MkID("bad timestamp"),
+			name: "pubSubSvr.20241302-030405.678.log",
+		},
+		{
+			ID:   testhelper.MkID("bad sequence number"),
+			name: "pubSubSvr.20240102-030405.678-02.log",
+		},
+		{
+			ID:   testhelper.MkID("extra text"),
+			name: "pubSubSvr.20240102-030405.678.bak.log",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			rot, ok := rf.parseRotated(tc.name)
+			testhelper.DiffBool(t, tc.IDStr(), "ok", ok, tc.expOK)
+
+			if ok {
+				testhelper.DiffString(t, tc.IDStr(), "stamp",
+					rot.stamp, tc.expStamp)
+				testhelper.DiffInt(t, tc.IDStr(), "seq", rot.seq, tc.expSeq)
+			}
+		})
+	}
+}
+
+func TestRotate(t *testing.T) {
+	const keep = 2
+
+	dir := t.TempDir()
+	others := []string{"pubSubSvr.old.log", "pubSubSvr.20240102.log"}
+
+	for _, name := range others {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0o600)
+		if err != nil {
+			t.Fatal("cannot create the file:", err)
+		}
+	}
+
+	rf, err := newRotatingFile(dir, "pubSubSvr", 0, 0, keep)
+	if err != nil {
+		t.Fatal("cannot open the log file:", err)
+	}
+
+	t.Cleanup(func() { _ = rf.f.Close() })
+
+	const rotations = 4
+
+	for i := range rotations {
+		if _, err := rf.Write([]byte{'0' + byte(i)}); err != nil {
+			t.Fatal("cannot write to the log file:", err)
+		}
+
+		if err := rf.rotate(); err != nil {
+			t.Fatal("cannot rotate the log file:", err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal("cannot read the log directory:", err)
+	}
+
+	var rotated []rotatedFile
+
+	for _, e := range entries {
+		name := e.Name()
+		if slices.Contains(others, name) || name == "pubSubSvr.log" {
+			continue
+		}
+
+		rot, ok := rf.parseRotated(name)
+		if !ok {
+			t.Error("unexpected file in the log directory:", name)
+			continue
+		}
+
+		rotated = append(rotated, rot)
+	}
+
+	testhelper.DiffInt(t, "rotated", "files", len(rotated), keep)
+
+	for _, name := range others {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error("a file which is not a rotated log was removed:", name)
+		}
+	}
+
+	var contents []string
+
+	for _, rot := range rotated {
+		b, err := os.ReadFile(filepath.Join(dir, rot.name))
+		if err != nil {
+			t.Fatal("cannot read the rotated file:", err)
+		}
+
+		contents = append(contents, string(b))
+	}
+
+	slices.Sort(contents)
+	testhelper.DiffStringSlice(t, "rotated", "contents",
+		contents, []string{"2", "3"})
+}
+
+func TestRotatedName(t *testing.T) {
+	dir := t.TempDir()
+	rf := &rotatingFile{dir: dir, baseName: "pubSubSvr"}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 678e6, time.UTC)
+
+	var names []string
+
+	for range 3 {
+		name, err := rf.rotatedName(now)
+		if err != nil {
+			t.Fatal("cannot make the rotated name:", err)
+		}
+
+		if err := os.WriteFile(name, nil, 0o600); err != nil {
+			t.Fatal("cannot create the file:", err)
+		}
+
+		names = append(names, filepath.Base(name))
+	}
+
+	testhelper.DiffStringSlice(t, "same time", "names", names, []string{
+		"pubSubSvr.20240102-030405.678.log",
+		"pubSubSvr.20240102-030405.678-1.log",
+		"pubSubSvr.20240102-030405.678-2.log",
+	})
+}
+
+func TestOpenExisting(t *testing.T) {
+	const maxAge = 24 * time.Hour
+
+	testCases := []struct {
+		testhelper.ID
+		contents    string
+		age         time.Duration
+		expRotation bool
+	}{
+		{
+			ID:          testhelper.MkID("old file"),
+			contents:    "old logs\n",
+			age:         2 * maxAge,
+			expRotation: true,
+		},
+		{
+			ID:       testhelper.MkID("recent file"),
+			contents: "recent logs\n",
+			age:      maxAge / 2,
+		},
+		{
+			ID:  testhelper.MkID("old but empty file"),
+			age: 2 * maxAge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := filepath.Join(dir, "pubSubSvr.log")
+
+			err := os.WriteFile(name, []byte(tc.contents), 0o600)
+			if err != nil {
+				t.Fatal("cannot create the log file:", err)
+			}
+
+			modTime := time.Now().Add(-tc.age)
+			if err := os.Chtimes(name, modTime, modTime); err != nil {
+				t.Fatal("cannot set the file times:", err)
+			}
+
+			rf, err := newRotatingFile(dir, "pubSubSvr", 0, maxAge, 1)
+			if err != nil {
+				t.Fatal("cannot open the log file:", err)
+			}
+
+			t.Cleanup(func() { _ = rf.f.Close() })
+
+			rf.size = max(rf.size, 1) // so that an empty file can rotate
+			testhelper.DiffBool(t, tc.IDStr(), "needs rotation",
+				rf.needsRotation(1), tc.expRotation)
+		})
+	}
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// noteTextMQTT describes how MQTT clients are supported
+const noteTextMQTT = "If an MQTT port is given the server also accepts" +
+	" connections from MQTT 3.1.1 clients on that port. The connection" +
+	" must use mutual TLS, as for pusu clients. MQTT clients and pusu" +
+	" clients share the same namespaces and topics." +
+	"\n\n" +
+	"The namespace of an MQTT client is taken from the user name in its" +
+	" CONNECT packet or, if no user name is given, from the identity in" +
+	" its client certificate; any password is ignored. The client" +
+	" identifier is used as the identity of the client." +
+	"\n\n" +
+	"The levels of an MQTT topic name become the parts of the pusu topic" +
+	" so the MQTT topic 'a/b' is the pusu topic '/a/b'. MQTT topic names" +
+	" which would not give a valid pusu topic, such as those starting" +
+	" with '/' or having empty levels, are rejected. An MQTT topic" +
+	" filter with wildcards ('+' or '#') subscribes to the topic given" +
+	" by the levels before the first wildcard and only those" +
+	" publications whose topic matches the filter are sent on to the" +
+	" client. A topic filter which cannot be mapped is rejected in the" +
+	" SUBACK. Publications are sent to MQTT clients with the topic on" +
+	" which they were published and any headers are dropped." +
+	"\n\n" +
+	"Publications from MQTT clients may use QoS 0, 1 or 2; they are" +
+	" acknowledged once they have been handed on for publication." +
+	" Subscriptions are always granted QoS 0. The retain flag is" +
+	" ignored and sessions are not kept after the client disconnects." +
+	" A will given in the CONNECT packet is treated as a last-will" +
+	" publication and is published if the client disconnects without" +
+	" first sending a DISCONNECT packet, or fails to send a packet" +
+	" within one and a half times its keep-alive interval."
+
+// mqttConnectTimeout is how long a new MQTT client has to send its CONNECT
+// packet
+const mqttConnectTimeout = 30 * time.Second
+
+// mqttSession records the MQTT topic filters a client has subscribed to.
+// Each filter maps to the pusu topic subscribed to on its behalf and the
+// number of filters using each pusu topic is kept so that the client can
+// be unsubscribed from the topic once no filters need it. It is shared
+// between the reader and the writer of the client.
+type mqttSession struct {
+	sync.Mutex
+
+	keepAlive time.Duration
+
+	filters map[string]pusu.Topic
+	bases   map[pusu.Topic]int
+}
+
+// newMQTTSession returns a new MQTT session with no subscriptions
+func newMQTTSession() *mqttSession {
+	return &mqttSession{
+		filters: make(map[string]pusu.Topic),
+		bases:   make(map[pusu.Topic]int),
+	}
+}
+
+// subscribe records the topic filter and the pusu topic subscribed to on
+// its behalf. It returns true if the client is not yet subscribed to the
+// topic.
+func (s *mqttSession) subscribe(filter string, base pusu.Topic) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.filters[filter]; ok {
+		return false
+	}
+
+	s.filters[filter] = base
+	s.bases[base]++
+
+	return s.bases[base] == 1
+}
+
+// unsubscribe removes the topic filter. It returns the pusu topic
+// subscribed to on its behalf and true if no other filter needs it.
+func (s *mqttSession) unsubscribe(filter string) (pusu.Topic, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	base, ok := s.filters[filter]
+	if !ok {
+		return "", false
+	}
+
+	delete(s.filters, filter)
+
+	s.bases[base]--
+	if s.bases[base] > 0 {
+		return base, false
+	}
+
+	delete(s.bases, base)
+
+	return base, true
+}
+
+// hasFilter returns true if the client has subscribed to the topic filter
+func (s *mqttSession) hasFilter(filter string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.filters[filter]
+
+	return ok
+}
+
+// matches returns true if the topic name matches any of the topic filters
+func (s *mqttSession) matches(name string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for filter := range s.filters {
+		if mqttMatch(filter, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// openMQTTListener constructs the tls listener for MQTT clients, if an MQTT
+// port has been given. Any errors will be logged, will set the exitStatus
+// to non-zero and this will return false.
+func (prog *prog) openMQTTListener() bool {
+	if prog.mqttPort == 0 {
+		return true
+	}
+
+	var err error
+
+	laddr := net.JoinHostPort("localhost", fmt.Sprintf("%d", prog.mqttPort))
+
+	prog.mqttListener, err = tls.Listen("tcp", laddr, prog.tlsConfig)
+	if err != nil {
+		prog.logger.Error("couldn't make the MQTT tls Listener",
+			pusu.ErrorAttr(err))
+		prog.setExitStatus(1)
+
+		return false
+	}
+
+	prog.logger.Info("listening for MQTT clients",
+		listeningPortAttr(prog.mqttPort))
+
+	return true
+}
+
+// closeMQTTListener closes the listener for MQTT clients, if there is one
+func (prog *prog) closeMQTTListener() {
+	if prog.mqttListener == nil {
+		return
+	}
+
+	prog.logger.Info("closing the MQTT listener",
+		listeningPortAttr(prog.mqttPort))
+
+	if err := prog.mqttListener.Close(); err != nil {
+		prog.logger.Error("problem closing the MQTT listener",
+			pusu.ErrorAttr(err))
+	} else {
+		prog.logger.Info("MQTT listener closed")
+	}
+}
+
+// acceptMQTT accepts connections from MQTT clients
+func (prog *prog) acceptMQTT(shared *clientShared) {
+	for {
+		conn, err := prog.mqttListener.Accept()
+		if err != nil {
+			prog.logger.Error("couldn't Accept the MQTT client connection",
+				pusu.ErrorAttr(err))
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			continue
+		}
+
+		if err := prog.connLimits.admitConn(remoteIP(conn)); err != nil {
+			go rejectMQTTConn(prog.logger, prog.auditLog, conn, err)
+
+			continue
+		}
+
+		startMQTTClient(prog.logger, prog.nextConnID(), conn, shared)
+	}
+}
+
+// rejectMQTTConn refuses the MQTT connection, replying to the CONNECT
+// packet with a CONNACK saying that the server is unavailable, and closes
+// it.
+func rejectMQTTConn(
+	logger *slog.Logger,
+	al *auditLog,
+	conn net.Conn,
+	reason error,
+) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	logger.Error("MQTT connection rejected",
+		netAddrAttr(conn), pusu.ErrorAttr(reason))
+
+	if err := conn.SetDeadline(time.Now().Add(rejectTimeout)); err != nil {
+		return
+	}
+
+	_, _ = readMQTTPacket(bufio.NewReader(conn))
+
+	al.recordConn(conn, auditEvtConnect, auditRejected, reason)
+
+	if _, err := conn.Write(mqttConnAckPacket(mqttConnUnavailable)); err != nil {
+		logger.Error("couldn't send the rejection to the MQTT client",
+			netAddrAttr(conn), pusu.ErrorAttr(err))
+	}
+}
+
+// mqttConnAckPacket returns a CONNACK packet with the return code
+func mqttConnAckPacket(rc byte) []byte {
+	return appendMQTTPacket(nil, mqttConnAck, 0, []byte{0, rc})
+}
+
+// startMQTTClient starts the reader and writer for a client connected over
+// MQTT
+func startMQTTClient(
+	logger *slog.Logger,
+	cid connID,
+	conn net.Conn,
+	shared *clientShared,
+) {
+	clt := &client{
+		cID:          cid,
+		conn:         conn,
+		subs:         make(map[pusu.Topic]bool),
+		sendChan:     make(chan outMsg, shared.profiles.chanSize()),
+		remoteIP:     remoteIP(conn),
+		origTopic:    true,
+		mqtt:         newMQTTSession(),
+		clientShared: shared,
+	}
+
+	clt.logger = logger.With(cid.Attr(), slog.Bool(cltAttrPfx+"MQTT", true))
+
+	clt.logger.Info("MQTT connection received", netAddrAttr(clt.conn))
+
+	var wg sync.WaitGroup
+
+	wg.Add((2))
+
+	go clt.mqttReader(&wg)
+	go clt.writer(&wg)
+
+	wg.Wait()
+
+	clt.connected = true
+}
+
+// sendRaw sends the bytes to the client as they are
+func (clt *client) sendRaw(b []byte) {
+	clt.send(outMsg{raw: b})
+}
+
+// readMQTTPacket reads the next packet from the client. The read must
+// complete within the keep-alive time allowed, if any.
+func (clt *client) readMQTTPacket(r *bufio.Reader) (mqttPacket, error) {
+	var deadline time.Time
+
+	if clt.mqtt.keepAlive > 0 {
+		deadline = time.Now().Add(clt.mqtt.keepAlive * 3 / 2)
+	}
+
+	if err := clt.conn.SetReadDeadline(deadline); err != nil {
+		return mqttPacket{}, err
+	}
+
+	return readMQTTPacket(r)
+}
+
+// mqttReader reads packets from the MQTT client repeatedly and handles
+// them. The first packet must be a CONNECT packet.
+func (clt *client) mqttReader(wg *sync.WaitGroup) {
+	clt.logger.Info("MQTT reader started")
+
+	wg.Done()
+
+	defer clt.logger.Info("MQTT reader finished")
+	defer clt.connLimits.releaseConn(clt.remoteIP)
+
+	if err := clt.admit(); err != nil {
+		if errors.Is(err, errConnLimit) {
+			clt.logger.Error("MQTT connection rejected", pusu.ErrorAttr(err))
+			clt.sendRaw(mqttConnAckPacket(mqttConnUnavailable))
+			clt.handleProtocolError(pusu.NoMsgID, err)
+		} else {
+			clt.handleReadError(err)
+		}
+
+		return
+	}
+
+	defer clt.connLimits.releaseIdentity(clt.certID)
+
+	r := bufio.NewReader(clt.conn)
+
+	if err := clt.conn.SetReadDeadline(
+		time.Now().Add(mqttConnectTimeout)); err != nil {
+		clt.handleReadError(err)
+
+		return
+	}
+
+	p, err := readMQTTPacket(r)
+	if err != nil {
+		clt.handleReadError(err)
+
+		return
+	}
+
+	if p.typ != mqttConnect {
+		err = fmt.Errorf("%w: the first packet must be a CONNECT, not %d",
+			errBadMQTT, p.typ)
+	} else {
+		err = clt.mqttHandleConnect(p)
+	}
+
+	if err != nil {
+		clt.logger.Error("couldn't handle the MQTT CONNECT",
+			pusu.ErrorAttr(err))
+		clt.audit(auditEvtProtocol, auditRejected, err)
+		clt.handleProtocolError(pusu.NoMsgID, err)
+
+		return
+	}
+
+	for {
+		p, err := clt.readMQTTPacket(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = fmt.Errorf("the connection closed without a DISCONNECT: %w",
+					io.ErrUnexpectedEOF)
+			}
+
+			clt.handleReadError(err)
+			clt.disconnect()
+
+			return
+		}
+
+		if p.typ == mqttDisconnect {
+			clt.handleReadError(io.EOF)
+			clt.disconnect()
+
+			return
+		}
+
+		err = clt.mqttHandlePacket(p)
+		if errors.Is(err, errMsgRejected) {
+			// MQTT 3.1.1 has no way to refuse a packet so it is dropped
+			clt.logger.Warn("MQTT packet dropped",
+				slog.Int("packet-type", int(p.typ)), pusu.ErrorAttr(err))
+
+			continue
+		}
+
+		if errors.Is(err, errRateLimited) {
+			clt.rateLimitDisconnect()
+
+			return
+		}
+
+		if err != nil {
+			clt.logger.Error("couldn't handle the MQTT packet",
+				slog.Int("packet-type", int(p.typ)), pusu.ErrorAttr(err))
+			clt.handleProtocolError(pusu.NoMsgID, err)
+
+			return
+		}
+	}
+}
+
+// mqttHandleConnect handles the CONNECT packet. It sets the namespace and
+// identity of the client and any will and hands on a Start message to the
+// server as for a pusu client.
+func (clt *client) mqttHandleConnect(p mqttPacket) error {
+	ci, rc, err := parseMQTTConnect(p.body)
+	if err != nil {
+		if rc != mqttConnAccepted {
+			clt.sendRaw(mqttConnAckPacket(rc))
+		}
+
+		return err
+	}
+
+	ns := ci.username
+	if !ci.hasUsername {
+		ns = clt.certID
+	}
+
+	if err := clt.enterNamespace(ns); err != nil {
+		clt.sendRaw(mqttConnAckPacket(mqttConnNotAuthorised))
+
+		return err
+	}
+
+	clt.identity = ci.clientID
+	if clt.identity == "" {
+		clt.identity = "mqtt-" + clt.cID.String()
+		clt.assignedID = true
+	}
+
+	clt.mqtt.keepAlive = ci.keepAlive
+
+	if ci.hasWill {
+		topic, err := mqttToTopic(ci.willTopic)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errBadWill, err)
+		}
+
+		if clt.will, err = clt.prepareWill(&pusu.PublishMsgPayload{
+			Topic:   string(topic),
+			Payload: ci.willPayload,
+		}); err != nil {
+			return err
+		}
+	}
+
+	clt.logger.Info("MQTT client start information",
+		clt.startInfoAttr(), clt.namespace.Attr(),
+		slog.Duration(cltAttrPfx+"KeepAlive", ci.keepAlive),
+		slog.Bool(cltAttrPfx+"Will", clt.will != nil))
+
+	clt.pubSubChan <- clientMessage{
+		clt: clt,
+		msg: &pusu.Message{MT: pusu.Start, MsgID: pusu.NoMsgID},
+	}
+
+	clt.sendRaw(mqttConnAckPacket(mqttConnAccepted))
+
+	return nil
+}
+
+// mqttHandlePacket handles a packet from the MQTT client after the CONNECT
+func (clt *client) mqttHandlePacket(p mqttPacket) error {
+	switch p.typ {
+	case mqttPublish:
+		return clt.mqttHandlePublish(p)
+	case mqttPubRel:
+		id, err := parseMQTTPacketID(p)
+		if err != nil {
+			return err
+		}
+
+		clt.sendRaw(mqttPacketID(mqttPubComp, 0, id))
+	case mqttSubscribe:
+		return clt.mqttHandleSubscribe(p)
+	case mqttUnsubscribe:
+		return clt.mqttHandleUnsubscribe(p)
+	case mqttPingReq:
+		clt.sendRaw(appendMQTTPacket(nil, mqttPingResp, 0, nil))
+	default:
+		return fmt.Errorf("%w: unexpected packet type: %d", errBadMQTT, p.typ)
+	}
+
+	return nil
+}
+
+// parseMQTTPacketID parses a PUBREL packet, returning the packet identifier
+func parseMQTTPacketID(p mqttPacket) (uint16, error) {
+	const pubRelFlags = 0x02
+
+	if p.flags != pubRelFlags || len(p.body) != 2 {
+		return 0, fmt.Errorf("%w: bad PUBREL packet", errBadMQTT)
+	}
+
+	return binary.BigEndian.Uint16(p.body), nil
+}
+
+// mqttHandlePublish handles a PUBLISH packet. The publication is checked
+// and handed on to the server as for a pusu publication and then
+// acknowledged according to its QoS.
+func (clt *client) mqttHandlePublish(p mqttPacket) error {
+	rcvd := time.Now()
+
+	pi, err := parseMQTTPublish(p)
+	if err != nil {
+		return err
+	}
+
+	topic, err := mqttToTopic(pi.topic)
+	if err != nil {
+		return err
+	}
+
+	pmp := &pusu.PublishMsgPayload{Topic: string(topic), Payload: pi.payload}
+
+	msg := &pusu.Message{MT: pusu.Publish, MsgID: pusu.NoMsgID}
+	if err := msg.Marshal(pmp, clt.logger); err != nil {
+		return err
+	}
+
+	if err := clt.applyRateLimits(msg, 1); err != nil {
+		return err
+	}
+
+	pub, err := clt.preparePublication(pmp)
+	if err != nil {
+		return err
+	}
+
+	clt.pubSubChan <- clientMessage{
+		clt:  clt,
+		msg:  msg,
+		pubs: []*publication{pub},
+		rcvd: rcvd,
+	}
+
+	switch pi.qos {
+	case 1:
+		clt.sendRaw(mqttPacketID(mqttPubAck, 0, pi.packetID))
+	case 2:
+		clt.sendRaw(mqttPacketID(mqttPubRec, 0, pi.packetID))
+	}
+
+	return nil
+}
+
+// mqttHandleSubscribe handles a SUBSCRIBE packet. The client is subscribed
+// to any pusu topics needed for the topic filters and the subscriptions
+// are acknowledged, each being granted QoS 0 or refused if the filter
+// cannot be mapped. If the new subscriptions would take the client over
+// the subscription limit they are all refused.
+func (clt *client) mqttHandleSubscribe(p mqttPacket) error {
+	id, subs, err := parseMQTTSubscribe(p)
+	if err != nil {
+		return err
+	}
+
+	if err := clt.applyRateLimits(&pusu.Message{
+		MT:      pusu.Subscribe,
+		MsgID:   pusu.NoMsgID,
+		Payload: p.body,
+	}, 1); err != nil {
+		return err
+	}
+
+	smp := &pusu.SubscriptionMsgPayload{}
+	codes := binary.BigEndian.AppendUint16(nil, id)
+
+	var added []string // the filters new to the session
+
+	for _, s := range subs {
+		if s.qos > 2 {
+			return fmt.Errorf("%w: bad requested QoS: %d", errBadMQTT, s.qos)
+		}
+
+		base, err := mqttFilterBase(s.filter)
+		if err != nil {
+			clt.logger.Error("MQTT subscription refused",
+				slog.String("filter", s.filter), pusu.ErrorAttr(err))
+
+			codes = append(codes, mqttSubAckFailure)
+
+			continue
+		}
+
+		if !clt.mqtt.hasFilter(s.filter) {
+			added = append(added, s.filter)
+		}
+
+		if clt.mqtt.subscribe(s.filter, base) {
+			smp.Subs = append(smp.Subs,
+				&pusu.SubscriptionMsgPayload_Sub{Topic: string(base)})
+		}
+
+		codes = append(codes, 0)
+	}
+
+	err = clt.mqttForward(pusu.Subscribe, smp)
+	if errors.Is(err, errMsgRejected) {
+		clt.logger.Warn("MQTT subscriptions refused", pusu.ErrorAttr(err))
+
+		for _, filter := range added {
+			clt.mqtt.unsubscribe(filter)
+		}
+
+		codes = codes[:len(codes)-len(subs)]
+		for range subs {
+			codes = append(codes, mqttSubAckFailure)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	clt.sendRaw(appendMQTTPacket(nil, mqttSubAck, 0, codes))
+
+	return nil
+}
+
+// mqttHandleUnsubscribe handles an UNSUBSCRIBE packet. The client is
+// unsubscribed from any pusu topics no longer needed for its topic filters
+// and the packet is acknowledged.
+func (clt *client) mqttHandleUnsubscribe(p mqttPacket) error {
+	id, subs, err := parseMQTTSubscribe(p)
+	if err != nil {
+		return err
+	}
+
+	smp := &pusu.SubscriptionMsgPayload{}
+
+	for _, s := range subs {
+		if base, last := clt.mqtt.unsubscribe(s.filter); last {
+			smp.Subs = append(smp.Subs,
+				&pusu.SubscriptionMsgPayload_Sub{Topic: string(base)})
+		}
+	}
+
+	if err := clt.mqttForward(pusu.Unsubscribe, smp); err != nil {
+		return err
+	}
+
+	clt.sendRaw(mqttPacketID(mqttUnsubAck, 0, id))
+
+	return nil
+}
+
+// mqttForward hands on the subscriptions to the server as a Subscribe or
+// Unsubscribe message, recording the change in the client's set of
+// subscriptions. Nothing is sent if there are no subscriptions.
+func (clt *client) mqttForward(
+	mt pusu.MsgType,
+	smp *pusu.SubscriptionMsgPayload,
+) error {
+	if len(smp.Subs) == 0 {
+		return nil
+	}
+
+	if mt == pusu.Subscribe {
+		if err := clt.checkNewSubs(subTopics(smp)); err != nil {
+			return err
+		}
+	}
+
+	msg := &pusu.Message{MT: mt, MsgID: pusu.NoMsgID}
+	if err := msg.Marshal(smp, clt.logger); err != nil {
+		return err
+	}
+
+	for _, sub := range smp.Subs {
+		if mt == pusu.Subscribe {
+			clt.subs[pusu.Topic(sub.Topic)] = true
+		} else {
+			delete(clt.subs, pusu.Topic(sub.Topic))
+		}
+	}
+
+	clt.pubSubChan <- clientMessage{
+		clt: clt,
+		msg: msg,
+	}
+
+	return nil
+}
+
+// mqttWrite writes the message to the MQTT client. Publications are sent
+// as QoS 0 PUBLISH packets if their topic matches one of the client's
+// topic filters and raw packets are written as they are. Any other
+// messages, such as Acks and Errors, have no MQTT equivalent and are
+// discarded.
+func (clt *client) mqttWrite(w io.Writer, om outMsg) error {
+	if om.raw != nil {
+		return om.write(w)
+	}
+
+	if om.msg.MT != pusu.Publish {
+		om.discard()
+
+		return nil
+	}
+
+	pmp, err := om.publication()
+	if err != nil {
+		return err
+	}
+
+	name := topicToMQTT(pusu.Topic(pmp.Topic))
+	if !clt.mqtt.matches(name) {
+		return nil
+	}
+
+	body := appendMQTTString(nil, name)
+	body = append(body, pmp.Payload...)
+
+	_, err = w.Write(appendMQTTPacket(nil, mqttPublish, 0, body))
+
+	return err
+}
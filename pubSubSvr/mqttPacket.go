@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// mqttPacketType is the type of an MQTT control packet
+type mqttPacketType byte
+
+// The MQTT 3.1.1 control packet types
+const (
+	mqttConnect     mqttPacketType = 1
+	mqttConnAck     mqttPacketType = 2
+	mqttPublish     mqttPacketType = 3
+	mqttPubAck      mqttPacketType = 4
+	mqttPubRec      mqttPacketType = 5
+	mqttPubRel      mqttPacketType = 6
+	mqttPubComp     mqttPacketType = 7
+	mqttSubscribe   mqttPacketType = 8
+	mqttSubAck      mqttPacketType = 9
+	mqttUnsubscribe mqttPacketType = 10
+	mqttUnsubAck    mqttPacketType = 11
+	mqttPingReq     mqttPacketType = 12
+	mqttPingResp    mqttPacketType = 13
+	mqttDisconnect  mqttPacketType = 14
+)
+
+// The MQTT CONNACK return codes
+const (
+	mqttConnAccepted      byte = 0
+	mqttConnBadProtocol   byte = 1
+	mqttConnBadClientID   byte = 2
+	mqttConnUnavailable   byte = 3
+	mqttConnNotAuthorised byte = 5
+)
+
+// mqttSubAckFailure is the SUBACK return code for a rejected subscription
+const mqttSubAckFailure byte = 0x80
+
+// The protocol name and level of MQTT 3.1.1
+const (
+	mqttProtocolName       = "MQTT"
+	mqttProtocolLevel byte = 4
+)
+
+// mqttMaxRemainingLenLen is the most bytes used to encode the remaining
+// length in the fixed header
+const mqttMaxRemainingLenLen = 4
+
+// mqttMaxPacketSize is the largest MQTT packet the server will accept. A
+// publication must fit in a pusu message so there is no point accepting
+// anything bigger.
+const mqttMaxPacketSize = pusu.MaxMessagePayload
+
+// errBadMQTT is the error returned when an MQTT packet is malformed
+var errBadMQTT = errors.New("bad MQTT packet")
+
+// mqttPacket is an MQTT control packet: the type, the flags from the fixed
+// header and the remainder of the packet
+type mqttPacket struct {
+	typ   mqttPacketType
+	flags byte
+	body  []byte
+}
+
+// readMQTTPacket reads the next MQTT control packet
+func readMQTTPacket(r *bufio.Reader) (mqttPacket, error) {
+	var p mqttPacket
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return p, err
+	}
+
+	p.typ = mqttPacketType(b >> 4)
+	p.flags = b & 0x0f
+
+	size := 0
+
+	for i := 0; ; i++ {
+		if i == mqttMaxRemainingLenLen {
+			return p, fmt.Errorf("%w: the remaining length is too long",
+				errBadMQTT)
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return p, unexpectedEOF(err)
+		}
+
+		size |= int(b&0x7f) << (7 * i)
+
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if size > mqttMaxPacketSize {
+		return p, fmt.Errorf("%w: the packet is too big: %d bytes (max: %d)",
+			errBadMQTT, size, mqttMaxPacketSize)
+	}
+
+	p.body = make([]byte, size)
+
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return p, unexpectedEOF(err)
+	}
+
+	return p, nil
+}
+
+// unexpectedEOF converts an EOF part way through a packet into an
+// unexpected EOF
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// appendMQTTPacket appends the encoded control packet to b
+func appendMQTTPacket(
+	b []byte,
+	typ mqttPacketType,
+	flags byte,
+	body []byte,
+) []byte {
+	b = append(b, byte(typ)<<4|flags)
+
+	size := len(body)
+	for {
+		d := byte(size & 0x7f)
+		size >>= 7
+
+		if size == 0 {
+			b = append(b, d)
+			break
+		}
+
+		b = append(b, d|0x80)
+	}
+
+	return append(b, body...)
+}
+
+// appendMQTTString appends the length-prefixed string to b
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s))) //nolint:gosec
+	return append(b, s...)
+}
+
+// mqttPacketID returns a packet carrying just the packet identifier
+func mqttPacketID(typ mqttPacketType, flags byte, id uint16) []byte {
+	return appendMQTTPacket(nil, typ, flags,
+		binary.BigEndian.AppendUint16(nil, id))
+}
+
+// mqttBody reads the fields of the body of an MQTT packet. The first error
+// is recorded and any further reads return zero values.
+type mqttBody struct {
+	b   []byte
+	err error
+}
+
+// short records that the body is too short
+func (mb *mqttBody) short(field string) {
+	if mb.err == nil {
+		mb.err = fmt.Errorf("%w: the packet is too short for the %s",
+			errBadMQTT, field)
+	}
+
+	mb.b = nil
+}
+
+// byte reads a single byte
+func (mb *mqttBody) byte(field string) byte {
+	if len(mb.b) < 1 {
+		mb.short(field)
+		return 0
+	}
+
+	v := mb.b[0]
+	mb.b = mb.b[1:]
+
+	return v
+}
+
+// uint16 reads a two byte integer
+func (mb *mqttBody) uint16(field string) uint16 {
+	if len(mb.b) < 2 {
+		mb.short(field)
+		return 0
+	}
+
+	v := binary.BigEndian.Uint16(mb.b)
+	mb.b = mb.b[2:]
+
+	return v
+}
+
+// bytes reads length-prefixed binary data
+func (mb *mqttBody) bytes(field string) []byte {
+	n := int(mb.uint16(field))
+	if len(mb.b) < n {
+		mb.short(field)
+		return nil
+	}
+
+	v := mb.b[:n]
+	mb.b = mb.b[n:]
+
+	return v
+}
+
+// string reads a length-prefixed string
+func (mb *mqttBody) string(field string) string {
+	return string(mb.bytes(field))
+}
+
+// mqttConnectInfo holds the contents of a CONNECT packet
+type mqttConnectInfo struct {
+	clientID     string
+	cleanSession bool
+	keepAlive    time.Duration
+
+	hasWill     bool
+	willTopic   string
+	willPayload []byte
+
+	hasUsername bool
+	username    string
+}
+
+// The flags in the CONNECT packet
+const (
+	mqttFlagReserved     = 0x01
+	mqttFlagCleanSession = 0x02
+	mqttFlagWill         = 0x04
+	mqttFlagWillQoS      = 0x18
+	mqttFlagWillRetain   = 0x20
+	mqttFlagPassword     = 0x40
+	mqttFlagUsername     = 0x80
+)
+
+// parseMQTTConnect parses the body of a CONNECT packet. If the packet is
+// well-formed but cannot be accepted the CONNACK return code is returned
+// with the error.
+func parseMQTTConnect(body []byte) (mqttConnectInfo, byte, error) {
+	var ci mqttConnectInfo
+
+	mb := &mqttBody{b: body}
+
+	name := mb.string("protocol name")
+	level := mb.byte("protocol level")
+	flags := mb.byte("connect flags")
+	keepAlive := mb.uint16("keep alive")
+
+	if mb.err != nil {
+		return ci, 0, mb.err
+	}
+
+	if name != mqttProtocolName {
+		return ci, 0, fmt.Errorf("%w: unknown protocol name: %q",
+			errBadMQTT, name)
+	}
+
+	if level != mqttProtocolLevel {
+		return ci, mqttConnBadProtocol,
+			fmt.Errorf("%w: unsupported protocol level: %d (expected %d)",
+				errBadMQTT, level, mqttProtocolLevel)
+	}
+
+	if flags&mqttFlagReserved != 0 {
+		return ci, 0, fmt.Errorf("%w: the reserved connect flag is set",
+			errBadMQTT)
+	}
+
+	if flags&mqttFlagWill == 0 &&
+		flags&(mqttFlagWillQoS|mqttFlagWillRetain) != 0 {
+		return ci, 0, fmt.Errorf("%w: will QoS or retain set without a will",
+			errBadMQTT)
+	}
+
+	if flags&mqttFlagUsername == 0 && flags&mqttFlagPassword != 0 {
+		return ci, 0, fmt.Errorf("%w: a password was given without a username",
+			errBadMQTT)
+	}
+
+	ci.cleanSession = flags&mqttFlagCleanSession != 0
+	ci.keepAlive = time.Duration(keepAlive) * time.Second
+	ci.clientID = mb.string("client identifier")
+
+	if flags&mqttFlagWill != 0 {
+		ci.hasWill = true
+		ci.willTopic = mb.string("will topic")
+		ci.willPayload = mb.bytes("will message")
+	}
+
+	if flags&mqttFlagUsername != 0 {
+		ci.hasUsername = true
+		ci.username = mb.string("user name")
+	}
+
+	if flags&mqttFlagPassword != 0 {
+		_ = mb.bytes("password") // authentication is by client certificate
+	}
+
+	if mb.err != nil {
+		return ci, 0, mb.err
+	}
+
+	if ci.clientID == "" && !ci.cleanSession {
+		return ci, mqttConnBadClientID,
+			fmt.Errorf("%w: a client identifier is needed"+
+				" unless the session is clean", errBadMQTT)
+	}
+
+	return ci, mqttConnAccepted, nil
+}
+
+// mqttPublishInfo holds the contents of a PUBLISH packet
+type mqttPublishInfo struct {
+	topic    string
+	qos      byte
+	packetID uint16
+	payload  []byte
+}
+
+// parseMQTTPublish parses a PUBLISH packet
+func parseMQTTPublish(p mqttPacket) (mqttPublishInfo, error) {
+	var pi mqttPublishInfo
+
+	pi.qos = (p.flags >> 1) & 0x03
+	if pi.qos == 3 {
+		return pi, fmt.Errorf("%w: bad QoS in PUBLISH: 3", errBadMQTT)
+	}
+
+	mb := &mqttBody{b: p.body}
+
+	pi.topic = mb.string("topic name")
+
+	if pi.qos > 0 {
+		pi.packetID = mb.uint16("packet identifier")
+	}
+
+	pi.payload = mb.b
+
+	return pi, mb.err
+}
+
+// mqttSubscription is a topic filter and the requested QoS from a SUBSCRIBE
+// or UNSUBSCRIBE packet; the QoS is only set for a SUBSCRIBE.
+type mqttSubscription struct {
+	filter string
+	qos    byte
+}
+
+// parseMQTTSubscribe parses a SUBSCRIBE or UNSUBSCRIBE packet, returning
+// the packet identifier and the topic filters
+func parseMQTTSubscribe(p mqttPacket) (uint16, []mqttSubscription, error) {
+	const subFlags = 0x02
+
+	if p.flags != subFlags {
+		return 0, nil, fmt.Errorf("%w: bad flags for packet type %d: %#x",
+			errBadMQTT, p.typ, p.flags)
+	}
+
+	mb := &mqttBody{b: p.body}
+	id := mb.uint16("packet identifier")
+
+	var subs []mqttSubscription
+
+	for mb.err == nil && len(mb.b) > 0 {
+		s := mqttSubscription{filter: mb.string("topic filter")}
+
+		if p.typ == mqttSubscribe {
+			s.qos = mb.byte("requested QoS")
+		}
+
+		subs = append(subs, s)
+	}
+
+	if mb.err == nil && len(subs) == 0 {
+		return 0, nil, fmt.Errorf("%w: no topic filters given", errBadMQTT)
+	}
+
+	return id, subs, mb.err
+}
+
+// mqttToTopic returns the pusu topic for the MQTT topic name. The topic
+// levels of the name become the parts of the topic so 'a/b' becomes '/a/b'.
+func mqttToTopic(name string) (pusu.Topic, error) {
+	if name == "" {
+		return "", fmt.Errorf("%w: the topic name is empty", errBadMQTT)
+	}
+
+	if strings.ContainsAny(name, "+#") {
+		return "", fmt.Errorf("%w: the topic name %q has a wildcard",
+			errBadMQTT, name)
+	}
+
+	topic := pusu.Topic("/" + name)
+	if err := topic.Check(); err != nil {
+		return "", fmt.Errorf("%w: %w", errBadMQTT, err)
+	}
+
+	return topic, nil
+}
+
+// topicToMQTT returns the MQTT topic name for the pusu topic
+func topicToMQTT(topic pusu.Topic) string {
+	return strings.TrimPrefix(string(topic), "/")
+}
+
+// mqttFilterBase checks the MQTT topic filter and returns the pusu topic to
+// subscribe to in order to receive all the publications which match it.
+// This is the topic given by the levels of the filter before the first
+// wildcard. Since a pusu subscription also receives publications on all
+// the sub-topics this may receive more than the filter matches; the
+// others are discarded before being sent to the client.
+func mqttFilterBase(filter string) (pusu.Topic, error) {
+	if filter == "" {
+		return "", fmt.Errorf("%w: the topic filter is empty", errBadMQTT)
+	}
+
+	levels := strings.Split(filter, "/")
+
+	var base []string
+
+	wild := false
+
+	for i, l := range levels {
+		switch {
+		case l == "#" && i == len(levels)-1, l == "+":
+			wild = true
+		case strings.ContainsAny(l, "+#"):
+			return "", fmt.Errorf("%w: bad wildcard in topic filter %q",
+				errBadMQTT, filter)
+		case !wild:
+			base = append(base, l)
+		}
+	}
+
+	topic := pusu.Topic("/" + strings.Join(base, "/"))
+	if err := topic.Check(); err != nil {
+		return "", fmt.Errorf("%w: %w", errBadMQTT, err)
+	}
+
+	return topic, nil
+}
+
+// mqttMatch returns true if the MQTT topic name matches the topic filter.
+// Names starting with '$' are not matched by filters starting with a
+// wildcard.
+func mqttMatch(filter, name string) bool {
+	if strings.HasPrefix(name, "$") &&
+		(strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	fLevels := strings.Split(filter, "/")
+	nLevels := strings.Split(name, "/")
+
+	for i, f := range fLevels {
+		if f == "#" {
+			return true
+		}
+
+		if i >= len(nLevels) {
+			return false
+		}
+
+		if f != "+" && f != nLevels[i] {
+			return false
+		}
+	}
+
+	return len(fLevels) == len(nLevels)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestReadMQTTPacket(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		typ   mqttPacketType
+		flags byte
+		body  []byte
+	}{
+		{
+			ID:  testhelper.MkID("empty body"),
+			typ: mqttPingReq,
+		},
+		{
+			ID:    testhelper.MkID("short body"),
+			typ:   mqttSubscribe,
+			flags: 0x02,
+			body:  []byte("subscribe"),
+		},
+		{
+			ID:   testhelper.MkID("multi-byte remaining length"),
+			typ:  mqttPublish,
+			body: bytes.Repeat([]byte("x"), 20000),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			b := appendMQTTPacket(nil, tc.typ, tc.flags, tc.body)
+
+			p, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(b)))
+			if err != nil {
+				t.Fatal(tc.IDStr(), ": unexpected error:", err)
+			}
+
+			testhelper.DiffInt(t, tc.IDStr(), "type", p.typ, tc.typ)
+			testhelper.DiffInt(t, tc.IDStr(), "flags", p.flags, tc.flags)
+			testhelper.DiffInt(t, tc.IDStr(), "body length",
+				len(p.body), len(tc.body))
+		})
+	}
+}
+
+// mqttConnectBody returns the body of a CONNECT packet with the given
+// flags and the fields following the variable header
+func mqttConnectBody(level, flags byte, fields ...string) []byte {
+	const keepAlive = 60
+
+	b := appendMQTTString(nil, mqttProtocolName)
+	b = append(b, level, flags, 0, keepAlive)
+
+	for _, f := range fields {
+		b = appendMQTTString(b, f)
+	}
+
+	return b
+}
+
+func TestParseMQTTConnect(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		body  []byte
+		expRC byte
+		expCI mqttConnectInfo
+	}{
+		{
+			ID: testhelper.MkID("minimal"),
+			body: mqttConnectBody(mqttProtocolLevel, mqttFlagCleanSession,
+				""),
+			expCI: mqttConnectInfo{
+				cleanSession: true,
+				keepAlive:    time.Minute,
+			},
+		},
+		{
+			ID: testhelper.MkID("will and username"),
+			body: mqttConnectBody(mqttProtocolLevel,
+				mqttFlagWill|mqttFlagUsername|mqttFlagPassword,
+				"sensor-1", "status", "gone", "factory", "secret"),
+			expCI: mqttConnectInfo{
+				clientID:    "sensor-1",
+				keepAlive:   time.Minute,
+				hasWill:     true,
+				willTopic:   "status",
+				willPayload: []byte("gone"),
+				hasUsername: true,
+				username:    "factory",
+			},
+		},
+		{
+			ID:     testhelper.MkID("bad: protocol level"),
+			ExpErr: testhelper.MkExpErr("unsupported protocol level: 3"),
+			body:   mqttConnectBody(3, mqttFlagCleanSession, ""),
+			expRC:  mqttConnBadProtocol,
+		},
+		{
+			ID:     testhelper.MkID("bad: no client ID"),
+			ExpErr: testhelper.MkExpErr("a client identifier is needed"),
+			body:   mqttConnectBody(mqttProtocolLevel, 0, ""),
+			expRC:  mqttConnBadClientID,
+		},
+		{
+			ID:     testhelper.MkID("bad: password without username"),
+			ExpErr: testhelper.MkExpErr("a password was given"),
+			body: mqttConnectBody(mqttProtocolLevel,
+				mqttFlagCleanSession|mqttFlagPassword, "", "secret"),
+		},
+		{
+			ID:     testhelper.MkID("bad: truncated"),
+			ExpErr: testhelper.MkExpErr("bad MQTT packet", "user name"),
+			body: mqttConnectBody(mqttProtocolLevel,
+				mqttFlagCleanSession|mqttFlagUsername, ""),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ci, rc, err := parseMQTTConnect(tc.body)
+			testhelper.DiffInt(t, tc.IDStr(), "return code", rc, tc.expRC)
+
+			if !testhelper.CheckExpErr(t, err, tc) || err != nil {
+				return
+			}
+
+			testhelper.DiffString(t, tc.IDStr(), "client ID",
+				ci.clientID, tc.expCI.clientID)
+			testhelper.DiffBool(t, tc.IDStr(), "clean session",
+				ci.cleanSession, tc.expCI.cleanSession)
+			testhelper.DiffInt(t, tc.IDStr(), "keep alive",
+				ci.keepAlive, tc.expCI.keepAlive)
+			testhelper.DiffBool(t, tc.IDStr(), "has will",
+				ci.hasWill, tc.expCI.hasWill)
+			testhelper.DiffString(t, tc.IDStr(), "will topic",
+				ci.willTopic, tc.expCI.willTopic)
+			testhelper.DiffString(t, tc.IDStr(), "will payload",
+				string(ci.willPayload), string(tc.expCI.willPayload))
+			testhelper.DiffString(t, tc.IDStr(), "username",
+				ci.username, tc.expCI.username)
+		})
+	}
+}
+
+func TestMQTTFilterBase(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		filter  string
+		expBase pusu.Topic
+	}{
+		{
+			ID:      testhelper.MkID("no wildcards"),
+			filter:  "a/b",
+			expBase: "/a/b",
+		},
+		{
+			ID:      testhelper.MkID("multi-level wildcard"),
+			filter:  "a/b/#",
+			expBase: "/a/b",
+		},
+		{
+			ID:      testhelper.MkID("single-level wildcard"),
+			filter:  "a/+/c",
+			expBase: "/a",
+		},
+		{
+			ID:      testhelper.MkID("everything"),
+			filter:  "#",
+			expBase: "/",
+		},
+		{
+			ID:     testhelper.MkID("bad: '#' not last"),
+			ExpErr: testhelper.MkExpErr("bad wildcard"),
+			filter: "a/#/c",
+		},
+		{
+			ID:     testhelper.MkID("bad: partial-level wildcard"),
+			ExpErr: testhelper.MkExpErr("bad wildcard"),
+			filter: "a/b+",
+		},
+		{
+			ID:     testhelper.MkID("bad: empty level"),
+			ExpErr: testhelper.MkExpErr("bad MQTT packet"),
+			filter: "a//b",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			base, err := mqttFilterBase(tc.filter)
+			if !testhelper.CheckExpErr(t, err, tc) || err != nil {
+				return
+			}
+
+			testhelper.DiffString(t, tc.IDStr(), "base", base, tc.expBase)
+		})
+	}
+}
+
+func TestMQTTMatch(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		filter   string
+		name     string
+		expMatch bool
+	}{
+		{
+			ID:       testhelper.MkID("exact"),
+			filter:   "a/b",
+			name:     "a/b",
+			expMatch: true,
+		},
+		{
+			ID:     testhelper.MkID("sub-topic without wildcard"),
+			filter: "a/b",
+			name:   "a/b/c",
+		},
+		{
+			ID:       testhelper.MkID("multi-level wildcard"),
+			filter:   "a/#",
+			name:     "a/b/c",
+			expMatch: true,
+		},
+		{
+			ID:       testhelper.MkID("multi-level wildcard, parent"),
+			filter:   "a/#",
+			name:     "a",
+			expMatch: true,
+		},
+		{
+			ID:       testhelper.MkID("single-level wildcard"),
+			filter:   "a/+/c",
+			name:     "a/b/c",
+			expMatch: true,
+		},
+		{
+			ID:     testhelper.MkID("single-level wildcard, too deep"),
+			filter: "a/+",
+			name:   "a/b/c",
+		},
+		{
+			ID:     testhelper.MkID("system topic, leading wildcard"),
+			filter: "#",
+			name:   "$sys/clients",
+		},
+		{
+			ID:       testhelper.MkID("system topic, named"),
+			filter:   "$sys/#",
+			name:     "$sys/clients",
+			expMatch: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			testhelper.DiffBool(t, tc.IDStr(), "match",
+				mqttMatch(tc.filter, tc.name), tc.expMatch)
+		})
+	}
+}
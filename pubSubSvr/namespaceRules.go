@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"os"
+	"regexp"
 	"strings"
 
 	"github.com/nickwells/english.mod/english"
@@ -13,24 +16,43 @@ import (
 type namespaceMap map[pusu.Namespace]bool
 
 // namespaceRules records the constraints on the allowed Namespace
-// values. Either the set of allowed namespaces can be non-empty or the slice
-// of valid prefixes can be non-empty but not both (this is enforced at
-// parameter setting time).
+// values. A namespace is allowed if it is not denied and either there are
+// no allow rules or it matches at least one of them: it is in the set of
+// allowed namespaces, has one of the allowed prefixes or matches one of
+// the allowed patterns. A namespace is denied if it is in the set of denied
+// namespaces, has one of the denied prefixes or matches one of the denied
+// patterns; deny rules take precedence over allow rules.
 type namespaceRules struct {
 	allowed  namespaceMap
 	prefixes []string
+	patterns []*regexp.Regexp
+
+	denied         namespaceMap
+	deniedPrefixes []string
+	deniedPatterns []*regexp.Regexp
 }
 
-// checkPrefixes returns a non-nil error if the set of prefixes is redundant
-// - if one entry is itself a prefix of another.
+// checkPrefixes returns a non-nil error if either the allowed or the denied
+// prefixes are redundant - if one entry is itself a prefix of another.
 func (rules namespaceRules) checkPrefixes() error {
+	if err := checkPrefixList("", rules.prefixes); err != nil {
+		return err
+	}
+
+	return checkPrefixList("denied ", rules.deniedPrefixes)
+}
+
+// checkPrefixList returns a non-nil error if the set of prefixes is
+// redundant - if one entry is itself a prefix of another. The description
+// is used in the error to say which prefixes are redundant.
+func checkPrefixList(desc string, prefixes []string) error {
 	redundantCount := 0
 
 	var errText string
 
-	for i, pfx := range rules.prefixes {
+	for i, pfx := range prefixes {
 	InnerLoop:
-		for j, otherPfx := range rules.prefixes {
+		for j, otherPfx := range prefixes {
 			if i == j {
 				continue InnerLoop
 			}
@@ -45,7 +67,7 @@ func (rules namespaceRules) checkPrefixes() error {
 	}
 
 	if redundantCount > 0 {
-		errText = "there are redundant prefixes: " + errText
+		errText = "there are redundant " + desc + "prefixes: " + errText
 		if redundantCount > 1 {
 			errText += fmt.Sprintf(" and %d %s", redundantCount-1,
 				english.Plural("other", redundantCount-1))
@@ -57,22 +79,216 @@ func (rules namespaceRules) checkPrefixes() error {
 	return nil
 }
 
-// isValid returns true if the given namespace is allowed. An empty namespace
-// map allows any namespace.
-func (rules namespaceRules) isValid(n pusu.Namespace) bool {
-	if len(rules.allowed) > 0 {
-		return rules.allowed[n]
+// hasAllowRules returns true if there are any allow rules
+func (rules namespaceRules) hasAllowRules() bool {
+	return len(rules.allowed) > 0 ||
+		len(rules.prefixes) > 0 ||
+		len(rules.patterns) > 0
+}
+
+// hasDenyRules returns true if there are any deny rules
+func (rules namespaceRules) hasDenyRules() bool {
+	return len(rules.denied) > 0 ||
+		len(rules.deniedPrefixes) > 0 ||
+		len(rules.deniedPatterns) > 0
+}
+
+// nsMatches returns true if the namespace is in the set, has one of the
+// prefixes or matches one of the patterns
+func nsMatches(
+	n pusu.Namespace,
+	names namespaceMap,
+	prefixes []string,
+	patterns []*regexp.Regexp,
+) bool {
+	if names[n] {
+		return true
 	}
 
-	if len(rules.prefixes) > 0 {
-		for _, pfx := range rules.prefixes {
-			if strings.HasPrefix(string(n), pfx) {
-				return true
-			}
+	for _, pfx := range prefixes {
+		if strings.HasPrefix(string(n), pfx) {
+			return true
 		}
+	}
 
+	for _, re := range patterns {
+		if re.MatchString(string(n)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isValid returns true if the given namespace is allowed. A namespace which
+// is denied is never allowed; otherwise if there are no allow rules any
+// namespace is allowed.
+func (rules namespaceRules) isValid(n pusu.Namespace) bool {
+	if nsMatches(n, rules.denied, rules.deniedPrefixes, rules.deniedPatterns) {
 		return false
 	}
 
-	return true
+	if !rules.hasAllowRules() {
+		return true
+	}
+
+	return nsMatches(n, rules.allowed, rules.prefixes, rules.patterns)
+}
+
+// compileNSPattern compiles the regular expression. The expression must
+// match the whole of the namespace.
+func compileNSPattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("bad namespace pattern %q: %w", pattern, err)
+	}
+
+	return re, nil
+}
+
+// addPatterns compiles the regular expressions and adds them to the allowed
+// or denied patterns
+func (rules *namespaceRules) addPatterns(deny bool, patterns ...string) error {
+	for _, p := range patterns {
+		re, err := compileNSPattern(p)
+		if err != nil {
+			return err
+		}
+
+		if deny {
+			rules.deniedPatterns = append(rules.deniedPatterns, re)
+		} else {
+			rules.patterns = append(rules.patterns, re)
+		}
+	}
+
+	return nil
+}
+
+// The actions and kinds of entry in the namespace rules file
+const (
+	nsRuleAllow = "allow"
+	nsRuleDeny  = "deny"
+
+	nsRuleName   = "name"
+	nsRulePrefix = "prefix"
+	nsRuleRegex  = "regex"
+)
+
+// noteTextNamespaceRules describes the namespace rules and the format of
+// the namespace rules file
+const noteTextNamespaceRules = "The server can limit the namespaces which" +
+	" clients may use. A namespace may be allowed by name, by prefix or" +
+	" by a regular expression which must match the whole namespace, and" +
+	" may be denied in the same ways. A namespace which is denied is" +
+	" never allowed, whatever the allow rules say. If there are no allow" +
+	" rules any namespace which is not denied is allowed; otherwise the" +
+	" namespace must match at least one allow rule. The rules can be" +
+	" given by parameters, in a rules file or both; they are combined." +
+	"\n\n" +
+	"Each line of the rules file has the form:" +
+	"\n\n" +
+	"action kind value" +
+	"\n\n" +
+	"where the action is '" + nsRuleAllow + "' or '" + nsRuleDeny + "'" +
+	" and the kind is '" + nsRuleName + "', '" + nsRulePrefix + "' or '" +
+	nsRuleRegex + "'. For instance:" +
+	"\n\n" +
+	nsRuleAllow + " " + nsRulePrefix + " team-\n" +
+	nsRuleAllow + " " + nsRuleRegex + " svc-[a-z]+-(dev|prod)\n" +
+	nsRuleDeny + " " + nsRuleName + " team-retired" +
+	"\n\n" +
+	"Blank lines and lines starting with '#' are ignored."
+
+// errBadNSRules is the error returned when the namespace rules file cannot
+// be loaded
+var errBadNSRules = errors.New("bad namespace rules")
+
+// parseNSRule parses a line from the namespace rules file, adding the rule
+// to the rules
+func (rules *namespaceRules) parseNSRule(line string) error {
+	const ruleParts = 3
+
+	parts := strings.Fields(line)
+	if len(parts) != ruleParts {
+		return fmt.Errorf("expected %d fields, found %d",
+			ruleParts, len(parts))
+	}
+
+	action, kind, val := parts[0], parts[1], parts[2]
+
+	var deny bool
+
+	switch action {
+	case nsRuleAllow:
+	case nsRuleDeny:
+		deny = true
+	default:
+		return fmt.Errorf("unknown action %q (use %q or %q)",
+			action, nsRuleAllow, nsRuleDeny)
+	}
+
+	switch kind {
+	case nsRuleName:
+		names := &rules.allowed
+		if deny {
+			names = &rules.denied
+		}
+
+		if *names == nil {
+			*names = make(namespaceMap)
+		}
+
+		(*names)[pusu.Namespace(val)] = true
+	case nsRulePrefix:
+		if deny {
+			rules.deniedPrefixes = append(rules.deniedPrefixes, val)
+		} else {
+			rules.prefixes = append(rules.prefixes, val)
+		}
+	case nsRuleRegex:
+		return rules.addPatterns(deny, val)
+	default:
+		return fmt.Errorf("unknown kind %q (use %q, %q or %q)",
+			kind, nsRuleName, nsRulePrefix, nsRuleRegex)
+	}
+
+	return nil
+}
+
+// loadNSRules reads the namespace rules file, adding the rules to those
+// already given. An empty filename adds no rules.
+func (rules *namespaceRules) loadNSRules(filename string) error {
+	if filename == "" {
+		return nil
+	}
+
+	f, err := os.Open(filename) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBadNSRules, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := rules.parseNSRule(line); err != nil {
+			return fmt.Errorf("%w: %s:%d: %w",
+				errBadNSRules, filename, lineNum, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%w: %w", errBadNSRules, err)
+	}
+
+	return nil
 }
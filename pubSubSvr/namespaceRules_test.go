@@ -0,0 +1,188 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestNamespaceRulesIsValid(t *testing.T) {
+	mkRules := func(t *testing.T, lines ...string) namespaceRules {
+		t.Helper()
+
+		var rules namespaceRules
+
+		for _, line := range lines {
+			if err := rules.parseNSRule(line); err != nil {
+				t.Fatal("cannot parse the rule:", err)
+			}
+		}
+
+		return rules
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		rules    []string
+		ns       pusu.Namespace
+		expValid bool
+	}{
+		{
+			ID:       testhelper.MkID("no rules"),
+			ns:       "anything",
+			expValid: true,
+		},
+		{
+			ID:       testhelper.MkID("deny only, not denied"),
+			rules:    []string{"deny name retired"},
+			ns:       "team-a",
+			expValid: true,
+		},
+		{
+			ID:    testhelper.MkID("deny only, denied"),
+			rules: []string{"deny name retired"},
+			ns:    "retired",
+		},
+		{
+			ID:       testhelper.MkID("name and prefix, by prefix"),
+			rules:    []string{"allow name ops", "allow prefix team-"},
+			ns:       "team-a",
+			expValid: true,
+		},
+		{
+			ID:       testhelper.MkID("name and prefix, by name"),
+			rules:    []string{"allow name ops", "allow prefix team-"},
+			ns:       "ops",
+			expValid: true,
+		},
+		{
+			ID:    testhelper.MkID("name and prefix, neither"),
+			rules: []string{"allow name ops", "allow prefix team-"},
+			ns:    "dev",
+		},
+		{
+			ID:       testhelper.MkID("regex"),
+			rules:    []string{`allow regex svc-[a-z]+-(dev|prod)`},
+			ns:       "svc-pay-prod",
+			expValid: true,
+		},
+		{
+			ID:    testhelper.MkID("regex must match the whole namespace"),
+			rules: []string{`allow regex svc-[a-z]+-(dev|prod)`},
+			ns:    "svc-pay-prod2",
+		},
+		{
+			ID: testhelper.MkID("deny takes precedence"),
+			rules: []string{
+				"allow prefix team-",
+				"deny regex team-.*-old",
+			},
+			ns: "team-a-old",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			rules := mkRules(t, tc.rules...)
+
+			testhelper.DiffBool(t, tc.IDStr(), "valid",
+				rules.isValid(tc.ns), tc.expValid)
+		})
+	}
+}
+
+func TestParseNSRule(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		line string
+	}{
+		{
+			ID:   testhelper.MkID("good"),
+			line: "deny prefix tmp-",
+		},
+		{
+			ID:     testhelper.MkID("bad: too few fields"),
+			ExpErr: testhelper.MkExpErr("expected 3 fields, found 2"),
+			line:   "allow team-a",
+		},
+		{
+			ID:     testhelper.MkID("bad: unknown action"),
+			ExpErr: testhelper.MkExpErr(`unknown action "permit"`),
+			line:   "permit name team-a",
+		},
+		{
+			ID:     testhelper.MkID("bad: unknown kind"),
+			ExpErr: testhelper.MkExpErr(`unknown kind "glob"`),
+			line:   "allow glob team-*",
+		},
+		{
+			ID:     testhelper.MkID("bad: bad regex"),
+			ExpErr: testhelper.MkExpErr("bad namespace pattern"),
+			line:   "allow regex team-(",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var rules namespaceRules
+
+			testhelper.CheckExpErr(t, rules.parseNSRule(tc.line), tc)
+		})
+	}
+}
+
+func TestCheckPrefixes(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		prefixes []string
+		rules    []string
+	}{
+		{
+			ID:       testhelper.MkID("good"),
+			prefixes: []string{"team-", "ops-"},
+			rules:    []string{"allow prefix app-", "deny prefix tmp-"},
+		},
+		{
+			ID: testhelper.MkID("bad: redundant allowed prefixes"),
+			ExpErr: testhelper.MkExpErr(
+				`there are redundant prefixes: "team-a" has "team-"`),
+			prefixes: []string{"team-", "team-a"},
+		},
+		{
+			ID: testhelper.MkID("bad: redundant prefixes from the rules"),
+			ExpErr: testhelper.MkExpErr(
+				`there are redundant prefixes: "team-a" has "team-"`),
+			prefixes: []string{"team-"},
+			rules:    []string{"allow prefix team-a"},
+		},
+		{
+			ID: testhelper.MkID("bad: redundant denied prefixes"),
+			ExpErr: testhelper.MkExpErr(
+				`there are redundant denied prefixes: "tmp-x" has "tmp-"`),
+			rules: []string{"deny prefix tmp-", "deny prefix tmp-x"},
+		},
+		{
+			ID: testhelper.MkID("bad: several redundant prefixes"),
+			ExpErr: testhelper.MkExpErr(
+				"there are redundant prefixes:", "and 1 other"),
+			prefixes: []string{"a", "ab", "b", "bc"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			rules := namespaceRules{prefixes: tc.prefixes}
+
+			for _, line := range tc.rules {
+				if err := rules.parseNSRule(line); err != nil {
+					t.Fatal("cannot parse the rule:", err)
+				}
+			}
+
+			testhelper.CheckExpErr(t, rules.checkPrefixes(), tc)
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// overflowPolicy records what to do with a message for a client whose
+// backlog of unsent messages is full
+type overflowPolicy string
+
+const (
+	overflowDisconnect overflowPolicy = "disconnect"
+	overflowDrop       overflowPolicy = "drop"
+)
+
+// dfltBacklog is the number of unsent messages a client may have queued if
+// no profile sets the backlog
+const dfltBacklog = 20
+
+// profileAnyNS is the namespace given for the default profile
+const profileAnyNS = "*"
+
+// The settings which may be given in a namespace profile
+const (
+	profBacklog    = "backlog"
+	profOverflow   = "overflow"
+	profMaxPayload = "max-payload"
+	profMaxPending = "durable-max-pending"
+	profRateLimit  = "rate-limit"
+)
+
+// noteTextProfiles describes the namespace profiles and the format of the
+// namespace profiles file
+const noteTextProfiles = "The clients in every namespace normally share" +
+	" the same limits. The namespace profiles file lets these be set for" +
+	" each namespace. Each line of the file has the form:" +
+	"\n\n" +
+	"namespace setting=value [setting=value...]" +
+	"\n\n" +
+	"where the settings are:" +
+	"\n\n" +
+	profBacklog + ": the most messages which may be queued for a client" +
+	" before it is treated as a slow consumer (default: 20)" +
+	"\n\n" +
+	profOverflow + ": what to do when a client's backlog is full; '" +
+	string(overflowDisconnect) + "' closes the connection and '" +
+	string(overflowDrop) + "' discards the message, leaving the client" +
+	" connected (default: " + string(overflowDisconnect) + ")" +
+	"\n\n" +
+	profMaxPayload + ": the largest publication payload, in bytes, which" +
+	" a client may publish" +
+	"\n\n" +
+	profMaxPending + ": the most publications held for each durable" +
+	" subscription in the namespace (default: the value of the '" +
+	paramNameDurablePending + "' parameter)" +
+	"\n\n" +
+	profRateLimit + ": the rate limit shared by all the clients in the" +
+	" namespace, given as msgs-per-sec[,bytes-per-sec]. A namespace may" +
+	" not be given a rate limit both here and by the '" +
+	paramNameRateLimitNamespace + "' parameter." +
+	"\n\n" +
+	"A profile for the namespace '" + profileAnyNS + "' sets the default" +
+	" for the namespaces without a profile of their own and any setting" +
+	" not given in a profile is taken from it; a rate limit may not be" +
+	" given in the default profile. For instance:" +
+	"\n\n" +
+	profileAnyNS + " " + profBacklog + "=50\n" +
+	"prices " + profOverflow + "=" + string(overflowDrop) + " " +
+	profBacklog + "=500\n" +
+	"audit " + profMaxPayload + "=4096 " + profRateLimit + "=100" +
+	"\n\n" +
+	"Blank lines and lines starting with '#' are ignored."
+
+// errBadProfiles is the error returned when the namespace profiles cannot
+// be loaded
+var errBadProfiles = errors.New("bad namespace profiles")
+
+// nsProfile holds the settings for the clients in a namespace and a count
+// of the messages dropped because a client's backlog was full. A zero
+// setting is taken from the default profile.
+type nsProfile struct {
+	name       string
+	backlog    int
+	overflow   overflowPolicy
+	maxPayload int
+	maxPending int
+	rateLimit  rateLimit
+
+	dropped atomic.Int64
+}
+
+// nsProfiles holds the default profile and the profiles for particular
+// namespaces
+type nsProfiles struct {
+	dflt *nsProfile
+	byNS map[pusu.Namespace]*nsProfile
+}
+
+// parsePositive parses the value of the setting which must be a positive
+// integer
+func parsePositive(setting, val string) (int, error) {
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s %q: %w", setting, val, err)
+	}
+
+	if n <= 0 {
+		return 0, fmt.Errorf("bad %s %q: it must be greater than zero",
+			setting, val)
+	}
+
+	return n, nil
+}
+
+// parseSetting parses a setting=value entry, setting the value in the
+// profile
+func (p *nsProfile) parseSetting(entry string) error {
+	setting, val, ok := strings.Cut(entry, "=")
+	if !ok {
+		return fmt.Errorf("bad setting %q - expected: setting=value", entry)
+	}
+
+	var err error
+
+	switch setting {
+	case profBacklog:
+		p.backlog, err = parsePositive(setting, val)
+	case profOverflow:
+		p.overflow = overflowPolicy(val)
+		if p.overflow != overflowDisconnect && p.overflow != overflowDrop {
+			err = fmt.Errorf("bad %s %q (use %q or %q)",
+				setting, val, overflowDisconnect, overflowDrop)
+		}
+	case profMaxPayload:
+		p.maxPayload, err = parsePositive(setting, val)
+		if err == nil && p.maxPayload > pusu.MaxMessagePayload {
+			err = fmt.Errorf("bad %s %q: it must not be more than %d",
+				setting, val, pusu.MaxMessagePayload)
+		}
+	case profMaxPending:
+		p.maxPending, err = parsePositive(setting, val)
+	case profRateLimit:
+		p.rateLimit, err = parseRateLimit(val)
+		if err == nil && p.name == profileAnyNS {
+			err = errors.New("the default profile cannot set a rate limit")
+		}
+	default:
+		err = fmt.Errorf("unknown setting %q", setting)
+	}
+
+	return err
+}
+
+// parseLine parses a line from the namespace profiles file, adding the
+// profile
+func (profiles *nsProfiles) parseLine(line string) error {
+	const minParts = 2
+
+	parts := strings.Fields(line)
+	if len(parts) < minParts {
+		return fmt.Errorf("expected a namespace and settings, found %q", line)
+	}
+
+	p := &nsProfile{name: parts[0]}
+
+	for _, entry := range parts[1:] {
+		if err := p.parseSetting(entry); err != nil {
+			return err
+		}
+	}
+
+	if p.name == profileAnyNS {
+		if profiles.dflt != nil {
+			return errors.New("the default profile is given more than once")
+		}
+
+		profiles.dflt = p
+
+		return nil
+	}
+
+	if profiles.byNS == nil {
+		profiles.byNS = make(map[pusu.Namespace]*nsProfile)
+	}
+
+	ns := pusu.Namespace(p.name)
+	if _, ok := profiles.byNS[ns]; ok {
+		return fmt.Errorf("the namespace %q is given more than once", ns)
+	}
+
+	profiles.byNS[ns] = p
+
+	return nil
+}
+
+// loadProfiles reads the namespace profiles file. An empty filename gives
+// no profiles other than the default.
+func loadProfiles(filename string, profiles *nsProfiles) error {
+	if filename == "" {
+		return nil
+	}
+
+	f, err := os.Open(filename) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBadProfiles, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := profiles.parseLine(line); err != nil {
+			return fmt.Errorf("%w: %s:%d: %w",
+				errBadProfiles, filename, lineNum, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%w: %w", errBadProfiles, err)
+	}
+
+	return nil
+}
+
+// setDefaults completes the profiles. Any setting not given in the default
+// profile is set from the server-wide value and any setting not given in
+// the profile for a namespace is set from the default profile.
+func (profiles *nsProfiles) setDefaults(maxPending int) {
+	if profiles.dflt == nil {
+		profiles.dflt = &nsProfile{name: profileAnyNS}
+	}
+
+	d := profiles.dflt
+
+	d.backlog = cmp.Or(d.backlog, dfltBacklog)
+	d.overflow = cmp.Or(d.overflow, overflowDisconnect)
+	d.maxPayload = cmp.Or(d.maxPayload, pusu.MaxMessagePayload)
+	d.maxPending = cmp.Or(d.maxPending, maxPending)
+
+	for _, p := range profiles.byNS {
+		p.backlog = cmp.Or(p.backlog, d.backlog)
+		p.overflow = cmp.Or(p.overflow, d.overflow)
+		p.maxPayload = cmp.Or(p.maxPayload, d.maxPayload)
+		p.maxPending = cmp.Or(p.maxPending, d.maxPending)
+	}
+}
+
+// addRateLimits adds the rate limits given in the profiles to the
+// namespace rate limits. It returns a non-nil error if a namespace already
+// has a rate limit.
+func (profiles *nsProfiles) addRateLimits(rules *rateLimitRules) error {
+	for ns, p := range profiles.byNS {
+		if p.rateLimit == (rateLimit{}) {
+			continue
+		}
+
+		if _, ok := rules.byNamespace[ns]; ok {
+			return fmt.Errorf(
+				"%w: the namespace %q has a rate limit given by the %q"+
+					" parameter",
+				errBadProfiles, ns, paramNameRateLimitNamespace)
+		}
+
+		rules.byNamespace[ns] = newRateLimiter("namespace: "+p.name,
+			p.rateLimit)
+		rules.namespaceLimitStrs = append(rules.namespaceLimitStrs,
+			p.name+"="+p.rateLimit.String())
+	}
+
+	return nil
+}
+
+// checkNamespaces returns a non-nil error if any of the namespaces with a
+// profile is not allowed by the namespace rules
+func (profiles *nsProfiles) checkNamespaces(nsRules namespaceRules) error {
+	for ns := range profiles.byNS {
+		if !nsRules.isValid(ns) {
+			return fmt.Errorf("%w: the namespace %q is not allowed",
+				errBadProfiles, ns)
+		}
+	}
+
+	return nil
+}
+
+// forNamespace returns the profile for the namespace, or the default
+// profile if it has none
+func (profiles *nsProfiles) forNamespace(ns pusu.Namespace) *nsProfile {
+	if profiles == nil {
+		return nil
+	}
+
+	if p, ok := profiles.byNS[ns]; ok {
+		return p
+	}
+
+	return profiles.dflt
+}
+
+// chanSize returns the size of the channel through which messages are
+// sent to a client. It is big enough for the largest backlog.
+func (profiles *nsProfiles) chanSize() int {
+	if profiles == nil || profiles.dflt == nil {
+		return dfltBacklog
+	}
+
+	size := profiles.dflt.backlog
+
+	for _, p := range profiles.byNS {
+		size = max(size, p.backlog)
+	}
+
+	return size
+}
+
+// all returns the default profile followed by the profiles for the
+// namespaces in name order
+func (profiles *nsProfiles) all() []*nsProfile {
+	all := []*nsProfile{profiles.dflt}
+
+	for _, ns := range slices.Sorted(maps.Keys(profiles.byNS)) {
+		all = append(all, profiles.byNS[ns])
+	}
+
+	return all
+}
+
+// report logs the profiles
+func (profiles *nsProfiles) report(logger *slog.Logger) {
+	for _, p := range profiles.all() {
+		logger.Info("namespace profile",
+			slog.String("namespace", p.name),
+			slog.Int(profBacklog, p.backlog),
+			slog.String(profOverflow, string(p.overflow)),
+			slog.Int(profMaxPayload, p.maxPayload),
+			slog.Int(profMaxPending, p.maxPending))
+	}
+}
+
+// statusAttr returns a slog Attr giving, for each profile which drops
+// messages when a client's backlog is full, the count of messages dropped
+// since the last call. The counts are reset.
+func (profiles *nsProfiles) statusAttr() slog.Attr {
+	var attrs []any
+
+	for _, p := range profiles.all() {
+		if p.overflow == overflowDrop {
+			attrs = append(attrs, slog.Int64(p.name, p.dropped.Swap(0)))
+		}
+	}
+
+	return slog.Group("overflowDropped", attrs...)
+}
+
+// nsEntry returns the entry in the map for the namespace, adding it with
+// the namespace profile if it is not already there
+func (prog *prog) nsEntry(nsm namespaceSubsMap, ns pusu.Namespace) *nsSubs {
+	entry, ok := nsm[ns]
+	if !ok {
+		entry = &nsSubs{
+			topics:  make(subsMap),
+			profile: prog.profiles.forNamespace(ns),
+		}
+		nsm[ns] = entry
+	}
+
+	return entry
+}
+
+// nsProfile returns the profile for the namespace, taken from its entry in
+// the map if it has one
+func (prog *prog) nsProfile(
+	nsm namespaceSubsMap,
+	ns pusu.Namespace,
+) *nsProfile {
+	if entry, ok := nsm[ns]; ok {
+		return entry.profile
+	}
+
+	return prog.profiles.forNamespace(ns)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestNSProfilesParse(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		lines []string
+	}{
+		{
+			ID: testhelper.MkID("good"),
+			lines: []string{
+				"* backlog=50 durable-max-pending=100",
+				"prices overflow=drop backlog=500",
+				"audit max-payload=4096 rate-limit=100,20000",
+			},
+		},
+		{
+			ID:     testhelper.MkID("bad: no settings"),
+			ExpErr: testhelper.MkExpErr("expected a namespace and settings"),
+			lines:  []string{"prices"},
+		},
+		{
+			ID:     testhelper.MkID("bad: not setting=value"),
+			ExpErr: testhelper.MkExpErr(`bad setting "backlog"`),
+			lines:  []string{"prices backlog"},
+		},
+		{
+			ID:     testhelper.MkID("bad: unknown setting"),
+			ExpErr: testhelper.MkExpErr(`unknown setting "retain"`),
+			lines:  []string{"prices retain=true"},
+		},
+		{
+			ID:     testhelper.MkID("bad: zero backlog"),
+			ExpErr: testhelper.MkExpErr("must be greater than zero"),
+			lines:  []string{"prices backlog=0"},
+		},
+		{
+			ID:     testhelper.MkID("bad: unknown overflow policy"),
+			ExpErr: testhelper.MkExpErr(`bad overflow "block"`),
+			lines:  []string{"prices overflow=block"},
+		},
+		{
+			ID:     testhelper.MkID("bad: payload too big"),
+			ExpErr: testhelper.MkExpErr("it must not be more than"),
+			lines:  []string{"prices max-payload=999999999"},
+		},
+		{
+			ID:     testhelper.MkID("bad: default rate limit"),
+			ExpErr: testhelper.MkExpErr("the default profile cannot set"),
+			lines:  []string{"* rate-limit=10"},
+		},
+		{
+			ID:     testhelper.MkID("bad: repeated namespace"),
+			ExpErr: testhelper.MkExpErr("given more than once"),
+			lines:  []string{"prices backlog=5", "prices overflow=drop"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var (
+				profiles nsProfiles
+				err      error
+			)
+
+			for _, line := range tc.lines {
+				if err = profiles.parseLine(line); err != nil {
+					break
+				}
+			}
+
+			testhelper.CheckExpErr(t, err, tc)
+		})
+	}
+}
+
+func TestNSProfilesDefaults(t *testing.T) {
+	var profiles nsProfiles
+
+	for _, line := range []string{
+		"* backlog=50",
+		"prices overflow=drop backlog=500",
+		"audit max-payload=4096",
+	} {
+		if err := profiles.parseLine(line); err != nil {
+			t.Fatal("cannot parse the profiles:", err)
+		}
+	}
+
+	const maxPending = 1000
+
+	profiles.setDefaults(maxPending)
+
+	testCases := []struct {
+		testhelper.ID
+		ns            pusu.Namespace
+		expBacklog    int
+		expOverflow   overflowPolicy
+		expMaxPayload int
+	}{
+		{
+			ID:            testhelper.MkID("no profile"),
+			ns:            "other",
+			expBacklog:    50,
+			expOverflow:   overflowDisconnect,
+			expMaxPayload: pusu.MaxMessagePayload,
+		},
+		{
+			ID:            testhelper.MkID("own backlog and overflow"),
+			ns:            "prices",
+			expBacklog:    500,
+			expOverflow:   overflowDrop,
+			expMaxPayload: pusu.MaxMessagePayload,
+		},
+		{
+			ID:            testhelper.MkID("default backlog"),
+			ns:            "audit",
+			expBacklog:    50,
+			expOverflow:   overflowDisconnect,
+			expMaxPayload: 4096,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			p := profiles.forNamespace(tc.ns)
+
+			testhelper.DiffInt(t, tc.IDStr(), "backlog",
+				p.backlog, tc.expBacklog)
+			testhelper.DiffString(t, tc.IDStr(), "overflow",
+				p.overflow, tc.expOverflow)
+			testhelper.DiffInt(t, tc.IDStr(), "max payload",
+				p.maxPayload, tc.expMaxPayload)
+			testhelper.DiffInt(t, tc.IDStr(), "durable max pending",
+				p.maxPending, maxPending)
+		})
+	}
+
+	testhelper.DiffInt(t, "profiles", "channel size", profiles.chanSize(), 500)
+}
+
+func TestSendOverflow(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		overflow     overflowPolicy
+		expSent      int
+		expConnected bool
+		expDropped   int64
+	}{
+		{
+			ID:       testhelper.MkID("disconnect"),
+			overflow: overflowDisconnect,
+			expSent:  2,
+		},
+		{
+			ID:           testhelper.MkID("drop"),
+			overflow:     overflowDrop,
+			expSent:      2,
+			expConnected: true,
+			expDropped:   2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			conn, _ := net.Pipe()
+			clt := &client{
+				logger:    testLogger,
+				conn:      conn,
+				connected: true,
+				sendChan:  make(chan outMsg, 10),
+				profile:   &nsProfile{backlog: 2, overflow: tc.overflow},
+			}
+
+			sent := 0
+
+			for range 4 {
+				if clt.send(outMsg{msg: pusu.Message{MT: pusu.Ping}}) {
+					sent++
+				}
+			}
+
+			testhelper.DiffInt(t, tc.IDStr(), "sent", sent, tc.expSent)
+			testhelper.DiffBool(t, tc.IDStr(), "connected",
+				clt.connected, tc.expConnected)
+			testhelper.DiffInt(t, tc.IDStr(), "dropped",
+				clt.profile.dropped.Load(), tc.expDropped)
+		})
+	}
+}
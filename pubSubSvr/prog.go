@@ -2,11 +2,18 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/nickwells/pusu.mod/pusu"
@@ -15,10 +22,31 @@ import (
 
 // clientMessage holds a message and the client who sent it
 type clientMessage struct {
-	clt *client
-	msg *pusu.Message
+	clt  *client
+	msg  *pusu.Message
+	pubs []*publication // the publications, for Publish messages only
+
+	// itemErrs holds the errors for any bad publications in a batch and
+	// confirm is set if the server should acknowledge the publications once
+	// they have been sent to the subscribers. For Publish messages only.
+	itemErrs []batchItemError
+	confirm  bool
+	rcvd     time.Time // when the client received the message
+
+	// filters holds any subscription filters and durables holds the names
+	// of any durable subscriptions, for Subscribe messages only
+	filters  map[pusu.Topic]filter
+	durables map[pusu.Topic]string
 }
 
+// logFormat records the format in which log messages are written
+type logFormat string
+
+const (
+	logFormatText logFormat = "text"
+	logFormatJSON logFormat = "json"
+)
+
 // prog holds program parameters and status
 type prog struct {
 	exitStatus int
@@ -26,29 +54,97 @@ type prog struct {
 
 	// parameters
 	port                    int           // the port number to listen on
+	mqttPort                int           // the port for MQTT clients
+	httpPort                int           // the port for the HTTP gateway
 	logDir                  string        // the directory for the log files
 	statusReportingInterval time.Duration // how long between status reports
 	certInfo                pusu.CertInfo // certificates
 	logLevel                slog.Level    // level at which to log messages
+	logFormat               logFormat     // the format of log messages
+	logToFile               bool          // log to files in the logDir
+	logMaxSize              int64         // rotate log files bigger than this
+	logMaxAge               time.Duration // rotate log files older than this
+	logKeep                 int           // the number of old log files to keep
+	auditFile               string        // the file to write audit records to
+	traceEndpoint           string        // the OTLP endpoint to send spans to
+	traceFile               string        // the file to write spans to
 	progName                string        // the name of the program
 
 	nsRules namespaceRules // the rules governing which namespaces are valid
 
+	connLimits *connLimits    // the limits on connections and subscriptions
+	rlRules    rateLimitRules // the rate limits to apply to client messages
+	hdrLimits  headerLimits   // the limits on publication headers
+
+	schemaFile string          // the file giving the schema registry
+	schemas    *schemaRegistry // the schemas publications must match
+
+	routingFile string       // the file giving the routing rules
+	routes      routingRules // the rules for republishing publications
+
+	bridgesFile string    // the file giving the namespace bridges
+	bridges     nsBridges // the topics exported and imported
+
+	profilesFile string     // the file giving the namespace profiles
+	profiles     nsProfiles // the settings for each namespace
+
+	compression compressionConfig // the payload compression to allow
+
+	writeMaxLatency time.Duration // the longest time writes are held back
+
+	dedupWindow  time.Duration // how long idempotency keys are remembered
+	dedupMaxKeys int           // the most idempotency keys to remember
+	dedup        *dedupCache   // the recently seen idempotency keys
+
+	durableCfg durableConfig // the settings for durable subscriptions
+	durables   *durableSubs  // the durable subscriptions
+
+	snapshotFile     string        // the file to save subscriptions in
+	snapshotInterval time.Duration // how long between snapshots
+	snapshotMaxAge   time.Duration // how long unclaimed subscriptions last
+	savedSubs        *savedSubs    // subscriptions restored from a snapshot
+
 	// program data
-	logger *slog.Logger
+	logger   *slog.Logger
+	auditLog *auditLog
+	tracer   *tracer
 
 	handlers serverMsgHandlerMap
 
-	listener  net.Listener
-	tlsConfig *tls.Config
+	listener     net.Listener
+	mqttListener net.Listener
+	httpListener net.Listener
+	tlsConfig    *tls.Config
+
+	lastConnID atomic.Int64 // the ID of the last connection accepted
 
 	pubSubChan     chan clientMessage
 	disconnectChan chan *client
+
+	stop    chan struct{} // closed when the server is to stop
+	stopped chan struct{} // closed once the pubSubHandler has stopped
 }
 
 // newProg returns a new Prog instance with the default values set
 func newProg() *prog {
-	const dfltStatusInterval = 5
+	const (
+		dfltStatusInterval = 5
+		dfltLogMaxSize     = 100 * 1024 * 1024
+		dfltLogMaxAge      = 24 * time.Hour
+		dfltLogKeep        = 7
+		dfltMaxHeaders     = 32
+		dfltMaxHeaderSize  = 4096
+		dfltCompressMin    = 1024
+		dfltDedupWindow    = 5 * time.Minute
+		dfltDedupMaxKeys   = 100000
+		dfltRedelivery     = 30 * time.Second
+		dfltMaxAttempts    = 5
+		dfltMaxInflight    = 10
+		dfltMaxPending     = 10000
+		dfltDeadLetter     = "/$dead-letter"
+		dfltSnapshotIntvl  = time.Minute
+		dfltSnapshotMaxAge = 7 * 24 * time.Hour
+	)
 
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -61,9 +157,37 @@ func newProg() *prog {
 		logDir:                  filepath.Join(homeDir, "logs"),
 		statusReportingInterval: dfltStatusInterval * time.Second,
 		logLevel:                slog.LevelInfo,
-		handlers:                make(serverMsgHandlerMap),
-		pubSubChan:              make(chan clientMessage),
-		disconnectChan:          make(chan *client),
+		logFormat:               logFormatText,
+		logMaxSize:              dfltLogMaxSize,
+		logMaxAge:               dfltLogMaxAge,
+		logKeep:                 dfltLogKeep,
+		connLimits:              newConnLimits(),
+		rlRules:                 rateLimitRules{action: rlActionThrottle},
+		schemas:                 &schemaRegistry{},
+		dedupWindow:             dfltDedupWindow,
+		dedupMaxKeys:            dfltDedupMaxKeys,
+		snapshotInterval:        dfltSnapshotIntvl,
+		snapshotMaxAge:          dfltSnapshotMaxAge,
+		durableCfg: durableConfig{
+			redeliveryTimeout: dfltRedelivery,
+			maxAttempts:       dfltMaxAttempts,
+			maxInflight:       dfltMaxInflight,
+			maxPending:        dfltMaxPending,
+			deadLetterTopic:   dfltDeadLetter,
+		},
+		compression: compressionConfig{
+			allowed: []contentEncoding{encGzip, encDeflate},
+			minSize: dfltCompressMin,
+		},
+		hdrLimits: headerLimits{
+			maxCount: dfltMaxHeaders,
+			maxSize:  dfltMaxHeaderSize,
+		},
+		handlers:       make(serverMsgHandlerMap),
+		pubSubChan:     make(chan clientMessage),
+		disconnectChan: make(chan *client),
+		stop:           make(chan struct{}),
+		stopped:        make(chan struct{}),
 	}
 }
 
@@ -75,12 +199,73 @@ func (prog *prog) setExitStatus(es int) {
 	}
 }
 
-// startLogger initialises the logger for the program
-func (prog *prog) startLogger() {
-	prog.logger = slog.New(
-		slog.NewTextHandler(os.Stdout,
-			&slog.HandlerOptions{Level: prog.logLevel},
-		))
+// startLogger initialises the logger and the audit log for the program. If
+// the log file cannot be opened the error is reported on stderr, if the
+// audit file cannot be opened the error is logged. In either case the
+// exitStatus is set to non-zero and this will return false.
+func (prog *prog) startLogger() bool {
+	var w io.Writer = os.Stdout
+
+	if prog.logToFile {
+		rf, err := newRotatingFile(prog.logDir, prog.progName,
+			prog.logMaxSize, prog.logMaxAge, prog.logKeep)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "couldn't start logging:", err)
+			prog.setExitStatus(1)
+
+			return false
+		}
+
+		w = rf
+	}
+
+	opts := &slog.HandlerOptions{Level: prog.logLevel}
+
+	var h slog.Handler
+
+	switch prog.logFormat {
+	case logFormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		h = slog.NewTextHandler(w, opts)
+	}
+
+	prog.logger = slog.New(h)
+
+	var err error
+
+	if prog.auditLog, err = newAuditLog(prog.auditFile); err != nil {
+		prog.logger.Error("couldn't start the audit log", pusu.ErrorAttr(err))
+		prog.setExitStatus(1)
+
+		return false
+	}
+
+	return true
+}
+
+// startTracer creates the tracer if a trace endpoint or trace file has been
+// given. Any errors will be logged, will set the exitStatus to non-zero and
+// this will return false.
+func (prog *prog) startTracer() bool {
+	var err error
+
+	prog.tracer, err = newTracer(prog.logger,
+		prog.progName, prog.traceEndpoint, prog.traceFile)
+	if err != nil {
+		prog.logger.Error("couldn't start the tracer", pusu.ErrorAttr(err))
+		prog.setExitStatus(1)
+
+		return false
+	}
+
+	if prog.tracer != nil {
+		prog.logger.Info("tracing publications",
+			slog.String("endpoint", prog.traceEndpoint),
+			slog.String("file", prog.traceFile))
+	}
+
+	return true
 }
 
 // openListener constructs the tls listener. Any errors will be logged, will
@@ -128,43 +313,75 @@ func (prog *prog) openListener() bool {
 	return true
 }
 
-// reportAllowedNamespaces prints log messages listing the allowed namespace
-// values
+// reportAllowedNamespaces prints log messages describing the effective
+// namespace policy: the allow rules, if any, and the deny rules which take
+// precedence over them
 func (prog *prog) reportAllowedNamespaces() {
-	if len(prog.nsRules.allowed) > 0 {
-		prog.logger.Info("limited namespaces - only those matching are allowed",
-			slog.Int("namespace-count", len(prog.nsRules.allowed)))
+	rules := prog.nsRules
 
-		for n := range prog.nsRules.allowed {
-			prog.logger.Info("allowed namespace", n.Attr())
-		}
+	switch {
+	case rules.hasAllowRules():
+		prog.logger.Info(
+			"limited namespaces - only those matching an allow rule"+
+				" and no deny rule are allowed",
+			slog.Int("namespace-count", len(rules.allowed)),
+			slog.Int("prefix-count", len(rules.prefixes)),
+			slog.Int("pattern-count", len(rules.patterns)))
+	case rules.hasDenyRules():
+		prog.logger.Info(
+			"any namespace is allowed unless it matches a deny rule")
+	default:
+		prog.logger.Info("any namespace is allowed")
 
 		return
 	}
 
-	if len(prog.nsRules.prefixes) > 0 {
-		prog.logger.Info(
-			"limited namespaces - it must have one of the following prefixes",
-			slog.Int("prefix-count", len(prog.nsRules.prefixes)))
+	for _, n := range slices.Sorted(maps.Keys(rules.allowed)) {
+		prog.logger.Info("allowed namespace", n.Attr())
+	}
 
-		for _, pfx := range prog.nsRules.prefixes {
-			prog.logger.Info("allowed prefixes", slog.String("prefix", pfx))
-		}
+	for _, pfx := range rules.prefixes {
+		prog.logger.Info("allowed prefix", slog.String("prefix", pfx))
+	}
 
-		return
+	for _, re := range rules.patterns {
+		prog.logger.Info("allowed pattern",
+			slog.String("pattern", re.String()))
 	}
 
-	prog.logger.Info("any namespace is allowed")
+	for _, n := range slices.Sorted(maps.Keys(rules.denied)) {
+		prog.logger.Info("denied namespace", n.Attr())
+	}
+
+	for _, pfx := range rules.deniedPrefixes {
+		prog.logger.Info("denied prefix", slog.String("prefix", pfx))
+	}
+
+	for _, re := range rules.deniedPatterns {
+		prog.logger.Info("denied pattern",
+			slog.String("pattern", re.String()))
+	}
 }
 
 // run is the starting point for the program, it should be called from main()
 // after the command-line parameters have been parsed. Use the setExitStatus
 // method to record the exit status and then main can exit with that status.
 func (prog *prog) run() {
-	prog.startLogger()
+	if !prog.startLogger() {
+		return
+	}
 
 	prog.logger.Info("starting", progNameAttr(prog.progName))
 	prog.reportAllowedNamespaces()
+	prog.rlRules.report(prog.logger)
+	prog.schemas.report(prog.logger)
+	prog.routes.report(prog.logger)
+	prog.bridges.report(prog.logger)
+	prog.profiles.report(prog.logger)
+
+	if !prog.startTracer() {
+		return
+	}
 
 	if !prog.openListener() {
 		return
@@ -181,44 +398,141 @@ func (prog *prog) run() {
 		}
 	}()
 
-	var cID connID
+	if !prog.openMQTTListener() {
+		return
+	}
+
+	defer prog.closeMQTTListener()
+
+	if !prog.openHTTPListener() {
+		return
+	}
+
+	defer prog.closeHTTPListener()
+
+	prog.dedup = newDedupCache(prog.dedupWindow, prog.dedupMaxKeys)
+	prog.durables = newDurableSubs(prog.durableCfg)
+
+	if !prog.restoreSnapshot() {
+		return
+	}
+
+	shared := &clientShared{
+		pubSubChan:     prog.pubSubChan,
+		disconnectChan: prog.disconnectChan,
+		nsRules:        prog.nsRules,
+		connLimits:     prog.connLimits,
+		rlRules:        &prog.rlRules,
+		hdrLimits:      prog.hdrLimits,
+		schemas:        prog.schemas,
+		savedSubs:      prog.savedSubs,
+		compression:    prog.compression,
+		auditLog:       prog.auditLog,
+		tracer:         prog.tracer,
+		profiles:       &prog.profiles,
+
+		writeMaxLatency: prog.writeMaxLatency,
+	}
 
 	go prog.pubSubHandler()
 
+	if prog.mqttListener != nil {
+		go prog.acceptMQTT(shared)
+	}
+
+	if prog.httpListener != nil {
+		go prog.serveHTTP(shared)
+	}
+
+	go prog.acceptClients(shared)
+
+	prog.awaitStop()
+}
+
+// acceptClients accepts client connections on the listener and starts a
+// client for each of them until the listener is closed
+func (prog *prog) acceptClients(shared *clientShared) {
 	for {
 		conn, err := prog.listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
 			prog.logger.Error("couldn't Accept the client connection",
 				pusu.ErrorAttr(err))
 
 			continue
 		}
 
-		cID++
+		if err := prog.connLimits.admitConn(remoteIP(conn)); err != nil {
+			go rejectConn(prog.logger, prog.auditLog, conn, err)
+
+			continue
+		}
 
-		startClient(prog.logger,
-			cID,
-			conn,
-			prog.pubSubChan,
-			prog.disconnectChan,
-			prog.nsRules)
+		startClient(prog.logger, prog.nextConnID(), conn, shared)
 	}
 }
 
+// awaitStop waits until the program is interrupted or terminated and then
+// stops the pubSubHandler, waiting for it to write a final snapshot
+func (prog *prog) awaitStop() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	defer signal.Stop(sigs)
+
+	sig := <-sigs
+	prog.logger.Info("stopping", slog.String("signal", sig.String()))
+
+	close(prog.stop)
+	<-prog.stopped
+}
+
 // setAllHandlers populates the server-side message handlers
 func (prog *prog) setAllHandlers() {
 	prog.handlers.setAllEntries(serverProtocolError(
-		"only publish, subscribe or unsubscribe messages are expected"))
+		"only start, publish, subscribe, unsubscribe or ack messages" +
+			" are expected"))
 	prog.handlers.setEntries(serverHandlePublish, pusu.Publish)
 	prog.handlers.setEntries(serverHandleSubscribe, pusu.Subscribe)
 	prog.handlers.setEntries(serverHandleUnsubscribe, pusu.Unsubscribe)
+	prog.handlers.setEntries(serverHandleAck, pusu.Ack)
+	prog.handlers.setEntries(serverHandleStart, pusu.Start)
 }
 
 // pubSubHandler handles all the pings, publications, subscriptions and
-// unsubscribes
+// unsubscribes. It also sends again any publications to durable
+// subscriptions which have not been acknowledged in time and, if a
+// snapshot file has been given, periodically saves the subscriptions. The
+// snapshots are written by a single snapshotWriter, in the order they were
+// taken; a snapshot is skipped if the writer has still not started on the
+// last one. When the server is stopped a final snapshot is written before
+// the pubSubHandler returns.
 func (prog *prog) pubSubHandler() {
+	const redeliveryInterval = time.Second
+
 	subscriptions := make(namespaceSubsMap)
 	ticker := time.NewTicker(prog.statusReportingInterval)
+	redeliveryTicker := time.NewTicker(redeliveryInterval)
+
+	var (
+		snapshotC <-chan time.Time // only set if snapshots are taken
+		snapshots chan *snapshot   // the snapshots waiting to be written
+		written   chan struct{}    // closed once all snapshots are written
+	)
+
+	if prog.snapshotFile != "" {
+		snapshotC = time.NewTicker(prog.snapshotInterval).C
+		snapshots = make(chan *snapshot, 1)
+		written = make(chan struct{})
+
+		go prog.snapshotWriter(snapshots, written)
+	}
+
+	defer close(prog.stopped)
+
 	msgTypeCount := map[pusu.MsgType]int{}
 
 	prog.setAllHandlers()
@@ -238,7 +552,27 @@ func (prog *prog) pubSubHandler() {
 		case clt := <-prog.disconnectChan:
 			prog.logger.Info("server client disconnection received",
 				clt.cID.Attr())
-			removeClientSubs(clt, subscriptions)
+			prog.serverHandleDisconnect(clt, subscriptions)
+
+		case now := <-redeliveryTicker.C:
+			prog.redeliver(now, subscriptions)
+
+		case <-snapshotC:
+			select {
+			case snapshots <- prog.takeSnapshot(subscriptions):
+			default:
+				prog.logger.Warn("snapshot skipped" +
+					" - the last one is still waiting to be written")
+			}
+
+		case <-prog.stop:
+			if snapshots != nil {
+				snapshots <- prog.takeSnapshot(subscriptions)
+				close(snapshots)
+				<-written
+			}
+
+			return
 
 		case <-ticker.C:
 			go logStatus(prog, msgTypeCount, len(subscriptions))
@@ -248,16 +582,26 @@ func (prog *prog) pubSubHandler() {
 	}
 }
 
-// removeClientSubs removes all the subscriptions that the client has
-func removeClientSubs(clt *client, subscriptions namespaceSubsMap) {
+// removeClientSubs removes all the subscriptions that the client has,
+// publishing an event for each topic left with no subscribers
+func (prog *prog) removeClientSubs(
+	clt *client,
+	subscriptions namespaceSubsMap,
+) {
 	if len(clt.subs) != 0 {
-		subsMap := subscriptions[clt.namespace]
+		subsMap := subscriptions.topics(clt.namespace)
 		for t := range clt.subs {
 			cs := subsMap[t]
+			if _, ok := cs[clt]; !ok {
+				continue // a durable subscription
+			}
+
 			delete(cs, clt)
 
 			if len(cs) == 0 {
 				delete(subsMap, t)
+				prog.notifySubscription(clt.namespace, t, sysEventLastSub,
+					subscriptions)
 
 				if len(subsMap) == 0 {
 					delete(subscriptions, clt.namespace)
@@ -282,6 +626,15 @@ func logStatus(prog *prog, msgTypeCount map[pusu.MsgType]int, subsCount int) {
 
 	counts := slog.Group("msgType", attrs...)
 
-	prog.logger.Info("status", counts)
+	prog.logger.Info("status",
+		counts,
+		prog.connLimits.statusAttr(),
+		prog.rlRules.statusAttr(),
+		prog.dedup.statusAttr(),
+		prog.durables.statusAttr(),
+		prog.routes.statusAttr(),
+		prog.bridges.statusAttr(),
+		prog.profiles.statusAttr(),
+		prog.tracer.statusAttr())
 	prog.logger.Info("subscriptions", slog.Int("namespaces", subsCount))
 }
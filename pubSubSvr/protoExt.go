@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// The server recognises some additional fields in the message payloads
+// beyond those declared in the pusu protocol definitions. Clients which do
+// not know about them will ignore them (protobuf preserves unknown fields)
+// and so they can be added without changing the protocol version. The
+// field numbers are well above those used by the protocol so as not to
+// clash with any later additions to it.
+const (
+	// extPublishHeaders is a map<string, string> on the PublishMsgPayload
+	// giving metadata about the publication
+	extPublishHeaders protowire.Number = 100
+	// extPublishBatch is a repeated PublishMsgPayload on the
+	// PublishMsgPayload giving a batch of publications
+	extPublishBatch protowire.Number = 101
+	// extSubFilter is a string on the SubscriptionMsgPayload.Sub giving a
+	// filter expression to apply to publications on the topic
+	extSubFilter protowire.Number = 100
+	// extSubDurable is a string on the SubscriptionMsgPayload.Sub giving
+	// the name of a durable subscription to the topic
+	extSubDurable protowire.Number = 101
+	// extStartEncodings is a repeated string on the StartMsgPayload giving
+	// the payload compression schemes the client can accept
+	extStartEncodings protowire.Number = 100
+	// extStartConfirms is a bool on the StartMsgPayload requesting that
+	// publications are only acknowledged once they have been sent to the
+	// subscribers, with the Ack giving the delivery counts
+	extStartConfirms protowire.Number = 101
+	// extStartWill is a PublishMsgPayload on the StartMsgPayload giving a
+	// publication to make on the client's behalf if the connection ends
+	// abnormally
+	extStartWill protowire.Number = 102
+	// extAckEncoding is a string in the payload of the Ack to the Start
+	// message giving the payload compression scheme chosen by the server
+	extAckEncoding protowire.Number = 100
+	// extAckBatchErrors is a repeated message in the payload of the Ack to
+	// a batch of publications describing those which were skipped
+	extAckBatchErrors protowire.Number = 101
+	// extAckBatchErrCount is an integer in the payload of the Ack to a
+	// batch of publications giving the number which were skipped
+	extAckBatchErrCount protowire.Number = 102
+	// extAckConfirms is a bool in the payload of the Ack to the Start
+	// message showing that publications will be confirmed
+	extAckConfirms protowire.Number = 103
+	// extAckDelivered is an integer in the payload of the Ack to a
+	// confirmed publication giving the number of subscribers to which it
+	// was sent
+	extAckDelivered protowire.Number = 104
+	// extAckDropped is an integer in the payload of the Ack to a
+	// confirmed publication giving the number of subscribers for which it
+	// was dropped
+	extAckDropped protowire.Number = 105
+	// extAckRestored is an integer in the payload of the Ack to the Start
+	// message giving the number of saved subscriptions restored
+	extAckRestored protowire.Number = 106
+)
+
+// The field numbers of the key and value in an encoded map entry
+const (
+	mapEntryKey   protowire.Number = 1
+	mapEntryValue protowire.Number = 2
+)
+
+// errBadExt is the error returned when an extension field cannot be decoded
+var errBadExt = errors.New("bad extension field")
+
+// extErr returns an error describing the protowire parse error code
+func extErr(code int) error {
+	return fmt.Errorf("%w: %w", errBadExt, protowire.ParseError(code))
+}
+
+// walkExtFields calls the function with the field number, wire type and
+// encoded value of each of the unknown fields of the message.
+func walkExtFields(
+	m proto.Message,
+	f func(n protowire.Number, typ protowire.Type, val []byte),
+) error {
+	b := m.ProtoReflect().GetUnknown()
+
+	for len(b) > 0 {
+		n, typ, tagLen := protowire.ConsumeTag(b)
+		if tagLen < 0 {
+			return extErr(tagLen)
+		}
+
+		valLen := protowire.ConsumeFieldValue(n, typ, b[tagLen:])
+		if valLen < 0 {
+			return extErr(valLen)
+		}
+
+		f(n, typ, b[tagLen:tagLen+valLen])
+
+		b = b[tagLen+valLen:]
+	}
+
+	return nil
+}
+
+// extFields returns the values of the unknown fields of the message having
+// the given field number and the bytes wire type. Any other fields are
+// ignored.
+func extFields(m proto.Message, num protowire.Number) ([][]byte, error) {
+	var vals [][]byte
+
+	err := walkExtFields(m,
+		func(n protowire.Number, typ protowire.Type, val []byte) {
+			if n == num && typ == protowire.BytesType {
+				v, _ := protowire.ConsumeBytes(val)
+				vals = append(vals, v)
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return vals, nil
+}
+
+// getExtBool returns the value of the bool extension field with the given
+// field number. It returns false if the field is not present.
+func getExtBool(m proto.Message, num protowire.Number) (bool, error) {
+	var v uint64
+
+	err := walkExtFields(m,
+		func(n protowire.Number, typ protowire.Type, val []byte) {
+			if n == num && typ == protowire.VarintType {
+				v, _ = protowire.ConsumeVarint(val)
+			}
+		})
+
+	return v != 0, err
+}
+
+// setExtFields replaces any unknown fields of the message having the given
+// field number with the supplied values (encoded with the bytes wire type).
+func setExtFields(m proto.Message, num protowire.Number, vals [][]byte) {
+	var kept []byte
+
+	b := m.ProtoReflect().GetUnknown()
+
+	for len(b) > 0 {
+		n, typ, tagLen := protowire.ConsumeTag(b)
+		if tagLen < 0 {
+			break
+		}
+
+		valLen := protowire.ConsumeFieldValue(n, typ, b[tagLen:])
+		if valLen < 0 {
+			break
+		}
+
+		if n != num {
+			kept = append(kept, b[:tagLen+valLen]...)
+		}
+
+		b = b[tagLen+valLen:]
+	}
+
+	for _, v := range vals {
+		kept = protowire.AppendTag(kept, num, protowire.BytesType)
+		kept = protowire.AppendBytes(kept, v)
+	}
+
+	m.ProtoReflect().SetUnknown(kept)
+}
+
+// getExtString returns the string extension field with the given field
+// number. If the field is repeated the last value is returned, as for a
+// normal protobuf field.
+func getExtString(m proto.Message, num protowire.Number) (string, error) {
+	vals, err := extFields(m, num)
+	if err != nil || len(vals) == 0 {
+		return "", err
+	}
+
+	return string(vals[len(vals)-1]), nil
+}
+
+// getExtStrings returns all the values of the repeated string extension
+// field with the given field number.
+func getExtStrings(m proto.Message, num protowire.Number) ([]string, error) {
+	vals, err := extFields(m, num)
+	if err != nil {
+		return nil, err
+	}
+
+	strs := make([]string, 0, len(vals))
+	for _, v := range vals {
+		strs = append(strs, string(v))
+	}
+
+	return strs, nil
+}
+
+// decodeMapEntry decodes a map<string, string> entry
+func decodeMapEntry(b []byte) (string, string, error) {
+	var k, v string
+
+	for len(b) > 0 {
+		n, typ, tagLen := protowire.ConsumeTag(b)
+		if tagLen < 0 {
+			return k, v, extErr(tagLen)
+		}
+
+		b = b[tagLen:]
+
+		if typ != protowire.BytesType {
+			valLen := protowire.ConsumeFieldValue(n, typ, b)
+			if valLen < 0 {
+				return k, v, extErr(valLen)
+			}
+
+			b = b[valLen:]
+
+			continue
+		}
+
+		s, valLen := protowire.ConsumeString(b)
+		if valLen < 0 {
+			return k, v, extErr(valLen)
+		}
+
+		switch n {
+		case mapEntryKey:
+			k = s
+		case mapEntryValue:
+			v = s
+		}
+
+		b = b[valLen:]
+	}
+
+	return k, v, nil
+}
+
+// getExtMap returns the map<string, string> extension field with the given
+// field number. It returns a nil map if the field is not present.
+func getExtMap(
+	m proto.Message,
+	num protowire.Number,
+) (map[string]string, error) {
+	entries, err := extFields(m, num)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+
+	vals := make(map[string]string, len(entries))
+
+	for _, e := range entries {
+		k, v, err := decodeMapEntry(e)
+		if err != nil {
+			return nil, err
+		}
+
+		vals[k] = v
+	}
+
+	return vals, nil
+}
+
+// setExtMap replaces the map<string, string> extension field with the given
+// field number. The entries are written in key order so that the encoding
+// is deterministic.
+func setExtMap(
+	m proto.Message,
+	num protowire.Number,
+	vals map[string]string,
+) {
+	entries := make([][]byte, 0, len(vals))
+
+	for _, k := range slices.Sorted(maps.Keys(vals)) {
+		var e []byte
+
+		e = protowire.AppendTag(e, mapEntryKey, protowire.BytesType)
+		e = protowire.AppendString(e, k)
+		e = protowire.AppendTag(e, mapEntryValue, protowire.BytesType)
+		e = protowire.AppendString(e, vals[k])
+
+		entries = append(entries, e)
+	}
+
+	setExtFields(m, num, entries)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestExtMap(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		hdrs map[string]string
+	}{
+		{
+			ID: testhelper.MkID("no headers"),
+		},
+		{
+			ID:   testhelper.MkID("one header"),
+			hdrs: map[string]string{"content-type": "application/json"},
+		},
+		{
+			ID: testhelper.MkID("several headers, one empty"),
+			hdrs: map[string]string{
+				"content-type": "application/json",
+				"origin":       "test",
+				"empty":        "",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			pmp := &pusu.PublishMsgPayload{
+				Topic:   "/a/b",
+				Payload: []byte("payload"),
+			}
+			setExtMap(pmp, extPublishHeaders, tc.hdrs)
+
+			b, err := proto.Marshal(pmp)
+			if err != nil {
+				t.Fatal("unexpected marshal error:", err)
+			}
+
+			var rcvd pusu.PublishMsgPayload
+			if err = proto.Unmarshal(b, &rcvd); err != nil {
+				t.Fatal("unexpected unmarshal error:", err)
+			}
+
+			testhelper.DiffString(t, tc.IDStr(), "topic",
+				rcvd.Topic, pmp.Topic)
+
+			hdrs, err := getExtMap(&rcvd, extPublishHeaders)
+			if err != nil {
+				t.Fatal("unexpected error getting the headers:", err)
+			}
+
+			if err = testhelper.DiffVals(hdrs, tc.hdrs); err != nil {
+				t.Log(tc.IDStr())
+				t.Errorf("\t: bad headers: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// noteTextPublishBatch describes how a batch of publications is sent
+const noteTextPublishBatch = "A publisher may send many publications in a" +
+	" single Publish message. Each publication is encoded as a Publish" +
+	" message payload, with its own topic, payload and headers, and" +
+	" the batch is carried in field number 101 of the Publish message" +
+	" payload as a repeated field of these. The Publish message must" +
+	" then have no topic or payload of its own." +
+	"\n\n" +
+	"The publications in the batch are checked individually; any which" +
+	" are bad are skipped and the rest are published together, in the" +
+	" order given, with no other publication between them. The batch is" +
+	" acknowledged with a single Ack message. If any of the publications" +
+	" were skipped the Ack payload holds, in field number 101, an entry" +
+	" for each of them giving its index in the batch (field 1, counting" +
+	" from zero) and the reason it was skipped (field 2). Field number" +
+	" 102 of the Ack payload gives the number skipped; if there are too" +
+	" many to fit in the Ack only the first are described." +
+	"\n\n" +
+	"Each publication in the batch counts as one message against any" +
+	" rate limits."
+
+// errBadBatch is the error returned when a batch of publications cannot be
+// decoded
+var errBadBatch = errors.New("bad publication batch")
+
+// The field numbers of the parts of an entry in the list of batch errors
+const (
+	batchErrIndex protowire.Number = 1
+	batchErrText  protowire.Number = 2
+)
+
+// batchItemError records why a publication in a batch was skipped
+type batchItemError struct {
+	index int
+	err   error
+}
+
+// clientHandlePublishBatch handles a Publish message carrying a batch of
+// publications. Each publication is checked as for a single publication
+// and those which are good are handed on to the server together. The
+// message is acknowledged once, reporting any bad publications. If the
+// client has asked for confirms the server sends the Ack once the
+// publications have been sent to the subscribers.
+func clientHandlePublishBatch(
+	clt *client,
+	msg *pusu.Message,
+	pmp *pusu.PublishMsgPayload,
+	items [][]byte,
+	rcvd time.Time,
+) error {
+	if pmp.Topic != "" || len(pmp.Payload) > 0 {
+		return fmt.Errorf("%w: a batch must not have its own topic or payload",
+			errBadBatch)
+	}
+
+	pubs := make([]*publication, 0, len(items))
+
+	var itemErrs []batchItemError
+
+	for i, item := range items {
+		pub, err := clt.prepareBatchItem(item)
+		if err != nil {
+			clt.logger.Error("bad publication in the batch",
+				slog.Int("index", i), pusu.ErrorAttr(err))
+
+			itemErrs = append(itemErrs, batchItemError{index: i, err: err})
+
+			continue
+		}
+
+		pubs = append(pubs, pub)
+	}
+
+	if len(pubs) > 0 || clt.confirms {
+		clt.pubSubChan <- clientMessage{
+			clt:      clt,
+			msg:      msg,
+			pubs:     pubs,
+			itemErrs: itemErrs,
+			confirm:  clt.confirms,
+			rcvd:     rcvd,
+		}
+	}
+
+	if !clt.confirms {
+		clt.sendMessage(publishAck(msg.MsgID, itemErrs, nil))
+	}
+
+	return nil
+}
+
+// prepareBatchItem decodes a publication from a batch and prepares it as
+// for a single publication
+func (clt *client) prepareBatchItem(item []byte) (*publication, error) {
+	pmp := &pusu.PublishMsgPayload{}
+
+	if err := proto.Unmarshal(item, pmp); err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadBatch, err)
+	}
+
+	nested, err := extFields(pmp, extPublishBatch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadBatch, err)
+	}
+
+	if len(nested) > 0 {
+		return nil, fmt.Errorf("%w: batches may not be nested", errBadBatch)
+	}
+
+	return clt.preparePublication(pmp)
+}
+
+// appendBatchErrs appends to the Ack payload the count of the publications
+// in a batch which were skipped and as many of the reasons as will fit in
+// the message.
+func appendBatchErrs(payload []byte, itemErrs []batchItemError) []byte {
+	if len(itemErrs) == 0 {
+		return payload
+	}
+
+	payload = protowire.AppendTag(payload, extAckBatchErrCount,
+		protowire.VarintType)
+	payload = protowire.AppendVarint(payload, uint64(len(itemErrs)))
+
+	for _, ie := range itemErrs {
+		var e []byte
+
+		e = protowire.AppendTag(e, batchErrIndex, protowire.VarintType)
+		e = protowire.AppendVarint(e, uint64(ie.index)) //nolint:gosec
+		e = protowire.AppendTag(e, batchErrText, protowire.BytesType)
+		e = protowire.AppendString(e, ie.err.Error())
+
+		entry := protowire.AppendTag(nil, extAckBatchErrors,
+			protowire.BytesType)
+		entry = protowire.AppendBytes(entry, e)
+
+		if len(payload)+len(entry) > pusu.MaxMessagePayload {
+			break
+		}
+
+		payload = append(payload, entry...)
+	}
+
+	return payload
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// batchMsg returns a Publish message carrying the publications as a batch
+func batchMsg(t *testing.T, outer *pusu.PublishMsgPayload,
+	items ...*pusu.PublishMsgPayload,
+) *pusu.Message {
+	t.Helper()
+
+	vals := make([][]byte, 0, len(items))
+
+	for _, item := range items {
+		b, err := proto.Marshal(item)
+		if err != nil {
+			t.Fatal("cannot marshal the batch item:", err)
+		}
+
+		vals = append(vals, b)
+	}
+
+	setExtFields(outer, extPublishBatch, vals)
+
+	msg := &pusu.Message{MT: pusu.Publish, MsgID: 42}
+	if err := msg.Marshal(outer, testLogger); err != nil {
+		t.Fatal("cannot marshal the batch:", err)
+	}
+
+	return msg
+}
+
+// batchErrIndexes returns the count of skipped publications and the indexes
+// of those described in the Ack payload
+func batchErrIndexes(t *testing.T, payload []byte) (int, []int) {
+	t.Helper()
+
+	count := 0
+
+	var idxs []int
+
+	for len(payload) > 0 {
+		n, typ, tagLen := protowire.ConsumeTag(payload)
+		valLen := protowire.ConsumeFieldValue(n, typ, payload[tagLen:])
+
+		if valLen < 0 {
+			t.Fatal("bad Ack payload:", protowire.ParseError(valLen))
+		}
+
+		switch n {
+		case extAckBatchErrCount:
+			v, _ := protowire.ConsumeVarint(payload[tagLen:])
+			count = int(v) //nolint:gosec
+		case extAckBatchErrors:
+			e, _ := protowire.ConsumeBytes(payload[tagLen:])
+			_, _, l := protowire.ConsumeTag(e)
+			v, _ := protowire.ConsumeVarint(e[l:])
+			idxs = append(idxs, int(v)) //nolint:gosec
+		}
+
+		payload = payload[tagLen+valLen:]
+	}
+
+	return count, idxs
+}
+
+func TestPublishBatch(t *testing.T) {
+	good := &pusu.PublishMsgPayload{Topic: "/a", Payload: []byte("1")}
+	badHdr := &pusu.PublishMsgPayload{Topic: "/b", Payload: []byte("2")}
+	setExtMap(badHdr, extPublishHeaders, map[string]string{"Bad": "x"})
+
+	nested := &pusu.PublishMsgPayload{}
+	setExtFields(nested, extPublishBatch, [][]byte{{}})
+
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		outer      *pusu.PublishMsgPayload
+		items      []*pusu.PublishMsgPayload
+		expPubs    []string
+		expErrIdxs []int
+	}{
+		{
+			ID:      testhelper.MkID("all good"),
+			outer:   &pusu.PublishMsgPayload{},
+			items:   []*pusu.PublishMsgPayload{good, good},
+			expPubs: []string{"/a", "/a"},
+		},
+		{
+			ID:         testhelper.MkID("some bad"),
+			outer:      &pusu.PublishMsgPayload{},
+			items:      []*pusu.PublishMsgPayload{badHdr, good, nested},
+			expPubs:    []string{"/a"},
+			expErrIdxs: []int{0, 2},
+		},
+		{
+			ID:         testhelper.MkID("all bad"),
+			outer:      &pusu.PublishMsgPayload{},
+			items:      []*pusu.PublishMsgPayload{badHdr},
+			expErrIdxs: []int{0},
+		},
+		{
+			ID: testhelper.MkID("bad: batch with a topic"),
+			ExpErr: testhelper.MkExpErr("bad publication batch",
+				"must not have its own topic"),
+			outer: &pusu.PublishMsgPayload{Topic: "/x"},
+			items: []*pusu.PublishMsgPayload{good},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			clt := &client{
+				logger:    testLogger,
+				connected: true,
+				sendChan:  make(chan outMsg, 1),
+				clientShared: &clientShared{
+					pubSubChan: make(chan clientMessage, 1),
+					schemas:    &schemaRegistry{},
+				},
+			}
+
+			err := clientHandlePublish(clt, batchMsg(t, tc.outer, tc.items...))
+			if !testhelper.CheckExpErr(t, err, tc) || err != nil {
+				return
+			}
+
+			var pubs []string
+
+			select {
+			case cMsg := <-clt.pubSubChan:
+				for _, pub := range cMsg.pubs {
+					pubs = append(pubs, pub.pmp.Topic)
+				}
+			default:
+			}
+
+			testhelper.DiffStringSlice(t, tc.IDStr(), "publications",
+				pubs, tc.expPubs)
+
+			ack := <-clt.sendChan
+			testhelper.DiffString(t, tc.IDStr(), "message type",
+				ack.msg.MT.String(), pusu.Ack.String())
+
+			count, idxs := batchErrIndexes(t, ack.msg.Payload)
+			testhelper.DiffInt(t, tc.IDStr(), "error count",
+				count, len(tc.expErrIdxs))
+			testhelper.DiffSlice(t, tc.IDStr(), "error indexes",
+				idxs, tc.expErrIdxs)
+		})
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// rateLimitAction records what to do with a message which exceeds a rate
+// limit
+type rateLimitAction string
+
+const (
+	rlActionThrottle   rateLimitAction = "throttle"
+	rlActionReject     rateLimitAction = "reject"
+	rlActionDisconnect rateLimitAction = "disconnect"
+)
+
+// errRateLimited is the error reported when a message exceeds a rate limit
+var errRateLimited = errors.New("rate limit exceeded")
+
+// maxThrottleWait is the longest that the reader of a throttled client will
+// wait before handling a message. It stops one large message, or a burst
+// far over the limits, from stalling the reader for an unbounded time.
+const maxThrottleWait = 5 * time.Second
+
+// errMsgRejected is wrapped by the errors returned from a message handler
+// when the message has been refused but the client may stay connected
+var errMsgRejected = errors.New("message rejected")
+
+// tokenBucket implements a simple token-bucket rate limiter. The bucket
+// holds at most one second's worth of tokens.
+type tokenBucket struct {
+	rate     float64 // tokens added per second
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// newTokenBucket returns a full token bucket refilling at the given rate
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{
+		rate:     rate,
+		capacity: rate,
+		tokens:   rate,
+	}
+}
+
+// refill adds any tokens accumulated since the last refill
+func (tb *tokenBucket) refill(now time.Time) {
+	if !tb.last.IsZero() {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		tb.tokens = min(tb.tokens, tb.capacity)
+	}
+
+	tb.last = now
+}
+
+// canTake returns true if n tokens are available. A full bucket will always
+// allow the tokens to be taken, even if n is greater than the capacity, so
+// that a single large request is never blocked forever.
+func (tb *tokenBucket) canTake(n float64) bool {
+	return tb.tokens >= n || tb.tokens >= tb.capacity
+}
+
+// take removes n tokens from the bucket and returns the time to wait until
+// the bucket is no longer in debt.
+func (tb *tokenBucket) take(n float64) time.Duration {
+	tb.tokens -= n
+	if tb.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// rateLimit holds the limits on the number of messages and bytes per
+// second. A zero value means that there is no limit.
+type rateLimit struct {
+	msgsPerSec  float64
+	bytesPerSec float64
+}
+
+// String returns a string representation of the rateLimit
+func (rl rateLimit) String() string {
+	return fmt.Sprintf("%g msgs/sec, %g bytes/sec",
+		rl.msgsPerSec, rl.bytesPerSec)
+}
+
+// parseRateLimit parses a string of the form: "msgs-per-sec,bytes-per-sec"
+// and returns the corresponding rateLimit. Either part may be zero,
+// meaning no limit, and the bytes part may be omitted.
+func parseRateLimit(s string) (rateLimit, error) {
+	var rl rateLimit
+
+	const maxParts = 2
+
+	parts := strings.Split(s, ",")
+	if len(parts) > maxParts {
+		return rl, fmt.Errorf(
+			"bad rate limit %q - expected: msgs-per-sec[,bytes-per-sec]", s)
+	}
+
+	vals := []*float64{&rl.msgsPerSec, &rl.bytesPerSec}
+
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return rl, fmt.Errorf("bad rate limit %q: %w", s, err)
+		}
+
+		if v < 0 {
+			return rl, fmt.Errorf("bad rate limit %q - must not be negative", s)
+		}
+
+		*vals[i] = v
+	}
+
+	return rl, nil
+}
+
+// parseNamedRateLimit parses a string of the form:
+// "name=msgs-per-sec,bytes-per-sec" and returns the name and the
+// corresponding rateLimit.
+func parseNamedRateLimit(s string) (string, rateLimit, error) {
+	name, limit, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return "", rateLimit{}, fmt.Errorf(
+			"bad rate limit %q - expected: name=msgs-per-sec[,bytes-per-sec]",
+			s)
+	}
+
+	rl, err := parseRateLimit(limit)
+
+	return name, rl, err
+}
+
+// rateLimiter applies a rateLimit. It may be shared between clients so it
+// is protected by a mutex.
+type rateLimiter struct {
+	sync.Mutex
+
+	name  string
+	msgs  *tokenBucket
+	bytes *tokenBucket
+}
+
+// newRateLimiter returns a rateLimiter applying the given limit
+func newRateLimiter(name string, rl rateLimit) *rateLimiter {
+	limiter := &rateLimiter{name: name}
+
+	if rl.msgsPerSec > 0 {
+		limiter.msgs = newTokenBucket(rl.msgsPerSec)
+	}
+
+	if rl.bytesPerSec > 0 {
+		limiter.bytes = newTokenBucket(rl.bytesPerSec)
+	}
+
+	return limiter
+}
+
+// buckets returns the buckets in use and the number of tokens to be taken
+// from each for the given number of messages of the given total size
+func (limiter *rateLimiter) buckets(
+	msgs, size int,
+) ([]*tokenBucket, []float64) {
+	var tbs []*tokenBucket
+
+	var counts []float64
+
+	if limiter.msgs != nil {
+		tbs = append(tbs, limiter.msgs)
+		counts = append(counts, float64(msgs))
+	}
+
+	if limiter.bytes != nil {
+		tbs = append(tbs, limiter.bytes)
+		counts = append(counts, float64(size))
+	}
+
+	return tbs, counts
+}
+
+// tryTake takes tokens for the messages of the given total size if they are
+// all available and returns true. Otherwise it takes nothing and returns
+// false.
+func (limiter *rateLimiter) tryTake(msgs, size int, now time.Time) bool {
+	return tryTakeAll([]*rateLimiter{limiter}, msgs, size, now) == nil
+}
+
+// tryTakeAll takes tokens for the messages of the given total size from
+// every limiter if they are all available and returns nil. Otherwise it
+// takes nothing and returns the first limiter which would be exceeded. The
+// limiters are locked in the order given so they must always be passed in
+// the same order, as returned by limitersFor.
+func tryTakeAll(
+	limiters []*rateLimiter,
+	msgs, size int,
+	now time.Time,
+) *rateLimiter {
+	for _, limiter := range limiters {
+		limiter.Lock()
+		defer limiter.Unlock()
+	}
+
+	for _, limiter := range limiters {
+		tbs, counts := limiter.buckets(msgs, size)
+
+		for i, tb := range tbs {
+			tb.refill(now)
+
+			if !tb.canTake(counts[i]) {
+				return limiter
+			}
+		}
+	}
+
+	for _, limiter := range limiters {
+		tbs, counts := limiter.buckets(msgs, size)
+
+		for i, tb := range tbs {
+			tb.take(counts[i])
+		}
+	}
+
+	return nil
+}
+
+// reserve takes tokens for the messages of the given total size and returns
+// the time to wait before the messages may be processed.
+func (limiter *rateLimiter) reserve(
+	msgs, size int,
+	now time.Time,
+) time.Duration {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	var wait time.Duration
+
+	tbs, counts := limiter.buckets(msgs, size)
+
+	for i, tb := range tbs {
+		tb.refill(now)
+		wait = max(wait, tb.take(counts[i]))
+	}
+
+	return wait
+}
+
+// rateLimitRules records the rate limits to apply to client messages and
+// the action to take when a limit is exceeded. A client is limited by the
+// per-identity limit for its certificate identity or else by the per-client
+// limit. In addition all the clients in a namespace share the limit for
+// that namespace.
+type rateLimitRules struct {
+	action rateLimitAction
+
+	clientLimitStr string
+	clientLimit    rateLimit
+
+	namespaceLimitStrs []string
+	byNamespace        map[pusu.Namespace]*rateLimiter
+
+	identityLimitStrs []string
+	byIdentity        map[string]*rateLimiter
+
+	throttled    atomic.Int64
+	rejected     atomic.Int64
+	disconnected atomic.Int64
+}
+
+// parseLimits parses the rate limit strings set by the parameters and
+// constructs the shared rate limiters.
+func (rules *rateLimitRules) parseLimits() error {
+	var err error
+
+	if rules.clientLimitStr != "" {
+		if rules.clientLimit, err = parseRateLimit(
+			rules.clientLimitStr); err != nil {
+			return err
+		}
+	}
+
+	rules.byNamespace = make(map[pusu.Namespace]*rateLimiter)
+
+	for _, s := range rules.namespaceLimitStrs {
+		name, rl, err := parseNamedRateLimit(s)
+		if err != nil {
+			return err
+		}
+
+		rules.byNamespace[pusu.Namespace(name)] = newRateLimiter(
+			"namespace: "+name, rl)
+	}
+
+	rules.byIdentity = make(map[string]*rateLimiter)
+
+	for _, s := range rules.identityLimitStrs {
+		name, rl, err := parseNamedRateLimit(s)
+		if err != nil {
+			return err
+		}
+
+		rules.byIdentity[name] = newRateLimiter("identity: "+name, rl)
+	}
+
+	return nil
+}
+
+// limitersFor returns the rate limiters which apply to a client with the
+// given certificate identity and namespace.
+func (rules *rateLimitRules) limitersFor(
+	certID string,
+	ns pusu.Namespace,
+) []*rateLimiter {
+	var limiters []*rateLimiter
+
+	if limiter, ok := rules.byIdentity[certID]; ok {
+		limiters = append(limiters, limiter)
+	} else if rules.clientLimit != (rateLimit{}) {
+		limiters = append(limiters,
+			newRateLimiter("client", rules.clientLimit))
+	}
+
+	if limiter, ok := rules.byNamespace[ns]; ok {
+		limiters = append(limiters, limiter)
+	}
+
+	return limiters
+}
+
+// report logs the configured rate limits
+func (rules *rateLimitRules) report(logger *slog.Logger) {
+	if rules.clientLimit != (rateLimit{}) {
+		logger.Info("rate limit", slog.String("limit", "client"),
+			slog.String("value", rules.clientLimit.String()))
+	}
+
+	for _, s := range rules.namespaceLimitStrs {
+		logger.Info("rate limit", slog.String("limit", "namespace"),
+			slog.String("value", s))
+	}
+
+	for _, s := range rules.identityLimitStrs {
+		logger.Info("rate limit", slog.String("limit", "identity"),
+			slog.String("value", s))
+	}
+}
+
+// statusAttr returns a slog Attr giving the counts of rate-limited messages
+// since the last call. The counts are reset.
+func (rules *rateLimitRules) statusAttr() slog.Attr {
+	return slog.Group("rateLimited",
+		slog.Int64(string(rlActionThrottle), rules.throttled.Swap(0)),
+		slog.Int64(string(rlActionReject), rules.rejected.Swap(0)),
+		slog.Int64(string(rlActionDisconnect), rules.disconnected.Swap(0)))
+}
+
+// applyRateLimits checks the message against the client's rate limits and
+// takes the configured action if any limit is exceeded. It returns a
+// non-nil error if the message should not be processed; if the message is
+// only to be rejected the error wraps errMsgRejected and the client should
+// not be disconnected, otherwise it wraps errRateLimited, the disconnection
+// has been audited and the close reason recorded and the client should be
+// disconnected. The message counts as msgs messages against the limits, so
+// that a batch of publications counts as the number of publications in
+// it. No tokens are taken unless every limit allows the message. A
+// throttled client waits no longer than maxThrottleWait for any one
+// message; the tokens taken still count against it so a client which keeps
+// exceeding its limits is slowed to them over successive messages.
+func (clt *client) applyRateLimits(msg *pusu.Message, msgs int) error {
+	if len(clt.limiters) == 0 {
+		return nil
+	}
+
+	size := len(msg.Payload)
+	now := time.Now()
+
+	if clt.rlRules.action == rlActionThrottle {
+		var wait time.Duration
+
+		for _, limiter := range clt.limiters {
+			wait = max(wait, limiter.reserve(msgs, size, now))
+		}
+
+		if wait > 0 {
+			clt.rlRules.throttled.Add(1)
+			clt.logger.Debug("throttling client",
+				msg.MT.Attr(), msg.MsgID.Attr(),
+				slog.Duration("wait", wait),
+				slog.Duration("waited", min(wait, maxThrottleWait)))
+			time.Sleep(min(wait, maxThrottleWait))
+		}
+
+		return nil
+	}
+
+	limiter := tryTakeAll(clt.limiters, msgs, size, now)
+	if limiter == nil {
+		return nil
+	}
+
+	err := fmt.Errorf("%w (%s)", errRateLimited, limiter.name)
+
+	clt.logger.Error("rate limit exceeded",
+		msg.MT.Attr(), msg.MsgID.Attr(),
+		slog.String("limit", limiter.name),
+		slog.String("action", string(clt.rlRules.action)))
+
+	if clt.rlRules.action == rlActionDisconnect {
+		clt.rlRules.disconnected.Add(1)
+		clt.setCloseReason(closeReasonRateLimit, err)
+		clt.audit(auditEvtRateLimit, auditDisconnected, err)
+
+		return err
+	}
+
+	clt.rlRules.rejected.Add(1)
+
+	return fmt.Errorf("%w: %w", errMsgRejected, err)
+}
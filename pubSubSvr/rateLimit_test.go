@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		s      string
+		expMsg float64
+		expB   float64
+	}{
+		{
+			ID:     testhelper.MkID("msgs only"),
+			s:      "10",
+			expMsg: 10,
+		},
+		{
+			ID:     testhelper.MkID("msgs and bytes"),
+			s:      "10, 2048",
+			expMsg: 10,
+			expB:   2048,
+		},
+		{
+			ID:     testhelper.MkID("bytes only"),
+			s:      "0,1000",
+			expMsg: 0,
+			expB:   1000,
+		},
+		{
+			ID:     testhelper.MkID("bad: too many parts"),
+			ExpErr: testhelper.MkExpErr(`bad rate limit "1,2,3"`),
+			s:      "1,2,3",
+		},
+		{
+			ID:     testhelper.MkID("bad: negative"),
+			ExpErr: testhelper.MkExpErr("must not be negative"),
+			s:      "-1",
+		},
+		{
+			ID:     testhelper.MkID("bad: not a number"),
+			ExpErr: testhelper.MkExpErr(`bad rate limit "x"`),
+			s:      "x",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			rl, err := parseRateLimit(tc.s)
+			if testhelper.CheckExpErr(t, err, tc) && err == nil {
+				testhelper.DiffFloat(t, tc.IDStr(), "msgs/sec",
+					rl.msgsPerSec, tc.expMsg, 0)
+				testhelper.DiffFloat(t, tc.IDStr(), "bytes/sec",
+					rl.bytesPerSec, tc.expB, 0)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Now()
+	limiter := newRateLimiter("test", rateLimit{msgsPerSec: 2})
+
+	testhelper.DiffBool(t, "first message", "allowed",
+		limiter.tryTake(1, 0, start), true)
+	testhelper.DiffBool(t, "second message", "allowed",
+		limiter.tryTake(1, 0, start), true)
+	testhelper.DiffBool(t, "third message", "allowed",
+		limiter.tryTake(1, 0, start), false)
+	testhelper.DiffBool(t, "after half a second", "allowed",
+		limiter.tryTake(1, 0, start.Add(time.Second/2)), true)
+
+	wait := limiter.reserve(1, 0, start.Add(time.Second/2))
+	testhelper.DiffInt(t, "reserve", "wait", wait, time.Second/2)
+}
+
+func TestTryTakeAll(t *testing.T) {
+	start := time.Now()
+	wide := newRateLimiter("wide", rateLimit{msgsPerSec: 10})
+	narrow := newRateLimiter("narrow", rateLimit{msgsPerSec: 1})
+	limiters := []*rateLimiter{wide, narrow}
+
+	if l := tryTakeAll(limiters, 1, 0, start); l != nil {
+		t.Errorf("first message: unexpectedly limited by %q", l.name)
+	}
+
+	l := tryTakeAll(limiters, 1, 0, start)
+	if l != narrow {
+		t.Errorf("second message: should be limited by %q", narrow.name)
+	}
+
+	testhelper.DiffFloat(t, "second message", "wide tokens left",
+		wide.msgs.tokens, 9, 0)
+}
+
+func TestApplyRateLimitsReject(t *testing.T) {
+	clt := testClient("test")
+	clt.limiters = []*rateLimiter{
+		newRateLimiter("test", rateLimit{msgsPerSec: 1}),
+	}
+	clt.clientShared = &clientShared{rlRules: &rateLimitRules{}}
+	clt.rlRules.action = rlActionReject
+
+	msg := &pusu.Message{MT: pusu.Publish}
+
+	if err := clt.applyRateLimits(msg, 1); err != nil {
+		t.Fatal("the first message should be allowed:", err)
+	}
+
+	err := clt.applyRateLimits(msg, 1)
+	testhelper.DiffBool(t, "second message", "rejected",
+		errors.Is(err, errMsgRejected), true)
+	testhelper.DiffBool(t, "second message", "still connected",
+		clt.connected, true)
+}
+
+func TestApplyRateLimitsThrottle(t *testing.T) {
+	const rate = 50 // so the last message waits about a fiftieth of a second
+
+	clt := testClient("test")
+	clt.limiters = []*rateLimiter{
+		newRateLimiter("test", rateLimit{msgsPerSec: rate}),
+	}
+	clt.clientShared = &clientShared{rlRules: &rateLimitRules{}}
+	clt.rlRules.action = rlActionThrottle
+
+	msg := &pusu.Message{MT: pusu.Publish}
+
+	start := time.Now()
+
+	// the first batch takes the whole burst so the next message must wait
+	for i, msgs := range []int{rate, 1} {
+		if err := clt.applyRateLimits(msg, msgs); err != nil {
+			t.Fatalf("message %d should be allowed: %v", i, err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Second/(2*rate) {
+		t.Errorf("the second message was not throttled: waited %s", elapsed)
+	}
+
+	testhelper.DiffInt(t, "throttle", "throttled count",
+		clt.rlRules.throttled.Load(), 1)
+}
+
+func TestApplyRateLimitsDisconnect(t *testing.T) {
+	var buf bytes.Buffer
+
+	conn, _ := net.Pipe()
+
+	clt := testClient("test")
+	clt.conn = conn
+	clt.limiters = []*rateLimiter{
+		newRateLimiter("test", rateLimit{msgsPerSec: 1}),
+	}
+	clt.clientShared = &clientShared{
+		rlRules:        &rateLimitRules{action: rlActionDisconnect},
+		auditLog:       testAuditLog(&buf),
+		disconnectChan: make(chan *client, 1),
+	}
+	clt.handlers = clientMsgHandlerMap{
+		pusu.Publish: func(clt *client, msg *pusu.Message) error {
+			return clt.applyRateLimits(msg, 1)
+		},
+	}
+
+	msg := &pusu.Message{MT: pusu.Publish, MsgID: 1}
+
+	testhelper.DiffBool(t, "first message", "handled",
+		clt.handleMsg(msg), true)
+	testhelper.DiffBool(t, "second message", "handled",
+		clt.handleMsg(msg), false)
+
+	select {
+	case <-clt.disconnectChan:
+	default:
+		t.Error("the server was not told of the disconnection")
+	}
+
+	reason, _ := clt.getCloseReason()
+	testhelper.DiffString(t, "second message", "close reason",
+		reason, closeReasonRateLimit)
+	testhelper.DiffInt(t, "second message", "disconnected count",
+		clt.rlRules.disconnected.Load(), 1)
+
+	testhelper.DiffBool(t, "second message", "still connected",
+		clt.connected, false)
+	testhelper.DiffInt(t, "second message", "messages sent",
+		len(clt.sendChan), 0)
+
+	recs := auditRecords(t, &buf)
+	testhelper.DiffInt(t, "second message", "audit records", len(recs), 1)
+
+	if len(recs) == 1 {
+		checkAuditRecord(t, "second message", recs[0], map[string]any{
+			"event":   "rate-limit",
+			"outcome": "disconnected",
+			"error":   "rate limit exceeded (test)",
+		})
+	}
+}
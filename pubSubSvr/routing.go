@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"google.golang.org/protobuf/proto"
+)
+
+// The headers added to a publication republished by a routing rule giving
+// the namespace and topic on which it was originally published
+const (
+	hdrRoutedFromNS    = "routed-from-namespace"
+	hdrRoutedFromTopic = "routed-from-topic"
+)
+
+// maxRepublications is the most times a publication is republished by the
+// routing rules, counting every rule applied to it and to its copies
+const maxRepublications = 8
+
+// noteTextRouting describes the format of the routing rules file
+var noteTextRouting = "The routing rules file gives topics whose" +
+	" publications are also to be published on other topics, possibly in" +
+	" another namespace. This lets a topic be mirrored or renamed" +
+	" without changing the publishers." +
+	"\n\n" +
+	"Each line of the file has the form:" +
+	"\n\n" +
+	"namespace source-topic target-topic [target-namespace]" +
+	"\n\n" +
+	"The namespace may be given as '*' to match any namespace. A" +
+	" publication on the source topic, or on any of its sub-topics, is" +
+	" republished on the target topic with the source topic replaced by" +
+	" the target topic, so with the rule:" +
+	"\n\n" +
+	"* /legacy/prices /md/prices" +
+	"\n\n" +
+	"a publication on '/legacy/prices/eur' is also published on" +
+	" '/md/prices/eur' in the same namespace. If a target namespace is" +
+	" given the publication is republished in that namespace instead." +
+	" Publications may not be routed onto the " + string(sysTopic) +
+	" topics. Unless the publication is republished only in another" +
+	" namespace the target topic may not be the source topic or one of" +
+	" its sub-topics as the republished publication would be routed" +
+	" again onto an ever longer topic." +
+	"\n\n" +
+	"Every rule which matches is applied and the republished" +
+	" publication is itself routed by any rules matching its new" +
+	" topic. A publication is not republished on a topic it has already" +
+	" passed through, and it and its copies are not republished more" +
+	" than " + strconv.Itoa(maxRepublications) + " times in all, so" +
+	" rules which would route publications in a loop are safe. The" +
+	" republished publication has '" + hdrRoutedFromNS + "' and '" +
+	hdrRoutedFromTopic + "' headers giving where it was first" +
+	" published. Publications made by the server itself, such as system" +
+	" events, are not routed." +
+	"\n\n" +
+	"Blank lines and lines starting with '#' are ignored."
+
+// errBadRouting is the error returned when the routing rules cannot be
+// loaded
+var errBadRouting = errors.New("bad routing rules")
+
+// routeRule republishes publications on the source topic, and its
+// sub-topics, in the source namespace onto the target topic. If the
+// target namespace is empty the publication stays in its namespace.
+type routeRule struct {
+	srcNS string
+	src   pusu.Topic
+	dstNS pusu.Namespace
+	dst   pusu.Topic
+}
+
+// topicParts returns the parts of the topic; the root topic has none
+func topicParts(topic pusu.Topic) []string {
+	if topic == "/" {
+		return nil
+	}
+
+	return strings.Split(string(topic)[1:], "/")
+}
+
+// target returns the namespace and topic onto which the publication on the
+// topic in the namespace should be republished and true if the rule
+// applies.
+func (rr routeRule) target(
+	ns pusu.Namespace,
+	topic pusu.Topic,
+) (pusu.Namespace, pusu.Topic, bool) {
+	if rr.srcNS != "*" && rr.srcNS != string(ns) {
+		return "", "", false
+	}
+
+	src := topicParts(rr.src)
+	parts := topicParts(topic)
+
+	if len(parts) < len(src) || !slices.Equal(parts[:len(src)], src) {
+		return "", "", false
+	}
+
+	dstParts := append(topicParts(rr.dst), parts[len(src):]...)
+	dst := pusu.Topic("/" + strings.Join(dstParts, "/"))
+
+	dstNS := rr.dstNS
+	if dstNS == "" {
+		dstNS = ns
+	}
+
+	return dstNS, dst, true
+}
+
+// routingRules holds the routing rules and counts of the publications
+// republished and of those not republished because they would loop or
+// have been republished too many times
+type routingRules struct {
+	rules []routeRule
+
+	routed  atomic.Int64
+	skipped atomic.Int64
+}
+
+// parseRouteRule parses a line from the routing rules file
+func parseRouteRule(line string) (routeRule, error) {
+	const (
+		minParts = 3
+		maxParts = 4
+	)
+
+	parts := strings.Fields(line)
+	if len(parts) < minParts || len(parts) > maxParts {
+		return routeRule{}, fmt.Errorf(
+			"expected %d or %d fields, found %d",
+			minParts, maxParts, len(parts))
+	}
+
+	rr := routeRule{
+		srcNS: parts[0],
+		src:   pusu.Topic(parts[1]),
+		dst:   pusu.Topic(parts[2]),
+	}
+
+	if len(parts) == maxParts {
+		rr.dstNS = pusu.Namespace(parts[3])
+	}
+
+	if err := rr.src.Check(); err != nil {
+		return rr, fmt.Errorf("bad source topic: %w", err)
+	}
+
+	if err := rr.dst.Check(); err != nil {
+		return rr, fmt.Errorf("bad target topic: %w", err)
+	}
+
+	if err := checkPublishTopic(rr.dst); err != nil {
+		return rr, fmt.Errorf("bad target topic: %w", err)
+	}
+
+	sameNS := rr.dstNS == "" ||
+		rr.srcNS == "*" ||
+		rr.srcNS == string(rr.dstNS)
+
+	if sameNS && rr.src == rr.dst {
+		return rr, errors.New("the source and target are the same")
+	}
+
+	if sameNS && slices.Contains(rr.dst.SubTopics(), rr.src) {
+		return rr, errors.New("the target is a sub-topic of the source")
+	}
+
+	return rr, nil
+}
+
+// loadRoutingRules reads the routing rules file. An empty filename gives
+// no rules.
+func loadRoutingRules(filename string) ([]routeRule, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(filename) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadRouting, err)
+	}
+	defer f.Close()
+
+	var rules []routeRule
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rr, err := parseRouteRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s:%d: %w",
+				errBadRouting, filename, lineNum, err)
+		}
+
+		rules = append(rules, rr)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadRouting, err)
+	}
+
+	return rules, nil
+}
+
+// checkNamespaces returns a non-nil error if any of the target namespaces
+// is not allowed by the namespace rules
+func (rr *routingRules) checkNamespaces(nsRules namespaceRules) error {
+	for _, r := range rr.rules {
+		if r.dstNS != "" && !nsRules.isValid(r.dstNS) {
+			return fmt.Errorf("%w: the target namespace %q is not allowed",
+				errBadRouting, r.dstNS)
+		}
+	}
+
+	return nil
+}
+
+// report logs the routing rules
+func (rr *routingRules) report(logger *slog.Logger) {
+	for _, r := range rr.rules {
+		logger.Info("routing rule",
+			pusu.Namespace(r.srcNS).Attr(),
+			slog.String("source", string(r.src)),
+			slog.String("target-namespace", string(r.dstNS)),
+			slog.String("target", string(r.dst)))
+	}
+}
+
+// statusAttr returns a slog Attr giving the counts of publications
+// republished and of those skipped because they would loop, or have been
+// republished too many times, since the last call. The counts are reset.
+func (rr *routingRules) statusAttr() slog.Attr {
+	return slog.Group("routed",
+		slog.Int64("republished", rr.routed.Swap(0)),
+		slog.Int64("loopsSkipped", rr.skipped.Swap(0)))
+}
+
+// routeKey identifies a topic in a namespace
+type routeKey struct {
+	ns    pusu.Namespace
+	topic pusu.Topic
+}
+
+// routedCopy returns a copy of the publication to be published on the
+// topic. The headers record where the publication was first published.
+func (pub *publication) routedCopy(
+	from routeKey,
+	topic pusu.Topic,
+) *publication {
+	rp := *pub
+
+	pmp, _ := proto.Clone(pub.pmp).(*pusu.PublishMsgPayload)
+	pmp.Topic = string(topic)
+	rp.pmp = pmp
+
+	hdrs := maps.Clone(pub.hdrs)
+	if hdrs == nil {
+		hdrs = make(map[string]string)
+	}
+
+	if _, ok := hdrs[hdrRoutedFromTopic]; !ok {
+		hdrs[hdrRoutedFromNS] = string(from.ns)
+		hdrs[hdrRoutedFromTopic] = string(from.topic)
+	}
+
+	rp.setHeaders(hdrs)
+
+	return &rp
+}
+
+// route republishes the publication, made on the topic in the namespace,
+// according to the routing rules. The topic is that given by the publisher,
+// taken before the publication was sent to any subscribers.
+func (prog *prog) route(
+	ns pusu.Namespace,
+	topic pusu.Topic,
+	pub *publication,
+	nsm namespaceSubsMap,
+) {
+	if len(prog.routes.rules) == 0 {
+		return
+	}
+
+	remaining := maxRepublications
+
+	prog.routeFrom([]routeKey{{ns: ns, topic: topic}}, pub, nsm, &remaining)
+}
+
+// routeFrom republishes the publication onto the target of each routing
+// rule matching the last namespace and topic in the path, and routes it on
+// from there. A publication is not republished onto a topic already in
+// the path nor once the remaining count of republications, shared by the
+// publication and all its copies, has been used up.
+func (prog *prog) routeFrom(
+	path []routeKey,
+	pub *publication,
+	nsm namespaceSubsMap,
+	remaining *int,
+) {
+	from := path[len(path)-1]
+
+	for _, rr := range prog.routes.rules {
+		dstNS, dst, ok := rr.target(from.ns, from.topic)
+		if !ok {
+			continue
+		}
+
+		to := routeKey{ns: dstNS, topic: dst}
+
+		if slices.Contains(path, to) || *remaining <= 0 {
+			reason := "routing loop"
+			if *remaining <= 0 {
+				reason = "too many republications"
+			}
+
+			prog.routes.skipped.Add(1)
+			prog.logger.Warn(reason+" - publication not republished",
+				from.ns.Attr(), from.topic.Attr(),
+				slog.String("target-namespace", string(dstNS)),
+				slog.String("target", string(dst)),
+				slog.Int("hops", len(path)-1))
+
+			continue
+		}
+
+		*remaining--
+
+		rp := pub.routedCopy(path[0], dst)
+
+		prog.fanOut(clientMessage{
+			clt:  &client{namespace: dstNS, logger: prog.logger},
+			msg:  &pusu.Message{MT: pusu.Publish, MsgID: pusu.NoMsgID},
+			rcvd: time.Now(),
+		}, rp, nsm)
+		prog.routes.routed.Add(1)
+		prog.bridge(dstNS, dst, rp, nsm)
+
+		prog.routeFrom(append(slices.Clip(path), to), rp, nsm, remaining)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestParseRouteRule(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		line    string
+		expRule routeRule
+	}{
+		{
+			ID:   testhelper.MkID("same namespace"),
+			line: "* /legacy/prices /md/prices",
+			expRule: routeRule{
+				srcNS: "*", src: "/legacy/prices", dst: "/md/prices",
+			},
+		},
+		{
+			ID:   testhelper.MkID("other namespace"),
+			line: "prices /fx /fx archive",
+			expRule: routeRule{
+				srcNS: "prices", src: "/fx", dstNS: "archive", dst: "/fx",
+			},
+		},
+		{
+			ID:     testhelper.MkID("bad: too few fields"),
+			ExpErr: testhelper.MkExpErr("expected 3 or 4 fields, found 2"),
+			line:   "* /a",
+		},
+		{
+			ID:     testhelper.MkID("bad: unclean source"),
+			ExpErr: testhelper.MkExpErr("bad source topic"),
+			line:   "* /a/ /b",
+		},
+		{
+			ID:     testhelper.MkID("bad: system topic target"),
+			ExpErr: testhelper.MkExpErr("bad target topic", "reserved"),
+			line:   "* /a /$sys/a",
+		},
+		{
+			ID:     testhelper.MkID("bad: routed to itself"),
+			ExpErr: testhelper.MkExpErr("the source and target are the same"),
+			line:   "* /a /a",
+		},
+		{
+			ID:     testhelper.MkID("bad: target under the source"),
+			ExpErr: testhelper.MkExpErr("the target is a sub-topic"),
+			line:   "* /a /a/b",
+		},
+		{
+			ID:     testhelper.MkID("bad: root source"),
+			ExpErr: testhelper.MkExpErr("the target is a sub-topic"),
+			line:   "prices / /x prices",
+		},
+		{
+			ID:   testhelper.MkID("root source, other namespace"),
+			line: "prices / /prices archive",
+			expRule: routeRule{
+				srcNS: "prices", src: "/", dstNS: "archive", dst: "/prices",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			rr, err := parseRouteRule(tc.line)
+			if !testhelper.CheckExpErr(t, err, tc) || err != nil {
+				return
+			}
+
+			if err = testhelper.DiffVals(rr, tc.expRule); err != nil {
+				t.Log(tc.IDStr())
+				t.Errorf("\t: bad rule: %s", err)
+			}
+		})
+	}
+}
+
+func TestRouteTarget(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		rule     routeRule
+		ns       pusu.Namespace
+		topic    pusu.Topic
+		expOK    bool
+		expNS    pusu.Namespace
+		expTopic pusu.Topic
+	}{
+		{
+			ID:       testhelper.MkID("exact topic"),
+			rule:     routeRule{srcNS: "*", src: "/a/b", dst: "/c"},
+			ns:       "test",
+			topic:    "/a/b",
+			expOK:    true,
+			expNS:    "test",
+			expTopic: "/c",
+		},
+		{
+			ID:       testhelper.MkID("sub-topic"),
+			rule:     routeRule{srcNS: "*", src: "/a/b", dst: "/c"},
+			ns:       "test",
+			topic:    "/a/b/d/e",
+			expOK:    true,
+			expNS:    "test",
+			expTopic: "/c/d/e",
+		},
+		{
+			ID:       testhelper.MkID("root source and target"),
+			rule:     routeRule{srcNS: "test", src: "/", dstNS: "x", dst: "/"},
+			ns:       "test",
+			topic:    "/a",
+			expOK:    true,
+			expNS:    "x",
+			expTopic: "/a",
+		},
+		{
+			ID:    testhelper.MkID("partial part"),
+			rule:  routeRule{srcNS: "*", src: "/a/b", dst: "/c"},
+			ns:    "test",
+			topic: "/a/bc",
+		},
+		{
+			ID:    testhelper.MkID("other namespace"),
+			rule:  routeRule{srcNS: "prices", src: "/a", dst: "/c"},
+			ns:    "test",
+			topic: "/a",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ns, topic, ok := tc.rule.target(tc.ns, tc.topic)
+			testhelper.DiffBool(t, tc.IDStr(), "ok", ok, tc.expOK)
+			testhelper.DiffString(t, tc.IDStr(), "namespace", ns, tc.expNS)
+			testhelper.DiffString(t, tc.IDStr(), "topic", topic, tc.expTopic)
+		})
+	}
+}
+
+func TestRoute(t *testing.T) {
+	const (
+		ns      = pusu.Namespace("test")
+		otherNS = pusu.Namespace("other")
+	)
+
+	prog := &prog{logger: testLogger}
+	prog.routes.rules = []routeRule{
+		{srcNS: "*", src: "/a", dst: "/b"},
+		{srcNS: "*", src: "/b", dst: "/a"},
+		{srcNS: string(ns), src: "/a", dstNS: otherNS, dst: "/c"},
+	}
+
+	subA, subB, subC := testClient(ns), testClient(ns), testClient(otherNS)
+
+	nsm := namespaceSubsMap{
+		ns: {topics: subsMap{
+			"/a": subscribers{subA: nil},
+			"/b": subscribers{subB: nil},
+		}},
+		otherNS: {topics: subsMap{
+			"/c": subscribers{subC: nil},
+		}},
+	}
+
+	pub := &publication{
+		pmp:   &pusu.PublishMsgPayload{Topic: "/a/x"},
+		plain: []byte("hello"),
+	}
+
+	prog.route(ns, pub.topic(), pub, nsm)
+
+	testhelper.DiffInt(t, "route", "publications on /a", len(subA.sendChan), 0)
+	testhelper.DiffInt(t, "route", "publications on /b", len(subB.sendChan), 1)
+	testhelper.DiffInt(t, "route", "publications on /c", len(subC.sendChan), 1)
+	testhelper.DiffInt(t, "route", "republished", prog.routes.routed.Load(), 2)
+	testhelper.DiffInt(t, "route", "loops skipped",
+		prog.routes.skipped.Load(), 1)
+
+	if len(subB.sendChan) != 1 {
+		return
+	}
+
+	pmp, err := (<-subB.sendChan).publication()
+	if err != nil {
+		t.Fatal("cannot decode the publication:", err)
+	}
+
+	hdrs, err := getExtMap(pmp, extPublishHeaders)
+	if err != nil {
+		t.Fatal("cannot decode the headers:", err)
+	}
+
+	testhelper.DiffString(t, "route", "topic", pmp.Topic, "/b")
+	testhelper.DiffString(t, "route", "routed-from namespace",
+		hdrs[hdrRoutedFromNS], string(ns))
+	testhelper.DiffString(t, "route", "routed-from topic",
+		hdrs[hdrRoutedFromTopic], "/a/x")
+}
+
+func TestRouteLimit(t *testing.T) {
+	const ns = pusu.Namespace("test")
+
+	prog := &prog{logger: testLogger}
+
+	const ruleCount = maxRepublications + 2
+
+	for i := range ruleCount {
+		prog.routes.rules = append(prog.routes.rules, routeRule{
+			srcNS: "*", src: "/a", dst: pusu.Topic(fmt.Sprintf("/b%d", i)),
+		})
+	}
+
+	prog.route(ns, "/a", &publication{
+		pmp: &pusu.PublishMsgPayload{Topic: "/a"},
+	}, namespaceSubsMap{})
+
+	testhelper.DiffInt(t, "route", "republished",
+		prog.routes.routed.Load(), maxRepublications)
+	testhelper.DiffInt(t, "route", "skipped",
+		prog.routes.skipped.Load(), ruleCount-maxRepublications)
+}
+
+func TestPublishRouted(t *testing.T) {
+	const ns = pusu.Namespace("test")
+
+	prog := &prog{logger: testLogger}
+
+	rule, err := parseRouteRule("* /legacy/prices /md/prices")
+	if err != nil {
+		t.Fatal("cannot parse the rule:", err)
+	}
+
+	prog.routes.rules = []routeRule{rule}
+
+	parentSub, routedSub := testClient(ns), testClient(ns)
+	nsm := namespaceSubsMap{
+		ns: {topics: subsMap{
+			"/legacy":    subscribers{parentSub: nil},
+			"/md/prices": subscribers{routedSub: nil},
+		}},
+	}
+
+	serverHandlePublish(prog, clientMessage{
+		clt: testClient(ns),
+		msg: &pusu.Message{MT: pusu.Publish, MsgID: 7},
+		pubs: []*publication{{
+			pmp:   &pusu.PublishMsgPayload{Topic: "/legacy/prices/eur"},
+			plain: []byte("1.08"),
+		}},
+	}, nsm)
+
+	testhelper.DiffInt(t, "publish", "publications on /legacy",
+		len(parentSub.sendChan), 1)
+	testhelper.DiffInt(t, "publish", "publications on /md/prices",
+		len(routedSub.sendChan), 1)
+
+	if len(routedSub.sendChan) != 1 {
+		return
+	}
+
+	pmp, err := (<-routedSub.sendChan).publication()
+	if err != nil {
+		t.Fatal("cannot decode the publication:", err)
+	}
+
+	hdrs, err := getExtMap(pmp, extPublishHeaders)
+	if err != nil {
+		t.Fatal("cannot decode the headers:", err)
+	}
+
+	testhelper.DiffString(t, "publish", "routed-from topic",
+		hdrs[hdrRoutedFromTopic], "/legacy/prices/eur")
+}
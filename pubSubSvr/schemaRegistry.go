@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// noteTextSchemaRegistry describes the format of the schema registry file
+const noteTextSchemaRegistry = "The schema registry file associates topic" +
+	" patterns with schemas. Each publication on a matching topic must" +
+	" have a payload which matches the schema; if it does not the" +
+	" publication is rejected and an Error is sent to the publisher." +
+	"\n\n" +
+	"Each line of the file has the form:" +
+	"\n\n" +
+	"namespace topic-pattern json schema-file" +
+	"\n\n" +
+	"or" +
+	"\n\n" +
+	"namespace topic-pattern proto descriptor-file message-name" +
+	"\n\n" +
+	"The namespace may be given as '*' to match any namespace." +
+	" The topic pattern matches a topic if it matches the topic or" +
+	" any of its parent topics; the pattern may contain '*'" +
+	" wildcards which match a single part of a topic." +
+	" A JSON schema file holds a JSON Schema document. A descriptor" +
+	" file holds a FileDescriptorSet, as generated by" +
+	" 'protoc --include_imports --descriptor_set_out=...', and the" +
+	" message name is the full name of the payload message in it." +
+	" Relative file names are taken from the directory holding the" +
+	" registry file." +
+	"\n\n" +
+	"The first line to match the namespace and topic gives the schema" +
+	" to use; topics which match no line are not checked." +
+	" Blank lines and lines starting with '#' are ignored."
+
+// The kinds of schema which can be registered
+const (
+	schemaKindJSON  = "json"
+	schemaKindProto = "proto"
+)
+
+// errBadRegistry is the error returned when the registry cannot be loaded
+var errBadRegistry = errors.New("bad schema registry")
+
+// payloadValidator checks that a payload conforms to a schema
+type payloadValidator interface {
+	validate(payload []byte) error
+}
+
+// jsonValidator validates payloads as JSON values against a JSON Schema
+type jsonValidator struct {
+	schema *jsonSchema
+}
+
+func (v jsonValidator) validate(payload []byte) error {
+	return v.schema.validateJSON(payload)
+}
+
+// protoValidator validates payloads as encodings of a protobuf message
+type protoValidator struct {
+	md protoreflect.MessageDescriptor
+}
+
+func (v protoValidator) validate(payload []byte) error {
+	msg := dynamicpb.NewMessage(v.md)
+
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return fmt.Errorf("%w: not a valid %s: %w",
+			errSchemaMismatch, v.md.FullName(), err)
+	}
+
+	if len(msg.GetUnknown()) > 0 {
+		return fmt.Errorf("%w: %s: unknown fields are present",
+			errSchemaMismatch, v.md.FullName())
+	}
+
+	return nil
+}
+
+// schemaEntry associates a topic pattern in a namespace with a schema
+type schemaEntry struct {
+	namespace string
+	pattern   string
+	kind      string
+	source    string
+	validator payloadValidator
+}
+
+// matches returns true if the entry applies to the topic in the namespace
+func (se schemaEntry) matches(ns pusu.Namespace, topic pusu.Topic) bool {
+	if se.namespace != "*" && se.namespace != string(ns) {
+		return false
+	}
+
+	return topicPatternMatches(se.pattern, topic)
+}
+
+// topicPatternMatches returns true if the pattern matches the topic or any
+// of its parent topics. The pattern may contain '*' wildcards which match
+// a single part of a topic.
+func topicPatternMatches(pattern string, topic pusu.Topic) bool {
+	for _, t := range topic.SubTopics() {
+		if ok, _ := path.Match(pattern, string(t)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// schemaRegistry holds the schemas which publication payloads must match
+type schemaRegistry struct {
+	entries []schemaEntry
+}
+
+// loadJSONValidator reads the JSON Schema from the file
+func loadJSONValidator(filename string) (payloadValidator, error) {
+	b, err := os.ReadFile(filename) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := parseJSONSchema(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonValidator{schema: s}, nil
+}
+
+// loadProtoValidator reads the FileDescriptorSet from the file and finds
+// the named message descriptor
+func loadProtoValidator(filename, msgName string) (payloadValidator, error) {
+	b, err := os.ReadFile(filename) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	var fds descriptorpb.FileDescriptorSet
+	if err = proto.Unmarshal(b, &fds); err != nil {
+		return nil, fmt.Errorf("bad descriptor set: %w", err)
+	}
+
+	files, err := protodesc.NewFiles(&fds)
+	if err != nil {
+		return nil, fmt.Errorf("bad descriptor set: %w", err)
+	}
+
+	d, err := files.FindDescriptorByName(protoreflect.FullName(msgName))
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the message %q: %w", msgName, err)
+	}
+
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a message", msgName)
+	}
+
+	return protoValidator{md: md}, nil
+}
+
+// parseEntry parses a line from the registry file. Relative file names are
+// taken from the given directory.
+func parseEntry(line, dir string) (schemaEntry, error) {
+	const (
+		jsonParts  = 4
+		protoParts = 5
+	)
+
+	parts := strings.Fields(line)
+	if len(parts) < jsonParts {
+		return schemaEntry{}, errors.New("too few fields")
+	}
+
+	se := schemaEntry{
+		namespace: parts[0],
+		pattern:   parts[1],
+		kind:      parts[2],
+		source:    parts[3],
+	}
+
+	if _, err := path.Match(se.pattern, "/"); err != nil {
+		return se, fmt.Errorf("bad topic pattern %q: %w", se.pattern, err)
+	}
+
+	filename := se.source
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(dir, filename)
+	}
+
+	var err error
+
+	switch se.kind {
+	case schemaKindJSON:
+		if len(parts) != jsonParts {
+			return se, errors.New("too many fields for a JSON schema")
+		}
+
+		se.validator, err = loadJSONValidator(filename)
+	case schemaKindProto:
+		if len(parts) != protoParts {
+			return se, errors.New(
+				"a proto schema needs a descriptor file and a message name")
+		}
+
+		se.source += " " + parts[4]
+		se.validator, err = loadProtoValidator(filename, parts[4])
+	default:
+		return se, fmt.Errorf("unknown schema kind %q (use %q or %q)",
+			se.kind, schemaKindJSON, schemaKindProto)
+	}
+
+	return se, err
+}
+
+// loadSchemaRegistry reads the schema registry file. An empty filename
+// gives an empty registry.
+func loadSchemaRegistry(filename string) (*schemaRegistry, error) {
+	sr := &schemaRegistry{}
+
+	if filename == "" {
+		return sr, nil
+	}
+
+	f, err := os.Open(filename) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadRegistry, err)
+	}
+	defer f.Close()
+
+	dir := filepath.Dir(filename)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		se, err := parseEntry(line, dir)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s:%d: %w",
+				errBadRegistry, filename, lineNum, err)
+		}
+
+		sr.entries = append(sr.entries, se)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadRegistry, err)
+	}
+
+	return sr, nil
+}
+
+// validate checks the publication payload against the schema, if any, for
+// the namespace and topic. It returns a non-nil error if the payload does
+// not match.
+func (sr *schemaRegistry) validate(
+	ns pusu.Namespace,
+	topic pusu.Topic,
+	payload []byte,
+) error {
+	for _, se := range sr.entries {
+		if se.matches(ns, topic) {
+			if err := se.validator.validate(payload); err != nil {
+				return fmt.Errorf("topic %q: %w", topic, err)
+			}
+
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// report logs the registered schemas
+func (sr *schemaRegistry) report(logger *slog.Logger) {
+	for _, se := range sr.entries {
+		logger.Info("schema registered",
+			pusu.Namespace(se.namespace).Attr(),
+			slog.String("topic-pattern", se.pattern),
+			slog.String("kind", se.kind),
+			slog.String("schema", se.source))
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// writeDescriptorSet writes a FileDescriptorSet, describing a message
+// test.Quote with a string symbol and a double price, to a file in the
+// directory and returns the name of the file
+func writeDescriptorSet(t *testing.T, dir string) string {
+	t.Helper()
+
+	field := func(
+		name string,
+		num int32,
+		typ descriptorpb.FieldDescriptorProto_Type,
+	) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(num),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   typ.Enum(),
+		}
+	}
+
+	fds := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{{
+			Name:    proto.String("quote.proto"),
+			Package: proto.String("test"),
+			Syntax:  proto.String("proto3"),
+			MessageType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("Quote"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("symbol", 1,
+						descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("price", 2,
+						descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+				},
+			}},
+		}},
+	}
+
+	b, err := proto.Marshal(fds)
+	if err != nil {
+		t.Fatal("cannot marshal the descriptor set:", err)
+	}
+
+	filename := filepath.Join(dir, "quote.pb")
+	if err := os.WriteFile(filename, b, 0o600); err != nil {
+		t.Fatal("cannot write the descriptor set:", err)
+	}
+
+	return filename
+}
+
+// writeFile writes the contents to the named file in the directory and
+// returns the full name of the file
+func writeFile(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, []byte(contents), 0o600); err != nil {
+		t.Fatal("cannot write the file:", err)
+	}
+
+	return filename
+}
+
+// quotePayload returns the encoding of a test.Quote message
+func quotePayload(symbol string, price float64) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	b = protowire.AppendString(b, symbol)
+	b = protowire.AppendTag(b, 2, protowire.Fixed64Type)
+
+	return protowire.AppendFixed64(b, math.Float64bits(price))
+}
+
+func TestLoadProtoValidator(t *testing.T) {
+	dir := t.TempDir()
+	descFile := writeDescriptorSet(t, dir)
+	badFile := writeFile(t, dir, "bad.pb", "not a descriptor set")
+
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		filename string
+		msgName  string
+	}{
+		{
+			ID:       testhelper.MkID("good"),
+			filename: descFile,
+			msgName:  "test.Quote",
+		},
+		{
+			ID: testhelper.MkID("bad: no such message"),
+			ExpErr: testhelper.MkExpErr(
+				`cannot find the message "test.Trade"`),
+			filename: descFile,
+			msgName:  "test.Trade",
+		},
+		{
+			ID: testhelper.MkID("bad: not a message"),
+			ExpErr: testhelper.MkExpErr(
+				`"test.Quote.price" is not a message`),
+			filename: descFile,
+			msgName:  "test.Quote.price",
+		},
+		{
+			ID:       testhelper.MkID("bad: not a descriptor set"),
+			ExpErr:   testhelper.MkExpErr("bad descriptor set"),
+			filename: badFile,
+			msgName:  "test.Quote",
+		},
+		{
+			ID:       testhelper.MkID("bad: no such file"),
+			ExpErr:   testhelper.MkExpErr("no such file or directory"),
+			filename: filepath.Join(dir, "missing.pb"),
+			msgName:  "test.Quote",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := loadProtoValidator(tc.filename, tc.msgName)
+			testhelper.CheckExpErr(t, err, tc)
+		})
+	}
+}
+
+func TestProtoValidator(t *testing.T) {
+	v, err := loadProtoValidator(writeDescriptorSet(t, t.TempDir()),
+		"test.Quote")
+	if err != nil {
+		t.Fatal("cannot load the validator:", err)
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		payload []byte
+	}{
+		{
+			ID:      testhelper.MkID("good"),
+			payload: quotePayload("EUR", 1.25),
+		},
+		{
+			ID:      testhelper.MkID("good: empty"),
+			payload: nil,
+		},
+		{
+			ID: testhelper.MkID("bad: not a protobuf encoding"),
+			ExpErr: testhelper.MkExpErr(
+				"payload does not match the schema",
+				"not a valid test.Quote"),
+			payload: []byte{0xff},
+		},
+		{
+			ID: testhelper.MkID("bad: unknown field"),
+			ExpErr: testhelper.MkExpErr(
+				"payload does not match the schema",
+				"test.Quote: unknown fields are present"),
+			payload: protowire.AppendVarint(
+				protowire.AppendTag(nil, 9, protowire.VarintType), 1),
+		},
+		{
+			ID: testhelper.MkID("bad: field of the wrong type"),
+			ExpErr: testhelper.MkExpErr(
+				"test.Quote: unknown fields are present"),
+			payload: protowire.AppendVarint(
+				protowire.AppendTag(nil, 1, protowire.VarintType), 1),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := v.validate(tc.payload)
+			if testhelper.CheckExpErr(t, err, tc) && err != nil &&
+				!errors.Is(err, errSchemaMismatch) {
+				t.Log(tc.IDStr())
+				t.Error("\t: the error should wrap errSchemaMismatch")
+			}
+		})
+	}
+}
+
+func TestParseEntry(t *testing.T) {
+	dir := t.TempDir()
+	writeDescriptorSet(t, dir)
+	writeFile(t, dir, "quote.json", `{"type": "object"}`)
+
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		line      string
+		expNS     string
+		expPat    string
+		expKind   string
+		expSource string
+	}{
+		{
+			ID:        testhelper.MkID("good: json"),
+			line:      "* /md/* json quote.json",
+			expNS:     "*",
+			expPat:    "/md/*",
+			expKind:   schemaKindJSON,
+			expSource: "quote.json",
+		},
+		{
+			ID:        testhelper.MkID("good: proto"),
+			line:      "prod /md proto quote.pb test.Quote",
+			expNS:     "prod",
+			expPat:    "/md",
+			expKind:   schemaKindProto,
+			expSource: "quote.pb test.Quote",
+		},
+		{
+			ID:        testhelper.MkID("good: absolute file name"),
+			line:      "* /md json " + filepath.Join(dir, "quote.json"),
+			expNS:     "*",
+			expPat:    "/md",
+			expKind:   schemaKindJSON,
+			expSource: filepath.Join(dir, "quote.json"),
+		},
+		{
+			ID:     testhelper.MkID("bad: too few fields"),
+			ExpErr: testhelper.MkExpErr("too few fields"),
+			line:   "* /md json",
+		},
+		{
+			ID:     testhelper.MkID("bad: json with too many fields"),
+			ExpErr: testhelper.MkExpErr("too many fields for a JSON schema"),
+			line:   "* /md json quote.json extra",
+		},
+		{
+			ID: testhelper.MkID("bad: proto with no message name"),
+			ExpErr: testhelper.MkExpErr(
+				"a proto schema needs a descriptor file and a message name"),
+			line: "* /md proto quote.pb",
+		},
+		{
+			ID: testhelper.MkID("bad: proto with too many fields"),
+			ExpErr: testhelper.MkExpErr(
+				"a proto schema needs a descriptor file and a message name"),
+			line: "* /md proto quote.pb test.Quote extra",
+		},
+		{
+			ID:     testhelper.MkID("bad: unknown kind"),
+			ExpErr: testhelper.MkExpErr(`unknown schema kind "xml"`),
+			line:   "* /md xml quote.xml",
+		},
+		{
+			ID:     testhelper.MkID("bad: topic pattern"),
+			ExpErr: testhelper.MkExpErr(`bad topic pattern "/md/["`),
+			line:   "* /md/[ json quote.json",
+		},
+		{
+			ID:     testhelper.MkID("bad: no such schema file"),
+			ExpErr: testhelper.MkExpErr("no such file or directory"),
+			line:   "* /md json missing.json",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			se, err := parseEntry(tc.line, dir)
+			if testhelper.CheckExpErr(t, err, tc) && err == nil {
+				testhelper.DiffString(t, tc.IDStr(), "namespace",
+					se.namespace, tc.expNS)
+				testhelper.DiffString(t, tc.IDStr(), "pattern",
+					se.pattern, tc.expPat)
+				testhelper.DiffString(t, tc.IDStr(), "kind",
+					se.kind, tc.expKind)
+				testhelper.DiffString(t, tc.IDStr(), "source",
+					se.source, tc.expSource)
+			}
+		})
+	}
+}
+
+func TestTopicPatternMatches(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		pattern string
+		topic   pusu.Topic
+		exp     bool
+	}{
+		{
+			ID:      testhelper.MkID("exact"),
+			pattern: "/md/prices",
+			topic:   "/md/prices",
+			exp:     true,
+		},
+		{
+			ID:      testhelper.MkID("parent topic"),
+			pattern: "/md",
+			topic:   "/md/prices/eur",
+			exp:     true,
+		},
+		{
+			ID:      testhelper.MkID("root"),
+			pattern: "/",
+			topic:   "/md/prices",
+			exp:     true,
+		},
+		{
+			ID:      testhelper.MkID("wildcard"),
+			pattern: "/md/*/eur",
+			topic:   "/md/prices/eur/spot",
+			exp:     true,
+		},
+		{
+			ID:      testhelper.MkID("wildcard matches only one part"),
+			pattern: "/md/*",
+			topic:   "/md",
+			exp:     false,
+		},
+		{
+			ID:      testhelper.MkID("child of the topic"),
+			pattern: "/md/prices",
+			topic:   "/md",
+			exp:     false,
+		},
+		{
+			ID:      testhelper.MkID("prefix of a part"),
+			pattern: "/md/pri",
+			topic:   "/md/prices",
+			exp:     false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			testhelper.DiffBool(t, tc.IDStr(), "matches",
+				topicPatternMatches(tc.pattern, tc.topic), tc.exp)
+		})
+	}
+}
+
+func TestSchemaRegistry(t *testing.T) {
+	dir := t.TempDir()
+	writeDescriptorSet(t, dir)
+	writeFile(t, dir, "any.json", `{"type": "string"}`)
+
+	sr, err := loadSchemaRegistry(writeFile(t, dir, "registry",
+		"# quotes are protobuf in prod\n"+
+			"\n"+
+			"prod /md/*/quote proto quote.pb test.Quote\n"+
+			"* /md json any.json\n"))
+	if err != nil {
+		t.Fatal("cannot load the registry:", err)
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		ns      pusu.Namespace
+		topic   pusu.Topic
+		payload []byte
+	}{
+		{
+			ID:      testhelper.MkID("proto schema"),
+			ns:      "prod",
+			topic:   "/md/eur/quote",
+			payload: quotePayload("EUR", 1.25),
+		},
+		{
+			ID: testhelper.MkID("proto schema: bad payload"),
+			ExpErr: testhelper.MkExpErr(`topic "/md/eur/quote"`,
+				"not a valid test.Quote"),
+			ns:      "prod",
+			topic:   "/md/eur/quote",
+			payload: []byte{0xff},
+		},
+		{
+			ID:      testhelper.MkID("other namespace: json schema"),
+			ns:      "test",
+			topic:   "/md/eur/quote",
+			payload: []byte(`"EUR"`),
+		},
+		{
+			ID:      testhelper.MkID("other namespace: bad payload"),
+			ExpErr:  testhelper.MkExpErr(`topic "/md/eur/quote"`),
+			ns:      "test",
+			topic:   "/md/eur/quote",
+			payload: quotePayload("EUR", 1.25),
+		},
+		{
+			ID:      testhelper.MkID("no matching entry"),
+			ns:      "prod",
+			topic:   "/news",
+			payload: []byte{0xff},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := sr.validate(tc.ns, tc.topic, tc.payload)
+			testhelper.CheckExpErr(t, err, tc)
+		})
+	}
+}
+
+func TestLoadSchemaRegistryErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "bad.pb", "not a descriptor set")
+
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		contents string
+	}{
+		{
+			ID: testhelper.MkID("bad line"),
+			ExpErr: testhelper.MkExpErr("bad schema registry",
+				"registry:3: too few fields"),
+			contents: "# comment\n\n* /md json\n",
+		},
+		{
+			ID: testhelper.MkID("bad schema file"),
+			ExpErr: testhelper.MkExpErr("bad schema registry",
+				"registry:1:", "bad descriptor set"),
+			contents: "* /md proto bad.pb test.Quote\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := loadSchemaRegistry(
+				writeFile(t, dir, "registry", tc.contents))
+			if testhelper.CheckExpErr(t, err, tc) &&
+				!errors.Is(err, errBadRegistry) {
+				t.Log(tc.IDStr())
+				t.Error("\t: the error should wrap errBadRegistry")
+			}
+		})
+	}
+}
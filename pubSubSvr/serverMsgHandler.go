@@ -6,14 +6,37 @@ import (
 	"github.com/nickwells/pusu.mod/pusu"
 )
 
+// subscribers is the type representing the collection of clients who are
+// subscribed to a topic. Each client maps to the filter to be applied to
+// publications before sending them to the client; a nil filter means that
+// all publications are sent.
+type subscribers map[*client]filter
+
 // subsMap is the type representing a map between a topic and a collection of
 // clients who are subscribed to that topic. There is one such map per
 // namespace
-type subsMap map[pusu.Topic]map[*client]bool
+type subsMap map[pusu.Topic]subscribers
+
+// nsSubs holds the subscriptions in a namespace together with the profile
+// giving the settings for the namespace
+type nsSubs struct {
+	topics  subsMap
+	profile *nsProfile
+}
+
+// namespaceSubsMap is the type representing a map between a namespace and
+// the subscriptions in that namespace
+type namespaceSubsMap map[pusu.Namespace]*nsSubs
 
-// namespaceSubsMap is the type representing a map between a topic and the
-// collection of clients who are subscribed to that topic
-type namespaceSubsMap map[pusu.Namespace]subsMap
+// topics returns the map of topics to subscribers for the namespace. It
+// returns nil if there have been no subscriptions in the namespace.
+func (nsm namespaceSubsMap) topics(ns pusu.Namespace) subsMap {
+	if entry, ok := nsm[ns]; ok {
+		return entry.topics
+	}
+
+	return nil
+}
 
 // serverMsgHandler is a function for handling a message from a server
 // perspective
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// noteTextSnapshot describes how subscriptions survive a restart
+const noteTextSnapshot = "If a snapshot file is given the server" +
+	" periodically saves the subscriptions of its clients, and the" +
+	" durable subscriptions together with the publications held for" +
+	" them, to the file. They are saved again when the server is stopped" +
+	" by an interrupt or terminate signal. When the server starts it" +
+	" restores the state saved in the file." +
+	"\n\n" +
+	"A client's subscriptions are saved against its namespace, the" +
+	" identity in its client certificate and the identity given in its" +
+	" Start message. When a client with the same namespace and" +
+	" identities next starts, its saved subscriptions, including any" +
+	" filters and durable subscription names, are restored before any" +
+	" other message from the client is handled, so it receives" +
+	" publications without having to subscribe again. The client can" +
+	" tell that this has happened from field number 106 of the payload" +
+	" of the Ack to its Start message which gives, as an integer, the" +
+	" number of subscriptions restored. The saved subscriptions of each" +
+	" client are restored only once. Clients which give no identity in" +
+	" their Start message are not saved. The saved subscriptions of a" +
+	" client which does not reconnect are kept for the time given by" +
+	" the '" + paramNameSnapshotMaxAge + "' parameter and then dropped." +
+	" If restoring them would take the client over the limit on the" +
+	" number of subscriptions none of them are restored." +
+	"\n\n" +
+	"Durable subscriptions are restored as soon as the server starts and" +
+	" the publications held for them are sent once a client attaches" +
+	" to them. Any publications which had been sent but not" +
+	" acknowledged are sent again." +
+	"\n\n" +
+	"Anything which happens after the last snapshot is lost when the" +
+	" server stops, so publications to durable subscriptions may be" +
+	" lost or delivered again."
+
+// snapshotVersion is the version of the snapshot file format
+const snapshotVersion = 1
+
+// clientKey identifies a client across connections by its namespace and
+// identities
+type clientKey struct {
+	ns       pusu.Namespace
+	certID   string
+	identity string
+}
+
+// key returns the clientKey for the client and whether its subscriptions
+// may be saved. They are only saved for pusu clients which gave their own
+// identity; MQTT sessions and HTTP gateway streams are not kept after the
+// client disconnects.
+func (clt *client) key() (clientKey, bool) {
+	key := clientKey{
+		ns:       clt.namespace,
+		certID:   clt.certID,
+		identity: clt.identity,
+	}
+
+	return key, clt.identity != "" &&
+		!clt.assignedID &&
+		clt.mqtt == nil &&
+		!clt.gateway
+}
+
+// savedSub records a subscription in a snapshot
+type savedSub struct {
+	Topic   pusu.Topic `json:"topic"`
+	Filter  string     `json:"filter,omitempty"`
+	Durable string     `json:"durable,omitempty"`
+}
+
+// savedClient records the subscriptions of a client in a snapshot and when
+// the client was last seen with them
+type savedClient struct {
+	Namespace    pusu.Namespace `json:"namespace"`
+	CertIdentity string         `json:"certIdentity"`
+	Identity     string         `json:"identity"`
+	Subs         []savedSub     `json:"subscriptions"`
+	Seen         time.Time      `json:"seen,omitzero"`
+}
+
+// savedPending records a publication held for a durable subscription in a
+// snapshot
+type savedPending struct {
+	Topic    pusu.Topic        `json:"topic"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Payload  []byte            `json:"payload"`
+	Attempts int               `json:"attempts"`
+}
+
+// savedDurable records a durable subscription in a snapshot
+type savedDurable struct {
+	Namespace pusu.Namespace `json:"namespace"`
+	Name      string         `json:"name"`
+	Topic     pusu.Topic     `json:"topic"`
+	Filter    string         `json:"filter,omitempty"`
+	Pending   []savedPending `json:"pending,omitempty"`
+}
+
+// snapshot is the state saved to the snapshot file
+type snapshot struct {
+	Version  int            `json:"version"`
+	Taken    time.Time      `json:"taken"`
+	Clients  []savedClient  `json:"clients"`
+	Durables []savedDurable `json:"durables"`
+}
+
+// savedSubs holds the subscriptions restored from a snapshot which have
+// yet to be claimed by a client. It is shared by all the clients.
+// Subscriptions which are not claimed within maxAge of the client last
+// being seen are dropped; a zero maxAge means they are kept until claimed.
+type savedSubs struct {
+	sync.Mutex
+
+	maxAge   time.Duration
+	byClient map[clientKey]*savedClient
+}
+
+// newSavedSubs returns the saved subscriptions of the clients in the
+// snapshot, other than those which are too old. Clients saved without a
+// time they were last seen are taken to have been seen when the snapshot
+// was taken.
+func newSavedSubs(
+	snap *snapshot,
+	maxAge time.Duration,
+	now time.Time,
+) *savedSubs {
+	ss := &savedSubs{
+		maxAge:   maxAge,
+		byClient: make(map[clientKey]*savedClient),
+	}
+
+	for _, sc := range snap.Clients {
+		seen := sc.Seen
+		if seen.IsZero() {
+			seen = snap.Taken
+		}
+
+		if ss.expired(seen, now) {
+			continue
+		}
+
+		key := clientKey{
+			ns:       sc.Namespace,
+			certID:   sc.CertIdentity,
+			identity: sc.Identity,
+		}
+		entry := savedClientFor(ss.byClient, key)
+		entry.Subs = append(entry.Subs, sc.Subs...)
+
+		if seen.After(entry.Seen) {
+			entry.Seen = seen
+		}
+	}
+
+	return ss
+}
+
+// expired returns true if subscriptions of a client last seen at the
+// given time are too old to be kept
+func (ss *savedSubs) expired(seen, now time.Time) bool {
+	return ss.maxAge > 0 && now.Sub(seen) > ss.maxAge
+}
+
+// take removes and returns the saved subscriptions for the client
+func (ss *savedSubs) take(key clientKey) []savedSub {
+	if ss == nil {
+		return nil
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	sc, ok := ss.byClient[key]
+	if !ok {
+		return nil
+	}
+
+	delete(ss.byClient, key)
+
+	return sc.Subs
+}
+
+// addTo adds the subscriptions yet to be claimed to the map of clients,
+// keeping the time each client was last seen. Subscriptions which are now
+// too old are dropped.
+func (ss *savedSubs) addTo(
+	clients map[clientKey]*savedClient,
+	now time.Time,
+) {
+	if ss == nil {
+		return
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	for key, saved := range ss.byClient {
+		if ss.expired(saved.Seen, now) {
+			delete(ss.byClient, key)
+
+			continue
+		}
+
+		sc := savedClientFor(clients, key)
+		sc.Subs = append(sc.Subs, saved.Subs...)
+
+		if sc.Seen.IsZero() {
+			sc.Seen = saved.Seen
+		}
+	}
+}
+
+// savedClientFor returns the entry in the map for the client, creating it
+// if necessary
+func savedClientFor(
+	clients map[clientKey]*savedClient,
+	key clientKey,
+) *savedClient {
+	sc, ok := clients[key]
+	if !ok {
+		sc = &savedClient{
+			Namespace:    key.ns,
+			CertIdentity: key.certID,
+			Identity:     key.identity,
+		}
+		clients[key] = sc
+	}
+
+	return sc
+}
+
+// restoreSubs restores any saved subscriptions for the client. They are
+// handed on to the server as if the client had subscribed to them. It
+// returns the number of subscriptions restored.
+func (clt *client) restoreSubs() int {
+	key, ok := clt.key()
+	if !ok {
+		return 0
+	}
+
+	subs := clt.savedSubs.take(key)
+	if len(subs) == 0 {
+		return 0
+	}
+
+	topics := make([]pusu.Topic, 0, len(subs))
+
+	for _, s := range subs {
+		topics = append(topics, s.Topic)
+	}
+
+	if err := clt.checkNewSubs(topics); err != nil {
+		clt.logger.Error("couldn't restore the subscriptions",
+			pusu.ErrorAttr(err))
+
+		return 0
+	}
+
+	smp := &pusu.SubscriptionMsgPayload{}
+
+	for _, s := range subs {
+		sub := &pusu.SubscriptionMsgPayload_Sub{Topic: string(s.Topic)}
+
+		if s.Filter != "" {
+			setExtFields(sub, extSubFilter, [][]byte{[]byte(s.Filter)})
+		}
+
+		if s.Durable != "" {
+			setExtFields(sub, extSubDurable, [][]byte{[]byte(s.Durable)})
+		}
+
+		smp.Subs = append(smp.Subs, sub)
+	}
+
+	filters, err := parseSubFilters(smp)
+	if err != nil {
+		clt.logger.Error("couldn't restore the subscriptions",
+			pusu.ErrorAttr(err))
+
+		return 0
+	}
+
+	durables, err := parseSubDurables(smp)
+	if err != nil {
+		clt.logger.Error("couldn't restore the subscriptions",
+			pusu.ErrorAttr(err))
+
+		return 0
+	}
+
+	msg := &pusu.Message{MT: pusu.Subscribe, MsgID: pusu.NoMsgID}
+	if err := msg.Marshal(smp, clt.logger); err != nil {
+		return 0
+	}
+
+	for _, s := range subs {
+		clt.subs[s.Topic] = true
+	}
+
+	clt.pubSubChan <- clientMessage{
+		clt:      clt,
+		msg:      msg,
+		filters:  filters,
+		durables: durables,
+	}
+
+	clt.logger.Info("subscriptions restored", slog.Int("count", len(subs)))
+
+	return len(subs)
+}
+
+// appendRestored appends the number of subscriptions restored to the
+// payload of the Ack to the Start message
+func appendRestored(payload []byte, restored int) []byte {
+	if restored == 0 {
+		return payload
+	}
+
+	payload = protowire.AppendTag(payload, extAckRestored, protowire.VarintType)
+
+	return protowire.AppendVarint(payload, uint64(restored)) //nolint:gosec
+}
+
+// takeSnapshot returns the current subscriptions and durable subscriptions.
+// It must be called from the pubSubHandler goroutine.
+func (prog *prog) takeSnapshot(nsm namespaceSubsMap) *snapshot {
+	clients := make(map[clientKey]*savedClient)
+
+	for _, entry := range nsm {
+		for topic, cMap := range entry.topics {
+			for clt, f := range cMap {
+				key, ok := clt.key()
+				if !ok || !clt.started {
+					continue
+				}
+
+				sc := savedClientFor(clients, key)
+				sc.Subs = append(sc.Subs,
+					savedSub{Topic: topic, Filter: filterText(f)})
+			}
+		}
+	}
+
+	snap := &snapshot{Version: snapshotVersion, Taken: time.Now()}
+
+	if prog.durables != nil {
+		for _, ds := range prog.durables.byKey {
+			snap.Durables = append(snap.Durables, ds.saved())
+
+			if ds.clt == nil || !ds.clt.started {
+				continue
+			}
+
+			if key, ok := ds.clt.key(); ok {
+				sc := savedClientFor(clients, key)
+				sc.Subs = append(sc.Subs, savedSub{
+					Topic:   ds.topic,
+					Filter:  filterText(ds.filter),
+					Durable: ds.name,
+				})
+			}
+		}
+	}
+
+	for _, sc := range clients {
+		sc.Seen = snap.Taken
+	}
+
+	prog.savedSubs.addTo(clients, snap.Taken)
+
+	snap.Clients = make([]savedClient, 0, len(clients))
+	for _, key := range slices.SortedFunc(maps.Keys(clients), cmpClientKey) {
+		snap.Clients = append(snap.Clients, *clients[key])
+	}
+
+	slices.SortFunc(snap.Durables, func(a, b savedDurable) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace),
+			cmp.Compare(a.Name, b.Name))
+	})
+
+	return snap
+}
+
+// cmpClientKey compares the client keys
+func cmpClientKey(a, b clientKey) int {
+	return cmp.Or(cmp.Compare(a.ns, b.ns),
+		cmp.Compare(a.certID, b.certID),
+		cmp.Compare(a.identity, b.identity))
+}
+
+// saved returns the record of the durable subscription for a snapshot. The
+// publications awaiting acknowledgement come first, in the order in which
+// they were first held.
+func (ds *durableSub) saved() savedDurable {
+	sd := savedDurable{
+		Namespace: ds.ns,
+		Name:      ds.name,
+		Topic:     ds.topic,
+		Filter:    filterText(ds.filter),
+	}
+
+	pending := append(ds.inflightInOrder(), ds.waiting...)
+
+	for _, pd := range pending {
+		sd.Pending = append(sd.Pending, savedPending{
+			Topic:    pd.pubTopic,
+			Headers:  pd.pub.hdrs,
+			Payload:  pd.pub.plain,
+			Attempts: pd.attempts,
+		})
+	}
+
+	return sd
+}
+
+// restore recreates the saved durable subscription, with no client
+// attached
+func (dss *durableSubs) restore(sd savedDurable, logger *slog.Logger) error {
+	if err := checkDurableName(sd.Name); err != nil {
+		return err
+	}
+
+	f, err := parseFilter(sd.Filter)
+	if err != nil {
+		return err
+	}
+
+	if f != nil {
+		f = sourcedFilter{filter: f, text: sd.Filter}
+	}
+
+	key := durableKey{ns: sd.Namespace, name: sd.Name}
+	if _, ok := dss.byKey[key]; ok {
+		return fmt.Errorf("%w: %q is saved more than once",
+			errBadDurable, sd.Name)
+	}
+
+	ds := &durableSub{
+		durableKey: key,
+		topic:      sd.Topic,
+		filter:     f,
+		inflight:   make(map[pusu.MsgID]*pendingDelivery),
+	}
+
+	for _, sp := range sd.Pending {
+		pub := &publication{
+			pmp:   &pusu.PublishMsgPayload{Topic: string(sp.Topic)},
+			hdrs:  sp.Headers,
+			plain: sp.Payload,
+		}
+
+		msg, err := pub.message(ds.topic, encodedPayload{payload: pub.plain},
+			logger)
+		if err != nil {
+			return err
+		}
+
+		pd := &pendingDelivery{
+			pub:      pub,
+			pubTopic: sp.Topic,
+			msg:      msg,
+			attempts: sp.Attempts,
+		}
+		ds.hold(pd)
+		ds.waiting = append(ds.waiting, pd)
+	}
+
+	dss.byKey[key] = ds
+	dss.addToTopic(ds)
+	dss.subCount.Add(1)
+	dss.pending.Add(int64(len(ds.waiting)))
+
+	return nil
+}
+
+// loadSnapshot reads the snapshot file. A missing file gives an empty
+// snapshot.
+func loadSnapshot(filename string) (*snapshot, error) {
+	snap := &snapshot{Version: snapshotVersion}
+
+	b, err := os.ReadFile(filename) //nolint:gosec
+	if errors.Is(err, fs.ErrNotExist) {
+		return snap, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the snapshot file: %w", err)
+	}
+
+	if err := json.Unmarshal(b, snap); err != nil {
+		return nil, fmt.Errorf("bad snapshot file %q: %w", filename, err)
+	}
+
+	if snap.Version != snapshotVersion {
+		return nil, fmt.Errorf(
+			"bad snapshot file %q: unknown version %d (expected %d)",
+			filename, snap.Version, snapshotVersion)
+	}
+
+	return snap, nil
+}
+
+// restoreSnapshot restores the state saved in the snapshot file, if one has
+// been given. Any errors will be logged, will set the exitStatus to
+// non-zero and this will return false.
+func (prog *prog) restoreSnapshot() bool {
+	if prog.snapshotFile == "" {
+		return true
+	}
+
+	snap, err := loadSnapshot(prog.snapshotFile)
+	if err == nil {
+		for _, sd := range snap.Durables {
+			if err = prog.durables.restore(sd, prog.logger); err != nil {
+				err = fmt.Errorf("bad snapshot file %q: %w",
+					prog.snapshotFile, err)
+
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		prog.logger.Error("couldn't restore the snapshot", pusu.ErrorAttr(err))
+		prog.setExitStatus(1)
+
+		return false
+	}
+
+	prog.savedSubs = newSavedSubs(snap, prog.snapshotMaxAge, time.Now())
+
+	prog.logger.Info("snapshot restored",
+		slog.String("file", prog.snapshotFile),
+		slog.Time("taken", snap.Taken),
+		slog.Int("clients", len(snap.Clients)),
+		slog.Int("durables", len(snap.Durables)))
+
+	return true
+}
+
+// snapshotWriter writes the snapshots, one at a time and in the order they
+// are received, so that a snapshot is never replaced by an older one. It
+// closes the written channel once the snapshots channel is closed and the
+// last snapshot has been written.
+func (prog *prog) snapshotWriter(
+	snapshots <-chan *snapshot,
+	written chan<- struct{},
+) {
+	defer close(written)
+
+	for snap := range snapshots {
+		prog.writeSnapshot(snap)
+	}
+}
+
+// writeSnapshot writes the snapshot to the snapshot file. The snapshot is
+// written to a temporary file which then replaces the snapshot file so
+// that the file is never left partly written.
+func (prog *prog) writeSnapshot(snap *snapshot) {
+	const filePerms = 0o600
+
+	err := func() error {
+		b, err := json.Marshal(snap)
+		if err != nil {
+			return err
+		}
+
+		tmp, err := os.CreateTemp(filepath.Dir(prog.snapshotFile),
+			filepath.Base(prog.snapshotFile)+".*")
+		if err != nil {
+			return err
+		}
+
+		defer os.Remove(tmp.Name()) //nolint:errcheck
+
+		if _, err = tmp.Write(b); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+
+		if err = tmp.Chmod(filePerms); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+
+		if err = tmp.Close(); err != nil {
+			return err
+		}
+
+		return os.Rename(tmp.Name(), prog.snapshotFile)
+	}()
+	if err != nil {
+		prog.logger.Error("couldn't write the snapshot",
+			slog.String("file", prog.snapshotFile), pusu.ErrorAttr(err))
+
+		return
+	}
+
+	prog.logger.Debug("snapshot written",
+		slog.String("file", prog.snapshotFile),
+		slog.Int("clients", len(snap.Clients)),
+		slog.Int("durables", len(snap.Durables)))
+}
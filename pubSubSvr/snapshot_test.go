@@ -0,0 +1,222 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	const ns = pusu.Namespace("test")
+
+	cfg := durableConfig{
+		redeliveryTimeout: time.Minute,
+		maxAttempts:       5,
+		maxInflight:       1,
+		maxPending:        10,
+		deadLetterTopic:   "/dl",
+	}
+	snapFile := filepath.Join(t.TempDir(), "subs.json")
+
+	newClient := func(identity string) *client {
+		clt := testClient(ns)
+		clt.identity, clt.certID = identity, "feeds"
+
+		return clt
+	}
+
+	f, err := parseFilter("region = eu")
+	if err != nil {
+		t.Fatal("cannot parse the filter:", err)
+	}
+
+	named, anon := newClient("feed-1"), newClient("")
+	nsm := namespaceSubsMap{
+		ns: {topics: subsMap{
+			"/a": subscribers{
+				named: sourcedFilter{filter: f, text: "region = eu"},
+				anon:  nil,
+			},
+		}},
+	}
+
+	saver := &prog{
+		logger:       testLogger,
+		snapshotFile: snapFile,
+		durables:     newDurableSubs(cfg),
+	}
+	saver.durables.attach(named, "orders", "/b", nil)
+
+	for range 2 {
+		pub := &publication{
+			pmp:   &pusu.PublishMsgPayload{Topic: "/b/c"},
+			plain: []byte("order"),
+		}
+		saver.sendToDurables(ns, pub, pub.topic(), "/b", time.Now(), nsm)
+	}
+
+	saver.writeSnapshot(saver.takeSnapshot(nsm))
+
+	restorer := &prog{
+		logger:       testLogger,
+		snapshotFile: snapFile,
+		durables:     newDurableSubs(cfg),
+	}
+	if !restorer.restoreSnapshot() {
+		t.Fatal("the snapshot was not restored")
+	}
+
+	ds := restorer.durables.byKey[durableKey{ns: ns, name: "orders"}]
+	if ds == nil {
+		t.Fatal("the durable subscription was not restored")
+	}
+
+	testhelper.DiffInt(t, "restored durable", "waiting", len(ds.waiting), 2)
+
+	clt := newClient("feed-1")
+	clt.clientShared = &clientShared{
+		pubSubChan: make(chan clientMessage, 1),
+		savedSubs:  restorer.savedSubs,
+		connLimits: newConnLimits(),
+	}
+
+	testhelper.DiffInt(t, "reconnected client", "restored",
+		clt.restoreSubs(), 2)
+	testhelper.DiffInt(t, "reconnected again", "restored",
+		clt.restoreSubs(), 0)
+
+	cMsg := <-clt.pubSubChan
+	testhelper.DiffString(t, "restored subscription", "filter",
+		filterText(cMsg.filters["/a"]), "region = eu")
+	testhelper.DiffString(t, "restored subscription", "durable",
+		cMsg.durables["/b"], "orders")
+}
+
+func TestSavedSubsMaxAge(t *testing.T) {
+	const maxAge = time.Hour
+
+	now := time.Now()
+	mkClient := func(identity string, seen time.Time) savedClient {
+		return savedClient{
+			Namespace: "test",
+			Identity:  identity,
+			Subs:      []savedSub{{Topic: "/a"}},
+			Seen:      seen,
+		}
+	}
+
+	snap := &snapshot{
+		Taken: now.Add(-maxAge / 2),
+		Clients: []savedClient{
+			mkClient("recent", now.Add(-maxAge/4)),
+			mkClient("old", now.Add(-2*maxAge)),
+			mkClient("unset", time.Time{}),
+		},
+	}
+
+	ss := newSavedSubs(snap, maxAge, now)
+	testhelper.DiffInt(t, "restored", "clients", len(ss.byClient), 2)
+
+	clients := map[clientKey]*savedClient{}
+	ss.addTo(clients, now.Add(maxAge*3/4))
+	testhelper.DiffInt(t, "next snapshot", "clients", len(clients), 1)
+
+	for key, sc := range clients {
+		testhelper.DiffString(t, "next snapshot", "client",
+			key.identity, "recent")
+		testhelper.DiffTime(t, "next snapshot", "seen",
+			sc.Seen, now.Add(-maxAge/4))
+	}
+}
+
+func TestRestoreSubsLimit(t *testing.T) {
+	key := clientKey{ns: "test", identity: "feed-1"}
+	limits := newConnLimits()
+	limits.maxSubs = 2
+
+	clt := testClient(key.ns)
+	clt.identity = key.identity
+	clt.subs["/a"] = true
+	clt.clientShared = &clientShared{
+		pubSubChan: make(chan clientMessage, 1),
+		connLimits: limits,
+		savedSubs: &savedSubs{
+			byClient: map[clientKey]*savedClient{
+				key: {Subs: []savedSub{{Topic: "/b"}, {Topic: "/c"}}},
+			},
+		},
+	}
+
+	testhelper.DiffInt(t, "over the limit", "restored", clt.restoreSubs(), 0)
+}
+
+func TestClientKey(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		clt   *client
+		expOK bool
+	}{
+		{
+			ID:    testhelper.MkID("pusu client"),
+			clt:   &client{identity: "feed-1"},
+			expOK: true,
+		},
+		{
+			ID:  testhelper.MkID("no identity"),
+			clt: &client{},
+		},
+		{
+			ID:  testhelper.MkID("identity made up by the server"),
+			clt: &client{identity: "mqtt-7", assignedID: true},
+		},
+		{
+			ID:  testhelper.MkID("MQTT client"),
+			clt: &client{identity: "sensor-1", mqtt: newMQTTSession()},
+		},
+		{
+			ID:  testhelper.MkID("HTTP gateway client"),
+			clt: &client{identity: "dashboard", gateway: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, ok := tc.clt.key()
+			testhelper.DiffBool(t, tc.IDStr(), "ok", ok, tc.expOK)
+		})
+	}
+}
+
+func TestSnapshotOnStop(t *testing.T) {
+	snapFile := filepath.Join(t.TempDir(), "subs.json")
+
+	srv := newProg()
+	srv.logger = testLogger
+	srv.snapshotFile = snapFile
+	srv.snapshotInterval = time.Hour
+	srv.statusReportingInterval = time.Hour
+	srv.durables = newDurableSubs(durableConfig{})
+
+	start := time.Now()
+
+	go srv.pubSubHandler()
+
+	close(srv.stop)
+
+	select {
+	case <-srv.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the pubSubHandler did not stop")
+	}
+
+	snap, err := loadSnapshot(snapFile)
+	if err != nil {
+		t.Fatal("the final snapshot was not written:", err)
+	}
+
+	testhelper.DiffBool(t, "final snapshot", "taken after the start",
+		!snap.Taken.Before(start), true)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// sysTopic is the topic, in every namespace, under which the server
+// publishes events. Clients may subscribe to it but may not publish on it.
+const sysTopic = pusu.Topic("/$sys")
+
+// The topics on which each kind of system event is published
+const (
+	sysTopicSubscriptions = sysTopic + "/subscriptions"
+	sysTopicClients       = sysTopic + "/clients"
+)
+
+// hdrSysEvent is the header giving the kind of a system event
+const hdrSysEvent = "sys-event"
+
+// The events published when a topic gains its first subscriber and loses
+// its last
+const (
+	sysEventFirstSub = "first-subscriber"
+	sysEventLastSub  = "last-subscriber"
+)
+
+// The events published when a client connects and disconnects
+const (
+	sysEventConnect    = "connect"
+	sysEventDisconnect = "disconnect"
+)
+
+// noteTextSysEvents describes the events published by the server
+const noteTextSysEvents = "The server publishes events about what is" +
+	" happening in each namespace on topics under " + string(sysTopic) +
+	" in that namespace. Clients may subscribe to these topics but may" +
+	" not publish on them. Each event has a '" + hdrSysEvent + "'" +
+	" header giving the kind of event and a JSON payload describing it." +
+	"\n\n" +
+	"When a topic gains its first subscriber a '" + sysEventFirstSub +
+	"' event is published on " + string(sysTopicSubscriptions) + " and" +
+	" when it loses its last subscriber, whether by unsubscribing or by" +
+	" disconnecting, a '" + sysEventLastSub + "' event is published. The" +
+	" payload gives the event and the topic, for instance:" +
+	"\n\n" +
+	`{"event":"` + sysEventFirstSub + `","topic":"/a/b"}` +
+	"\n\n" +
+	"A publisher can subscribe to this topic to learn when to start and" +
+	" stop producing publications on a topic. Note that a publication is" +
+	" also sent to the subscribers to any of the parent topics of the" +
+	" topic it is published on, so the publisher may need to watch those" +
+	" too. Durable subscriptions and subscriptions to the system topics" +
+	" themselves do not cause events." +
+	"\n\n" +
+	"When a client has started, that is once its Start message has been" +
+	" accepted, a '" + sysEventConnect + "' event is published on " +
+	string(sysTopicClients) + " and when it disconnects a '" +
+	sysEventDisconnect + "' event is published. The payload gives the" +
+	" connection ID, the identity given in the Start message, the" +
+	" identity from the client certificate and the namespace. A" +
+	" disconnect event also gives the reason: '" + closeReasonEOF + "'" +
+	" if the client closed the connection, '" + closeReasonReadErr +
+	"', '" + closeReasonSlow + "' if the client was disconnected because" +
+	" it was not keeping up with the messages sent to it, '" +
+	closeReasonProtocol + "' if it was disconnected because it sent a" +
+	" bad message or '" + closeReasonRateLimit + "' if it was" +
+	" disconnected for exceeding its rate limit; any error is also" +
+	" given. For instance:" +
+	"\n\n" +
+	`{"event":"` + sysEventDisconnect + `","connID":"42",` +
+	`"identity":"feed-1","certIdentity":"feeds","namespace":"prices",` +
+	`"reason":"` + closeReasonEOF + `"}`
+
+// errReservedTopic is the error returned when a client publishes on a
+// topic reserved for the server
+var errReservedTopic = errors.New("reserved topic")
+
+// isSysTopic returns true if the topic is the system topic or one of its
+// sub-topics
+func isSysTopic(topic pusu.Topic) bool {
+	return topic == sysTopic ||
+		strings.HasPrefix(string(topic), string(sysTopic)+"/")
+}
+
+// checkPublishTopic returns a non-nil error if a client may not publish on
+// the topic
+func checkPublishTopic(topic pusu.Topic) error {
+	if isSysTopic(topic) {
+		return fmt.Errorf("%w: %q - only the server may publish on %q",
+			errReservedTopic, topic, sysTopic)
+	}
+
+	return nil
+}
+
+// subscriptionEvent is the payload of the events published when a topic
+// gains its first subscriber or loses its last
+type subscriptionEvent struct {
+	Event string     `json:"event"`
+	Topic pusu.Topic `json:"topic"`
+}
+
+// publishSysEvent publishes the event on the system topic in the namespace
+func (prog *prog) publishSysEvent(
+	ns pusu.Namespace,
+	topic pusu.Topic,
+	event string,
+	payload any,
+	nsm namespaceSubsMap,
+) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		prog.logger.Error("couldn't encode the system event",
+			ns.Attr(), topic.Attr(), pusu.ErrorAttr(err))
+
+		return
+	}
+
+	prog.publishInternal(ns, topic,
+		map[string]string{hdrSysEvent: event}, b, nsm)
+}
+
+// notifySubscription publishes the event recording that the topic has
+// gained its first subscriber or lost its last. Nothing is published for
+// the system topics themselves.
+func (prog *prog) notifySubscription(
+	ns pusu.Namespace,
+	topic pusu.Topic,
+	event string,
+	nsm namespaceSubsMap,
+) {
+	if isSysTopic(topic) {
+		return
+	}
+
+	prog.publishSysEvent(ns, sysTopicSubscriptions, event,
+		subscriptionEvent{Event: event, Topic: topic}, nsm)
+}
+
+// clientEvent is the payload of the events published when a client
+// connects or disconnects
+type clientEvent struct {
+	Event        string         `json:"event"`
+	ConnID       string         `json:"connID"`
+	Identity     string         `json:"identity"`
+	CertIdentity string         `json:"certIdentity"`
+	Namespace    pusu.Namespace `json:"namespace"`
+	Reason       string         `json:"reason,omitempty"`
+	Error        string         `json:"error,omitempty"`
+}
+
+// notifyClient publishes the event recording that the client has connected
+// or disconnected
+func (prog *prog) notifyClient(
+	clt *client,
+	event string,
+	nsm namespaceSubsMap,
+) {
+	ce := clientEvent{
+		Event:        event,
+		ConnID:       clt.cID.String(),
+		Identity:     clt.identity,
+		CertIdentity: clt.certID,
+		Namespace:    clt.namespace,
+	}
+
+	if event == sysEventDisconnect {
+		ce.Reason, ce.Error = clt.getCloseReason()
+	}
+
+	prog.publishSysEvent(clt.namespace, sysTopicClients, event, ce, nsm)
+}
+
+// serverHandleStart handles a Start message from the server side. It
+// publishes the event recording that the client has connected.
+//
+// Note that this handler takes the clientMessage sent over the pubSubChan by
+// the clientHandleStart func.
+func serverHandleStart(prog *prog, cMsg clientMessage, nsm namespaceSubsMap) {
+	cMsg.clt.started = true
+
+	prog.notifyClient(cMsg.clt, sysEventConnect, nsm)
+}
+
+// serverHandleDisconnect handles the disconnection of the client. It
+// removes all its subscriptions, publishes any last-will publication and,
+// if the client had started, publishes the event recording that it has
+// disconnected.
+func (prog *prog) serverHandleDisconnect(
+	clt *client,
+	nsm namespaceSubsMap,
+) {
+	prog.removeClientSubs(clt, nsm)
+	prog.durables.detachClient(clt)
+	prog.publishWill(clt, nsm)
+
+	if clt.started {
+		prog.notifyClient(clt, sysEventDisconnect, nsm)
+	}
+}
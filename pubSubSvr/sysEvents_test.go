@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+	"google.golang.org/protobuf/proto"
+)
+
+// subMsg returns a message of the given type for the topics
+func subMsg(t *testing.T, mt pusu.MsgType, topics ...string) *pusu.Message {
+	t.Helper()
+
+	smp := &pusu.SubscriptionMsgPayload{}
+	for _, topic := range topics {
+		smp.Subs = append(smp.Subs,
+			&pusu.SubscriptionMsgPayload_Sub{Topic: topic})
+	}
+
+	payload, err := proto.Marshal(smp)
+	if err != nil {
+		t.Fatal("cannot marshal the subscriptions:", err)
+	}
+
+	return &pusu.Message{MT: mt, Payload: payload}
+}
+
+// sysEventPayloads returns the payloads of the events sent to the client
+func sysEventPayloads(t *testing.T, clt *client) [][]byte {
+	t.Helper()
+
+	var payloads [][]byte
+
+	for {
+		select {
+		case om := <-clt.sendChan:
+			msg, err := pusu.ReadMsg(bytes.NewReader(om.enc.bytes()))
+			om.discard()
+
+			if err != nil {
+				t.Fatal("cannot read the event:", err)
+			}
+
+			pmp := &pusu.PublishMsgPayload{}
+			if err := proto.Unmarshal(msg.Payload, pmp); err != nil {
+				t.Fatal("cannot unmarshal the event:", err)
+			}
+
+			payloads = append(payloads, pmp.Payload)
+		default:
+			return payloads
+		}
+	}
+}
+
+// sysEvents returns the subscription events sent to the client
+func sysEvents(t *testing.T, clt *client) []string {
+	t.Helper()
+
+	var events []string
+
+	for _, payload := range sysEventPayloads(t, clt) {
+		var se subscriptionEvent
+		if err := json.Unmarshal(payload, &se); err != nil {
+			t.Fatal("cannot decode the event:", err)
+		}
+
+		events = append(events, se.Event+" "+string(se.Topic))
+	}
+
+	return events
+}
+
+func TestSubscriptionEvents(t *testing.T) {
+	const ns = pusu.Namespace("test")
+
+	prog := &prog{logger: testLogger}
+
+	watcher := testClient(ns)
+	nsm := namespaceSubsMap{
+		ns: {topics: subsMap{
+			sysTopicSubscriptions: subscribers{watcher: nil},
+		}},
+	}
+
+	clt1, clt2 := testClient(ns), testClient(ns)
+
+	serverHandleSubscribe(prog,
+		clientMessage{clt: clt1, msg: subMsg(t, pusu.Subscribe, "/a", "/b")},
+		nsm)
+	serverHandleSubscribe(prog,
+		clientMessage{clt: clt2, msg: subMsg(t, pusu.Subscribe, "/a")},
+		nsm)
+	testhelper.DiffStringSlice(t, "subscribe", "events",
+		sysEvents(t, watcher),
+		[]string{sysEventFirstSub + " /a", sysEventFirstSub + " /b"})
+
+	serverHandleUnsubscribe(prog,
+		clientMessage{clt: clt1, msg: subMsg(t, pusu.Unsubscribe, "/a", "/b")},
+		nsm)
+	testhelper.DiffStringSlice(t, "unsubscribe", "events",
+		sysEvents(t, watcher), []string{sysEventLastSub + " /b"})
+
+	clt2.subs["/a"] = true
+	prog.removeClientSubs(clt2, nsm)
+	testhelper.DiffStringSlice(t, "disconnect", "events",
+		sysEvents(t, watcher), []string{sysEventLastSub + " /a"})
+
+	testhelper.DiffBool(t, "publish on a system topic", "rejected",
+		checkPublishTopic(sysTopicSubscriptions) != nil, true)
+	testhelper.DiffBool(t, "publish on another topic", "rejected",
+		checkPublishTopic("/$system") != nil, false)
+}
+
+func TestClientEvents(t *testing.T) {
+	const ns = pusu.Namespace("test")
+
+	prog := &prog{logger: testLogger}
+
+	watcher := testClient(ns)
+	nsm := namespaceSubsMap{
+		ns: {topics: subsMap{sysTopicClients: subscribers{watcher: nil}}},
+	}
+
+	newClient := func(id connID) *client {
+		clt := testClient(ns)
+		clt.cID, clt.identity, clt.certID = id, "feed", "feeds"
+		clt.connected, clt.started = false, false
+
+		return clt
+	}
+
+	unstarted := newClient(1)
+	unstarted.setCloseReason(closeReasonReadErr, errors.New("bad cert"))
+	prog.serverHandleDisconnect(unstarted, nsm)
+
+	clt := newClient(2)
+	serverHandleStart(prog,
+		clientMessage{clt: clt, msg: &pusu.Message{MT: pusu.Start}}, nsm)
+	clt.setCloseReason(closeReasonSlow, nil)
+	clt.setCloseReason(closeReasonReadErr, errors.New("closed"))
+	prog.serverHandleDisconnect(clt, nsm)
+
+	var events []clientEvent
+
+	for _, payload := range sysEventPayloads(t, watcher) {
+		var ce clientEvent
+		if err := json.Unmarshal(payload, &ce); err != nil {
+			t.Fatal("cannot decode the event:", err)
+		}
+
+		events = append(events, ce)
+	}
+
+	exp := []clientEvent{
+		{
+			Event:        sysEventConnect,
+			ConnID:       clt.cID.String(),
+			Identity:     "feed",
+			CertIdentity: "feeds",
+			Namespace:    ns,
+		},
+		{
+			Event:        sysEventDisconnect,
+			ConnID:       clt.cID.String(),
+			Identity:     "feed",
+			CertIdentity: "feeds",
+			Namespace:    ns,
+			Reason:       closeReasonSlow,
+		},
+	}
+
+	testhelper.DiffSlice(t, "connect and disconnect", "events", events, exp)
+}
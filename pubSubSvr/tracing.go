@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+)
+
+// The names of the W3C trace context headers
+const (
+	hdrTraceparent = "traceparent"
+	hdrTracestate  = "tracestate"
+)
+
+// errBadTraceparent is returned if the traceparent header is malformed
+var errBadTraceparent = errors.New("bad traceparent")
+
+// traceContext holds the W3C trace context identifying a span
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	flags   byte
+	state   string
+}
+
+// isValid returns true if the trace and span IDs are set
+func (tc traceContext) isValid() bool {
+	return tc.traceID != [16]byte{} && tc.spanID != [8]byte{}
+}
+
+// sampled returns true if the sampled flag is set
+func (tc traceContext) sampled() bool {
+	return tc.flags&1 == 1
+}
+
+// traceparent returns the value of the traceparent header for the context
+func (tc traceContext) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x",
+		hex.EncodeToString(tc.traceID[:]),
+		hex.EncodeToString(tc.spanID[:]),
+		tc.flags)
+}
+
+// decodeHexTo decodes the lower-case hex string into the byte slice, which
+// must be exactly the right size.
+func decodeHexTo(dst []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(dst)) {
+		return fmt.Errorf("%w: %q has the wrong length", errBadTraceparent, s)
+	}
+
+	if strings.ToLower(s) != s {
+		return fmt.Errorf("%w: %q is not lower-case hex", errBadTraceparent, s)
+	}
+
+	if _, err := hex.Decode(dst, []byte(s)); err != nil {
+		return fmt.Errorf("%w: %w", errBadTraceparent, err)
+	}
+
+	return nil
+}
+
+// traceContextFromHeaders returns the trace context given by the
+// traceparent and tracestate headers. If there is no traceparent header the
+// returned context will not be valid and the error will be nil.
+//
+// The traceparent must be as given by the W3C Trace Context
+// recommendation: a version, a trace ID, a parent span ID and the flags,
+// all in lower-case hex and of the right lengths. Version "ff" is invalid
+// and neither ID may be all zeros. A version later than "00" may have more
+// fields after the flags; these are ignored.
+func traceContextFromHeaders(hdrs map[string]string) (traceContext, error) {
+	const (
+		traceparentParts = 4
+		firstVersion     = "00"
+		invalidVersion   = "ff"
+	)
+
+	var tc traceContext
+
+	tp, ok := hdrs[hdrTraceparent]
+	if !ok {
+		return tc, nil
+	}
+
+	parts := strings.Split(tp, "-")
+	if len(parts) < traceparentParts ||
+		(parts[0] == firstVersion && len(parts) != traceparentParts) {
+		return tc, fmt.Errorf("%w: %q - wrong number of fields",
+			errBadTraceparent, tp)
+	}
+
+	var version, flags [1]byte
+
+	for _, p := range []struct {
+		dst []byte
+		s   string
+	}{
+		{dst: version[:], s: parts[0]},
+		{dst: tc.traceID[:], s: parts[1]},
+		{dst: tc.spanID[:], s: parts[2]},
+		{dst: flags[:], s: parts[3]},
+	} {
+		if err := decodeHexTo(p.dst, p.s); err != nil {
+			return traceContext{}, err
+		}
+	}
+
+	if parts[0] == invalidVersion {
+		return traceContext{}, fmt.Errorf("%w: %q - invalid version",
+			errBadTraceparent, tp)
+	}
+
+	if !tc.isValid() {
+		return traceContext{}, fmt.Errorf("%w: %q - all-zero ID",
+			errBadTraceparent, tp)
+	}
+
+	tc.flags = flags[0]
+	tc.state = hdrs[hdrTracestate]
+
+	return tc, nil
+}
+
+// setTraceHeaders sets the trace context headers from the trace context
+func setTraceHeaders(hdrs map[string]string, tc traceContext) {
+	hdrs[hdrTraceparent] = tc.traceparent()
+
+	if tc.state != "" {
+		hdrs[hdrTracestate] = tc.state
+	} else {
+		delete(hdrs, hdrTracestate)
+	}
+}
+
+// spanKind is the OTLP span kind
+type spanKind int
+
+const (
+	spanKindInternal spanKind = 1
+	spanKindServer   spanKind = 2
+	spanKindClient   spanKind = 3
+	spanKindProducer spanKind = 4
+	spanKindConsumer spanKind = 5
+)
+
+// span records a single traced operation. All the methods are safe to
+// call on a nil span (which is what the tracer returns when the operation is
+// not being traced) and do nothing.
+type span struct {
+	tracer       *tracer
+	tc           traceContext
+	parentSpanID [8]byte
+	name         string
+	kind         spanKind
+	start        time.Time
+	end          time.Time
+	attrs        map[string]string
+	errText      string
+}
+
+// context returns the trace context of the span. This can be used as the
+// parent of other spans.
+func (s *span) context() traceContext {
+	if s == nil {
+		return traceContext{}
+	}
+
+	return s.tc
+}
+
+// setAttr sets an attribute on the span
+func (s *span) setAttr(key, val string) {
+	if s == nil {
+		return
+	}
+
+	s.attrs[key] = val
+}
+
+// setError records that the operation failed
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.errText = err.Error()
+}
+
+// finish records the end time of the span and passes it to the tracer for
+// exporting.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+
+	select {
+	case s.tracer.spans <- s:
+	default:
+		s.tracer.dropped.Add(1)
+	}
+}
+
+// tracer records spans for traced publications and exports them in OTLP
+// JSON format to a collector endpoint, a file or both. Only publications
+// carrying a sampled trace context are traced. A nil tracer traces nothing.
+type tracer struct {
+	logger      *slog.Logger
+	serviceName string
+
+	endpoint   string
+	httpClient *http.Client
+	file       io.Writer
+
+	spans   chan *span
+	dropped atomic.Int64
+}
+
+// newTracer returns a tracer exporting spans to the endpoint and the file
+// (either may be empty). If both are empty it returns nil.
+func newTracer(
+	logger *slog.Logger,
+	serviceName, endpoint, filename string,
+) (*tracer, error) {
+	const (
+		filePerms   = 0o600
+		maxSpans    = 10000
+		httpTimeout = 5 * time.Second
+	)
+
+	if endpoint == "" && filename == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	t := &tracer{
+		logger:      logger,
+		serviceName: serviceName,
+		endpoint:    endpoint,
+		httpClient:  &http.Client{Timeout: httpTimeout},
+		spans:       make(chan *span, maxSpans),
+	}
+
+	if filename != "" {
+		f, err := os.OpenFile(filename,
+			os.O_CREATE|os.O_WRONLY|os.O_APPEND, filePerms)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open the trace file: %w", err)
+		}
+
+		t.file = f
+	}
+
+	go t.run()
+
+	return t, nil
+}
+
+// startSpan returns a new span with the given parent. It returns nil if the
+// tracer is nil or the parent is not a valid, sampled trace context.
+func (t *tracer) startSpan(
+	name string,
+	kind spanKind,
+	parent traceContext,
+	start time.Time,
+) *span {
+	if t == nil || !parent.isValid() || !parent.sampled() {
+		return nil
+	}
+
+	s := &span{
+		tracer:       t,
+		tc:           parent,
+		parentSpanID: parent.spanID,
+		name:         name,
+		kind:         kind,
+		start:        start,
+		attrs:        map[string]string{},
+	}
+
+	for s.tc.spanID == [8]byte{} || s.tc.spanID == parent.spanID {
+		binary.LittleEndian.PutUint64(s.tc.spanID[:],
+			rand.Uint64()) //nolint:gosec
+	}
+
+	return s
+}
+
+// statusAttr returns a slog Attr giving the number of spans dropped since
+// the last call. The count is reset.
+func (t *tracer) statusAttr() slog.Attr {
+	if t == nil {
+		return slog.Attr{}
+	}
+
+	return slog.Int64("droppedSpans", t.dropped.Swap(0))
+}
+
+// run collects the finished spans into batches and exports them
+func (t *tracer) run() {
+	const (
+		maxBatch      = 512
+		flushInterval = time.Second
+	)
+
+	ticker := time.NewTicker(flushInterval)
+	batch := make([]*span, 0, maxBatch)
+
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < maxBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		t.export(batch)
+		batch = batch[:0]
+	}
+}
+
+// The following types give the OTLP JSON encoding of the exported spans
+type (
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		TraceState        string         `json:"traceState,omitempty"`
+		Name              string         `json:"name"`
+		Kind              spanKind       `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpScopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpResourceSpans struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+)
+
+// otlpKV returns an OTLP string attribute
+func otlpKV(key, val string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{StringValue: val}}
+}
+
+// otlpTime returns the OTLP JSON representation of the time
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// toOTLP converts the span to its OTLP JSON representation
+func (s *span) toOTLP() otlpSpan {
+	const (
+		statusOK    = 1
+		statusError = 2
+	)
+
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.tc.traceID[:]),
+		SpanID:            hex.EncodeToString(s.tc.spanID[:]),
+		ParentSpanID:      hex.EncodeToString(s.parentSpanID[:]),
+		TraceState:        s.tc.state,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: otlpTime(s.start),
+		EndTimeUnixNano:   otlpTime(s.end),
+		Status:            otlpStatus{Code: statusOK},
+	}
+
+	for k, v := range s.attrs {
+		o.Attributes = append(o.Attributes, otlpKV(k, v))
+	}
+
+	if s.errText != "" {
+		o.Status = otlpStatus{Code: statusError, Message: s.errText}
+	}
+
+	return o
+}
+
+// export writes the batch of spans to the trace file and sends it to the
+// collector endpoint.
+func (t *tracer) export(batch []*span) {
+	ss := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(batch))}
+	ss.Scope.Name = t.serviceName
+
+	for _, s := range batch {
+		ss.Spans = append(ss.Spans, s.toOTLP())
+	}
+
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{ss}}
+	rs.Resource.Attributes = []otlpKeyValue{
+		otlpKV("service.name", t.serviceName),
+	}
+
+	body, err := json.Marshal(otlpTraces{
+		ResourceSpans: []otlpResourceSpans{rs},
+	})
+	if err != nil {
+		t.logger.Error("couldn't encode the trace spans", pusu.ErrorAttr(err))
+		return
+	}
+
+	if t.file != nil {
+		if _, err := t.file.Write(append(body, '\n')); err != nil {
+			t.logger.Error("couldn't write the trace spans",
+				pusu.ErrorAttr(err))
+		}
+	}
+
+	if t.endpoint != "" {
+		t.post(body)
+	}
+}
+
+// post sends the encoded spans to the collector endpoint
+func (t *tracer) post(body []byte) {
+	req, err := http.NewRequestWithContext(context.Background(),
+		http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		t.logger.Error("couldn't make the trace export request",
+			pusu.ErrorAttr(err))
+
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		t.logger.Error("couldn't export the trace spans", pusu.ErrorAttr(err))
+		return
+	}
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		t.logger.Error("the trace collector rejected the spans",
+			slog.String("status", resp.Status))
+	}
+}
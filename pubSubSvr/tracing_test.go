@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+const (
+	testTraceID = "0af7651916cd43dd8448eb211c80319c"
+	testSpanID  = "b7ad6b7169203331"
+	testTP      = "00-" + testTraceID + "-" + testSpanID + "-01"
+)
+
+func TestTraceContextFromHeaders(t *testing.T) {
+	const zeroTraceID = "00000000000000000000000000000000"
+
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		tp         string
+		state      string
+		expValid   bool
+		expSampled bool
+		expTP      string
+	}{
+		{
+			ID: testhelper.MkID("no traceparent"),
+		},
+		{
+			ID:         testhelper.MkID("good traceparent"),
+			tp:         testTP,
+			state:      "vendor=x",
+			expValid:   true,
+			expSampled: true,
+			expTP:      testTP,
+		},
+		{
+			ID:       testhelper.MkID("good traceparent, not sampled"),
+			tp:       "00-" + testTraceID + "-" + testSpanID + "-00",
+			expValid: true,
+			expTP:    "00-" + testTraceID + "-" + testSpanID + "-00",
+		},
+		{
+			ID:         testhelper.MkID("later version with more fields"),
+			tp:         "01-" + testTraceID + "-" + testSpanID + "-01-extra",
+			expValid:   true,
+			expSampled: true,
+			expTP:      testTP,
+		},
+		{
+			ID:     testhelper.MkID("bad: too few fields"),
+			ExpErr: testhelper.MkExpErr("wrong number of fields"),
+			tp:     "00-abc-01",
+		},
+		{
+			ID:     testhelper.MkID("bad: version 00 with more fields"),
+			ExpErr: testhelper.MkExpErr("wrong number of fields"),
+			tp:     testTP + "-extra",
+		},
+		{
+			ID:     testhelper.MkID("bad: invalid version"),
+			ExpErr: testhelper.MkExpErr("invalid version"),
+			tp:     "ff-" + testTraceID + "-" + testSpanID + "-01",
+		},
+		{
+			ID:     testhelper.MkID("bad: version too long"),
+			ExpErr: testhelper.MkExpErr(`"000" has the wrong length`),
+			tp:     "000-" + testTraceID + "-" + testSpanID + "-01",
+		},
+		{
+			ID:     testhelper.MkID("bad: trace ID too short"),
+			ExpErr: testhelper.MkExpErr("has the wrong length"),
+			tp:     "00-" + testTraceID[1:] + "-" + testSpanID + "-01",
+		},
+		{
+			ID:     testhelper.MkID("bad: span ID too long"),
+			ExpErr: testhelper.MkExpErr("has the wrong length"),
+			tp:     "00-" + testTraceID + "-" + testSpanID + "0-01",
+		},
+		{
+			ID:     testhelper.MkID("bad: flags too long"),
+			ExpErr: testhelper.MkExpErr(`"001" has the wrong length`),
+			tp:     "00-" + testTraceID + "-" + testSpanID + "-001",
+		},
+		{
+			ID:     testhelper.MkID("bad: upper-case hex"),
+			ExpErr: testhelper.MkExpErr("is not lower-case hex"),
+			tp:     "00-0AF7651916CD43DD8448EB211C80319C-" + testSpanID + "-01",
+		},
+		{
+			ID:     testhelper.MkID("bad: not hex"),
+			ExpErr: testhelper.MkExpErr("invalid byte"),
+			tp:     "00-" + testTraceID + "-b7ad6b716920333z-01",
+		},
+		{
+			ID:     testhelper.MkID("bad: zero trace ID"),
+			ExpErr: testhelper.MkExpErr("all-zero ID"),
+			tp:     "00-" + zeroTraceID + "-" + testSpanID + "-01",
+		},
+		{
+			ID:     testhelper.MkID("bad: zero span ID"),
+			ExpErr: testhelper.MkExpErr("all-zero ID"),
+			tp:     "00-" + testTraceID + "-0000000000000000-01",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			hdrs := map[string]string{}
+			if tc.tp != "" {
+				hdrs[hdrTraceparent] = tc.tp
+			}
+
+			if tc.state != "" {
+				hdrs[hdrTracestate] = tc.state
+			}
+
+			trc, err := traceContextFromHeaders(hdrs)
+			testhelper.CheckExpErr(t, err, tc)
+
+			if err != nil && !errors.Is(err, errBadTraceparent) {
+				t.Log(tc.IDStr())
+				t.Error("\t: the error should wrap errBadTraceparent")
+			}
+
+			testhelper.DiffBool(t, tc.IDStr(), "valid",
+				trc.isValid(), tc.expValid)
+			testhelper.DiffBool(t, tc.IDStr(), "sampled",
+				trc.sampled(), tc.expSampled)
+
+			if tc.expValid {
+				testhelper.DiffString(t, tc.IDStr(), "traceparent",
+					trc.traceparent(), tc.expTP)
+				testhelper.DiffString(t, tc.IDStr(), "tracestate",
+					trc.state, tc.state)
+			}
+		})
+	}
+}
+
+// testTracer returns a tracer which holds the finished spans on its
+// channel rather than exporting them
+func testTracer() *tracer {
+	return &tracer{
+		logger:      testLogger,
+		serviceName: "pubSubSvr",
+		spans:       make(chan *span, 10),
+	}
+}
+
+func TestFanOutTraceContext(t *testing.T) {
+	const ns = pusu.Namespace("test")
+
+	testCases := []struct {
+		testhelper.ID
+		tp        string
+		expSpans  int
+		expTraced bool
+	}{
+		{
+			ID:        testhelper.MkID("sampled"),
+			tp:        testTP,
+			expSpans:  2,
+			expTraced: true,
+		},
+		{
+			ID: testhelper.MkID("not sampled"),
+			tp: "00-" + testTraceID + "-" + testSpanID + "-00",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			prog := &prog{logger: testLogger, tracer: testTracer()}
+			sub := testClient(ns)
+			nsm := namespaceSubsMap{
+				ns: {topics: subsMap{"/a": subscribers{sub: nil}}},
+			}
+
+			serverHandlePublish(prog, clientMessage{
+				clt: testClient(ns),
+				msg: &pusu.Message{MT: pusu.Publish, MsgID: 7},
+				pubs: []*publication{{
+					pmp:  &pusu.PublishMsgPayload{Topic: "/a/b"},
+					hdrs: map[string]string{hdrTraceparent: tc.tp},
+				}},
+			}, nsm)
+
+			testhelper.DiffInt(t, tc.IDStr(), "spans",
+				len(prog.tracer.spans), tc.expSpans)
+
+			var fanOut *span
+
+			for range len(prog.tracer.spans) {
+				if s := <-prog.tracer.spans; s.name == "pubsub fan-out" {
+					fanOut = s
+				}
+			}
+
+			pmp, err := (<-sub.sendChan).publication()
+			if err != nil {
+				t.Fatal("cannot decode the publication:", err)
+			}
+
+			hdrs, err := getExtMap(pmp, extPublishHeaders)
+			if err != nil {
+				t.Fatal("cannot decode the headers:", err)
+			}
+
+			if !tc.expTraced {
+				testhelper.DiffString(t, tc.IDStr(), "traceparent",
+					hdrs[hdrTraceparent], tc.tp)
+
+				return
+			}
+
+			if fanOut == nil {
+				t.Fatal("there is no fan-out span")
+			}
+
+			testhelper.DiffString(t, tc.IDStr(), "traceparent",
+				hdrs[hdrTraceparent], fanOut.context().traceparent())
+			testhelper.DiffString(t, tc.IDStr(), "trace ID",
+				hex.EncodeToString(fanOut.tc.traceID[:]), testTraceID)
+		})
+	}
+}
+
+func TestExportOTLP(t *testing.T) {
+	var buf bytes.Buffer
+
+	tr := testTracer()
+	tr.file = &buf
+
+	parent, err := traceContextFromHeaders(
+		map[string]string{hdrTraceparent: testTP, hdrTracestate: "v=1"})
+	if err != nil {
+		t.Fatal("cannot parse the traceparent:", err)
+	}
+
+	start := time.Unix(1, 500)
+	s := tr.startSpan("pubsub write", spanKindProducer, parent, start)
+	s.setAttr("pubsub.topic", "/a")
+	s.setError(errors.New("write failed"))
+	s.end = start.Add(time.Second)
+
+	tr.export([]*span{s})
+
+	var traces otlpTraces
+	if err := json.Unmarshal(buf.Bytes(), &traces); err != nil {
+		t.Fatal("cannot decode the exported spans:", err)
+	}
+
+	if len(traces.ResourceSpans) != 1 ||
+		len(traces.ResourceSpans[0].ScopeSpans) != 1 ||
+		len(traces.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatal("expected one resource, one scope and one span, got:",
+			buf.String())
+	}
+
+	rs := traces.ResourceSpans[0]
+	if err := testhelper.DiffVals(rs.Resource.Attributes,
+		[]otlpKeyValue{otlpKV("service.name", "pubSubSvr")}); err != nil {
+		t.Log("resource")
+		t.Errorf("\t: bad attributes: %s", err)
+	}
+
+	testhelper.DiffString(t, "scope", "name",
+		rs.ScopeSpans[0].Scope.Name, "pubSubSvr")
+
+	o := rs.ScopeSpans[0].Spans[0]
+	testhelper.DiffString(t, "span", "trace ID", o.TraceID, testTraceID)
+	testhelper.DiffString(t, "span", "parent span ID",
+		o.ParentSpanID, testSpanID)
+	testhelper.DiffString(t, "span", "span ID",
+		o.SpanID, hex.EncodeToString(s.tc.spanID[:]))
+	testhelper.DiffString(t, "span", "trace state", o.TraceState, "v=1")
+	testhelper.DiffString(t, "span", "name", o.Name, "pubsub write")
+	testhelper.DiffInt(t, "span", "kind", o.Kind, spanKindProducer)
+	testhelper.DiffString(t, "span", "start",
+		o.StartTimeUnixNano, "1000000500")
+	testhelper.DiffString(t, "span", "end", o.EndTimeUnixNano, "2000000500")
+	testhelper.DiffInt(t, "span", "status code", o.Status.Code, 2)
+	testhelper.DiffString(t, "span", "status message",
+		o.Status.Message, "write failed")
+
+	if err := testhelper.DiffVals(o.Attributes,
+		[]otlpKeyValue{otlpKV("pubsub.topic", "/a")}); err != nil {
+		t.Log("span")
+		t.Errorf("\t: bad attributes: %s", err)
+	}
+}
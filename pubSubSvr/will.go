@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"google.golang.org/protobuf/proto"
+)
+
+// noteTextWill describes last-will publications
+const noteTextWill = "A client may give, in its Start message, a last-will" +
+	" publication which the server publishes on the client's behalf if" +
+	" the connection ends abnormally. This lets the subscribers to a" +
+	" publisher's topics learn that it has gone and that the data they" +
+	" hold may be stale." +
+	"\n\n" +
+	"The will is published if the connection is lost through a read" +
+	" error, if the client is disconnected because it was not keeping up" +
+	" with the messages sent to it or because it broke the protocol or a" +
+	" rate limit. It is not published if the client closes the" +
+	" connection cleanly. The server does not time out idle connections" +
+	" so a client which has stopped but whose connection is still open" +
+	" is not treated as having gone until the network reports the" +
+	" connection as lost." +
+	"\n\n" +
+	"The will is encoded as a Publish message payload, with its own" +
+	" topic, payload and any headers, and is carried in field number" +
+	" 102 of the Start message payload. It is checked when the Start" +
+	" message is received, as for any other publication, and the Start" +
+	" message is rejected if the will is bad. The will is published in" +
+	" the client's namespace."
+
+// errBadWill is the error returned when a last-will publication is bad
+var errBadWill = errors.New("bad last-will publication")
+
+// parseWill returns the last-will publication from the Start message, if
+// any. The will is checked as for any other publication.
+func (clt *client) parseWill(smp *pusu.StartMsgPayload) (*publication, error) {
+	vals, err := extFields(smp, extStartWill)
+	if err != nil || len(vals) == 0 {
+		return nil, err
+	}
+
+	pmp := &pusu.PublishMsgPayload{}
+
+	if err := proto.Unmarshal(vals[len(vals)-1], pmp); err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadWill, err)
+	}
+
+	return clt.prepareWill(pmp)
+}
+
+// prepareWill checks the last-will publication as for any other
+// publication
+func (clt *client) prepareWill(
+	pmp *pusu.PublishMsgPayload,
+) (*publication, error) {
+	if err := pusu.Topic(pmp.Topic).Check(); err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadWill, err)
+	}
+
+	pub, err := clt.preparePublication(pmp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadWill, err)
+	}
+
+	return pub, nil
+}
+
+// publishWill publishes the client's last-will publication, if it has one,
+// unless the client closed the connection cleanly.
+func (prog *prog) publishWill(clt *client, nsm namespaceSubsMap) {
+	if clt.will == nil {
+		return
+	}
+
+	reason, errText := clt.getCloseReason()
+	if reason == closeReasonEOF {
+		return
+	}
+
+	prog.logger.Info("publishing the client's last will",
+		clt.cID.Attr(), clt.will.topic().Attr(),
+		slog.String("reason", reason),
+		slog.String("error", errText))
+
+	prog.fanOut(clientMessage{
+		clt:  clt,
+		msg:  &pusu.Message{MT: pusu.Publish, MsgID: pusu.NoMsgID},
+		rcvd: time.Now(),
+	}, clt.will, nsm)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nickwells/pusu.mod/pusu"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseWill(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		will     *pusu.PublishMsgPayload
+		expTopic string
+	}{
+		{
+			ID: testhelper.MkID("no will"),
+		},
+		{
+			ID: testhelper.MkID("good will"),
+			will: &pusu.PublishMsgPayload{
+				Topic:   "/feed/status",
+				Payload: []byte("gone"),
+			},
+			expTopic: "/feed/status",
+		},
+		{
+			ID: testhelper.MkID("bad: unclean topic"),
+			ExpErr: testhelper.MkExpErr("bad last-will publication",
+				"unclean"),
+			will: &pusu.PublishMsgPayload{Topic: "/feed//status"},
+		},
+		{
+			ID: testhelper.MkID("bad: system topic"),
+			ExpErr: testhelper.MkExpErr("bad last-will publication",
+				"reserved topic"),
+			will: &pusu.PublishMsgPayload{Topic: "/$sys/clients"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			clt := &client{
+				logger:       testLogger,
+				clientShared: &clientShared{schemas: &schemaRegistry{}},
+			}
+
+			smp := &pusu.StartMsgPayload{}
+
+			if tc.will != nil {
+				b, err := proto.Marshal(tc.will)
+				if err != nil {
+					t.Fatal("cannot marshal the will:", err)
+				}
+
+				setExtFields(smp, extStartWill, [][]byte{b})
+			}
+
+			pub, err := clt.parseWill(smp)
+			if !testhelper.CheckExpErr(t, err, tc) || err != nil {
+				return
+			}
+
+			topic := ""
+			if pub != nil {
+				topic = pub.pmp.Topic
+			}
+
+			testhelper.DiffString(t, tc.IDStr(), "topic", topic, tc.expTopic)
+		})
+	}
+}
+
+func TestPublishWill(t *testing.T) {
+	const ns = pusu.Namespace("test")
+
+	prog := &prog{logger: testLogger}
+
+	testCases := []struct {
+		testhelper.ID
+		reason    string
+		expWrites int
+	}{
+		{
+			ID:     testhelper.MkID("clean close"),
+			reason: closeReasonEOF,
+		},
+		{
+			ID:        testhelper.MkID("read error"),
+			reason:    closeReasonReadErr,
+			expWrites: 1,
+		},
+		{
+			ID:        testhelper.MkID("slow consumer"),
+			reason:    closeReasonSlow,
+			expWrites: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			sub := &client{
+				namespace: ns,
+				logger:    testLogger,
+				connected: true,
+				sendChan:  make(chan outMsg, 1),
+			}
+			nsm := namespaceSubsMap{
+				ns: {topics: subsMap{"/feed": subscribers{sub: nil}}},
+			}
+
+			clt := &client{
+				namespace: ns,
+				logger:    testLogger,
+				will: &publication{
+					pmp:   &pusu.PublishMsgPayload{Topic: "/feed/status"},
+					plain: []byte("gone"),
+				},
+			}
+			clt.setCloseReason(tc.reason, errors.New("oops"))
+
+			prog.publishWill(clt, nsm)
+
+			testhelper.DiffInt(t, tc.IDStr(), "publications",
+				len(sub.sendChan), tc.expWrites)
+		})
+	}
+}